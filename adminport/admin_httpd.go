@@ -37,6 +37,7 @@
 package adminport
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net"
 	"net/http"
@@ -46,7 +47,7 @@ import (
 	base "github.com/Xiaomei-Zhang/goxdcr/base"
 )
 
-var logger_server *log.CommonLogger = log.NewLogger("HttpServer", log.DefaultLoggerContext)
+var logger_server *log.CommonLogger = log.NewLogger("HttpServer", log.AdminLoggerContext)
 
 type httpServer struct {
 	mu        sync.RWMutex   // handle concurrent updates to this object
@@ -54,17 +55,19 @@ type httpServer struct {
 	srv       *http.Server // http server
 	urlPrefix string       // URL path prefix for adminport
 	reqch     chan<- Request // request channel back to application
+	tlsConfig *TLSConfig   // tls settings. server listens on plain http when nil
 
 	logPrefix string
 }
 
 // NewHTTPServer creates an instance of admin-server. Start() will actually
-// start the server.
-func NewHTTPServer(name, connAddr, urlPrefix string, reqch chan<- Request, handler RequestHandler) Server {
+// start the server. The server listens on https when tlsConfig is not nil.
+func NewHTTPServer(name, connAddr, urlPrefix string, reqch chan<- Request, handler RequestHandler, tlsConfig *TLSConfig) Server {
 
 	s := &httpServer{
 		reqch:     reqch,
 		urlPrefix: urlPrefix,
+		tlsConfig: tlsConfig,
 		logPrefix: fmt.Sprintf("[%s:%s]", name, connAddr),
 	}
 	logger_server.Infof("%v new http server %v %v %v\n", s.logPrefix, name, connAddr, urlPrefix)
@@ -87,6 +90,10 @@ func (s *httpServer) Start() (err error) {
 	if s.lis, err = net.Listen("tcp", s.srv.Addr); err != nil {
 		return err
 	}
+	if s.tlsConfig != nil {
+		s.lis = tls.NewListener(s.lis, s.tlsConfig.serverConfig())
+		logger_server.Infof("%s serving https\n", s.logPrefix)
+	}
 
 	// Server routine
 	go func() {
@@ -134,16 +141,43 @@ func (s *httpServer) systemHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
-    waitch := make(chan interface{}, 1)
-    // send and wait
-    s.reqch <-  &httpAdminRequest{srv: s, req: r, waitch: waitch}
-    val := <-waitch
+	// the body is read here, on the goroutine of the connection, so that a slow client does not
+	// hold up the dispatch of other requests
+	var val interface{}
+	r.Body = http.MaxBytesReader(w, r.Body, base.AdminportMaxRequestBodySize)
+	if _, readErr := readRequestBody(r); readErr != nil {
+		val = NewRequestError(http.StatusBadRequest, ErrorCodeInvalidRequest, "Failed to read request body. "+readErr.Error())
+	} else {
+		waitch := make(chan interface{}, 1)
+		// send and wait
+		s.reqch <- &httpAdminRequest{srv: s, req: r, waitch: waitch}
+		val = <-waitch
+	}
+
+	if isV2Path(r.URL.Path) {
+		writeV2Response(w, val)
+		return
+	}
 
 	switch v := (val).(type) {
 		case error:
-			http.Error(w, v.Error(), http.StatusInternalServerError)
-			err = fmt.Errorf("%v, %v", ErrorInternal, v)
-			logger_ap.Errorf("%v", err)
+			switch v {
+			case ErrorUnauthorized:
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", AuthRealm))
+				http.Error(w, v.Error(), http.StatusUnauthorized)
+			case ErrorForbidden:
+				http.Error(w, v.Error(), http.StatusForbidden)
+			case ErrorRequestTimeout, ErrorTooManyQueuedRequests:
+				http.Error(w, v.Error(), http.StatusServiceUnavailable)
+			default:
+				if reqErr, ok := v.(*RequestError); ok {
+					http.Error(w, reqErr.Error(), reqErr.Status)
+					break
+				}
+				http.Error(w, v.Error(), http.StatusInternalServerError)
+				err = fmt.Errorf("%v, %v", ErrorInternal, v)
+				logger_ap.Errorf("%v", err)
+			}
 		case []byte:
 			w.Write(v)
 	}
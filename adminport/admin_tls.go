@@ -0,0 +1,192 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+// tls support for adminport.
+
+package adminport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// errors
+var ErrorMissingCertOrKey = errors.New("Both certificate file and key file need to be specified to enable tls.")
+var ErrorInvalidCAFile = errors.New("No valid certificate is found in CA file.")
+
+const (
+	HttpScheme  = "http"
+	HttpsScheme = "https"
+)
+
+/************************************
+/* struct TLSConfig
+*************************************/
+// TLSConfig holds the tls settings of adminport.
+// certificates are loaded when the config is created and reloaded on SIGHUP
+type TLSConfig struct {
+	// certificate and private key of this node
+	CertFile string
+	KeyFile  string
+
+	// CA used to verify client certificates. client certificates are not requested when it is empty
+	ClientCAFile string
+	// if true, clients without a valid certificate are rejected; otherwise client certificates are
+	// verified only when they are presented
+	RequireClientCert bool
+
+	// CA of the cluster, used to verify other xdcr nodes when forwarding requests to them
+	ClusterCAFile string
+
+	// current certificate and CA pools, replaced as a whole on reload
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	clusterCA *x509.CertPool
+	lock      sync.RWMutex
+
+	sigch chan os.Signal
+	finch chan bool
+}
+
+func NewTLSConfig(certFile, keyFile, clientCAFile string, requireClientCert bool, clusterCAFile string) (*TLSConfig, error) {
+	if len(certFile) == 0 || len(keyFile) == 0 {
+		return nil, ErrorMissingCertOrKey
+	}
+	config := &TLSConfig{CertFile: certFile,
+		KeyFile:           keyFile,
+		ClientCAFile:      clientCAFile,
+		RequireClientCert: requireClientCert,
+		ClusterCAFile:     clusterCAFile}
+
+	if err := config.Reload(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// (re)load certificate, key and CA files from disk.
+// the current certificates are kept if any of the files fails to load
+func (config *TLSConfig) Reload() error {
+	cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	var clientCAs, clusterCA *x509.CertPool
+	if len(config.ClientCAFile) > 0 {
+		if clientCAs, err = loadCertPool(config.ClientCAFile); err != nil {
+			return err
+		}
+	}
+	if len(config.ClusterCAFile) > 0 {
+		if clusterCA, err = loadCertPool(config.ClusterCAFile); err != nil {
+			return err
+		}
+	}
+
+	config.lock.Lock()
+	defer config.lock.Unlock()
+	config.cert = &cert
+	config.clientCAs = clientCAs
+	config.clusterCA = clusterCA
+	logger_server.Infof("Loaded certificate %v and key %v\n", config.CertFile, config.KeyFile)
+	return nil
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, ErrorInvalidCAFile
+	}
+	return pool, nil
+}
+
+// start reloading certificates whenever the process receives SIGHUP
+func (config *TLSConfig) StartReloadOnSignal() {
+	config.sigch = make(chan os.Signal, 1)
+	config.finch = make(chan bool)
+	signal.Notify(config.sigch, syscall.SIGHUP)
+
+	go func(sigch chan os.Signal, finch chan bool) {
+		for {
+			select {
+			case <-finch:
+				return
+			case <-sigch:
+				logger_server.Info("SIGHUP received, reloading certificates")
+				if err := config.Reload(); err != nil {
+					logger_server.Errorf("Failed to reload certificates, keep using the current ones. err=%v\n", err)
+				}
+			}
+		}
+	}(config.sigch, config.finch)
+}
+
+func (config *TLSConfig) StopReloadOnSignal() {
+	if config.sigch != nil {
+		signal.Stop(config.sigch)
+		close(config.finch)
+		config.sigch = nil
+	}
+}
+
+func (config *TLSConfig) certificate() *tls.Certificate {
+	config.lock.RLock()
+	defer config.lock.RUnlock()
+	return config.cert
+}
+
+// tls config for the adminport listener.
+// certificates and client CAs are looked up per connection so that reloads take effect immediately
+func (config *TLSConfig) serverConfig() *tls.Config {
+	serverConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	serverConfig.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		config.lock.RLock()
+		defer config.lock.RUnlock()
+
+		connConfig := &tls.Config{MinVersion: tls.VersionTLS12,
+			Certificates: []tls.Certificate{*config.cert}}
+		if config.clientCAs != nil {
+			connConfig.ClientCAs = config.clientCAs
+			if config.RequireClientCert {
+				connConfig.ClientAuth = tls.RequireAndVerifyClientCert
+			} else {
+				connConfig.ClientAuth = tls.VerifyClientCertIfGiven
+			}
+		}
+		return connConfig, nil
+	}
+	return serverConfig
+}
+
+// http client used to forward requests to other xdcr nodes.
+// other nodes are verified with the cluster CA, and this node presents its own
+// certificate in case other nodes verify client certificates
+func (config *TLSConfig) forwardingClient() *http.Client {
+	config.lock.RLock()
+	defer config.lock.RUnlock()
+
+	clientConfig := &tls.Config{MinVersion: tls.VersionTLS12,
+		RootCAs: config.clusterCA,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return config.certificate(), nil
+		}}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig, DisableKeepAlives: true}}
+}
@@ -20,46 +20,57 @@ import (
 	"time"
 	"errors"
 	"github.com/Xiaomei-Zhang/goxdcr/log"
+	"github.com/Xiaomei-Zhang/goxdcr/metadata"
 	rm "github.com/Xiaomei-Zhang/goxdcr/replication_manager"
 	utils "github.com/Xiaomei-Zhang/goxdcr/utils"
 )
 
-var StaticPaths = [3]string{CreateReplicationPath, SettingsReplicationsPath, StatisticsPath}
+var StaticPaths = [4]string{CreateReplicationPath, SettingsReplicationsPath, StatisticsPath, InternalSettingsPath}
 var DynamicPathPrefixes = [4]string{DeleteReplicationPrefix, PauseReplicationPrefix, ResumeReplicationPrefix, SettingsReplicationsPath}
 
 var MaxForwardingRetry = 5
 var ForwardingRetryInterval = time.Second * 10
 
-var logger_ap *log.CommonLogger = log.NewLogger("AdminPort", log.DefaultLoggerContext)
+var logger_ap *log.CommonLogger = log.NewLogger("AdminPort", log.AdminLoggerContext)
+// logs who changed what through the rest service, and the requests that are rejected
+var logger_audit *log.CommonLogger = log.NewLogger("Audit", log.AdminLoggerContext)
 
 
 type xdcrRestHandler struct {
+	auth      *AuthConfig
+	tlsConfig *TLSConfig
 }
 
 // admin-port entry point
-func MainAdminPort(laddr string) {
+// adminport serves https when tlsConfig is not nil
+func MainAdminPort(laddr string, auth *AuthConfig, tlsConfig *TLSConfig) {
 	var err error
 
-	h := new(xdcrRestHandler)
+	h := &xdcrRestHandler{auth: auth, tlsConfig: tlsConfig}
 	reqch := make(chan Request)
-	server := NewHTTPServer("xdcr", utils.GetHostAddr(laddr, base.AdminportNumber), base.AdminportUrlPrefix, reqch, new(Handler))
+	server := NewHTTPServer("xdcr", utils.GetHostAddr(laddr, base.AdminportNumber), base.AdminportUrlPrefix, reqch, new(Handler), tlsConfig)
 
-	server.Start()
+	if tlsConfig != nil {
+		tlsConfig.StartReloadOnSignal()
+		defer tlsConfig.StopReloadOnSignal()
+	}
+
+	if err = server.Start(); err != nil {
+		logger_ap.Errorf("Failed to start adminport. err=%v\n", err)
+		return
+	}
 	logger_ap.Infof("server started %v !\n", laddr)
 
+	dispatcher := newRequestDispatcher(h, time.Duration(base.AdminportRequestTimeout)*time.Millisecond)
+
 loop:
 	for {
 		select {
-		case req, ok := <-reqch: // admin requests are serialized here
+		case req, ok := <-reqch: // admin requests are dispatched here, and serialized per replication
 			if ok == false {
 				break loop
 			}
-			httpReq := req.GetHttpRequest()
-			if response, err := h.handleRequest(httpReq); err == nil {
-				req.Send(response)
-			} else {
-				req.SendError(err)
-			}
+			dispatcher.dispatch(req)
 		}
 	}
 	if err != nil {
@@ -69,17 +80,9 @@ loop:
 	server.Stop()
 }
 
-func (h *xdcrRestHandler) handleRequest(
-	request *http.Request) (response []byte , err error) {
-	
-	logger_ap.Infof("handleRequest called\n")
-	// TODO change to debug
-	logger_ap.Infof("Request: %v \n", request)
-
-	key, err := h.GetMessageKeyFromRequest(request)
-	if err != nil {
-		return nil, err
-	}
+// handle an authorized request with the message key decoded from it
+func (h *xdcrRestHandler) handleRequestWithKey(
+	request *http.Request, key string) (response []byte, err error) {
 	
 	switch (key) {
 	case CreateReplicationPath + base.UrlDelimiter + MethodPost:
@@ -99,6 +102,43 @@ func (h *xdcrRestHandler) handleRequest(
 		response, err = h.doChangeReplicationSettingsRequest(request)
 	case StatisticsPath + base.UrlDelimiter + MethodGet:
 		response, err = h.doGetStatisticsRequest(request)
+	case InternalSettingsPath + base.UrlDelimiter + MethodGet:
+		response, err = h.doViewInternalSettingsRequest(request)
+	case InternalSettingsPath + base.UrlDelimiter + MethodPost:
+		response, err = h.doChangeInternalSettingsRequest(request)
+	case V2ReplicationsPath + base.UrlDelimiter + MethodPost:
+		response, err = h.doV2CreateReplicationRequest(request)
+	case V2ReplicationsPath + DynamicSuffix + base.UrlDelimiter + MethodGet:
+		response, err = h.doV2GetReplicationRequest(request)
+	case V2ReplicationsPath + DynamicSuffix + base.UrlDelimiter + MethodDelete:
+		response, err = h.doV2DeleteReplicationRequest(request)
+	case V2ReplicationsPath + DynamicSuffix + base.UrlDelimiter + V2PauseAction + base.UrlDelimiter + MethodPost:
+		response, err = h.doV2PauseReplicationRequest(request)
+	case V2ReplicationsPath + DynamicSuffix + base.UrlDelimiter + V2ResumeAction + base.UrlDelimiter + MethodPost:
+		response, err = h.doV2ResumeReplicationRequest(request)
+	case V2ReplicationsPath + DynamicSuffix + base.UrlDelimiter + V2SettingsAction + base.UrlDelimiter + MethodGet:
+		response, err = h.doV2ViewReplicationSettingsRequest(request)
+	case V2ReplicationsPath + DynamicSuffix + base.UrlDelimiter + V2SettingsAction + base.UrlDelimiter + MethodPost:
+		response, err = h.doV2ChangeReplicationSettingsRequest(request)
+	case V2ReplicationsPath + DynamicSuffix + base.UrlDelimiter + V2HealthAction + base.UrlDelimiter + MethodGet:
+		response, err = h.doV2GetReplicationHealthRequest(request)
+	case V2ReplicationsPath + DynamicSuffix + base.UrlDelimiter + V2ErrorsAction + base.UrlDelimiter + MethodGet:
+		response, err = h.doV2GetReplicationErrorsRequest(request)
+	case V2ReplicationsPath + DynamicSuffix + base.UrlDelimiter + V2ErrorsAction + base.UrlDelimiter + MethodDelete:
+		response, err = h.doV2ClearReplicationErrorsRequest(request)
+	case V2StatisticsPath + base.UrlDelimiter + MethodGet:
+		// statistics are returned in json in both versions
+		response, err = h.doGetStatisticsRequest(request)
+	case V2OpenAPIPath + base.UrlDelimiter + MethodGet:
+		response, err = h.doV2GetOpenAPIRequest(request)
+	case V2LeaderPath + base.UrlDelimiter + MethodGet:
+		response, err = h.doV2GetLeaderRequest(request)
+	case V2DebugGenServersPath + base.UrlDelimiter + MethodGet:
+		response, err = h.doV2GetDebugGenServersRequest(request)
+	case V2LoggingPath + base.UrlDelimiter + MethodGet:
+		response, err = h.doV2GetLoggingRequest(request)
+	case V2LoggingPath + base.UrlDelimiter + MethodPost:
+		response, err = h.doV2ChangeLoggingRequest(request)
 	default:
 		err = ErrorInvalidRequest
 	}
@@ -113,30 +153,11 @@ func (h *xdcrRestHandler) doCreateReplicationRequest(request *http.Request) ([]b
 		return nil, err
 	}
 	
-	fromClusterUuid, err := rm.XDCRCompTopologyService().MyCluster()
+	replicationId, err := h.createReplication(request, fromBucket, toClusterUuid, toBucket, filterName, settings, forward)
 	if err != nil {
 		return nil, err
 	}
-	
-	logger_ap.Debugf("fromClusterUuid=%v \n", fromClusterUuid)
-	
-	// apply default replication settings
-	if err := ApplyDefaultSettings(&settings); err != nil {
-		return nil, err
-	}
-
-	replicationId, err := rm.CreateReplication(fromClusterUuid, fromBucket, toClusterUuid, toBucket, filterName, settings, forward)
-	
-	if err != nil {
-		return nil, err
-	} else {
-		if forward {	
-		// forward replication request to other KV nodes involved if necessary
-		h.forwardReplicationRequest(request)	
-		}
-		
-		return NewCreateReplicationResponse(replicationId), nil
-	}
+	return NewCreateReplicationResponse(replicationId), nil
 }
 
 func (h *xdcrRestHandler) doDeleteReplicationRequest(request *http.Request) ([]byte, error) {
@@ -147,20 +168,8 @@ func (h *xdcrRestHandler) doDeleteReplicationRequest(request *http.Request) ([]b
 		return nil, err
 	}
 	
-	logger_ap.Debugf("Request params: replicationId=%v\n", replicationId)
-	
-	err = rm.DeleteReplication(replicationId, forward)
-	
-	if err != nil {
-		return nil, err
-	} else {
-		if forward {		
-			// forward replication request to other KV nodes involved 
-			h.forwardReplicationRequest(request)
-		}
-		// no response body in success case
-		return nil, nil
-	}
+	// no response body in success case
+	return nil, h.deleteReplication(request, replicationId, forward)
 }
 
 func (h *xdcrRestHandler) doPauseReplicationRequest(request *http.Request) ([]byte, error) {
@@ -171,20 +180,8 @@ func (h *xdcrRestHandler) doPauseReplicationRequest(request *http.Request) ([]by
 		return nil, err
 	}
 	
-	logger_ap.Debugf("Request params: replicationId=%v\n", replicationId)
-	
-	err = rm.PauseReplication(replicationId, forward, false/*sync*/)
-	
-	if err != nil {
-		return nil, err
-	} else {
-		if forward {		
-			// forward replication request to other KV nodes involved 
-			h.forwardReplicationRequest(request)
-		}
-		// no response body in success case
-		return nil, nil
-	}
+	// no response body in success case
+	return nil, h.pauseReplication(request, replicationId, forward)
 }
 
 func (h *xdcrRestHandler) doResumeReplicationRequest(request *http.Request) ([]byte, error) {
@@ -195,20 +192,8 @@ func (h *xdcrRestHandler) doResumeReplicationRequest(request *http.Request) ([]b
 		return nil, err
 	}
 	
-	logger_ap.Debugf("Request params: replicationId=%v\n", replicationId)
-	
-	err = rm.ResumeReplication(replicationId, forward, false/*sync*/)
-	
-	if err != nil {
-		return nil, err
-	} else {
-		if forward {		
-			// forward replication request to other KV nodes involved 
-			h.forwardReplicationRequest(request)
-		}
-		// no response body in success case
-		return nil, nil
-	}
+	// no response body in success case
+	return nil, h.resumeReplication(request, replicationId, forward)
 }
 
 func (h *xdcrRestHandler) doViewReplicationSettingsRequest(request *http.Request) ([]byte, error) {
@@ -222,14 +207,13 @@ func (h *xdcrRestHandler) doViewReplicationSettingsRequest(request *http.Request
 	
 	logger_ap.Debugf("Request decoded: replicationId=%v", replicationId)
 	
-	// read replication spec with the specified replication id
-	replSpec, err := rm.MetadataService().ReplicationSpec(replicationId)
+	settings, err := h.replicationSettings(replicationId)
 	if err != nil {
 		return nil, err
 	}
 	
 	// marshal replication settings in replication spec and return it
-	return NewViewReplicationSettingsResponse(replSpec.Settings)
+	return NewViewReplicationSettingsResponse(settings)
 }
 
 func (h *xdcrRestHandler) doChangeReplicationSettingsRequest(request *http.Request) ([]byte, error) {
@@ -247,7 +231,7 @@ func (h *xdcrRestHandler) doChangeReplicationSettingsRequest(request *http.Reque
 	
 	logger_ap.Debugf("Request decoded: replicationId=%v; inputSettings=%v", replicationId, inputSettingsMap)
 	
-	err = rm.HandleChangesToReplicationSettings(replicationId, inputSettingsMap)
+	err = rm.HandleChangesToReplicationSettings(replicationId, inputSettingsMap, nil)
 	
 	return nil, err
 }
@@ -264,6 +248,125 @@ func (h *xdcrRestHandler) doGetStatisticsRequest(request *http.Request) ([]byte,
 	}
 }
 
+// get default replication settings, which are returned in json
+func (h *xdcrRestHandler) doViewInternalSettingsRequest(request *http.Request) ([]byte, error) {
+	logger_ap.Infof("doViewInternalSettingsRequest\n")
+
+	defaultSettings, err := rm.ReplicationSettingsService().GetReplicationSettings()
+	if err != nil {
+		return nil, err
+	}
+	return NewV2ReplicationSettingsResponse(defaultSettings)
+}
+
+// change default replication settings. the request body is either form-encoded or json.
+// the resulting default replication settings are returned in json
+func (h *xdcrRestHandler) doChangeInternalSettingsRequest(request *http.Request) ([]byte, error) {
+	logger_ap.Infof("doChangeInternalSettingsRequest\n")
+
+	var inputSettingsMap map[string]interface{}
+	var err error
+	if strings.HasPrefix(request.Header.Get(ContentType), JsonContentType) {
+		var inheritedKeys []string
+		inputSettingsMap, inheritedKeys, err = DecodeV2SettingsFromRequest(request)
+		if err == nil && len(inheritedKeys) > 0 {
+			err = utils.InvalidValueInHttpRequestError(ReplSettingInternalToRestMap[inheritedKeys[0]], nil)
+		}
+	} else {
+		inputSettingsMap, err = DecodeSettingsFromRequest(request, true)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	logger_ap.Debugf("Request decoded: inputSettings=%v", inputSettingsMap)
+
+	// default settings are in metadata shared by all nodes, and do not need to be forwarded
+	defaultSettings, err := rm.SetDefaultReplicationSettings(inputSettingsMap)
+	if err != nil {
+		return nil, err
+	}
+	return NewV2ReplicationSettingsResponse(defaultSettings)
+}
+
+// operations shared by all versions of rest api. 
+// parameters have been decoded from the request, which is kept only for forwarding
+
+func (h *xdcrRestHandler) createReplication(request *http.Request, fromBucket, toClusterUuid, toBucket, filterName string, settings map[string]interface{}, forward bool) (string, error) {
+	fromClusterUuid, err := rm.XDCRCompTopologyService().MyCluster()
+	if err != nil {
+		return "", err
+	}
+	
+	logger_ap.Debugf("fromClusterUuid=%v \n", fromClusterUuid)
+	
+	// settings that are not specified are inherited from default replication settings
+	replicationId, err := rm.CreateReplication(fromClusterUuid, fromBucket, toClusterUuid, toBucket, filterName, settings, forward)
+	if err != nil {
+		return "", err
+	}
+	
+	if forward {	
+		// forward replication request to other KV nodes involved if necessary
+		h.forwardReplicationRequest(request)	
+	}
+	return replicationId, nil
+}
+
+func (h *xdcrRestHandler) deleteReplication(request *http.Request, replicationId string, forward bool) error {
+	logger_ap.Debugf("Request params: replicationId=%v\n", replicationId)
+	
+	err := rm.DeleteReplication(replicationId, forward)
+	if err != nil {
+		return err
+	}
+	
+	if forward {		
+		// forward replication request to other KV nodes involved 
+		h.forwardReplicationRequest(request)
+	}
+	return nil
+}
+
+func (h *xdcrRestHandler) pauseReplication(request *http.Request, replicationId string, forward bool) error {
+	logger_ap.Debugf("Request params: replicationId=%v\n", replicationId)
+	
+	err := rm.PauseReplication(replicationId, forward, false/*sync*/)
+	if err != nil {
+		return err
+	}
+	
+	if forward {		
+		// forward replication request to other KV nodes involved 
+		h.forwardReplicationRequest(request)
+	}
+	return nil
+}
+
+func (h *xdcrRestHandler) resumeReplication(request *http.Request, replicationId string, forward bool) error {
+	logger_ap.Debugf("Request params: replicationId=%v\n", replicationId)
+	
+	err := rm.ResumeReplication(replicationId, forward, false/*sync*/)
+	if err != nil {
+		return err
+	}
+	
+	if forward {		
+		// forward replication request to other KV nodes involved 
+		h.forwardReplicationRequest(request)
+	}
+	return nil
+}
+
+// read replication settings in the replication spec with the specified replication id
+func (h *xdcrRestHandler) replicationSettings(replicationId string) (*metadata.ReplicationSettings, error) {
+	replSpec, err := rm.MetadataService().ReplicationSpec(replicationId)
+	if err != nil {
+		return nil, err
+	}
+	return replSpec.Settings, nil
+}
+
 // forward requests to other nodes.
 func (h *xdcrRestHandler) forwardReplicationRequest(request *http.Request) error {
 	logger_ap.Infof("forwardReplicationRequest\n")
@@ -279,47 +382,79 @@ func (h *xdcrRestHandler) forwardReplicationRequest(request *http.Request) error
 	}
 	
 	if len(xdcrNodesMap) > 1 {
-		if err = request.ParseForm(); err != nil {
+		method, requestUrl, contentType, newBody, err := newForwardedRequestParams(request)
+		if err != nil {
 			return err
 		}
-		
-		// set "Forward" flag to false in the forwarded request
-		var paramMap = make(map[string]interface{}, 0)
-		for key, valArr := range request.Form {
-			if len(valArr) > 0 {
-				paramMap[key] = valArr[0]
-	    	}
-		}
-		paramMap[Forward] = "false" 
-		// this Encode op should never fail since paramMap is fully under control
-		newBody, _ := EncodeMapIntoByteArray(paramMap)
 	
 		for xdcrNode, port := range xdcrNodesMap {
 			// do not forward to current node 
 			if xdcrNode != myAddr {
-				go forwardReplicationRequestToXDCRNode(request.URL.String(), newBody, xdcrNode, int(port))
+				go h.forwardReplicationRequestToXDCRNode(method, requestUrl, contentType, newBody, xdcrNode, int(port))
 			}
 		}
 	}
 	return nil
 }
 
-func forwardReplicationRequestToXDCRNode(oldRequestUrl string, newRequestBody []byte, xdcrAddr string, port int) (*http.Response, error) {
-	logger_ap.Infof("forwardReplicationRequestToXDCRNode. oldRequestUrl=%v, newRequestBody=%v, xdcrAddr=%v, port=%v\n", 
-	                oldRequestUrl, string(newRequestBody), xdcrAddr, port)
+// method, url, content type and body of the request forwarded to other nodes, 
+// which is the original request with "Forward" flag set to false
+func newForwardedRequestParams(request *http.Request) (method, requestUrl, contentType string, body []byte, err error) {
+	if isV2Request(request) {
+		// v2 requests carry the flag in url query and keep their json body
+		body, err = readRequestBody(request)
+		if err != nil {
+			return
+		}
+		newUrl := *request.URL
+		query := newUrl.Query()
+		query.Set(Forward, "false")
+		newUrl.RawQuery = query.Encode()
+		return request.Method, newUrl.String(), JsonContentType, body, nil
+	}
 
-	newUrl := "http://" + utils.GetHostAddr(xdcrAddr, port) + oldRequestUrl
-	newRequest, err := http.NewRequest(MethodPost, newUrl, bytes.NewBuffer(newRequestBody))
-	if err != nil {
-		return nil, err
+	if err = request.ParseForm(); err != nil {
+		return
 	}
-	newRequest.Header.Set(ContentType, DefaultContentType)
+		
+	// set "Forward" flag to false in the forwarded request
+	var paramMap = make(map[string]interface{}, 0)
+	for key, valArr := range request.Form {
+		if len(valArr) > 0 {
+			paramMap[key] = valArr[0]
+    	}
+	}
+	paramMap[Forward] = "false" 
+	// this Encode op should never fail since paramMap is fully under control
+	body, _ = EncodeMapIntoByteArray(paramMap)
+	return MethodPost, request.URL.String(), DefaultContentType, body, nil
+}
+
+func (h *xdcrRestHandler) forwardReplicationRequestToXDCRNode(method, oldRequestUrl, contentType string, newRequestBody []byte, xdcrAddr string, port int) (*http.Response, error) {
+	logger_ap.Infof("forwardReplicationRequestToXDCRNode. method=%v, oldRequestUrl=%v, newRequestBody=%v, xdcrAddr=%v, port=%v\n", 
+	                method, oldRequestUrl, string(newRequestBody), xdcrAddr, port)
+
+	scheme, client := HttpScheme, http.DefaultClient
+	if h.tlsConfig != nil {
+		scheme, client = HttpsScheme, h.tlsConfig.forwardingClient()
+	}
+	newUrl := scheme + "://" + utils.GetHostAddr(xdcrAddr, port) + oldRequestUrl
    
    	retryInterval := ForwardingRetryInterval
     for i := 0; i <= MaxForwardingRetry; i++ {
-    	response, err := http.DefaultClient.Do(newRequest)
-    	logger_ap.Infof("forwarding request=%v for the %vth time\n", newRequest, i + 1)
-    	if err == nil && response.StatusCode == 200 {
+    	// a new request is needed for each try since the body of the previous one has been consumed
+		newRequest, err := http.NewRequest(method, newUrl, bytes.NewBuffer(newRequestBody))
+		if err != nil {
+			return nil, err
+		}
+		newRequest.Header.Set(ContentType, contentType)
+		// forwarded requests are accepted by the other node only with the internal credential
+		h.auth.setInternalCredential(newRequest)
+
+    	response, err := client.Do(newRequest)
+    	// do not log the request itself, which contains the internal credential
+    	logger_ap.Infof("forwarding request to %v for the %vth time\n", newUrl, i + 1)
+    	if err == nil && (response.StatusCode == http.StatusOK || response.StatusCode == http.StatusNoContent) {
     		logger_ap.Infof("forwarding request succeeded")
 			return response, err
     	}
@@ -346,7 +481,18 @@ func (h *xdcrRestHandler) GetMessageKeyFromRequest(r *http.Request) (string, err
 		path = path[:len(path)-1]
 	}
 	
+	if strings.HasPrefix(path + base.UrlDelimiter, V2Prefix) {
+		v2Key, err := v2MessageKeyFromPath(path)
+		if err != nil {
+			return "", err
+		}
+		key = v2Key
+	}
+	
 	for _, staticPath := range StaticPaths {
+		if len(key) > 0 {
+			break
+		}
 		if path == staticPath {
 			// if path in url is a static path, use it as name
 			key = path
@@ -376,18 +522,3 @@ func (h *xdcrRestHandler) GetMessageKeyFromRequest(r *http.Request) (string, err
 		return key, nil
 	}
 }
-
-// apply default replication settings for the ones that are not explicitly specified
-func ApplyDefaultSettings(settings *map[string]interface{}) error {
-	defaultSettings, err := rm.ReplicationSettingsService().GetReplicationSettings()
-	if err != nil {
-		return err
-	}
-	
-	for key, val := range defaultSettings.ToMap() {
-		if _, ok := (*settings)[key]; !ok {
-			(*settings)[key] = val
-		}
-	}
-	return nil
-}
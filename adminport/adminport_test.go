@@ -0,0 +1,117 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package adminport
+
+import (
+	"bytes"
+	"github.com/Xiaomei-Zhang/goxdcr/base"
+	"github.com/Xiaomei-Zhang/goxdcr/log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// log sink that can be read while the adminport writes to it
+type syncBuffer struct {
+	buffer bytes.Buffer
+	lock   sync.Mutex
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buffer.String()
+}
+
+// start the adminport on a free local port. returns the url prefix of the port
+func startTestAdminPort(t *testing.T) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find a free port, err=%v", err)
+	}
+	addr := lis.Addr().String()
+	base.AdminportNumber = lis.Addr().(*net.TCPAddr).Port
+	lis.Close()
+
+	store := NewMemoryUserStore()
+	store.AddUser("admin", "adminSecret", RoleAdmin)
+	go MainAdminPort("127.0.0.1", NewAuthConfig("internal", "internalSecret", NewBasicAuthenticator(store)), nil)
+
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			return "http://" + addr + base.AdminportUrlPrefix
+		}
+	}
+	t.Fatalf("adminport is not up")
+	return ""
+}
+
+func sendTestRequest(t *testing.T, method, url, user, password, body string) int {
+	request, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("failed to create request, err=%v", err)
+	}
+	request.SetBasicAuth(user, password)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("failed to send request, err=%v", err)
+	}
+	response.Body.Close()
+	return response.StatusCode
+}
+
+func TestAdminPortAuditsChangeRequests(t *testing.T) {
+	audit := &syncBuffer{}
+	savedLogFile := log.AdminLoggerContext.Log_file
+	log.AdminLoggerContext.Log_file = audit
+	defer func() { log.AdminLoggerContext.Log_file = savedLogFile }()
+
+	url := startTestAdminPort(t) + V2ReplicationsPath
+
+	// rejected before it gets to any handler
+	if status := sendTestRequest(t, MethodPost, url, "admin", "wrongSecret", "{}"); status != http.StatusUnauthorized {
+		t.Errorf("request with wrong password got status %v", status)
+	}
+	if entry := auditEntry(audit.String(), "Request is rejected"); !strings.Contains(entry, "path=/"+V2ReplicationsPath) {
+		t.Errorf("rejected request is not audited, audit log=%q", audit.String())
+	}
+
+	// authorized, and then fails in the handler since the body is not a valid replication
+	if status := sendTestRequest(t, MethodPost, url, "admin", "adminSecret", "{}"); status != http.StatusBadRequest {
+		t.Errorf("invalid create request got status %v", status)
+	}
+	if entry := auditEntry(audit.String(), "Request is authorized"); !strings.Contains(entry, "user=admin") ||
+		!strings.Contains(entry, "method=POST") {
+		t.Errorf("authorized request is not audited, audit log=%q", audit.String())
+	}
+	if strings.Contains(audit.String(), "Secret") {
+		t.Errorf("credentials are logged, audit log=%q", audit.String())
+	}
+}
+
+// the first line in the log with the audit message
+func auditEntry(logged, msg string) string {
+	for _, line := range strings.Split(logged, "\n") {
+		if strings.HasPrefix(line, "Audit") && strings.Contains(line, msg) {
+			return line
+		}
+	}
+	return ""
+}
@@ -0,0 +1,331 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+// authentication and role based access control for adminport.
+
+package adminport
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	base "github.com/Xiaomei-Zhang/goxdcr/base"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// errors
+var ErrorUnauthorized = errors.New("Unauthorized. Valid credentials are required to access this resource.")
+var ErrorForbidden = errors.New("Forbidden. The user does not have the privilege required to access this resource.")
+var ErrorUnknownUser = errors.New("Unknown user or incorrect password")
+var ErrorNoRoutePermission = errors.New("No permission has been defined for the request")
+
+// realm sent back in WWW-Authenticate header
+const AuthRealm = "xdcr"
+
+// roles of adminport users.
+// a role grants all privileges of the roles listed before it, except for RoleInternal,
+// which is reserved for requests forwarded between xdcr nodes
+type Role int
+
+const (
+	RoleNone Role = iota
+	// RoleReadOnly can view settings and statistics
+	RoleReadOnly
+	// RoleAdmin can, in addition, create, delete, pause, resume replications and change settings
+	RoleAdmin
+	// RoleInternal is granted to the internal credential used by xdcr nodes to forward requests to each other
+	RoleInternal
+)
+
+const (
+	ROLE_NONE_STR      string = "none"
+	ROLE_READ_ONLY_STR string = "ro_admin"
+	ROLE_ADMIN_STR     string = "admin"
+	ROLE_INTERNAL_STR  string = "internal"
+)
+
+func (role Role) String() string {
+	switch role {
+	case RoleReadOnly:
+		return ROLE_READ_ONLY_STR
+	case RoleAdmin:
+		return ROLE_ADMIN_STR
+	case RoleInternal:
+		return ROLE_INTERNAL_STR
+	}
+	return ROLE_NONE_STR
+}
+
+func RoleFromStr(roleStr string) (Role, error) {
+	switch roleStr {
+	case ROLE_READ_ONLY_STR:
+		return RoleReadOnly, nil
+	case ROLE_ADMIN_STR:
+		return RoleAdmin, nil
+	case ROLE_INTERNAL_STR:
+		return RoleInternal, nil
+	}
+	return RoleNone, errors.New(fmt.Sprintf("%v is not a valid role", roleStr))
+}
+
+// whether a user with this role may access a route that requires the specified role
+func (role Role) Permits(required Role) bool {
+	if required == RoleInternal {
+		return role == RoleInternal
+	}
+	return role >= required
+}
+
+// authenticated user of adminport
+type User struct {
+	Name string
+	Role Role
+}
+
+// Authenticator authenticates an incoming http request.
+// Authenticators are pluggable. The adminport tries the configured authenticators in
+// order, and the first one that recognizes the credentials in the request decides.
+type Authenticator interface {
+	// returns the authenticated user.
+	// returns nil user and nil error when the request does not carry credentials
+	// that the authenticator knows how to verify, so that the next authenticator can be tried
+	Authenticate(request *http.Request) (*User, error)
+}
+
+// UserStore verifies user credentials against a configured set of users
+type UserStore interface {
+	Verify(name, password string) (*User, error)
+}
+
+/************************************
+/* struct MemoryUserStore
+*************************************/
+type userEntry struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+	Role     string `json:"role"`
+}
+
+// in-memory implementation of UserStore, which can be populated from a json file
+type MemoryUserStore struct {
+	users map[string]*userEntry
+	lock  sync.RWMutex
+}
+
+func NewMemoryUserStore() *MemoryUserStore {
+	return &MemoryUserStore{users: make(map[string]*userEntry)}
+}
+
+// load users from a json file, which contains an array of {"name":..., "password":..., "role":...}
+func NewUserStoreFromFile(path string) (*MemoryUserStore, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*userEntry, 0)
+	if err = json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+
+	store := NewMemoryUserStore()
+	for _, entry := range entries {
+		role, err := RoleFromStr(entry.Role)
+		if err != nil {
+			return nil, err
+		}
+		if err = store.AddUser(entry.Name, entry.Password, role); err != nil {
+			return nil, err
+		}
+	}
+	return store, nil
+}
+
+func (store *MemoryUserStore) AddUser(name, password string, role Role) error {
+	if len(name) == 0 {
+		return errors.New("User name cannot be empty")
+	}
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.users[name] = &userEntry{Name: name, Password: password, Role: role.String()}
+	return nil
+}
+
+func (store *MemoryUserStore) RemoveUser(name string) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	delete(store.users, name)
+}
+
+func (store *MemoryUserStore) Verify(name, password string) (*User, error) {
+	store.lock.RLock()
+	entry, ok := store.users[name]
+	store.lock.RUnlock()
+
+	if !ok || subtle.ConstantTimeCompare([]byte(entry.Password), []byte(password)) != 1 {
+		return nil, ErrorUnknownUser
+	}
+
+	role, err := RoleFromStr(entry.Role)
+	if err != nil {
+		return nil, err
+	}
+	return &User{Name: name, Role: role}, nil
+}
+
+/************************************
+/* struct BasicAuthenticator
+*************************************/
+// BasicAuthenticator authenticates requests with http basic authentication against a UserStore
+type BasicAuthenticator struct {
+	userStore UserStore
+}
+
+func NewBasicAuthenticator(userStore UserStore) *BasicAuthenticator {
+	return &BasicAuthenticator{userStore: userStore}
+}
+
+func (auth *BasicAuthenticator) Authenticate(request *http.Request) (*User, error) {
+	name, password, ok := request.BasicAuth()
+	if !ok {
+		return nil, nil
+	}
+	return auth.userStore.Verify(name, password)
+}
+
+/************************************
+/* struct AuthConfig
+*************************************/
+// AuthConfig holds the authentication settings of adminport
+type AuthConfig struct {
+	// authenticators tried in order for every incoming request
+	Authenticators []Authenticator
+
+	// internal credential used by xdcr nodes to forward requests to each other.
+	// it is never accepted for requests that ask for forwarding.
+	InternalUser     string
+	InternalPassword string
+}
+
+func NewAuthConfig(internalUser, internalPassword string, authenticators ...Authenticator) *AuthConfig {
+	return &AuthConfig{Authenticators: authenticators,
+		InternalUser:     internalUser,
+		InternalPassword: internalPassword}
+}
+
+// authenticate request with the internal credential first, and then with the configured authenticators
+func (config *AuthConfig) authenticate(request *http.Request) (*User, error) {
+	if name, password, ok := request.BasicAuth(); ok && len(config.InternalUser) > 0 && name == config.InternalUser {
+		if subtle.ConstantTimeCompare([]byte(password), []byte(config.InternalPassword)) == 1 {
+			return &User{Name: name, Role: RoleInternal}, nil
+		}
+		return nil, ErrorUnauthorized
+	}
+
+	for _, authenticator := range config.Authenticators {
+		user, err := authenticator.Authenticate(request)
+		if err != nil {
+			logger_ap.Infof("Authentication failed. err=%v\n", err)
+			return nil, ErrorUnauthorized
+		}
+		if user != nil {
+			return user, nil
+		}
+	}
+	return nil, ErrorUnauthorized
+}
+
+// set the internal credential on a request forwarded to another xdcr node
+func (config *AuthConfig) setInternalCredential(request *http.Request) {
+	if len(config.InternalUser) > 0 {
+		request.SetBasicAuth(config.InternalUser, config.InternalPassword)
+	}
+}
+
+// role required for each message key returned by GetMessageKeyFromRequest
+var RoutePermissions = map[string]Role{
+	CreateReplicationPath + base.UrlDelimiter + MethodPost:                     RoleAdmin,
+	DeleteReplicationPrefix + DynamicSuffix + base.UrlDelimiter + MethodDelete: RoleAdmin,
+	DeleteReplicationPrefix + DynamicSuffix + base.UrlDelimiter + MethodPost:   RoleAdmin,
+	PauseReplicationPrefix + DynamicSuffix + base.UrlDelimiter + MethodPost:    RoleAdmin,
+	ResumeReplicationPrefix + DynamicSuffix + base.UrlDelimiter + MethodPost:   RoleAdmin,
+	SettingsReplicationsPath + DynamicSuffix + base.UrlDelimiter + MethodGet:   RoleReadOnly,
+	SettingsReplicationsPath + DynamicSuffix + base.UrlDelimiter + MethodPost:  RoleAdmin,
+	StatisticsPath + base.UrlDelimiter + MethodGet:                             RoleReadOnly,
+	InternalSettingsPath + base.UrlDelimiter + MethodGet:                       RoleReadOnly,
+	InternalSettingsPath + base.UrlDelimiter + MethodPost:                      RoleAdmin,
+
+	V2ReplicationsPath + base.UrlDelimiter + MethodPost:                                                            RoleAdmin,
+	V2ReplicationsPath + DynamicSuffix + base.UrlDelimiter + MethodGet:                                             RoleReadOnly,
+	V2ReplicationsPath + DynamicSuffix + base.UrlDelimiter + MethodDelete:                                          RoleAdmin,
+	V2ReplicationsPath + DynamicSuffix + base.UrlDelimiter + V2PauseAction + base.UrlDelimiter + MethodPost:        RoleAdmin,
+	V2ReplicationsPath + DynamicSuffix + base.UrlDelimiter + V2ResumeAction + base.UrlDelimiter + MethodPost:       RoleAdmin,
+	V2ReplicationsPath + DynamicSuffix + base.UrlDelimiter + V2SettingsAction + base.UrlDelimiter + MethodGet:      RoleReadOnly,
+	V2ReplicationsPath + DynamicSuffix + base.UrlDelimiter + V2SettingsAction + base.UrlDelimiter + MethodPost:     RoleAdmin,
+	V2ReplicationsPath + DynamicSuffix + base.UrlDelimiter + V2HealthAction + base.UrlDelimiter + MethodGet:        RoleReadOnly,
+	V2ReplicationsPath + DynamicSuffix + base.UrlDelimiter + V2ErrorsAction + base.UrlDelimiter + MethodGet:        RoleReadOnly,
+	V2ReplicationsPath + DynamicSuffix + base.UrlDelimiter + V2ErrorsAction + base.UrlDelimiter + MethodDelete:     RoleAdmin,
+	V2StatisticsPath + base.UrlDelimiter + MethodGet:                                                              RoleReadOnly,
+	V2OpenAPIPath + base.UrlDelimiter + MethodGet:                                                                 RoleReadOnly,
+	V2LeaderPath + base.UrlDelimiter + MethodGet:                                                                  RoleReadOnly,
+	V2DebugGenServersPath + base.UrlDelimiter + MethodGet:                                                         RoleReadOnly,
+	V2LoggingPath + base.UrlDelimiter + MethodGet:                                                                 RoleReadOnly,
+	V2LoggingPath + base.UrlDelimiter + MethodPost:                                                                RoleAdmin,
+}
+
+// authorize the request for the specified message key.
+// requests that are not to be forwarded, i.e., requests that have been forwarded
+// from another xdcr node, are accepted only with the internal credential, so that
+// an external client cannot make changes on one node only.
+func (config *AuthConfig) authorize(request *http.Request, key string) (*User, error) {
+	user, err := config.authenticate(request)
+	if err != nil {
+		return nil, err
+	}
+
+	required, ok := RoutePermissions[key]
+	if !ok {
+		return nil, ErrorNoRoutePermission
+	}
+
+	if isForwardedRequest(request) {
+		required = RoleInternal
+	}
+
+	if user.Role == RoleInternal {
+		// the internal credential can only be used for forwarded requests
+		if required != RoleInternal {
+			return nil, ErrorForbidden
+		}
+	} else if !user.Role.Permits(required) {
+		logger_ap.Infof("User %v with role %v is not permitted to access %v\n", user.Name, user.Role, key)
+		return nil, ErrorForbidden
+	}
+
+	return user, nil
+}
+
+// a request is forwarded from another xdcr node when its forward flag is explicitly set to false
+func isForwardedRequest(request *http.Request) bool {
+	if err := request.ParseForm(); err != nil {
+		return false
+	}
+	forwardStr := request.Form.Get(Forward)
+	if len(forwardStr) == 0 {
+		return false
+	}
+	forward, err := strconv.ParseBool(forwardStr)
+	return err == nil && !forward
+}
@@ -19,8 +19,6 @@ import (
 	"net/url"
 	"io/ioutil"
 	"errors"
-	"regexp"
-	"fmt"
 )
 
 // http request method types
@@ -51,22 +49,32 @@ const (
 	DynamicSuffix = "/dynamic"
 )
 
-// constants used for parsing internal settings
+// constants used for parsing internal settings. 
+// they are the rest keys in metadata.ReplicationSettingsSchema
 const (
-	ReplicationType                = "xdcrReplicationType"
-	FilterExpression               = "xdcrFilterExpression"
-	Active                         = "xdcrActive"
-	CheckpointInterval             = "xdcrCheckpointInterval"
-	BatchCount                     = "xdcrWorkerBatchSize"
-	BatchSize                      = "xdcrDocBatchSizeKb"
-	FailureRestartInterval         = "xdcrFailureRestartInterval"
-	OptimisticReplicationThreshold = "xdcrOptimisticReplicationThreshold"
-	HttpConnection                 = "httpConnections"
-	SourceNozzlePerNode            = "xdcrSourceNozzlePerNode"
-	TargetNozzlePerNode            = "xdcrTargetNozzlePerNode"
-	MaxExpectedReplicationLag      = "xdcrMaxExpectedReplicationLag"
-	TimeoutPercentageCap           = "xdcrTimeoutPercentageCap"
-	LogLevel                       = "xdcrLogLevel"
+	ReplicationType                = metadata.ReplicationTypeRestKey
+	FilterExpression               = metadata.FilterExpressionRestKey
+	Active                         = metadata.ActiveRestKey
+	CheckpointInterval             = metadata.CheckpointIntervalRestKey
+	BatchCount                     = metadata.BatchCountRestKey
+	BatchSize                      = metadata.BatchSizeRestKey
+	FailureRestartInterval         = metadata.FailureRestartIntervalRestKey
+	OptimisticReplicationThreshold = metadata.OptimisticReplicationThresholdRestKey
+	HttpConnection                 = metadata.HttpConnectionRestKey
+	SourceNozzlePerNode            = metadata.SourceNozzlePerNodeRestKey
+	TargetNozzlePerNode            = metadata.TargetNozzlePerNodeRestKey
+	MaxExpectedReplicationLag      = metadata.MaxExpectedReplicationLagRestKey
+	TimeoutPercentageCap           = metadata.TimeoutPercentageCapRestKey
+	TimeoutCapPolicy               = metadata.TimeoutCapPolicyRestKey
+	ErrorPolicies                  = metadata.ErrorPoliciesRestKey
+	QueueSize                      = metadata.QueueSizeRestKey
+	QueueHighWatermark             = metadata.QueueHighWatermarkRestKey
+	SpoolMaxSize                   = metadata.SpoolMaxSizeRestKey
+	SpoolOverflowPolicy            = metadata.SpoolOverflowPolicyRestKey
+	Deduplication                  = metadata.DeduplicationRestKey
+	Compression                    = metadata.CompressionRestKey
+	CompressionThreshold           = metadata.CompressionThresholdRestKey
+	LogLevel                       = metadata.PipelineLogLevelRestKey
 )
 
 // constants for parsing create replication request
@@ -111,40 +119,19 @@ const (
 var MissingSettingsInRequest = errors.New("Invalid http request. No replication setting parameters have been supplied.")
 
 // replication settings key in rest api -> internal replication settings key
-var ReplSettingRestToInternalMap = map[string]string {
-	ReplicationType: metadata.ReplicationType,
-	FilterExpression: metadata.FilterExpression,
-	Active: metadata.Active,
-	CheckpointInterval: metadata.CheckpointInterval,
-	BatchCount: metadata.BatchCount,
-	BatchSize: metadata.BatchSize,
-	FailureRestartInterval: metadata.FailureRestartInterval,
-	OptimisticReplicationThreshold: metadata.OptimisticReplicationThreshold,
-	SourceNozzlePerNode: metadata.SourceNozzlePerNode,
-	TargetNozzlePerNode: metadata.TargetNozzlePerNode,
-	MaxExpectedReplicationLag: metadata.MaxExpectedReplicationLag,
-	TimeoutPercentageCap: metadata.TimeoutPercentageCap,
-	LogLevel: metadata.PipelineLogLevel,
-} 
+var ReplSettingRestToInternalMap = make(map[string]string)
 
 // internal replication settings key -> replication settings key in rest api
-var ReplSettingInternalToRestMap = map[string]string {
-	metadata.ReplicationType: ReplicationType,
-	metadata.FilterExpression: FilterExpression,
-	metadata.Active: Active,
-	metadata.CheckpointInterval: CheckpointInterval,
-	metadata.BatchCount: BatchCount,
-	metadata.BatchSize: BatchSize,
-	metadata.FailureRestartInterval: FailureRestartInterval,
-	metadata.OptimisticReplicationThreshold: OptimisticReplicationThreshold,
-	metadata.SourceNozzlePerNode: SourceNozzlePerNode,
-	metadata.TargetNozzlePerNode: TargetNozzlePerNode,
-	metadata.MaxExpectedReplicationLag: MaxExpectedReplicationLag,
-	metadata.TimeoutPercentageCap: TimeoutPercentageCap,
-	metadata.PipelineLogLevel: LogLevel,
-} 
-
-var logger_msgutil *log.CommonLogger = log.NewLogger("MessageUtils", log.DefaultLoggerContext)
+var ReplSettingInternalToRestMap = make(map[string]string)
+
+func init() {
+	for _, spec := range metadata.ReplicationSettingsSchema.Specs() {
+		ReplSettingRestToInternalMap[spec.RestKey] = spec.Key
+		ReplSettingInternalToRestMap[spec.Key] = spec.RestKey
+	}
+}
+
+var logger_msgutil *log.CommonLogger = log.NewLogger("MessageUtils", log.AdminLoggerContext)
 
 // decode parameters from create replication request
 func DecodeCreateReplicationRequest(request *http.Request) (fromBucket, toClusterUuid, toBucket, filterName string, forward bool, settings map[string]interface{}, err error) {	
@@ -300,53 +287,11 @@ func DecodeSettingsFromRequest(request *http.Request, throwError bool) (map[stri
 			return nil, err
 		}
 		
-		val := valArr[0]
-		
-		switch key {
-			case ReplicationType:	
-				fallthrough
-			case FilterExpression:
-				err := verifyFilterExpression(val) 
-				if err != nil {
-					errMsg := fmt.Sprintf("Invalid value, %v, for parameter, %v, in http request. It needs to be a valid regular expression.", val, key)
-					return nil, utils.NewEnhancedError(errMsg, err)
-				}
-				settings[internalKey] = val
-			case Active:
-				active, err := strconv.ParseBool(val)
-				if err != nil {
-					err = utils.InvalidValueInHttpRequestError(key, val)
-					return nil, err
-				}
-				settings[internalKey] = active
-			case CheckpointInterval:
-				fallthrough
-			case BatchCount:
-				fallthrough
-			case BatchSize:
-				fallthrough
-			case FailureRestartInterval:
-				fallthrough
-			case OptimisticReplicationThreshold:
-				fallthrough
-			case HttpConnection:
-				fallthrough
-			case SourceNozzlePerNode:
-				fallthrough
-			case TargetNozzlePerNode:
-				fallthrough
-			case MaxExpectedReplicationLag:
-				fallthrough
-			case TimeoutPercentageCap:
-				intVal, err := strconv.ParseInt(val, base.ParseIntBase, base.ParseIntBitSize)
-				if err != nil {
-					err = utils.InvalidValueInHttpRequestError(key, val)
-					return nil, err
-				}
-				settings[internalKey] = int(intVal)
-			case LogLevel:
-				settings[internalKey] = val
+		val, err := parseSettingValue(key, valArr[0])
+		if err != nil {
+			return nil, err
 		}
+		settings[internalKey] = val
 	}
 	
 	if len(settings) == 0 && throwError {
@@ -422,9 +367,20 @@ func EncodeMapIntoByteArray(data map[string]interface{}) ([]byte, error) {
 	return []byte (params.Encode()), nil
 }
 
-func verifyFilterExpression(filterExpression string) error {
-	_, err := regexp.Compile(filterExpression)
-	return err
-}
-
+// parse the string value of a replication setting in rest api into the data type of the setting,
+// and validate it against the settings schema
+func parseSettingValue(key, val string) (interface{}, error) {
+	spec := metadata.ReplicationSettingsSchema.SpecByRestKey(key)
+	if spec == nil {
+		return nil, utils.InvalidParameterInHttpRequestError(key)
+	}
 
+	settingVal, err := spec.ParseString(val)
+	if err != nil {
+		return nil, utils.InvalidValueInHttpRequestError(key, val)
+	}
+	if err = spec.Validate(settingVal); err != nil {
+		return nil, utils.NewEnhancedError(utils.InvalidValueInHttpRequestError(key, val).Error(), err)
+	}
+	return settingVal, nil
+}
@@ -0,0 +1,415 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+// OpenAPI description of the v2 rest api, served at v2/openapi.json.
+// The routes need to be kept in sync with rest_v2.go. The replication settings are
+// generated from metadata.ReplicationSettingsSchema
+
+package adminport
+
+import (
+	"encoding/json"
+	"github.com/Xiaomei-Zhang/goxdcr/metadata"
+)
+
+// OpenAPI description without the properties of replication settings
+const OpenAPISpecTemplate = `{
+  "openapi": "3.0.0",
+  "info": {
+    "title": "XDCR REST API",
+    "version": "2.0"
+  },
+  "security": [{"basicAuth": []}],
+  "paths": {
+    "/v2/replications": {
+      "post": {
+        "summary": "Create a replication",
+        "parameters": [{"$ref": "#/components/parameters/forward"}],
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {"$ref": "#/components/schemas/CreateReplicationRequest"}}}
+        },
+        "responses": {
+          "200": {
+            "description": "Replication created",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/CreateReplicationResponse"}}}
+          },
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v2/replications/{replicationId}": {
+      "parameters": [{"$ref": "#/components/parameters/replicationId"}],
+      "get": {
+        "summary": "View a replication, with its health and recent errors on this node",
+        "responses": {
+          "200": {
+            "description": "Replication",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Replication"}}}
+          },
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "delete": {
+        "summary": "Delete a replication",
+        "parameters": [{"$ref": "#/components/parameters/forward"}],
+        "responses": {
+          "204": {"description": "Replication deleted"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v2/replications/{replicationId}/pause": {
+      "parameters": [{"$ref": "#/components/parameters/replicationId"}],
+      "post": {
+        "summary": "Pause a replication",
+        "parameters": [{"$ref": "#/components/parameters/forward"}],
+        "responses": {
+          "204": {"description": "Replication paused"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v2/replications/{replicationId}/resume": {
+      "parameters": [{"$ref": "#/components/parameters/replicationId"}],
+      "post": {
+        "summary": "Resume a replication",
+        "parameters": [{"$ref": "#/components/parameters/forward"}],
+        "responses": {
+          "204": {"description": "Replication resumed"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v2/replications/{replicationId}/health": {
+      "parameters": [{"$ref": "#/components/parameters/replicationId"}],
+      "get": {
+        "summary": "Health of the replication on this node, combined from the health checks of its parts, connectors and services",
+        "responses": {
+          "200": {
+            "description": "Replication health",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ReplicationHealth"}}}
+          },
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v2/replications/{replicationId}/errors": {
+      "parameters": [{"$ref": "#/components/parameters/replicationId"}],
+      "get": {
+        "summary": "Most recent errors of the replication on this node, oldest first. The errors are kept across restarts of the replication",
+        "responses": {
+          "200": {
+            "description": "Replication errors",
+            "content": {"application/json": {"schema": {
+              "type": "object",
+              "properties": {"errors": {"type": "array", "items": {"$ref": "#/components/schemas/ReplicationError"}}}
+            }}}
+          },
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "delete": {
+        "summary": "Clear the errors of the replication on this node",
+        "responses": {
+          "204": {"description": "Errors cleared"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v2/replications/{replicationId}/settings": {
+      "parameters": [{"$ref": "#/components/parameters/replicationId"}],
+      "get": {
+        "summary": "View the settings of a replication",
+        "parameters": [{
+          "name": "source",
+          "in": "query",
+          "description": "If true, each setting is returned as {\"value\": ..., \"source\": \"replication\"|\"default\"}, where source tells whether the setting is explicitly set on the replication or inherited from default replication settings.",
+          "schema": {"type": "boolean", "default": false}
+        }],
+        "responses": {
+          "200": {
+            "description": "Replication settings",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ReplicationSettings"}}}
+          },
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "post": {
+        "summary": "Change the settings of a replication. Settings with null value go back to being inherited from default replication settings",
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ReplicationSettings"}}}
+        },
+        "responses": {
+          "204": {"description": "Settings changed"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v2/stats": {
+      "get": {
+        "summary": "Statistics of running replications",
+        "responses": {
+          "200": {
+            "description": "Statistics keyed by replication id",
+            "content": {"application/json": {"schema": {"type": "object"}}}
+          },
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v2/leader": {
+      "get": {
+        "summary": "The leader among xdcr nodes, which runs the duties that run once per cluster, as observed by this node",
+        "responses": {
+          "200": {
+            "description": "Leader",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/LeaderResponse"}}}
+          },
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v2/debug/genservers": {
+      "get": {
+        "summary": "Metrics of the running gen_servers, e.g., mailbox depths, queue wait times, callback durations and heartbeat latencies",
+        "responses": {
+          "200": {
+            "description": "Metrics keyed by the names of the gen_servers, e.g., <replication id>/<part id>",
+            "content": {"application/json": {"schema": {"type": "object"}}}
+          },
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v2/logging": {
+      "get": {
+        "summary": "Log levels of modules that override the log levels of pipelines and processes, and how user data is redacted in logs, on this node",
+        "responses": {
+          "200": {
+            "description": "Logging settings",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Logging"}}}
+          },
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "post": {
+        "summary": "Change the log levels of modules and the redaction mode on this node. A module whose log level is null goes back to the log level of its pipeline or process",
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Logging"}}}
+        },
+        "responses": {
+          "200": {
+            "description": "Logging settings after the change",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Logging"}}}
+          },
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v2/openapi.json": {
+      "get": {
+        "summary": "This document",
+        "responses": {
+          "200": {"description": "OpenAPI description of the v2 api", "content": {"application/json": {"schema": {"type": "object"}}}}
+        }
+      }
+    }
+  },
+  "components": {
+    "securitySchemes": {
+      "basicAuth": {"type": "http", "scheme": "basic"}
+    },
+    "parameters": {
+      "replicationId": {
+        "name": "replicationId",
+        "in": "path",
+        "required": true,
+        "schema": {"type": "string"}
+      },
+      "forward": {
+        "name": "forward",
+        "in": "query",
+        "description": "Whether the request is forwarded to other xdcr nodes. Only false is set, on requests forwarded between xdcr nodes.",
+        "schema": {"type": "boolean", "default": true}
+      }
+    },
+    "responses": {
+      "Error": {
+        "description": "Error",
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ErrorEnvelope"}}}
+      }
+    },
+    "schemas": {
+      "CreateReplicationRequest": {
+        "allOf": [
+          {
+            "type": "object",
+            "required": ["fromBucket", "uuid", "toBucket"],
+            "properties": {
+              "fromBucket": {"type": "string"},
+              "uuid": {"type": "string", "description": "uuid of the target cluster"},
+              "toBucket": {"type": "string"},
+              "filterName": {"type": "string"}
+            }
+          },
+          {"$ref": "#/components/schemas/ReplicationSettings"}
+        ]
+      },
+      "CreateReplicationResponse": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "string"}
+        }
+      },
+      "LeaderResponse": {
+        "type": "object",
+        "properties": {
+          "leader": {
+            "type": "object",
+            "nullable": true,
+            "description": "null when no node holds a valid lease",
+            "properties": {
+              "nodeId": {"type": "string"},
+              "term": {"type": "integer", "description": "increases every time the leadership changes hands. Used as fencing token"},
+              "leaseExpiry": {"type": "string", "format": "date-time"}
+            }
+          },
+          "isLeader": {"type": "boolean", "description": "whether this node is the leader"}
+        }
+      },
+      "Health": {
+        "type": "object",
+        "required": ["status"],
+        "properties": {
+          "status": {"type": "string", "enum": ["ok", "degraded", "failed"]},
+          "reason": {"type": "string", "description": "why the status is not ok"}
+        }
+      },
+      "ReplicationHealth": {
+        "allOf": [
+          {"$ref": "#/components/schemas/Health"},
+          {
+            "type": "object",
+            "properties": {
+              "components": {
+                "type": "object",
+                "description": "health of the parts, connectors and services of the replication, keyed by their ids",
+                "additionalProperties": {"$ref": "#/components/schemas/Health"}
+              }
+            }
+          }
+        ]
+      },
+      "ReplicationError": {
+        "type": "object",
+        "properties": {
+          "time": {"type": "string", "format": "date-time"},
+          "partId": {"type": "string", "description": "id of the part or service that raised the error, or of the component that failed its health check"},
+          "class": {"type": "string", "enum": ["transient", "topology_change", "authentication", "configuration", "fatal"]},
+          "message": {"type": "string"}
+        }
+      },
+      "Replication": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "string"},
+          "fromBucket": {"type": "string"},
+          "uuid": {"type": "string", "description": "uuid of the target cluster"},
+          "toBucket": {"type": "string"},
+          "filterName": {"type": "string"},
+          "active": {"type": "boolean"},
+          "health": {
+            "allOf": [{"$ref": "#/components/schemas/ReplicationHealth"}],
+            "nullable": true,
+            "description": "null when the replication is not running on this node"
+          },
+          "errors": {"type": "array", "items": {"$ref": "#/components/schemas/ReplicationError"}}
+        }
+      },
+      "Logging": {
+        "type": "object",
+        "properties": {
+          "logLevels": {
+            "type": "object",
+            "description": "module, e.g., XmemNozzle -> log level",
+            "additionalProperties": {"type": "string", "nullable": true, "enum": ["Error", "Info", "Debug", "Trace", null]}
+          },
+          "redaction": {
+            "type": "string",
+            "enum": ["none", "tag", "hash"],
+            "description": "how user data, e.g., document keys, is logged: as it is, wrapped in <ud></ud> tags, or replaced by its sha1 hash"
+          }
+        }
+      },
+      "ReplicationSettings": {
+        "type": "object",
+        "description": "properties are generated from the replication settings schema"
+      },
+      "ErrorEnvelope": {
+        "type": "object",
+        "properties": {
+          "error": {
+            "type": "object",
+            "required": ["code", "message"],
+            "properties": {
+              "code": {
+                "type": "string",
+                "enum": ["invalid_request", "unauthorized", "forbidden", "not_found", "service_unavailable", "internal_error"]
+              },
+              "message": {"type": "string"},
+              "details": {
+                "type": "object",
+                "description": "parameter name -> what is wrong with the parameter",
+                "additionalProperties": {"type": "string"}
+              }
+            }
+          }
+        }
+      }
+    }
+  }
+}
+`
+
+// OpenAPI description with replication settings filled in from the settings schema
+func NewOpenAPISpec() ([]byte, error) {
+	spec := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(OpenAPISpecTemplate), &spec); err != nil {
+		return nil, err
+	}
+
+	properties := make(map[string]interface{})
+	for _, settingSpec := range metadata.ReplicationSettingsSchema.Specs() {
+		property := map[string]interface{}{
+			"description": settingSpec.Description,
+			"default":     settingSpec.Default,
+		}
+		switch settingSpec.Type {
+		case metadata.SettingTypeBool:
+			property["type"] = "boolean"
+		case metadata.SettingTypeInt:
+			property["type"] = "integer"
+			if settingSpec.HasRange {
+				property["minimum"] = settingSpec.Min
+				property["maximum"] = settingSpec.Max
+			}
+		default:
+			property["type"] = "string"
+		}
+		properties[settingSpec.RestKey] = property
+	}
+
+	schemas := spec["components"].(map[string]interface{})["schemas"].(map[string]interface{})
+	schemas["ReplicationSettings"].(map[string]interface{})["properties"] = properties
+
+	return json.Marshal(spec)
+}
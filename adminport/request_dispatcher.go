@@ -0,0 +1,242 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+// dispatcher of admin requests.
+//
+// Requests on different replications are handled in parallel. Requests that
+// change the same replication are queued and handled strictly in the order they
+// are received. Read-only requests never wait behind changes.
+//
+// Dispatch runs on the single loop of the adminport, so it only does in-memory work.
+// Request bodies have been read before the requests get here, and the uuid of the
+// local cluster, which is part of the id of a replication to be created, is looked
+// up in the background.
+
+package adminport
+
+import (
+	"errors"
+	"github.com/Xiaomei-Zhang/goxdcr/base"
+	"github.com/Xiaomei-Zhang/goxdcr/metadata"
+	rm "github.com/Xiaomei-Zhang/goxdcr/replication_manager"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrorRequestTimeout = errors.New("Request timed out. The operation may still complete in the background.")
+var ErrorTooManyQueuedRequests = errors.New("Too many requests are pending on the replication. Try again later.")
+
+// queue key for requests that cannot be associated with a replication id
+const unknownReplicationQueue = ""
+
+// result of handling a request
+type requestResult struct {
+	response []byte
+	err      error
+}
+
+// a request waiting in a replication queue
+type queuedRequest struct {
+	request  *http.Request
+	key      string
+	resultch chan *requestResult
+}
+
+// requests on one replication, handled in order by a single goroutine
+type replicationQueue struct {
+	reqch   chan *queuedRequest
+	pending int
+}
+
+type requestDispatcher struct {
+	handler *xdcrRestHandler
+	// replication id -> queue of pending change requests on the replication
+	queues map[string]*replicationQueue
+	lock   sync.Mutex
+	// max time a client waits for the response
+	timeout time.Duration
+	// uuid of the local cluster, empty until it has been looked up
+	sourceClusterUUID atomic.Value
+}
+
+func newRequestDispatcher(handler *xdcrRestHandler, timeout time.Duration) *requestDispatcher {
+	d := &requestDispatcher{handler: handler,
+		queues:  make(map[string]*replicationQueue),
+		timeout: timeout}
+	d.sourceClusterUUID.Store("")
+	go d.lookupSourceClusterUuid()
+	return d
+}
+
+// look up the uuid of the local cluster, retrying until it is known
+func (d *requestDispatcher) lookupSourceClusterUuid() {
+	for {
+		if top_svc := rm.XDCRCompTopologyService(); top_svc != nil {
+			uuid, err := top_svc.MyCluster()
+			if err == nil && uuid != "" {
+				d.sourceClusterUUID.Store(uuid)
+				return
+			}
+			logger_ap.Infof("Failed to look up the uuid of the local cluster, err=%v. Will retry.\n", err)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// uuid of the local cluster, or empty if it is not known yet
+func (d *requestDispatcher) sourceClusterUuid() string {
+	return d.sourceClusterUUID.Load().(string)
+}
+
+// dispatch a request and send the response back without blocking the caller
+func (d *requestDispatcher) dispatch(req Request) {
+	request := req.GetHttpRequest()
+	// the request itself is not logged, since its Authorization header carries the password
+	logger_ap.Infof("Request: %v %v\n", request.Method, request.URL.Path)
+
+	key, err := d.handler.GetMessageKeyFromRequest(request)
+	if err != nil {
+		req.SendError(err)
+		return
+	}
+
+	// reject unauthorized requests before they can occupy any queue
+	user, err := d.handler.auth.authorize(request, key)
+	if err != nil {
+		logger_audit.Infow("Request is rejected", "method", request.Method, "path", request.URL.Path, "remote_addr", request.RemoteAddr, "err", err)
+		req.SendError(err)
+		return
+	}
+	logger_ap.Debugf("Request authorized for user %v with role %v\n", user.Name, user.Role)
+	if request.Method != MethodGet {
+		logger_audit.Infow("Request is authorized", "user", user.Name, "role", user.Role, "method", request.Method, "path", request.URL.Path,
+			"remote_addr", request.RemoteAddr)
+	}
+
+	resultch := make(chan *requestResult, 1)
+	if isReadOnlyKey(key) {
+		go d.handle(request, key, resultch)
+	} else {
+		d.enqueue(d.replicationIdFromRequest(request, key), &queuedRequest{request: request, key: key, resultch: resultch})
+	}
+
+	go d.waitForResult(req, resultch)
+}
+
+// send the result of the request back to the client, or a timeout error if the result
+// does not come back in time. A request that has timed out still runs to completion
+// so that requests queued behind it on the same replication stay in order
+func (d *requestDispatcher) waitForResult(req Request, resultch chan *requestResult) {
+	timer := time.NewTimer(d.timeout)
+	defer timer.Stop()
+
+	select {
+	case result := <-resultch:
+		if result.err == nil {
+			req.Send(result.response)
+		} else {
+			req.SendError(result.err)
+		}
+	case <-timer.C:
+		logger_ap.Errorf("Request %v %v timed out after %v\n", req.GetHttpRequest().Method, req.GetHttpRequest().URL.Path, d.timeout)
+		req.SendError(ErrorRequestTimeout)
+	}
+}
+
+func (d *requestDispatcher) handle(request *http.Request, key string, resultch chan *requestResult) {
+	result := &requestResult{}
+	// Fault-tolerance. A panic in one request should not bring down the queue it is in.
+	defer func() {
+		if r := recover(); r != nil {
+			logger_ap.Errorf("adminport.request.recovered `%v`\n", r)
+			result.err = ErrorInternal
+		}
+		resultch <- result
+	}()
+
+	result.response, result.err = d.handler.handleRequestWithKey(request, key)
+}
+
+func (d *requestDispatcher) enqueue(replicationId string, queuedReq *queuedRequest) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	queue, ok := d.queues[replicationId]
+	if !ok {
+		queue = &replicationQueue{reqch: make(chan *queuedRequest, base.AdminportMaxQueuedRequests)}
+		d.queues[replicationId] = queue
+		go d.processQueue(replicationId, queue)
+	}
+	queue.pending++
+
+	select {
+	case queue.reqch <- queuedReq:
+	default:
+		queue.pending--
+		queuedReq.resultch <- &requestResult{err: ErrorTooManyQueuedRequests}
+	}
+}
+
+// handle requests on one replication in order. The goroutine exits, and the queue is removed,
+// once there are no more pending requests on the replication
+func (d *requestDispatcher) processQueue(replicationId string, queue *replicationQueue) {
+	logger_ap.Debugf("Started request queue for replication %v\n", replicationId)
+	for queuedReq := range queue.reqch {
+		d.handle(queuedReq.request, queuedReq.key, queuedReq.resultch)
+
+		d.lock.Lock()
+		queue.pending--
+		if queue.pending == 0 {
+			delete(d.queues, replicationId)
+			d.lock.Unlock()
+			break
+		}
+		d.lock.Unlock()
+	}
+	logger_ap.Debugf("Request queue for replication %v exits\n", replicationId)
+}
+
+// requests which do not change anything
+func isReadOnlyKey(key string) bool {
+	return strings.HasSuffix(key, base.UrlDelimiter+MethodGet)
+}
+
+// id of the replication that a change request is on. Requests whose replication id cannot be
+// worked out, e.g., creations received before the uuid of the local cluster is known, all go
+// to the same queue
+func (d *requestDispatcher) replicationIdFromRequest(request *http.Request, key string) string {
+	pathPrefix := key[:strings.LastIndex(key, base.UrlDelimiter)]
+	if strings.HasPrefix(pathPrefix, V2ReplicationsPath+DynamicSuffix) {
+		replicationId, err := DecodeReplicationIdFromV2Request(request)
+		if err == nil {
+			return replicationId
+		}
+	} else if pathPrefix == V2ReplicationsPath {
+		// errors in the request are reported when it is handled
+		fromBucket, toClusterUuid, toBucket, filterName, _, err := DecodeV2CreateReplicationRequest(request)
+		if fromClusterUuid := d.sourceClusterUuid(); err == nil && fromClusterUuid != "" {
+			return metadata.ReplicationId(fromClusterUuid, fromBucket, toClusterUuid, toBucket, filterName)
+		}
+	} else if strings.HasSuffix(pathPrefix, DynamicSuffix) {
+		replicationId, err := DecodeReplicationIdFromHttpRequest(request, pathPrefix[:len(pathPrefix)-len(DynamicSuffix)])
+		if err == nil {
+			return replicationId
+		}
+	} else if pathPrefix == CreateReplicationPath {
+		// the id of the replication to be created is derived from the request parameters
+		if fromClusterUuid := d.sourceClusterUuid(); fromClusterUuid != "" && request.ParseForm() == nil {
+			return metadata.ReplicationId(fromClusterUuid, request.Form.Get(FromBucket), request.Form.Get(ToClusterUuid),
+				request.Form.Get(ToBucket), request.Form.Get(FilterName))
+		}
+	}
+	return unknownReplicationQueue
+}
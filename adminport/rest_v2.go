@@ -0,0 +1,741 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+// version 2 of the rest api.
+//
+// v2 requests and responses have json bodies, and errors are returned in a common envelope:
+//   {"error": {"code": "...", "message": "...", "details": {"<parameter>": "<what is wrong with it>"}}}
+// replication settings use the same names, e.g., xdcrCheckpointInterval, in all requests and responses.
+// The form-encoded routes of the original api are kept unchanged.
+
+package adminport
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/Xiaomei-Zhang/goxdcr/base"
+	"github.com/Xiaomei-Zhang/goxdcr/common"
+	"github.com/Xiaomei-Zhang/goxdcr/gen_server"
+	"github.com/Xiaomei-Zhang/goxdcr/log"
+	"github.com/Xiaomei-Zhang/goxdcr/metadata"
+	"github.com/Xiaomei-Zhang/goxdcr/metadata_svc"
+	rm "github.com/Xiaomei-Zhang/goxdcr/replication_manager"
+	utils "github.com/Xiaomei-Zhang/goxdcr/utils"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const JsonContentType = "application/json"
+
+// constants used for parsing v2 url path
+const (
+	V2Prefix           = "v2/"
+	V2ReplicationsPath = "v2/replications"
+	V2StatisticsPath   = "v2/stats"
+	V2OpenAPIPath      = "v2/openapi.json"
+	V2LeaderPath       = "v2/leader"
+	// metrics of the gen_servers, e.g., mailbox depths and callback durations, for debugging
+	V2DebugGenServersPath = "v2/debug/genservers"
+	// log levels of modules and redaction of user data in logs, on the current node
+	V2LoggingPath = "v2/logging"
+	// actions on a replication, which follow the replication id in url path,
+	// e.g., v2/replications/$replication_id/pause
+	V2PauseAction    = "pause"
+	V2ResumeAction   = "resume"
+	V2SettingsAction = "settings"
+	V2HealthAction   = "health"
+	V2ErrorsAction   = "errors"
+	// query parameter for showing the sources of replication settings
+	SettingSourceParam = "source"
+)
+
+var V2StaticPaths = [6]string{V2ReplicationsPath, V2StatisticsPath, V2OpenAPIPath, V2LeaderPath, V2DebugGenServersPath, V2LoggingPath}
+var V2ReplicationActions = [5]string{V2PauseAction, V2ResumeAction, V2SettingsAction, V2HealthAction, V2ErrorsAction}
+
+// error codes in v2 error envelope
+const (
+	ErrorCodeInvalidRequest     = "invalid_request"
+	ErrorCodeUnauthorized       = "unauthorized"
+	ErrorCodeForbidden          = "forbidden"
+	ErrorCodeNotFound           = "not_found"
+	ErrorCodeServiceUnavailable = "service_unavailable"
+	ErrorCodeInternal           = "internal_error"
+)
+
+/************************************
+/* struct RequestError
+*************************************/
+// RequestError is an error in a v2 request, which is returned in the error envelope
+type RequestError struct {
+	// http status code of the response
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// parameter name -> what is wrong with the parameter
+	Details map[string]string `json:"details,omitempty"`
+}
+
+func NewRequestError(status int, code string, message string) *RequestError {
+	return &RequestError{Status: status,
+		Code:    code,
+		Message: message}
+}
+
+// invalid request with the errors on individual parameters
+func NewInvalidRequestError(details map[string]string) *RequestError {
+	err := NewRequestError(http.StatusBadRequest, ErrorCodeInvalidRequest, "Invalid parameters in http request.")
+	err.Details = details
+	return err
+}
+
+func (err *RequestError) Error() string {
+	if len(err.Details) == 0 {
+		return err.Message
+	}
+	return fmt.Sprintf("%v details=%v", err.Message, err.Details)
+}
+
+type errorEnvelope struct {
+	Error *RequestError `json:"error"`
+}
+
+// convert an error from request handling into a RequestError
+func toRequestError(err error) *RequestError {
+	switch err {
+	case ErrorUnauthorized:
+		return NewRequestError(http.StatusUnauthorized, ErrorCodeUnauthorized, err.Error())
+	case ErrorForbidden:
+		return NewRequestError(http.StatusForbidden, ErrorCodeForbidden, err.Error())
+	case ErrorInvalidRequest, ErrorNoRoutePermission:
+		return NewRequestError(http.StatusNotFound, ErrorCodeNotFound, err.Error())
+	case ErrorRequestTimeout, ErrorTooManyQueuedRequests:
+		return NewRequestError(http.StatusServiceUnavailable, ErrorCodeServiceUnavailable, err.Error())
+	}
+
+	switch v := err.(type) {
+	case *RequestError:
+		return v
+	case base.SettingsError:
+		// invalid settings in the request, keyed by rest keys
+		details := make(map[string]string)
+		for key, settingErr := range v.ErrorMap() {
+			if restKey, ok := ReplSettingInternalToRestMap[key]; ok {
+				key = restKey
+			}
+			details[key] = settingErr.Error()
+		}
+		return NewInvalidRequestError(details)
+	}
+	return NewRequestError(http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+}
+
+// write the response to a v2 request, which is either a json body or an error
+func writeV2Response(w http.ResponseWriter, val interface{}) {
+	w.Header().Set(ContentType, JsonContentType)
+
+	switch v := val.(type) {
+	case error:
+		reqErr := toRequestError(v)
+		if reqErr.Status == http.StatusUnauthorized {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", AuthRealm))
+		}
+		body, err := json.Marshal(&errorEnvelope{Error: reqErr})
+		if err != nil {
+			// should never get here
+			http.Error(w, reqErr.Error(), reqErr.Status)
+			return
+		}
+		w.WriteHeader(reqErr.Status)
+		w.Write(body)
+	case []byte:
+		if len(v) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Write(v)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// whether a url path, with adminport url prefix, is in v2 api
+func isV2Path(urlPath string) bool {
+	return strings.HasPrefix(urlPath, base.AdminportUrlPrefix+V2Prefix)
+}
+
+func isV2Request(request *http.Request) bool {
+	return isV2Path(request.URL.Path)
+}
+
+// get the message key, without http method suffix, from the path of a v2 request.
+// paths under v2/replications/$replication_id are mapped to v2/replications/dynamic[/$action]
+func v2MessageKeyFromPath(path string) (string, error) {
+	for _, staticPath := range V2StaticPaths {
+		if path == staticPath {
+			return path, nil
+		}
+	}
+
+	if strings.HasPrefix(path, V2ReplicationsPath+base.UrlDelimiter) {
+		_, action := splitV2ReplicationPath(path)
+		key := V2ReplicationsPath + DynamicSuffix
+		if len(action) > 0 {
+			key += base.UrlDelimiter + action
+		}
+		return key, nil
+	}
+
+	return "", NewRequestError(http.StatusNotFound, ErrorCodeNotFound, utils.InvalidPathInHttpRequestError(path).Error())
+}
+
+// split v2/replications/$replication_id[/$action] into replication id, which is still escaped, and action
+func splitV2ReplicationPath(path string) (escapedReplicationId, action string) {
+	escapedReplicationId = path[len(V2ReplicationsPath+base.UrlDelimiter):]
+	if index := strings.LastIndex(escapedReplicationId, base.UrlDelimiter); index >= 0 {
+		for _, replAction := range V2ReplicationActions {
+			if escapedReplicationId[index+1:] == replAction {
+				return escapedReplicationId[:index], replAction
+			}
+		}
+	}
+	return escapedReplicationId, ""
+}
+
+// decode replication id from v2 request with path v2/replications/$replication_id[/$action]
+func DecodeReplicationIdFromV2Request(request *http.Request) (string, error) {
+	path := strings.TrimSuffix(request.URL.Path[len(base.AdminportUrlPrefix):], base.UrlDelimiter)
+	if !strings.HasPrefix(path, V2ReplicationsPath+base.UrlDelimiter) {
+		return "", utils.MissingReplicationIdInHttpRequestError(request.URL.Path)
+	}
+
+	escapedReplicationId, _ := splitV2ReplicationPath(path)
+	if len(escapedReplicationId) == 0 {
+		return "", utils.MissingReplicationIdInHttpRequestError(request.URL.Path)
+	}
+	return url.QueryUnescape(escapedReplicationId)
+}
+
+// read the body of a request and put it back, so that the body can be read again,
+// e.g., when the request is forwarded to other nodes
+func readRequestBody(request *http.Request) ([]byte, error) {
+	if request.Body == nil {
+		return nil, nil
+	}
+	body, err := ioutil.ReadAll(request.Body)
+	request.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	request.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// decode the json object in request body
+func decodeJsonObjectFromRequest(request *http.Request) (map[string]interface{}, error) {
+	body, err := readRequestBody(request)
+	if err != nil {
+		return nil, err
+	}
+
+	params := make(map[string]interface{})
+	if len(bytes.TrimSpace(body)) == 0 {
+		return params, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	// keep numbers as they are so that integers can be told apart from floats
+	decoder.UseNumber()
+	if err = decoder.Decode(&params); err != nil {
+		return nil, NewRequestError(http.StatusBadRequest, ErrorCodeInvalidRequest, "Request body needs to be a json object. "+err.Error())
+	}
+	return params, nil
+}
+
+// convert the json value of a replication setting into the data type of the setting.
+// the json type of the value needs to match the data type of the setting, e.g., "10" is not accepted for an integer setting
+func decodeJsonSettingValue(key string, val interface{}) (interface{}, error) {
+	var strVal string
+	switch v := val.(type) {
+	case string:
+		strVal = v
+	case bool:
+		strVal = strconv.FormatBool(v)
+	case json.Number:
+		strVal = v.String()
+	default:
+		return nil, utils.InvalidValueInHttpRequestError(key, val)
+	}
+
+	settingVal, err := parseSettingValue(key, strVal)
+	if err != nil {
+		return nil, err
+	}
+
+	matched := false
+	switch settingVal.(type) {
+	case int:
+		_, matched = val.(json.Number)
+	case bool:
+		_, matched = val.(bool)
+	case string:
+		_, matched = val.(string)
+	}
+	if !matched {
+		return nil, utils.InvalidValueInHttpRequestError(key, val)
+	}
+	return settingVal, nil
+}
+
+// decode replication settings from json params into internal settings map.
+// settings with null value are to be inherited from default replication settings, and
+// their internal keys are returned in inheritedKeys. 
+// errors on individual settings are collected in details
+func decodeJsonSettings(params map[string]interface{}, details map[string]string) (settings map[string]interface{}, inheritedKeys []string) {
+	settings = make(map[string]interface{})
+	inheritedKeys = make([]string, 0)
+	for key, val := range params {
+		internalKey, ok := ReplSettingRestToInternalMap[key]
+		if !ok {
+			details[key] = "Unknown parameter."
+			continue
+		}
+		if val == nil {
+			inheritedKeys = append(inheritedKeys, internalKey)
+			continue
+		}
+		settingVal, err := decodeJsonSettingValue(key, val)
+		if err != nil {
+			details[key] = err.Error()
+			continue
+		}
+		settings[internalKey] = settingVal
+	}
+	return
+}
+
+// decode parameters from v2 create replication request, which has a json body like
+// {"fromBucket": ..., "uuid": ..., "toBucket": ..., "filterName": ..., "xdcrCheckpointInterval": ...}
+func DecodeV2CreateReplicationRequest(request *http.Request) (fromBucket, toClusterUuid, toBucket, filterName string, settings map[string]interface{}, err error) {
+	params, err := decodeJsonObjectFromRequest(request)
+	if err != nil {
+		return
+	}
+
+	details := make(map[string]string)
+	settingParams := make(map[string]interface{})
+	for key, val := range params {
+		switch key {
+		case FromBucket, ToClusterUuid, ToBucket, FilterName:
+			strVal, ok := val.(string)
+			if !ok {
+				details[key] = utils.IncorrectValueTypeInHttpRequestError(key, val, "string").Error()
+				continue
+			}
+			switch key {
+			case FromBucket:
+				fromBucket = strVal
+			case ToClusterUuid:
+				toClusterUuid = strVal
+			case ToBucket:
+				toBucket = strVal
+			case FilterName:
+				filterName = strVal
+			}
+		default:
+			// other keys must be for replication settings
+			settingParams[key] = val
+		}
+	}
+
+	for key, val := range map[string]string{FromBucket: fromBucket, ToClusterUuid: toClusterUuid, ToBucket: toBucket} {
+		if _, ok := details[key]; !ok && len(val) == 0 {
+			details[key] = "Required, but not supplied."
+		}
+	}
+
+	// settings with null value are inherited, the same as those not specified
+	settings, _ = decodeJsonSettings(settingParams, details)
+	if len(details) > 0 {
+		err = NewInvalidRequestError(details)
+	}
+	return
+}
+
+// decode replication settings from v2 change settings request, which has a json body like
+// {"xdcrCheckpointInterval": 600, "xdcrActive": true, "xdcrWorkerBatchSize": null}
+// where settings with null value go back to being inherited from default replication settings
+func DecodeV2SettingsFromRequest(request *http.Request) (settings map[string]interface{}, inheritedKeys []string, err error) {
+	params, err := decodeJsonObjectFromRequest(request)
+	if err != nil {
+		return
+	}
+	if len(params) == 0 {
+		err = NewRequestError(http.StatusBadRequest, ErrorCodeInvalidRequest, MissingSettingsInRequest.Error())
+		return
+	}
+
+	details := make(map[string]string)
+	settings, inheritedKeys = decodeJsonSettings(params, details)
+	if len(details) > 0 {
+		return nil, nil, NewInvalidRequestError(details)
+	}
+	return
+}
+
+// the forward flag of a v2 request is in url query, and defaults to true
+func decodeV2ForwardFlag(request *http.Request) bool {
+	return !isForwardedRequest(request)
+}
+
+func NewV2CreateReplicationResponse(replicationId string) ([]byte, error) {
+	return json.Marshal(map[string]interface{}{ReplicationId: replicationId})
+}
+
+// leader is null when there is no valid lease. isLeader tells whether the node serving the request is the leader
+func NewV2LeaderResponse(leader *metadata_svc.LeaderInfo, isLeader bool) ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"leader":   leader,
+		"isLeader": isLeader,
+	})
+}
+
+// replication settings keyed by the names in rest api
+func NewV2ReplicationSettingsResponse(settings *metadata.ReplicationSettings) ([]byte, error) {
+	restSettings := make(map[string]interface{})
+	if settings != nil {
+		for key, val := range settings.ToMap() {
+			restSettings[ReplSettingInternalToRestMap[key]] = val
+		}
+	}
+	return json.Marshal(restSettings)
+}
+
+// sources of replication settings
+const (
+	// explicitly set on the replication
+	SettingSourceReplication = "replication"
+	// inherited from default replication settings
+	SettingSourceDefault = "default"
+)
+
+// value of a replication setting with where it comes from
+type settingWithSource struct {
+	Value  interface{} `json:"value"`
+	Source string      `json:"source"`
+}
+
+// replication settings keyed by the names in rest api, along with whether they are explicitly
+// set on the replication or inherited from default replication settings
+func NewV2ReplicationSettingsWithSourceResponse(spec *metadata.ReplicationSpecification) ([]byte, error) {
+	restSettings := make(map[string]*settingWithSource)
+	for key, val := range spec.Settings.ToMap() {
+		source := SettingSourceDefault
+		if spec.IsSettingOverridden(key) {
+			source = SettingSourceReplication
+		}
+		restSettings[ReplSettingInternalToRestMap[key]] = &settingWithSource{Value: val, Source: source}
+	}
+	return json.Marshal(restSettings)
+}
+
+/************************************
+/* v2 request handlers
+*************************************/
+func (h *xdcrRestHandler) doV2CreateReplicationRequest(request *http.Request) ([]byte, error) {
+	logger_ap.Infof("doV2CreateReplicationRequest\n")
+
+	fromBucket, toClusterUuid, toBucket, filterName, settings, err := DecodeV2CreateReplicationRequest(request)
+	if err != nil {
+		return nil, err
+	}
+
+	replicationId, err := h.createReplication(request, fromBucket, toClusterUuid, toBucket, filterName, settings, decodeV2ForwardFlag(request))
+	if err != nil {
+		return nil, err
+	}
+	return NewV2CreateReplicationResponse(replicationId)
+}
+
+func (h *xdcrRestHandler) doV2DeleteReplicationRequest(request *http.Request) ([]byte, error) {
+	logger_ap.Infof("doV2DeleteReplicationRequest\n")
+
+	replicationId, err := DecodeReplicationIdFromV2Request(request)
+	if err != nil {
+		return nil, err
+	}
+	return nil, h.deleteReplication(request, replicationId, decodeV2ForwardFlag(request))
+}
+
+func (h *xdcrRestHandler) doV2PauseReplicationRequest(request *http.Request) ([]byte, error) {
+	logger_ap.Infof("doV2PauseReplicationRequest\n")
+
+	replicationId, err := DecodeReplicationIdFromV2Request(request)
+	if err != nil {
+		return nil, err
+	}
+	return nil, h.pauseReplication(request, replicationId, decodeV2ForwardFlag(request))
+}
+
+func (h *xdcrRestHandler) doV2ResumeReplicationRequest(request *http.Request) ([]byte, error) {
+	logger_ap.Infof("doV2ResumeReplicationRequest\n")
+
+	replicationId, err := DecodeReplicationIdFromV2Request(request)
+	if err != nil {
+		return nil, err
+	}
+	return nil, h.resumeReplication(request, replicationId, decodeV2ForwardFlag(request))
+}
+
+func (h *xdcrRestHandler) doV2ViewReplicationSettingsRequest(request *http.Request) ([]byte, error) {
+	logger_ap.Infof("doV2ViewReplicationSettingsRequest\n")
+
+	replicationId, err := DecodeReplicationIdFromV2Request(request)
+	if err != nil {
+		return nil, err
+	}
+
+	// sources of the settings are returned when requested with source=true
+	if showSource, _ := strconv.ParseBool(request.URL.Query().Get(SettingSourceParam)); showSource {
+		replSpec, err := rm.MetadataService().ReplicationSpec(replicationId)
+		if err != nil {
+			return nil, err
+		}
+		return NewV2ReplicationSettingsWithSourceResponse(replSpec)
+	}
+
+	settings, err := h.replicationSettings(replicationId)
+	if err != nil {
+		return nil, err
+	}
+	return NewV2ReplicationSettingsResponse(settings)
+}
+
+func (h *xdcrRestHandler) doV2ChangeReplicationSettingsRequest(request *http.Request) ([]byte, error) {
+	logger_ap.Infof("doV2ChangeReplicationSettingsRequest\n")
+
+	replicationId, err := DecodeReplicationIdFromV2Request(request)
+	if err != nil {
+		return nil, err
+	}
+	settings, inheritedKeys, err := DecodeV2SettingsFromRequest(request)
+	if err != nil {
+		return nil, err
+	}
+
+	logger_ap.Debugf("Request decoded: replicationId=%v; inputSettings=%v; inheritedSettings=%v", replicationId, settings, inheritedKeys)
+
+	return nil, rm.HandleChangesToReplicationSettings(replicationId, settings, inheritedKeys)
+}
+
+func (h *xdcrRestHandler) doV2GetOpenAPIRequest(request *http.Request) ([]byte, error) {
+	return NewOpenAPISpec()
+}
+
+// the leader among xdcr nodes, as observed by the current node
+func (h *xdcrRestHandler) doV2GetLeaderRequest(request *http.Request) ([]byte, error) {
+	elector := rm.LeaderElector()
+	if elector == nil {
+		return NewV2LeaderResponse(nil, false)
+	}
+	isLeader, _ := elector.IsLeader()
+	return NewV2LeaderResponse(elector.Leader(), isLeader)
+}
+
+// combined health of the components of a replication running on the current node
+func (h *xdcrRestHandler) doV2GetReplicationHealthRequest(request *http.Request) ([]byte, error) {
+	replicationId, err := DecodeReplicationIdFromV2Request(request)
+	if err != nil {
+		return nil, err
+	}
+
+	health := rm.GetReplicationHealth(replicationId)
+	if health == nil {
+		return nil, NewRequestError(http.StatusNotFound, ErrorCodeNotFound, fmt.Sprintf("Replication %v is not running on this node.", replicationId))
+	}
+	return json.Marshal(health)
+}
+
+// a replication, with its health and recent errors on the current node. health is null when
+// the replication is not running on the current node
+func NewV2ReplicationResponse(spec *metadata.ReplicationSpecification, health *common.PipelineHealth, errorRecords []*base.ErrorRecord) ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		ReplicationId: spec.Id,
+		"fromBucket":  spec.SourceBucketName,
+		"uuid":        spec.TargetClusterUUID,
+		"toBucket":    spec.TargetBucketName,
+		"filterName":  spec.FilterName,
+		"active":      spec.Settings.Active,
+		"health":      health,
+		"errors":      errorRecords,
+	})
+}
+
+func (h *xdcrRestHandler) doV2GetReplicationRequest(request *http.Request) ([]byte, error) {
+	replicationId, err := DecodeReplicationIdFromV2Request(request)
+	if err != nil {
+		return nil, err
+	}
+
+	replSpec, err := v2ReplicationSpec(replicationId)
+	if err != nil {
+		return nil, err
+	}
+	return NewV2ReplicationResponse(replSpec, rm.GetReplicationHealth(replicationId), rm.GetReplicationErrors(replicationId))
+}
+
+// most recent errors of a replication on the current node, oldest first
+func (h *xdcrRestHandler) doV2GetReplicationErrorsRequest(request *http.Request) ([]byte, error) {
+	replicationId, err := DecodeReplicationIdFromV2Request(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = v2ReplicationSpec(replicationId); err != nil {
+		return nil, err
+	}
+	return json.Marshal(map[string]interface{}{"errors": rm.GetReplicationErrors(replicationId)})
+}
+
+// clear the errors of a replication on the current node
+func (h *xdcrRestHandler) doV2ClearReplicationErrorsRequest(request *http.Request) ([]byte, error) {
+	logger_ap.Infof("doV2ClearReplicationErrorsRequest\n")
+
+	replicationId, err := DecodeReplicationIdFromV2Request(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = v2ReplicationSpec(replicationId); err != nil {
+		return nil, err
+	}
+	rm.ClearReplicationErrors(replicationId)
+	return nil, nil
+}
+
+// spec of an existing replication. not_found is returned if there is no such replication
+func v2ReplicationSpec(replicationId string) (*metadata.ReplicationSpecification, error) {
+	replSpec, err := rm.MetadataService().ReplicationSpec(replicationId)
+	if err != nil {
+		return nil, NewRequestError(http.StatusNotFound, ErrorCodeNotFound, fmt.Sprintf("Replication %v does not exist.", replicationId))
+	}
+	return replSpec, nil
+}
+
+// keys in v2 logging requests and responses
+const (
+	LogLevelsKey = "logLevels"
+	RedactionKey = "redaction"
+)
+
+// overridden log levels keyed by module, and the redaction mode
+func NewV2LoggingResponse() ([]byte, error) {
+	levels := make(map[string]string)
+	for module, level := range log.ModuleLogLevels() {
+		levels[module] = level.String()
+	}
+	return json.Marshal(map[string]interface{}{
+		LogLevelsKey: levels,
+		RedactionKey: log.GetRedactionMode().String(),
+	})
+}
+
+// decode {"logLevels": {"<module>": "<level>"|null, ...}, "redaction": "<mode>"}, where null clears
+// the log level of a module. Nothing is applied if any of the parameters is invalid
+func DecodeV2LoggingRequest(request *http.Request) (levels map[string]*log.LogLevel, redaction *log.RedactionMode, err error) {
+	params, err := decodeJsonObjectFromRequest(request)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	levels = make(map[string]*log.LogLevel)
+	details := make(map[string]string)
+	for key, val := range params {
+		switch key {
+		case LogLevelsKey:
+			levelsParam, ok := val.(map[string]interface{})
+			if !ok {
+				details[key] = "needs to be a json object of module names to log levels"
+				continue
+			}
+			for module, levelVal := range levelsParam {
+				if levelVal == nil {
+					levels[module] = nil
+					continue
+				}
+				levelStr, ok := levelVal.(string)
+				if !ok {
+					details[LogLevelsKey+"."+module] = "needs to be a string or null"
+					continue
+				}
+				level, err := log.LogLevelFromStr(levelStr)
+				if err != nil {
+					details[LogLevelsKey+"."+module] = err.Error()
+					continue
+				}
+				levels[module] = &level
+			}
+		case RedactionKey:
+			modeStr, ok := val.(string)
+			if !ok {
+				details[key] = "needs to be a string"
+				continue
+			}
+			mode, err := log.RedactionModeFromStr(modeStr)
+			if err != nil {
+				details[key] = err.Error()
+				continue
+			}
+			redaction = &mode
+		default:
+			details[key] = "unknown parameter"
+		}
+	}
+	if len(details) > 0 {
+		return nil, nil, NewInvalidRequestError(details)
+	}
+	return levels, redaction, nil
+}
+
+func (h *xdcrRestHandler) doV2GetLoggingRequest(request *http.Request) ([]byte, error) {
+	return NewV2LoggingResponse()
+}
+
+// change the log levels of modules and the redaction mode on the current node
+func (h *xdcrRestHandler) doV2ChangeLoggingRequest(request *http.Request) ([]byte, error) {
+	logger_ap.Infof("doV2ChangeLoggingRequest\n")
+
+	levels, redaction, err := DecodeV2LoggingRequest(request)
+	if err != nil {
+		return nil, err
+	}
+
+	for module, level := range levels {
+		if level == nil {
+			log.ClearModuleLogLevel(module)
+			logger_ap.Infof("Log level of module %v is cleared\n", module)
+		} else {
+			log.SetModuleLogLevel(module, *level)
+			logger_ap.Infof("Log level of module %v is set to %v\n", module, *level)
+		}
+	}
+	if redaction != nil {
+		log.SetRedactionMode(*redaction)
+		logger_ap.Infof("Redaction mode is set to %v\n", *redaction)
+	}
+	return NewV2LoggingResponse()
+}
+
+// metrics of all running gen_servers, keyed by the names they are registered under
+func (h *xdcrRestHandler) doV2GetDebugGenServersRequest(request *http.Request) ([]byte, error) {
+	return json.Marshal(gen_server.DefaultMetricsRegistry.Snapshots(""))
+}
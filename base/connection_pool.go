@@ -10,15 +10,35 @@
 package base
 
 import (
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"net/url"
 	//	"log"
 	"github.com/Xiaomei-Zhang/goxdcr/log"
+	mc "github.com/couchbase/gomemcached"
 	mcc "github.com/couchbase/gomemcached/client"
 	cb "github.com/couchbaselabs/go-couchbase"
 	"sync"
 )
 
+// HELLO features of memcached
+const (
+	helloFeatureDatatype = uint16(0x01)
+	helloFeatureSnappy   = uint16(0x0a)
+)
+
+// the name that connections identify themselves with in HELLO
+const helloAgentName = "goxdcr"
+
+// features negotiated with memcached by HELLO when a connection is opened
+type MemcachedFeatures struct {
+	// the datatype byte of requests is honored
+	Datatype bool
+	// snappy compressed values are accepted, with the snappy datatype flag set
+	Snappy bool
+}
+
 type ConnPool struct {
 	clients  chan *mcc.Client
 	hostName string
@@ -26,6 +46,10 @@ type ConnPool struct {
 	password string
 	maxConn  int
 	logger   *log.CommonLogger
+
+	// features negotiated by the connections of the pool, which all go to the same host
+	features      MemcachedFeatures
+	lock_features sync.RWMutex
 }
 
 type connPoolMgr struct {
@@ -82,13 +106,30 @@ func (p *ConnPool) Get() (*mcc.Client, error) {
 		}
 	default:
 		//no more connection, create more
-		mcClient, err := newConn(p.hostName, p.userName, p.password)
-		return mcClient, err
+		mcClient, features, err := newConn(p.hostName, p.userName, p.password)
+		if err != nil {
+			return nil, ClassifyError(fmt.Sprintf("connecting to %v", p.hostName), err)
+		}
+		p.setFeatures(features)
+		return mcClient, nil
 	}	
 		
 	return nil, errors.New("connection pool is closed")
 }
 
+// features negotiated by the most recently opened connection of the pool
+func (p *ConnPool) Features() MemcachedFeatures {
+	p.lock_features.RLock()
+	defer p.lock_features.RUnlock()
+	return p.features
+}
+
+func (p *ConnPool) setFeatures(features MemcachedFeatures) {
+	p.lock_features.Lock()
+	defer p.lock_features.Unlock()
+	p.features = features
+}
+
 //
 // Release connection back to the pool
 //
@@ -177,17 +218,27 @@ func (connPoolMgr *connPoolMgr) CreatePool(poolName string, hostName string, use
 	}()
 
 	//	 initialize the connection pool
+	var connErr error
 	for i := 0; i < connectionSize; i++ {
-		mcClient, err := newConn(hostName, username, password)
+		mcClient, features, err := newConn(hostName, username, password)
 		if err == nil {
 			connPoolMgr.logger.Debug("A client connection is established")
+			p.setFeatures(features)
 			p.clients <- mcClient
 		} else {
 			connPoolMgr.logger.Debugf("error establishing connection with hostname=%s, username=%s, password=%s - %s", hostName, username, password, err)
+			connErr = err
 		}
 
 	}
 
+	// a pool without any connection is not kept, so that it is created again on the next try.
+	// the error is classified, e.g., a bucket that has been deleted fails authentication
+	if len(p.clients) == 0 && connErr != nil {
+		connPoolMgr.logger.Errorf("Failed to create connection pool %s. err=%v\n", poolName, connErr)
+		return nil, ClassifyError(fmt.Sprintf("connecting to %v", hostName), connErr)
+	}
+
 	connPoolMgr.token.Lock()
 	connPoolMgr.conn_pools_map[poolName] = p
 	connPoolMgr.token.Unlock()
@@ -221,14 +272,15 @@ func newConnection(bucket *cb.Bucket, vbid uint16, username string, password str
 	// Through the vbucket map, get the host which is the vbucket master
 	hostStr := GetHostStr(bucket, vbid)
 
-	return newConn(hostStr, username, password)
+	conn, _, err = newConn(hostStr, username, password)
+	return conn, err
 }
 
-func newConn(hostName string, username string, password string) (conn *mcc.Client, err error) {
+func newConn(hostName string, username string, password string) (conn *mcc.Client, features MemcachedFeatures, err error) {
 	// connect to host
 	conn, err = mcc.Connect("tcp", hostName)
 	if err != nil {
-		return nil, err
+		return nil, features, err
 	}
 
 	// authentic using user/pass
@@ -238,11 +290,47 @@ func newConn(hostName string, username string, password string) (conn *mcc.Clien
 		if err != nil {
 			_connPoolMgr.logger.Errorf("err=%v\n", err)
 			conn.Close()
-			return nil, err
+			return nil, features, err
+		}
+	}
+
+	features, err = negotiateFeatures(conn)
+	if err != nil {
+		_connPoolMgr.logger.Errorf("Failed to negotiate features with %v. err=%v\n", hostName, err)
+		conn.Close()
+		return nil, features, err
+	}
+
+	return conn, features, nil
+}
+
+// negotiate datatype and snappy with HELLO. A server that does not know HELLO supports neither
+func negotiateFeatures(conn *mcc.Client) (features MemcachedFeatures, err error) {
+	body := make([]byte, 4)
+	binary.BigEndian.PutUint16(body, helloFeatureDatatype)
+	binary.BigEndian.PutUint16(body[2:], helloFeatureSnappy)
+	res, err := conn.Send(&mc.MCRequest{Opcode: mc.HELLO,
+		Key:  []byte(helloAgentName),
+		Body: body})
+	if err != nil {
+		if res != nil && res.Status == mc.UNKNOWN_COMMAND {
+			return features, nil
 		}
+		return features, err
 	}
 
-	return conn, nil
+	// the server replies with the features it has enabled
+	for i := 0; i+2 <= len(res.Body); i += 2 {
+		switch binary.BigEndian.Uint16(res.Body[i:]) {
+		case helloFeatureDatatype:
+			features.Datatype = true
+		case helloFeatureSnappy:
+			features.Snappy = true
+		}
+	}
+	// snappy values are flagged by the datatype byte
+	features.Snappy = features.Snappy && features.Datatype
+	return features, nil
 }
 
 //return the singleton ConnPoolMgr
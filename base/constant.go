@@ -26,10 +26,39 @@ var AdminportUrlPrefix = UrlDelimiter
 var AdminportNumber = 12100
 // AdminportReadTimeout timeout, in milliseconds, is read timeout for
 // golib's http server.
-var AdminportReadTimeout = 0
+var AdminportReadTimeout = 10000
 // AdminportWriteTimeout timeout, in milliseconds, is write timeout for
 // golib's http server.
-var AdminportWriteTimeout = 0
+var AdminportWriteTimeout = 60000
+// AdminportRequestTimeout timeout, in milliseconds, is the max time that
+// a client waits for the response to an admin request.
+var AdminportRequestTimeout = 30000
+// AdminportMaxQueuedRequests is the max number of change requests
+// that can be pending on one replication.
+var AdminportMaxQueuedRequests = 100
+// AdminportMaxRequestBodySize is the max size, in bytes, of the body
+// of an admin request.
+var AdminportMaxRequestBodySize int64 = 1024 * 1024
+
+// TopologyPollInterval, in milliseconds, is the interval at which
+// topology watcher polls the vbucket server maps of watched buckets.
+var TopologyPollInterval = 10000
+
+// LeaderLeaseDuration, in milliseconds, is how long the lease of the leader
+// among xdcr nodes is valid without being renewed.
+var LeaderLeaseDuration = 15000
+// LeaderLeaseRenewInterval, in milliseconds, is the interval at which
+// xdcr nodes renew or try to acquire the leader lease.
+var LeaderLeaseRenewInterval = 5000
+
+// QueueOverflowDir is the local directory where the queues in front of
+// outgoing nozzles overflow to when their memory is full. Overflow is
+// disabled when it is empty.
+var QueueOverflowDir = ""
+
+// SpoolDir is the local directory where outgoing nozzles spool mutations
+// while their targets are unreachable. Spooling is disabled when it is empty.
+var SpoolDir = ""
 
 //outgoing nozzle type
 type XDCROutgoingNozzleType int
@@ -42,6 +71,7 @@ const (
 const (
 	PIPELINE_SUPERVISOR_SVC string = "PipelineSupervisor"
 	CHECKPOINT_MGR_SVC string = "CheckpointManager"
+	VB_LOAD_BALANCER_SVC string = "VBLoadBalancer"
 )
 
 // constants for integer parsing
@@ -49,4 +79,5 @@ var ParseIntBase    = 10
 var ParseIntBitSize = 64
 
 var ErrorNotMyVbucket = errors.New("NOT_MY_VBUCKET")
+var ErrorBucketNotFound = errors.New("Bucket is not found.")
 
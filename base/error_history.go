@@ -0,0 +1,87 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package base
+
+import (
+	"sync"
+	"time"
+)
+
+// number of the most recent errors that are kept for each replication
+var ErrorHistorySize = 50
+
+// ErrorRecord is an error that a replication has run into
+type ErrorRecord struct {
+	Time time.Time `json:"time"`
+	// id of the part or service that raised the error, or of the component that failed its health check
+	PartId  string `json:"partId"`
+	Class   string `json:"class"`
+	Message string `json:"message"`
+}
+
+func NewErrorRecord(partId string, err error) *ErrorRecord {
+	return &ErrorRecord{Time: time.Now(),
+		PartId:  partId,
+		Class:   ErrorClassOf(err).String(),
+		Message: err.Error()}
+}
+
+/************************************
+/* struct ErrorHistory
+*************************************/
+// ErrorHistory is a ring buffer of the most recent errors of a replication. It is thread safe
+type ErrorHistory struct {
+	records []*ErrorRecord
+	// index of the slot that the next record goes to
+	next int
+	// number of records in the buffer, which is at most len(records)
+	count int
+	lock  sync.RWMutex
+}
+
+func NewErrorHistory(size int) *ErrorHistory {
+	if size < 1 {
+		size = 1
+	}
+	return &ErrorHistory{records: make([]*ErrorRecord, size)}
+}
+
+// Add a record, which overwrites the oldest record when the buffer is full
+func (history *ErrorHistory) Add(record *ErrorRecord) {
+	history.lock.Lock()
+	defer history.lock.Unlock()
+	history.records[history.next] = record
+	history.next = (history.next + 1) % len(history.records)
+	if history.count < len(history.records) {
+		history.count++
+	}
+}
+
+// Records returns the records in the buffer, oldest first
+func (history *ErrorHistory) Records() []*ErrorRecord {
+	history.lock.RLock()
+	defer history.lock.RUnlock()
+	records := make([]*ErrorRecord, 0, history.count)
+	oldest := (history.next - history.count + len(history.records)) % len(history.records)
+	for i := 0; i < history.count; i++ {
+		records = append(records, history.records[(oldest+i)%len(history.records)])
+	}
+	return records
+}
+
+func (history *ErrorHistory) Clear() {
+	history.lock.Lock()
+	defer history.lock.Unlock()
+	for i := range history.records {
+		history.records[i] = nil
+	}
+	history.next = 0
+	history.count = 0
+}
@@ -0,0 +1,49 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package base
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestErrorHistory(t *testing.T) {
+	history := NewErrorHistory(3)
+	if records := history.Records(); len(records) != 0 {
+		t.Fatalf("Expected no records, got %v", len(records))
+	}
+
+	for i := 0; i < 5; i++ {
+		history.Add(NewErrorRecord(fmt.Sprintf("xmem_%v", i), errors.New("failed")))
+	}
+	records := history.Records()
+	if len(records) != 3 {
+		t.Fatalf("Expected 3 records, got %v", len(records))
+	}
+	// the oldest records are overwritten
+	for i, record := range records {
+		if expected := fmt.Sprintf("xmem_%v", i+2); record.PartId != expected {
+			t.Errorf("Expected record %v to be of %v, got %v", i, expected, record.PartId)
+		}
+	}
+	if records[0].Class != "fatal" {
+		t.Errorf("Expected class fatal, got %v", records[0].Class)
+	}
+
+	history.Clear()
+	if records := history.Records(); len(records) != 0 {
+		t.Errorf("Expected no records after clear, got %v", len(records))
+	}
+	history.Add(NewErrorRecord("dcp_0", ErrorNotMyVbucket))
+	if records := history.Records(); len(records) != 1 || records[0].Class != "topology_change" {
+		t.Errorf("Unexpected records after clear, %v", records)
+	}
+}
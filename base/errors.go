@@ -0,0 +1,218 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package base
+
+import (
+	"errors"
+	"fmt"
+	mc "github.com/couchbase/gomemcached"
+	"io"
+	"net"
+	"strings"
+)
+
+// ErrorClass tells what kind of failure an error is, which decides how the failure is handled
+type ErrorClass int
+
+const (
+	// the failure is expected to go away by itself, e.g., socket timeouts or TMPFAIL
+	ErrorClassTransient ErrorClass = iota
+	// vbuckets have moved between nodes, e.g., NOT_MY_VBUCKET
+	ErrorClassTopologyChange
+	// the credentials are rejected by the source or the target
+	ErrorClassAuthentication
+	// the replication is configured with something that does not exist or is invalid, e.g., a missing target bucket
+	ErrorClassConfiguration
+	// any other failure
+	ErrorClassFatal
+)
+
+var errorClassNames = map[ErrorClass]string{ErrorClassTransient: "transient",
+	ErrorClassTopologyChange: "topology_change",
+	ErrorClassAuthentication: "authentication",
+	ErrorClassConfiguration:  "configuration",
+	ErrorClassFatal:          "fatal"}
+
+func (class ErrorClass) String() string {
+	if name, ok := errorClassNames[class]; ok {
+		return name
+	}
+	return fmt.Sprintf("ErrorClass(%d)", int(class))
+}
+
+// names of the classes, in the order of the classes
+func errorClassList() string {
+	names := []string{}
+	for class := ErrorClassTransient; class <= ErrorClassFatal; class++ {
+		names = append(names, class.String())
+	}
+	return strings.Join(names, ", ")
+}
+
+func ErrorClassFromStr(str string) (ErrorClass, error) {
+	for class, name := range errorClassNames {
+		if name == str {
+			return class, nil
+		}
+	}
+	return ErrorClassFatal, errors.New(fmt.Sprintf("Invalid error class, %v. Valid classes: %v.", str, errorClassList()))
+}
+
+/************************************
+/* struct ClassifiedError
+*************************************/
+// ClassifiedError is an error raised by a component, with its class and what the component was doing
+type ClassifiedError struct {
+	Class ErrorClass
+	// what the component was doing when the error happened, e.g., "receiving responses from target"
+	Context string
+	Err     error
+}
+
+func NewClassifiedError(class ErrorClass, context string, err error) *ClassifiedError {
+	return &ClassifiedError{Class: class, Context: context, Err: err}
+}
+
+// ClassifyError wraps err with context, and with the class inferred from err. errors that are
+// already classified keep their class
+func ClassifyError(context string, err error) *ClassifiedError {
+	if classified, ok := err.(*ClassifiedError); ok {
+		return classified
+	}
+	return NewClassifiedError(ErrorClassOf(err), context, err)
+}
+
+func (err *ClassifiedError) Error() string {
+	return fmt.Sprintf("%v error %v: %v", err.Class, err.Context, err.Err)
+}
+
+func (err *ClassifiedError) Unwrap() error {
+	return err.Err
+}
+
+// ErrorClassOf returns the class of a classified error, or infers the class of other errors from
+// their memcached status, network failure, or from missing buckets and invalid settings.
+// errors that can't be told apart are fatal
+func ErrorClassOf(err error) ErrorClass {
+	var classified *ClassifiedError
+	if errors.As(err, &classified) {
+		return classified.Class
+	}
+	if err == ErrorNotMyVbucket {
+		return ErrorClassTopologyChange
+	}
+	if errors.Is(err, ErrorBucketNotFound) {
+		return ErrorClassConfiguration
+	}
+	var settingsErr SettingsError
+	if errors.As(err, &settingsErr) {
+		return ErrorClassConfiguration
+	}
+	if err == io.EOF {
+		return ErrorClassTransient
+	}
+	if resp, ok := err.(*mc.MCResponse); ok {
+		switch resp.Status {
+		case mc.NOT_MY_VBUCKET:
+			return ErrorClassTopologyChange
+		case mc.AUTH_ERROR:
+			return ErrorClassAuthentication
+		case mc.TMPFAIL, mc.ENOMEM, mc.EBUSY:
+			return ErrorClassTransient
+		}
+		return ErrorClassFatal
+	}
+	if _, ok := err.(net.Error); ok {
+		// timeouts, refused and reset connections
+		return ErrorClassTransient
+	}
+	return ErrorClassFatal
+}
+
+// ErrorPolicy is how the pipeline supervisor handles the errors of a class
+type ErrorPolicy int
+
+const (
+	// the error is logged and counted, and the component carries on
+	ErrorPolicyIgnore ErrorPolicy = iota
+	// the component that raised the error is restarted in place
+	ErrorPolicyRestartPart
+	// the whole pipeline is restarted
+	ErrorPolicyRestartPipeline
+	// the replication is paused, and the error is shown to the user until the replication is resumed
+	ErrorPolicyPause
+)
+
+var errorPolicyNames = map[ErrorPolicy]string{ErrorPolicyIgnore: "ignore",
+	ErrorPolicyRestartPart:     "restart_part",
+	ErrorPolicyRestartPipeline: "restart_pipeline",
+	ErrorPolicyPause:           "pause"}
+
+func (policy ErrorPolicy) String() string {
+	if name, ok := errorPolicyNames[policy]; ok {
+		return name
+	}
+	return fmt.Sprintf("ErrorPolicy(%d)", int(policy))
+}
+
+func errorPolicyList() string {
+	names := []string{}
+	for policy := ErrorPolicyIgnore; policy <= ErrorPolicyPause; policy++ {
+		names = append(names, policy.String())
+	}
+	return strings.Join(names, ", ")
+}
+
+func ErrorPolicyFromStr(str string) (ErrorPolicy, error) {
+	for policy, name := range errorPolicyNames {
+		if name == str {
+			return policy, nil
+		}
+	}
+	return ErrorPolicyRestartPipeline, errors.New(fmt.Sprintf("Invalid error policy, %v. Valid policies: %v.", str, errorPolicyList()))
+}
+
+// error class -> how the errors of the class are handled
+type ErrorPolicies map[ErrorClass]ErrorPolicy
+
+// the policies for the classes that are not configured
+func DefaultErrorPolicies() ErrorPolicies {
+	return ErrorPolicies{ErrorClassTransient: ErrorPolicyRestartPart,
+		ErrorClassTopologyChange: ErrorPolicyRestartPipeline,
+		ErrorClassAuthentication: ErrorPolicyPause,
+		ErrorClassConfiguration:  ErrorPolicyPause,
+		ErrorClassFatal:          ErrorPolicyRestartPipeline}
+}
+
+// ParseErrorPolicies parses comma separated class=policy pairs, e.g., "transient=ignore,fatal=pause",
+// over the default policies
+func ParseErrorPolicies(str string) (ErrorPolicies, error) {
+	policies := DefaultErrorPolicies()
+	for _, pair := range strings.Split(str, ",") {
+		pair = strings.TrimSpace(pair)
+		if len(pair) == 0 {
+			continue
+		}
+		parts := strings.Split(pair, "=")
+		if len(parts) != 2 {
+			return nil, errors.New(fmt.Sprintf("Invalid error policy, %v. It needs to be in the form of class=policy.", pair))
+		}
+		class, err := ErrorClassFromStr(strings.TrimSpace(parts[0]))
+		if err != nil {
+			return nil, err
+		}
+		policy, err := ErrorPolicyFromStr(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, err
+		}
+		policies[class] = policy
+	}
+	return policies, nil
+}
@@ -0,0 +1,71 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package base
+
+import (
+	"errors"
+	mc "github.com/couchbase/gomemcached"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestErrorClassOf(t *testing.T) {
+	tests := []struct {
+		err   error
+		class ErrorClass
+	}{
+		{ErrorNotMyVbucket, ErrorClassTopologyChange},
+		{io.EOF, ErrorClassTransient},
+		{&net.OpError{Op: "read", Err: errors.New("i/o timeout")}, ErrorClassTransient},
+		{&mc.MCResponse{Status: mc.AUTH_ERROR}, ErrorClassAuthentication},
+		{&mc.MCResponse{Status: mc.TMPFAIL}, ErrorClassTransient},
+		{&mc.MCResponse{Status: mc.NOT_MY_VBUCKET}, ErrorClassTopologyChange},
+		{errors.New("something else"), ErrorClassFatal},
+		{NewClassifiedError(ErrorClassConfiguration, "connecting to target", errors.New("no bucket")), ErrorClassConfiguration},
+		{ErrorBucketNotFound, ErrorClassConfiguration},
+		{*NewSettingsError(), ErrorClassConfiguration},
+	}
+	for _, test := range tests {
+		if class := ErrorClassOf(test.err); class != test.class {
+			t.Errorf("Expected %v to be %v, got %v", test.err, test.class, class)
+		}
+	}
+
+	// classified errors keep their class and context
+	classified := NewClassifiedError(ErrorClassConfiguration, "connecting to target", errors.New("no bucket"))
+	if ClassifyError("sending batch", classified) != classified {
+		t.Errorf("Classified error is classified again")
+	}
+	if expected := "transient error sending batch: EOF"; ClassifyError("sending batch", io.EOF).Error() != expected {
+		t.Errorf("Expected %v, got %v", expected, ClassifyError("sending batch", io.EOF))
+	}
+}
+
+func TestParseErrorPolicies(t *testing.T) {
+	policies, err := ParseErrorPolicies(" transient=ignore, fatal=pause ")
+	if err != nil {
+		t.Fatalf("Failed to parse error policies. err=%v", err)
+	}
+	expected := DefaultErrorPolicies()
+	expected[ErrorClassTransient] = ErrorPolicyIgnore
+	expected[ErrorClassFatal] = ErrorPolicyPause
+	for class, policy := range expected {
+		if policies[class] != policy {
+			t.Errorf("Expected %v for %v, got %v", policy, class, policies[class])
+		}
+	}
+
+	for _, invalid := range []string{"transient", "transient=restart", "unknown=ignore"} {
+		if _, err := ParseErrorPolicies(invalid); err == nil {
+			t.Errorf("Expected error on %v", invalid)
+		}
+	}
+}
@@ -48,10 +48,33 @@ func (se SettingsError) Add(key string, err error) {
 	se.err_map[key] = err
 }
 
+// setting key -> error on the setting
+func (se SettingsError) ErrorMap() map[string]error {
+	return se.err_map
+}
+
 type PipelineFailureHandler interface {
 	OnError(pipeline common.Pipeline, partsError map[string]error)
 }
 
+// implemented by the PipelineFailureHandlers that are to be notified when the combined health
+// status of a pipeline changes, e.g., when it becomes degraded
+type PipelineHealthHandler interface {
+	OnHealthChange(pipeline common.Pipeline, health *common.PipelineHealth)
+}
+
+// implemented by the PipelineFailureHandlers that can pause the replication of a failed pipeline
+// instead of restarting it, e.g., when the failure needs the user to step in
+type PipelinePauseHandler interface {
+	OnPause(pipeline common.Pipeline, partsError map[string]error)
+}
+
+// implemented by the PipelineFailureHandlers that keep the history of the errors of pipelines,
+// which are recorded whether or not they lead to restarts
+type PipelineErrorRecorder interface {
+	RecordError(pipeline common.Pipeline, partId string, err error)
+}
+
 // timestamp for a specific vb
 type VBTimestamp struct{
     Vbno  uint16
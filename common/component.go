@@ -22,6 +22,10 @@ const (
 	DataSent ComponentEventType = iota
 	DataFiltered ComponentEventType = iota
 	ErrorEncountered ComponentEventType = iota
+	BackPressureRaised ComponentEventType = iota
+	BackPressureReleased ComponentEventType = iota
+	//the data item is superseded by a later version of the same key and is not sent
+	DataDeduped ComponentEventType = iota
 )
 
 //ComponentEventListener abstracts anybody who is interested in an event of a component
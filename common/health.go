@@ -0,0 +1,96 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+//HealthStatus is the status of a health check. Statuses are ordered from the best to the worst
+type HealthStatus int
+
+const (
+	HealthOk HealthStatus = iota
+	//the component works, but not as well as it should, e.g., it is held up by back pressure
+	HealthDegraded
+	//the component does not work, e.g., it is not started or not responding
+	HealthFailed
+)
+
+func (status HealthStatus) String() string {
+	switch status {
+	case HealthOk:
+		return "ok"
+	case HealthDegraded:
+		return "degraded"
+	case HealthFailed:
+		return "failed"
+	}
+	return fmt.Sprintf("unknown health status %d", int(status))
+}
+
+func (status HealthStatus) MarshalJSON() ([]byte, error) {
+	return json.Marshal(status.String())
+}
+
+//Health is the result of the health check of a component
+type Health struct {
+	Status HealthStatus `json:"status"`
+	//why the component is not ok
+	Reason string `json:"reason,omitempty"`
+}
+
+var Healthy = Health{Status: HealthOk}
+
+func NewHealth(status HealthStatus, reason string) Health {
+	return Health{Status: status, Reason: reason}
+}
+
+//HealthChecker is implemented by the components whose health can be checked, i.e., parts, connectors
+//and pipeline services. HealthCheck needs to return within timeout, and must not wait on the data
+//flowing through the component
+type HealthChecker interface {
+	HealthCheck(timeout time.Duration) Health
+}
+
+//PipelineHealth is the combined health of the components of a pipeline, whose status is the worst
+//status of the components, and whose reason lists the components with that status
+type PipelineHealth struct {
+	Health
+	//component id -> health
+	Components map[string]Health `json:"components"`
+}
+
+func NewPipelineHealth(components map[string]Health) *PipelineHealth {
+	ids := make([]string, 0, len(components))
+	for id, _ := range components {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	health := &PipelineHealth{Health: Healthy, Components: components}
+	reasons := []string{}
+	for _, id := range ids {
+		component := components[id]
+		if component.Status > health.Status {
+			health.Status = component.Status
+			reasons = reasons[:0]
+		}
+		if component.Status == health.Status && component.Status != HealthOk {
+			reasons = append(reasons, fmt.Sprintf("%v: %v", id, component.Reason))
+		}
+	}
+	health.Reason = strings.Join(reasons, "; ")
+	return health
+}
@@ -0,0 +1,43 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package common
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestPipelineHealth(t *testing.T) {
+	health := NewPipelineHealth(map[string]Health{})
+	if health.Status != HealthOk || health.Reason != "" {
+		t.Errorf("Expected empty pipeline to be ok, got %v", health.Health)
+	}
+
+	// the worst status wins, and only the components with it are listed
+	health = NewPipelineHealth(map[string]Health{
+		"dcp_1":   Healthy,
+		"queue_1": NewHealth(HealthDegraded, "back pressure is raised"),
+		"xmem_2":  NewHealth(HealthFailed, "not responding"),
+		"xmem_1":  NewHealth(HealthFailed, "not started")})
+	if health.Status != HealthFailed {
+		t.Errorf("Expected %v, got %v", HealthFailed, health.Status)
+	}
+	if expected := "xmem_1: not started; xmem_2: not responding"; health.Reason != expected {
+		t.Errorf("Expected reason %q, got %q", expected, health.Reason)
+	}
+
+	bytes, err := json.Marshal(NewHealth(HealthDegraded, "slow"))
+	if err != nil {
+		t.Fatalf("Failed to marshal health. err=%v", err)
+	}
+	if expected := `{"status":"degraded","reason":"slow"}`; string(bytes) != expected {
+		t.Errorf("Expected %v, got %v", expected, string(bytes))
+	}
+}
@@ -23,6 +23,9 @@ type PipelineRuntimeContext interface {
 	
 	//return a service handle
 	Service (svc_name string) PipelineService
+
+	//return all registered services, keyed by service name
+	Services () map[string]PipelineService
 	
 	//register a new service
 	//if the feed is active, the service would be started rightway
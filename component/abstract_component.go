@@ -22,7 +22,10 @@ type AbstractComponent struct {
 	logger    *log.CommonLogger
 }
 
+// the id of the component is set as the part id field of logger, which is logged with everything
+// logged by the component
 func NewAbstractComponentWithLogger(id string, logger *log.CommonLogger) AbstractComponent {
+	logger.SetField(log.FIELD_PART_ID, id)
 	return AbstractComponent{
 		id:                 id,
 		event_listeners:    make(map[common.ComponentEventType][]common.ComponentEventListener),
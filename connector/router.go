@@ -11,10 +11,12 @@ package connector
 
 import (
 	"errors"
+	"fmt"
 	common "github.com/Xiaomei-Zhang/goxdcr/common"
 	component "github.com/Xiaomei-Zhang/goxdcr/component"
 	"github.com/Xiaomei-Zhang/goxdcr/log"
 	"sync"
+	"time"
 )
 
 // Router routes data to downstream parts
@@ -22,6 +24,11 @@ import (
 var ErrorInvalidRouterConfig = errors.New("Invalid Router configuration. Parts and/or routing call back function are not defined.")
 var ErrorInvalidRoutingResult = errors.New("Invalid results from routing algorithm.")
 
+// a router with data being forwarded is degraded, and then failed, when it has not finished
+// forwarding any data for these long, e.g., when it is deadlocked
+var ForwardStallDegraded = 10 * time.Second
+var ForwardStallFailed = 60 * time.Second
+
 // call back function implementing the routing alrogithm
 // @Param - data to be routed
 // @Return - a map of partId to data to the routed to that part
@@ -33,6 +40,12 @@ type Router struct {
 	routing_callback *Routing_Callback_Func
 
 	stateLock sync.RWMutex
+
+	// number of Forward calls in progress, and the last time one of them finished,
+	// or started when there was none in progress
+	forwarding    int
+	last_progress time.Time
+	progressLock  sync.Mutex
 }
 
 func NewRouter(id string, downStreamParts map[string]common.Part,
@@ -47,6 +60,9 @@ func NewRouter(id string, downStreamParts map[string]common.Part,
 }
 
 func (router *Router) Forward(data interface{}) error {
+	router.forwardStarted()
+	defer router.forwardDone()
+
 	router.stateLock.RLock()
 	defer router.stateLock.RUnlock()
 
@@ -71,6 +87,41 @@ func (router *Router) Forward(data interface{}) error {
 	return err
 }
 
+func (router *Router) forwardStarted() {
+	router.progressLock.Lock()
+	defer router.progressLock.Unlock()
+	if router.forwarding == 0 {
+		router.last_progress = time.Now()
+	}
+	router.forwarding++
+}
+
+func (router *Router) forwardDone() {
+	router.progressLock.Lock()
+	defer router.progressLock.Unlock()
+	router.forwarding--
+	router.last_progress = time.Now()
+}
+
+// the router is degraded or failed when the data being forwarded is stalled, e.g., on
+// a downstream part that does not take data, or on a deadlock
+func (router *Router) HealthCheck(timeout time.Duration) common.Health {
+	router.progressLock.Lock()
+	defer router.progressLock.Unlock()
+	if router.forwarding == 0 {
+		return common.Healthy
+	}
+
+	stalled := time.Since(router.last_progress)
+	reason := fmt.Sprintf("%v forwards have made no progress for %v", router.forwarding, stalled)
+	if stalled > ForwardStallFailed {
+		return common.NewHealth(common.HealthFailed, reason)
+	} else if stalled > ForwardStallDegraded {
+		return common.NewHealth(common.HealthDegraded, reason)
+	}
+	return common.Healthy
+}
+
 func (router *Router) DownStreams() map[string]common.Part {
 	router.stateLock.RLock()
 	defer router.stateLock.RUnlock()
@@ -7,11 +7,17 @@ import (
     pp "github.com/Xiaomei-Zhang/goxdcr/pipeline"
     pctx "github.com/Xiaomei-Zhang/goxdcr/pipeline_ctx"
     "github.com/Xiaomei-Zhang/goxdcr/base"
+    "github.com/Xiaomei-Zhang/goxdcr/connector"
+    "github.com/Xiaomei-Zhang/goxdcr/gen_server"
     "github.com/Xiaomei-Zhang/goxdcr/metadata"
     "github.com/Xiaomei-Zhang/goxdcr/metadata_svc"
     "github.com/Xiaomei-Zhang/goxdcr/parts"
     "github.com/Xiaomei-Zhang/goxdcr/pipeline_svc"
+	"io/ioutil"
 	"math"
+	"net/url"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -21,6 +27,8 @@ const (
 	PART_NAME_DELIMITER     = "_"
 	DCP_NOZZLE_NAME_PREFIX      = "dcp"
 	XMEM_NOZZLE_NAME_PREFIX = "xmem"
+	QUEUE_PART_NAME_PREFIX  = "queue"
+	CONNECTOR_NAME_SUFFIX   = "connector"
 )
 
 // errors
@@ -28,6 +36,11 @@ var ErrorNoSourceKV = errors.New("Invalid configuration. No source kv node is fo
 var ErrorNoSourceNozzle = errors.New("Invalid configuration. No source nozzle can be constructed since the source kv nodes are not the master for any vbuckets.")
 var ErrorNoTargetNozzle = errors.New("Invalid configuration. No target nozzle can be constructed.")
 
+// parts with gen_servers, whose metrics are published under the names set
+type metricsPublisher interface {
+	SetMetricsName(name string)
+}
+
 // Factory for XDCR pipelines
 type XDCRFactory struct {
 	metadata_svc             metadata_svc.MetadataSvc
@@ -56,7 +69,9 @@ func NewXDCRFactory(metadata_svc metadata_svc.MetadataSvc,
 }
 
 func (xdcrf *XDCRFactory) NewPipeline(topic string) (common.Pipeline, error) {
+	// everything logged by the pipeline is logged with its topic
 	logger_ctx := log.CopyCtx(xdcrf.default_logger_ctx)
+	logger_ctx.Fields[log.FIELD_TOPIC] = topic
 
 	spec, err := xdcrf.metadata_svc.ReplicationSpec(topic)
 	xdcrf.logger.Debugf("replication specification = %v\n", spec)
@@ -80,13 +95,13 @@ func (xdcrf *XDCRFactory) NewPipeline(topic string) (common.Pipeline, error) {
 		return nil, err
 	}
 
-	// TODO construct queue parts. This will affect vbMap in router. may need an additional outNozzle -> downStreamPart/queue map in constructRouter
-	downStreamParts := make(map[string]common.Part)
-	for partId, outNozzle := range outNozzles {
-		downStreamParts[partId] = outNozzle
+	// a queue part sits in front of each out nozzle, so that a slow out nozzle does not hold up the others
+	downStreamParts, vbQueueMap, err := xdcrf.constructQueueParts(outNozzles, vbNozzleMap, logger_ctx)
+	if err != nil {
+		return nil, err
 	}
 
-	router, err := xdcrf.constructRouter(spec, downStreamParts, vbNozzleMap, logger_ctx)
+	router, err := xdcrf.constructRouter(spec, downStreamParts, vbQueueMap, logger_ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -98,6 +113,13 @@ func (xdcrf *XDCRFactory) NewPipeline(topic string) (common.Pipeline, error) {
 
 	// construct pipeline
 	pipeline := pp.NewPipelineWithSettingConstructor(topic, sourceNozzles, outNozzles, xdcrf.ConstructSettingsForPart, logger_ctx)
+
+	// parts publish the metrics of their gen_servers under the topic of the pipeline
+	for _, part := range pp.GetAllParts(pipeline) {
+		if server, ok := part.(metricsPublisher); ok {
+			server.SetMetricsName(gen_server.MetricsName(topic, part.Id()))
+		}
+	}
 	if pipelineContext, err := pctx.NewWithSettingConstructor(pipeline, xdcrf.ConstructSettingsForService, logger_ctx); err != nil {
 		return nil, err
 	} else {
@@ -167,7 +189,8 @@ func (xdcrf *XDCRFactory) constructSourceNozzles(spec *metadata.ReplicationSpeci
 		var index int
 		for i := 0; i < numOfDcpNozzles; i++ {
 			// construct vbList for the dcpNozzle
-			// before statistics info is available, the default load balancing stragegy is to evenly distribute vbuckets among dcpNozzles
+			// before statistics info is available, the default load balancing stragegy is to evenly distribute vbuckets among dcpNozzles.
+			// VBLoadBalancer moves vbuckets off the dcpNozzles that turn out to be hot
 
 			//bucket has to be created for each DcpNozzle as it uses its underline
 			//connection. Each Upr connection needs a separate socket
@@ -253,7 +276,8 @@ func (xdcrf *XDCRFactory) constructOutgoingNozzles(spec *metadata.ReplicationSpe
 			outNozzles[outNozzle.Id()] = outNozzle
 
 			// construct vbMap for the out nozzle, which is needed by the router
-			// before statistics info is available, the default load balancing stragegy is to evenly distribute vbuckets among out nozzles
+			// before statistics info is available, the default load balancing stragegy is to evenly distribute vbuckets among out nozzles.
+			// VBLoadBalancer moves vbuckets off the out nozzles that turn out to be hot
 			for i := 0; i < numOfVbPerNozzle; i++ {
 				if index < numOfVbs {
 					vbNozzleMap[kvVBList[index]] = outNozzle.Id()
@@ -273,6 +297,36 @@ func (xdcrf *XDCRFactory) constructOutgoingNozzles(spec *metadata.ReplicationSpe
 	return outNozzles, vbNozzleMap, nil
 }
 
+// construct a queue part for each out nozzle, and route vbuckets to the queue parts in front of
+// the out nozzles they are mapped to
+func (xdcrf *XDCRFactory) constructQueueParts(outNozzles map[string]common.Nozzle,
+	vbNozzleMap map[uint16]string,
+	logger_ctx *log.LoggerContext) (map[string]common.Part, map[uint16]string, error) {
+	queueParts := make(map[string]common.Part)
+	for partId, outNozzle := range outNozzles {
+		// partIds of the queue parts look like "queue_xmem_$kvaddr_1"
+		queuePart := parts.NewQueuePart(queuePartId(partId), logger_ctx)
+		err := queuePart.SetConnector(connector.NewSimpleConnector(queuePart.Id()+PART_NAME_DELIMITER+CONNECTOR_NAME_SUFFIX, outNozzle, logger_ctx))
+		if err != nil {
+			xdcrf.logger.Errorf("err=%v\n", err)
+			return nil, nil, err
+		}
+		queueParts[queuePart.Id()] = queuePart
+	}
+
+	vbQueueMap := make(map[uint16]string)
+	for vbno, partId := range vbNozzleMap {
+		vbQueueMap[vbno] = queuePartId(partId)
+	}
+
+	xdcrf.logger.Infof("Constructed %v queue parts\n", len(queueParts))
+	return queueParts, vbQueueMap, nil
+}
+
+func queuePartId(outNozzleId string) string {
+	return QUEUE_PART_NAME_PREFIX + PART_NAME_DELIMITER + outNozzleId
+}
+
 func (xdcrf *XDCRFactory) constructRouter(spec *metadata.ReplicationSpecification,
 	downStreamParts map[string]common.Part,
 	vbNozzleMap map[uint16]string,
@@ -343,16 +397,19 @@ func (xdcrf *XDCRFactory) ConstructSettingsForPart(pipeline common.Pipeline, par
 
 	if _, ok := part.(*parts.XmemNozzle); ok {
 		xdcrf.logger.Debugf("Construct settings for XmemNozzle %s", part.Id())
-		return xdcrf.constructSettingsForXmemNozzle(pipeline.Topic(), settings)
+		return xdcrf.constructSettingsForXmemNozzle(pipeline.Topic(), part, settings)
 	} else if _, ok := part.(*parts.DcpNozzle); ok {
 		xdcrf.logger.Debugf("Construct settings for DcpNozzle %s", part.Id())
 		return xdcrf.constructSettingsForDcpNozzle(pipeline, part.(*parts.DcpNozzle), settings)
+	} else if _, ok := part.(*parts.QueuePart); ok {
+		xdcrf.logger.Debugf("Construct settings for QueuePart %s", part.Id())
+		return xdcrf.constructSettingsForQueuePart(pipeline.Topic(), part, settings)
 	} else {
 		return settings, nil
 	}
 }
 
-func (xdcrf *XDCRFactory) constructSettingsForXmemNozzle(topic string, settings map[string]interface{}) (map[string]interface{}, error) {
+func (xdcrf *XDCRFactory) constructSettingsForXmemNozzle(topic string, part common.Part, settings map[string]interface{}) (map[string]interface{}, error) {
 	xmemSettings := make(map[string]interface{})
 	// TODO this may break
 	repSettings, err := metadata.SettingsFromMap(settings)
@@ -363,11 +420,83 @@ func (xdcrf *XDCRFactory) constructSettingsForXmemNozzle(topic string, settings
 	xmemSettings[parts.XMEM_SETTING_BATCHSIZE] = repSettings.BatchSize
 	xmemSettings[parts.XMEM_SETTING_RESP_TIMEOUT] = xdcrf.getTargetTimeoutEstimate(topic)
 	xmemSettings[parts.XMEM_SETTING_BATCH_EXPIRATION_TIME] = time.Duration(float64(repSettings.MaxExpectedReplicationLag)*0.7) * time.Millisecond
+	xmemSettings[parts.XMEM_SETTING_DEDUP] = repSettings.Deduplication
+	xmemSettings[parts.XMEM_SETTING_COMPRESSION] = repSettings.Compression
+	xmemSettings[parts.XMEM_SETTING_COMPRESSION_THRESHOLD] = repSettings.CompressionThreshold
+	if len(base.SpoolDir) > 0 && repSettings.SpoolMaxSize > 0 {
+		xmemSettings[parts.XMEM_SETTING_SPOOL_DIR] = filepath.Join(base.SpoolDir, partFileName(topic, part))
+		xmemSettings[parts.XMEM_SETTING_SPOOL_MAX_SIZE] = repSettings.SpoolMaxSize * 1024 * 1024
+		if repSettings.SpoolOverflowPolicy == metadata.SpoolOverflowPolicyDrop {
+			xmemSettings[parts.XMEM_SETTING_SPOOL_OVERFLOW_POLICY] = parts.SpoolOverflowDrop
+		} else {
+			xmemSettings[parts.XMEM_SETTING_SPOOL_OVERFLOW_POLICY] = parts.SpoolOverflowBlock
+		}
+	}
 
 	return xmemSettings, nil
 
 }
 
+func (xdcrf *XDCRFactory) constructSettingsForQueuePart(topic string, part common.Part, settings map[string]interface{}) (map[string]interface{}, error) {
+	queueSettings := make(map[string]interface{})
+	repSettings, err := metadata.SettingsFromMap(settings)
+	if err != nil {
+		return nil, err
+	}
+	queueSettings[parts.QUEUE_SETTING_SIZE] = repSettings.QueueSize * 1024
+	queueSettings[parts.QUEUE_SETTING_HIGH_WATERMARK] = repSettings.QueueHighWatermark * 1024
+	if len(base.QueueOverflowDir) > 0 {
+		queueSettings[parts.QUEUE_SETTING_OVERFLOW_FILE] = filepath.Join(base.QueueOverflowDir, partFileName(topic, part))
+	}
+
+	return queueSettings, nil
+}
+
+// name of the local file or directory of a part. replication ids and part ids contain characters
+// that are not safe in file names
+func partFileName(topic string, part common.Part) string {
+	return url.QueryEscape(topic + PART_NAME_DELIMITER + part.Id())
+}
+
+// remove the local files that the parts of the replication keep across restarts, i.e., the
+// overflow files of the queues and the spools of the xmem nozzles. It is called once the
+// replication is deleted and its pipeline is stopped, so that a replication created later
+// with the same id does not pick up stale data
+func RemovePartFiles(topic string) error {
+	err := removePartFilesInDir(base.QueueOverflowDir, topic+PART_NAME_DELIMITER+QUEUE_PART_NAME_PREFIX+PART_NAME_DELIMITER)
+	spoolErr := removePartFilesInDir(base.SpoolDir, topic+PART_NAME_DELIMITER+XMEM_NOZZLE_NAME_PREFIX+PART_NAME_DELIMITER)
+	if err == nil {
+		err = spoolErr
+	}
+	return err
+}
+
+// remove the files and directories in dir whose unescaped names start with prefix
+func removePartFilesInDir(dir string, prefix string) error {
+	if len(dir) == 0 {
+		return nil
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var firstErr error
+	for _, entry := range entries {
+		name, err := url.QueryUnescape(entry.Name())
+		if err != nil || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
 func (xdcrf *XDCRFactory) getTargetTimeoutEstimate(topic string) time.Duration {
 	//TODO: implement
 	//need to get the tcp ping time for the estimate
@@ -404,9 +533,20 @@ func (xdcrf *XDCRFactory) registerServices(pipeline common.Pipeline, logger_ctx
 	ctx.RegisterService(base.PIPELINE_SUPERVISOR_SVC, supervisor)
 	//register pipeline checkpoint manager
 	ctx.RegisterService(base.CHECKPOINT_MGR_SVC, &pipeline_svc.CheckpointManager{})
+	//register vbucket load balancer
+	ctx.RegisterService(base.VB_LOAD_BALANCER_SVC, pipeline_svc.NewVBLoadBalancer(nozzleGroup, logger_ctx))
 	//register pipeline statistics manager
 }
 
+// nozzles constructed for the same kv node, e.g., "dcp_$kvaddr_0" and "dcp_$kvaddr_1",
+// are in the same group, among which vbuckets can be moved
+func nozzleGroup(nozzleId string) string {
+	if index := strings.LastIndex(nozzleId, PART_NAME_DELIMITER); index >= 0 {
+		return nozzleId[:index]
+	}
+	return nozzleId
+}
+
 func (xdcrf *XDCRFactory) ConstructSettingsForService(pipeline common.Pipeline, service common.PipelineService, settings map[string]interface{}) (map[string]interface{}, error) {
 	if _, ok := service.(*pipeline_svc.PipelineSupervisor); ok {
 		xdcrf.logger.Debug("Construct settings for PipelineSupervisor")
@@ -422,5 +562,15 @@ func (xdcrf *XDCRFactory) constructSettingsForSupervisor(topic string, settings
 		return nil, err
 	}
 	s[pipeline_svc.PIPELINE_LOG_LEVEL] = repSettings.LogLevel
+	s[pipeline_svc.TIMEOUT_PERCENTAGE_CAP] = repSettings.TimeoutPercentageCap
+	s[pipeline_svc.MAX_EXPECTED_LAG] = time.Duration(repSettings.MaxExpectedReplicationLag) * time.Millisecond
+	if repSettings.TimeoutCapPolicy == metadata.TimeoutCapPolicyRestart {
+		s[pipeline_svc.TIMEOUT_CAP_POLICY] = pipeline_svc.TimeoutCapRestart
+	} else {
+		s[pipeline_svc.TIMEOUT_CAP_POLICY] = pipeline_svc.TimeoutCapDegrade
+	}
+	if s[pipeline_svc.ERROR_POLICIES], err = base.ParseErrorPolicies(repSettings.ErrorPolicies); err != nil {
+		return nil, err
+	}
 	return s, nil
 }
@@ -0,0 +1,79 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package factory
+
+import (
+	"github.com/Xiaomei-Zhang/goxdcr/base"
+	"github.com/Xiaomei-Zhang/goxdcr/metadata"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// create a local file of a part of the replication in dir
+func createPartFile(t *testing.T, dir string, topic string, partId string) string {
+	path := filepath.Join(dir, url.QueryEscape(topic+PART_NAME_DELIMITER+partId))
+	if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+		t.Fatalf("failed to create %v, err=%v", path, err)
+	}
+	return path
+}
+
+// create the spool directory, with a segment in it, of a nozzle of the replication in dir
+func createSpoolDir(t *testing.T, dir string, topic string, nozzleId string) string {
+	path := filepath.Join(dir, url.QueryEscape(topic+PART_NAME_DELIMITER+nozzleId))
+	if err := os.Mkdir(path, 0755); err != nil {
+		t.Fatalf("failed to create %v, err=%v", path, err)
+	}
+	createPartFile(t, path, "segment", "0")
+	return path
+}
+
+func TestRemovePartFiles(t *testing.T) {
+	queueDir := t.TempDir()
+	spoolDir := t.TempDir()
+	savedQueueDir, savedSpoolDir := base.QueueOverflowDir, base.SpoolDir
+	base.QueueOverflowDir, base.SpoolDir = queueDir, spoolDir
+	defer func() { base.QueueOverflowDir, base.SpoolDir = savedQueueDir, savedSpoolDir }()
+
+	topic := metadata.ReplicationId("source", "default", "target", "default", "")
+	// the id of a replication with a filter starts with the id of the one without
+	otherTopic := metadata.ReplicationId("source", "default", "target", "default", "filter")
+
+	removed := []string{
+		createPartFile(t, queueDir, topic, queuePartId("xmem_127.0.0.1:12000_0")),
+		createPartFile(t, queueDir, topic, queuePartId("xmem_127.0.0.1:12000_1")),
+		createSpoolDir(t, spoolDir, topic, "xmem_127.0.0.1:12000_0"),
+	}
+	kept := []string{
+		createPartFile(t, queueDir, otherTopic, queuePartId("xmem_127.0.0.1:12000_0")),
+		createSpoolDir(t, spoolDir, otherTopic, "xmem_127.0.0.1:12000_0"),
+	}
+
+	if err := RemovePartFiles(topic); err != nil {
+		t.Fatalf("RemovePartFiles failed, err=%v", err)
+	}
+	for _, path := range removed {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%v is not removed, err=%v", path, err)
+		}
+	}
+	for _, path := range kept {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%v of another replication is removed, err=%v", path, err)
+		}
+	}
+
+	// nothing to remove
+	if err := RemovePartFiles(topic); err != nil {
+		t.Fatalf("RemovePartFiles on removed files failed, err=%v", err)
+	}
+}
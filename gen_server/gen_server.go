@@ -10,18 +10,49 @@
 package gen_server
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"github.com/Xiaomei-Zhang/goxdcr/log"
 	utils "github.com/Xiaomei-Zhang/goxdcr/utils"
 	"reflect"
+	"runtime/debug"
 	"time"
 )
 
+// commands handled by the server routine
+type commandType int
+
 const (
-	cmdStop      = 0
-	cmdHeartBeat = 1
+	cmdStop commandType = iota
+	cmdHeartBeat
+	//message sent by SendMsg_async
+	cmdMsg
+	cmdCall
+	cmdCast
 )
 
+func (cmd commandType) String() string {
+	switch cmd {
+	case cmdStop:
+		return "stop"
+	case cmdHeartBeat:
+		return "heartbeat"
+	case cmdMsg:
+		return "msg"
+	case cmdCall:
+		return "call"
+	case cmdCast:
+		return "cast"
+	}
+	return fmt.Sprintf("unknown command %d", int(cmd))
+}
+
+var ErrorServerNotStarted = errors.New("Server is not started.")
+var ErrorServerStopped = errors.New("Server is stopped.")
+var ErrorNoCallHandler = errors.New("No call handler is registered.")
+var ErrorNoCastHandler = errors.New("No cast handler is registered.")
+
 //var logger *log.CommonLogger
 //
 //func init() {
@@ -33,20 +64,58 @@ type Behavior_Callback_Func func() error
 type Exit_Callback_Func func()
 type Error_Handler_Func func(err error)
 
+//Call_Callback_Func handles the request of a Call on the server routine, and returns the reply
+type Call_Callback_Func func(request interface{}) (interface{}, error)
+
+//Cast_Callback_Func handles the request of a Cast on the server routine.
+//The error it returns is reported to the error handler
+type Cast_Callback_Func func(request interface{}) error
+
+//reply of a call, or of a stop
+type reply struct {
+	value interface{}
+	err   error
+}
+
+//command to the server routine
+type command struct {
+	cmdType commandType
+	//request of a call or cast
+	request interface{}
+	//message sent by SendMsg_async
+	msg []interface{}
+	//context of a call. the call is skipped if it is done before the server gets to it
+	ctx context.Context
+	//reply channel of calls and stops. it is buffered so that the server never blocks on a caller
+	//that has given up
+	respch chan reply
+	//reply channel of heartbeats
+	heartBeatRespch chan []interface{}
+	timestamp       time.Time
+}
+
 type GenServer struct {
 	//msg channel
-	msgChan chan []interface{}
+	msgChan chan *command
 
 	//heartbeat channel
-	heartBeatChan chan []interface{}
+	heartBeatChan chan *command
+
+	//closed when the server routine exits
+	doneChan chan bool
 
 	msg_callback      *Msg_Callback_Func
 //	behavior_callback *Behavior_Callback_Func
 	exit_callback     *Exit_Callback_Func
 	error_handler     *Error_Handler_Func
+	call_callback     *Call_Callback_Func
+	cast_callback     *Cast_Callback_Func
 
 	isStarted bool
 	logger    *log.CommonLogger
+
+	//registered with DefaultMetricsRegistry while the server is running
+	metrics *ServerMetrics
 }
 
 func NewGenServer(msg_callback *Msg_Callback_Func,
@@ -55,87 +124,139 @@ func NewGenServer(msg_callback *Msg_Callback_Func,
 	error_handler *Error_Handler_Func,
 	logger_context *log.LoggerContext,
 	module string) GenServer {
-	return GenServer{msgChan: make(chan []interface{}, 1),
-		heartBeatChan:     make(chan []interface{}, 1),
+	msgChan := make(chan *command, 1)
+	return GenServer{msgChan: msgChan,
+		heartBeatChan:     make(chan *command, 1),
+		doneChan:          make(chan bool),
 		msg_callback:      msg_callback,
 //		behavior_callback: behavior_callback,
 		exit_callback:     exit_callback,
 		error_handler:     error_handler,
 		isStarted:         false,
-		logger:            log.NewLogger(module, logger_context)}
+		logger:            log.NewLogger(module, logger_context),
+		metrics:           newServerMetrics(module, msgChan)}
+}
+
+//SetMetricsName sets the name the metrics of the server are registered under, which defaults to
+//the module of the server. It needs to be unique, e.g., MetricsName(topic, partId) for a part of a
+//pipeline, and needs to be set before the server is started
+func (s *GenServer) SetMetricsName(name string) {
+	s.metrics.setName(name)
+}
+
+func (s *GenServer) Metrics() *ServerMetrics {
+	return s.metrics
+}
+
+//SetCallHandler registers the callback that handles calls. It needs to be set before the server is started
+func (s *GenServer) SetCallHandler(call_callback *Call_Callback_Func) {
+	s.call_callback = call_callback
+}
+
+//SetCastHandler registers the callback that handles casts. It needs to be set before the server is started
+func (s *GenServer) SetCastHandler(cast_callback *Cast_Callback_Func) {
+	s.cast_callback = cast_callback
 }
 
 func (s *GenServer) Start_server() (err error) {
 	defer utils.RecoverPanic(&err)
 
-	go s.run()
+	//a server can be started again after it is stopped, e.g., when it is restarted by a supervisor
+	s.doneChan = make(chan bool)
+	go s.run(s.doneChan)
 	s.isStarted = true
+	DefaultMetricsRegistry.Register(s.metrics)
 	return err
 }
 
-func (s *GenServer) run() {
+func (s *GenServer) run(doneChan chan bool) {
+	defer close(doneChan)
+
 	// resp ch used when exiting the routine
-	var exitRespCh chan []interface{}
+	var exitRespCh chan reply
 loop:
 	for {
 		select {
 		case heartBeatReq := <-s.heartBeatChan:
+			s.metrics.heartBeatResponded(time.Since(heartBeatReq.timestamp))
 			s.logger.Debug("Recieved heart beat message...")
-			if err1, respch_heartbeat, timestamp := s.decodeCmd(cmdHeartBeat, heartBeatReq); err1 == nil {
-				s.logger.Infof("responded heart beat sent at %v\n", timestamp)
-				select {
-				case respch_heartbeat <- []interface{}{true}:
-				default:
-				}
-			} else {
-				s.logger.Errorf("Error decoding heartbeat cmd, err=%v\n", err1)
+			s.logger.Infof("responded heart beat sent at %v\n", heartBeatReq.timestamp)
+			select {
+			case heartBeatReq.heartBeatRespch <- []interface{}{true}:
+			default:
 			}
 
-		case msg := <-s.msgChan:
-			if err2, respch, timestamp := s.decodeCmd(cmdStop, msg); err2 == nil {
-				s.logger.Infof("server is stopped per request sent at %v\n", timestamp)
-				close(s.msgChan)
-				exitRespCh = respch
+		case cmd := <-s.msgChan:
+			s.metrics.commandReceived(cmd)
+			switch cmd.cmdType {
+			case cmdStop:
+				s.logger.Infof("server is stopped per request sent at %v\n", cmd.timestamp)
+				exitRespCh = cmd.respch
 				break loop
-			} else {
-				if (*s.msg_callback) != nil {
-					err := (*s.msg_callback)(msg)
+			case cmdCall:
+				s.handleCall(cmd)
+			case cmdCast:
+				if err := s.invoke(cmd.cmdType, func() error { return (*s.cast_callback)(cmd.request) }); err != nil {
+					s.reportError(err)
+				}
+			case cmdMsg:
+				if s.msg_callback != nil && (*s.msg_callback) != nil {
+					err := s.invoke(cmd.cmdType, func() error { return (*s.msg_callback)(cmd.msg) })
 					if err != nil {
 						//report error
 						s.reportError(err)
 					}
 				}
+			default:
+				s.logger.Errorf("Unexpected command %v\n", cmd.cmdType)
 			}
-
 		}
 	}
 
 	if s.exit_callback != nil && (*s.exit_callback) != nil {
-		(*s.exit_callback)()
-		//probably no need to report error during exitting.
+		err := s.invoke(cmdStop, func() error {
+			(*s.exit_callback)()
+			return nil
+		})
+		if err != nil {
+			//still respond to the stop, so that the caller does not hang
+			s.logger.Errorf("exit_callback failed. err=%v\n", err)
+		}
 	} else {
 		s.logger.Debugf("No exit_callback for %s\n", reflect.TypeOf(s).Name())
 	}
-	
+
 	if exitRespCh != nil {
-		exitRespCh <- []interface{}{true}
+		exitRespCh <- reply{value: true}
 	}
 }
 
-func (s *GenServer) decodeCmd(command int, msg []interface{}) (error, chan []interface{}, time.Time) {
-	if len(msg) != 3 {
-		return errors.New("Failed to decode command"), nil, time.Now()
-	} else {
-		cmd := msg[0].(int)
-		respch := msg[1].(chan []interface{})
-		timestamp := msg[2].(time.Time)
-		if cmd == command {
-			return nil, respch, timestamp
-		} else {
-			return errors.New("Failed to decode command"), nil, time.Now()
-		}
-
+func (s *GenServer) handleCall(cmd *command) {
+	if err := cmd.ctx.Err(); err != nil {
+		//the caller has given up
+		s.logger.Debugf("Skip call that is done before being handled. err=%v\n", err)
+		return
 	}
+
+	var value interface{}
+	err := s.invoke(cmd.cmdType, func() (err error) {
+		value, err = (*s.call_callback)(cmd.request)
+		return err
+	})
+	cmd.respch <- reply{value: value, err: err}
+}
+
+//invoke a callback on the server routine. a panic in the callback is recovered, and returned as an error
+func (s *GenServer) invoke(cmd commandType, callback func() error) (err error) {
+	start := time.Now()
+	defer func() {
+		s.metrics.callbackDone(cmd, time.Since(start))
+		if r := recover(); r != nil {
+			s.logger.Errorf("Panic in %v callback. panic=%v\n%s", cmd, r, debug.Stack())
+			err = errors.New(fmt.Sprintf("Panic in %v callback: %v", cmd, r))
+		}
+	}()
+	return callback()
 }
 
 func (s *GenServer) IsStarted() bool {
@@ -145,39 +266,121 @@ func (s *GenServer) IsStarted() bool {
 func (s *GenServer) Stop_server() error {
 	if s.isStarted {
 
-		respChan := make(chan []interface{})
-		s.msgChan <- []interface{}{cmdStop, respChan, time.Now()}
+		respChan := make(chan reply, 1)
+		s.msgChan <- &command{cmdType: cmdStop, respch: respChan, timestamp: time.Now()}
 
 		response := <-respChan
-		succeed := response[0].(bool)
-
-		if succeed {
+		if response.err == nil {
 			s.isStarted = false
+			DefaultMetricsRegistry.Unregister(s.metrics)
 			s.logger.Debug("Stopped")
 			return nil
 		} else {
-			error_msg := response[1].(string)
 			s.logger.Debug("Failed to stop")
-			return errors.New(error_msg)
+			return response.err
 		}
 	}
 	return nil
 }
 
+//Call sends the request to the server routine, and waits for the reply of the call handler.
+//It returns the error of ctx if ctx is done before the reply comes, and ErrorServerStopped
+//if the server stops before handling the request
+func (s *GenServer) Call(ctx context.Context, request interface{}) (interface{}, error) {
+	if !s.isStarted {
+		return nil, ErrorServerNotStarted
+	}
+	if s.call_callback == nil || (*s.call_callback) == nil {
+		return nil, ErrorNoCallHandler
+	}
+
+	cmd := &command{cmdType: cmdCall,
+		request:   request,
+		ctx:       ctx,
+		respch:    make(chan reply, 1),
+		timestamp: time.Now()}
+	select {
+	case s.msgChan <- cmd:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-s.doneChan:
+		return nil, ErrorServerStopped
+	}
+
+	select {
+	case response := <-cmd.respch:
+		return response.value, response.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-s.doneChan:
+		return nil, ErrorServerStopped
+	}
+}
+
+//Cast sends the request to the server routine to be handled by the cast handler, without
+//waiting for it to be handled. It blocks while the server is busy with an earlier command
+func (s *GenServer) Cast(request interface{}) error {
+	if !s.isStarted {
+		return ErrorServerNotStarted
+	}
+	if s.cast_callback == nil || (*s.cast_callback) == nil {
+		return ErrorNoCastHandler
+	}
+
+	select {
+	case s.msgChan <- &command{cmdType: cmdCast, request: request, timestamp: time.Now()}:
+		return nil
+	case <-s.doneChan:
+		return ErrorServerStopped
+	}
+}
+
 func (s *GenServer) HeartBeat_sync() bool {
-	respchan := make(chan []interface{})
-	s.heartBeatChan <- []interface{}{cmdHeartBeat, respchan}
+	respchan := make(chan []interface{}, 1)
+	select {
+	case s.heartBeatChan <- &command{cmdType: cmdHeartBeat, heartBeatRespch: respchan, timestamp: time.Now()}:
+	case <-s.doneChan:
+		return false
+	}
 
-	response := <-respchan
-	if response != nil {
+	select {
+	case response := <-respchan:
+		return response[0].(bool)
+	case <-s.doneChan:
+		return false
+	}
+}
+
+//Responsive checks whether the server routine responds to a heartbeat within timeout
+func (s *GenServer) Responsive(timeout time.Duration) bool {
+	if !s.isStarted {
+		return false
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	respchan := make(chan []interface{}, 1)
+	select {
+	case s.heartBeatChan <- &command{cmdType: cmdHeartBeat, heartBeatRespch: respchan, timestamp: time.Now()}:
+	case <-timer.C:
+		return false
+	case <-s.doneChan:
+		return false
+	}
+
+	select {
+	case response := <-respchan:
 		return response[0].(bool)
+	case <-timer.C:
+		return false
+	case <-s.doneChan:
+		return false
 	}
-	return false
 }
 
 func (s *GenServer) HeartBeat_async(respchan chan []interface{}, timestamp time.Time) error {
 	select {
-	case s.heartBeatChan <- []interface{}{cmdHeartBeat, respchan, timestamp}:
+	case s.heartBeatChan <- &command{cmdType: cmdHeartBeat, heartBeatRespch: respchan, timestamp: timestamp}:
 		s.logger.Info("heart beat test")
 		return nil
 	default:
@@ -191,7 +394,7 @@ func (s *GenServer) Logger() *log.CommonLogger {
 }
 
 func (s *GenServer) reportError(err error) {
-	if s.error_handler != nil {
+	if s.error_handler != nil && (*s.error_handler) != nil {
 		(*s.error_handler)(err)
 	} else {
 		//no error handler is registered, log the error
@@ -200,5 +403,5 @@ func (s *GenServer) reportError(err error) {
 }
 
 func (s *GenServer) SendMsg_async(msg []interface{}) {
-	s.msgChan <- msg
+	s.msgChan <- &command{cmdType: cmdMsg, msg: msg, timestamp: time.Now()}
 }
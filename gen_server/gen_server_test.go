@@ -10,158 +10,234 @@
 package gen_server
 
 import (
+	"context"
 	"errors"
-	"fmt"
-	common "github.com/Xiaomei-Zhang/goxdcr/common"
-	part "github.com/Xiaomei-Zhang/goxdcr/part"
-	base "github.com/Xiaomei-Zhang/couchbase_goxdcr_impl/base"
-	"sync"
+	"strings"
 	"testing"
 	"time"
 )
 
-type example_part struct {
-	dataChan chan interface{}
+const testWaitTime = 2 * time.Second
+
+// a server that keeps a counter, which is only touched by its server routine
+type counterServer struct {
 	GenServer
-	part.AbstractPart
-	increase_amount int
-	waitGrp         sync.WaitGroup
+	counter int
+	exited  bool
+	errors  chan error
 }
 
-func newExamplePart(id string, increase_amount int) *example_part {
-	var exit_callback gen_server.Exit_Callback_Func
-	var extend_callback gen_server.Behavior_Callback_Func
-	part_server := gen_server.NewGenServer(nil, &extend_callback, &exit_callback)
-	part := &example_part{make(chan interface{}), part_server, part.NewAbstractPart(id), increase_amount, sync.WaitGroup{}}
-	exit_callback = part.onExit
-	extend_callback = part.runData
-	return part
+// requests of counterServer
+type getCounter struct{}
+type addToCounter struct {
+	amount int
+}
+type sleep struct {
+	duration time.Duration
+}
+type panicNow struct{}
+
+func newCounterServer() *counterServer {
+	var exit_callback_func Exit_Callback_Func
+	var error_handler_func Error_Handler_Func
+	var call_callback_func Call_Callback_Func
+	var cast_callback_func Cast_Callback_Func
+	server := &counterServer{GenServer: NewGenServer(nil, nil, &exit_callback_func, &error_handler_func, nil, "CounterServer"),
+		errors: make(chan error, 10)}
+	exit_callback_func = server.onExit
+	error_handler_func = server.onError
+	call_callback_func = server.handleCall
+	cast_callback_func = server.handleCast
+	server.SetCallHandler(&call_callback_func)
+	server.SetCastHandler(&cast_callback_func)
+	return server
 }
-func (p *example_part) runData() {
-	select {
-	case data := <-p.dataChan:
-		go p.processData(data)
-		p.waitGrp.Add(1)
-	default:
 
+func (server *counterServer) handleCall(request interface{}) (interface{}, error) {
+	switch req := request.(type) {
+	case getCounter:
+		return server.counter, nil
+	case sleep:
+		time.Sleep(req.duration)
+		return nil, nil
+	case panicNow:
+		panic("call panics")
 	}
+	return nil, errors.New("unknown request")
 }
 
-func (p *example_part) Start(settings map[string]interface{}) error {
-	return p.Start_server()
+func (server *counterServer) handleCast(request interface{}) error {
+	switch req := request.(type) {
+	case addToCounter:
+		server.counter += req.amount
+		return nil
+	case panicNow:
+		panic("cast panics")
+	}
+	return errors.New("unknown request")
 }
 
-func (p *example_part) Stop() error {
-	return p.Stop_server()
+func (server *counterServer) onExit() {
+	server.exited = true
 }
 
-func (p *example_part) processData(data interface{}) {
-	newData := data.(int) + p.increase_amount
-	fmt.Println(fmt.Sprint(newData))
-	//raise DataProcessed event
-	p.RaiseEvent(common.DataProcessed, data, p, nil, nil)
-
-	p.Connector().Forward(newData)
-
-	p.waitGrp.Done()
+func (server *counterServer) onError(err error) {
+	server.errors <- err
+}
 
+func startCounterServer(t *testing.T) *counterServer {
+	server := newCounterServer()
+	if err := server.Start_server(); err != nil {
+		t.Fatalf("Failed to start server. err=%v", err)
+	}
+	return server
 }
 
-func (p *example_part) onExit() {
-	fmt.Println("Before Exit")
-	p.waitGrp.Wait()
+func expectCounter(t *testing.T, server *counterServer, expected int) {
+	ctx, cancel := context.WithTimeout(context.Background(), testWaitTime)
+	defer cancel()
+	counter, err := server.Call(ctx, getCounter{})
+	if err != nil || counter != expected {
+		t.Errorf("Expected counter %v, got %v, err=%v", expected, counter, err)
+	}
 }
 
-func (p *example_part) Receive(data interface{}) error {
-	if p.dataChan == nil || !p.IsStarted() {
-		return errors.New("The Part is not running, not ready to process data")
+func TestStartStop(t *testing.T) {
+	server := startCounterServer(t)
+	if !server.IsStarted() {
+		t.Errorf("Server is not started")
+	}
+	if err := server.Stop_server(); err != nil {
+		t.Fatalf("Failed to stop server. err=%v", err)
+	}
+	if server.IsStarted() || !server.exited {
+		t.Errorf("Server is not stopped")
+	}
+
+	// calls and casts are rejected once the server stops
+	if _, err := server.Call(context.Background(), getCounter{}); err != ErrorServerNotStarted {
+		t.Errorf("Expected %v, got %v", ErrorServerNotStarted, err)
 	}
-	p.dataChan <- data
+	if err := server.Cast(addToCounter{1}); err != ErrorServerNotStarted {
+		t.Errorf("Expected %v, got %v", ErrorServerNotStarted, err)
+	}
+}
+
+func TestCallAndCast(t *testing.T) {
+	server := startCounterServer(t)
+	defer server.Stop_server()
 
-	//raise DataReceived event
-	p.RaiseEvent(common.DataReceived, data, p, nil, nil)
+	for i := 0; i < 10; i++ {
+		if err := server.Cast(addToCounter{i}); err != nil {
+			t.Fatalf("Failed to cast. err=%v", err)
+		}
+	}
+	// casts are handled in order, before the later call
+	expectCounter(t, server, 45)
 
-	return nil
+	if _, err := server.Call(context.Background(), "unknown"); err == nil || err.Error() != "unknown request" {
+		t.Errorf("Expected the error of the call handler, got %v", err)
+	}
 }
 
-func TestStartStop(t *testing.T) {
-	p := newExamplePart("XYZ", 10)
-	t.Log("Part XYZ is created")
-	err := p.Start(make(map[string]interface{}))
+func TestCallDeadline(t *testing.T) {
+	server := startCounterServer(t)
+	defer server.Stop_server()
 
-	if err == nil {
-		time.Sleep(2 * time.Second)
-		p.Stop()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := server.Call(ctx, sleep{500 * time.Millisecond}); err != context.DeadlineExceeded {
+		t.Errorf("Expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	if time.Since(start) > 400*time.Millisecond {
+		t.Errorf("Call did not return at its deadline")
 	}
+
+	// the server is still serving once the slow call is done
+	expectCounter(t, server, 0)
 }
 
-func TestHeartBeat(t *testing.T) {
-	p := newExamplePart("XYZ", 12)
-	t.Log("Part XYZ is created")
-	err := p.Start(make(map[string]interface{}))
-
-	if err == nil {
-		var waitGrp sync.WaitGroup
-		finchan := make(chan bool)
-		finchan2 := make(chan bool)
-		ticker := time.NewTicker(200 * time.Millisecond)
-		//launch the heartbeat checker
-		waitGrp.Add(1)
-		go heartBeatChecker(p, ticker.C, finchan2, &waitGrp)
-
-		//launch life killer
-		waitGrp.Add(1)
-		go lifeKiller(p, finchan, 5*time.Second, t, &waitGrp)
-
-	loop2:
-		for {
-			select {
-			case <-finchan:
-				finchan2 <- true
-				ticker.Stop()
-
-				break loop2
-			default:
-				//				fmt.Printf("finchan %s = %d\n", fmt.Sprint(finchan), len(finchan))
-			}
+func TestCallbackPanics(t *testing.T) {
+	server := startCounterServer(t)
+
+	// a panic in a call is returned to the caller
+	_, err := server.Call(context.Background(), panicNow{})
+	if err == nil || !strings.Contains(err.Error(), "call panics") {
+		t.Errorf("Expected the panic to be returned as error, got %v", err)
+	}
+
+	// a panic in a cast is reported to the error handler
+	if err = server.Cast(panicNow{}); err != nil {
+		t.Fatalf("Failed to cast. err=%v", err)
+	}
+	select {
+	case err = <-server.errors:
+		if !strings.Contains(err.Error(), "cast panics") {
+			t.Errorf("Expected the panic to be reported, got %v", err)
 		}
+	case <-time.After(testWaitTime):
+		t.Fatalf("Panic in cast was not reported")
+	}
 
-		waitGrp.Wait()
+	// the server survives the panics
+	server.Cast(addToCounter{3})
+	expectCounter(t, server, 3)
+	if err = server.Stop_server(); err != nil {
+		t.Errorf("Failed to stop server. err=%v", err)
 	}
 }
 
-func heartBeatChecker(p *example_part, timechan <-chan time.Time, finchan chan bool, waitGrp *sync.WaitGroup) {
-	defer waitGrp.Done()
-loop:
-	for {
-		for now := range timechan {
-			select {
-			case <-finchan:
-				break loop
-			default:
-				if !p.HeartBeat() {
-					//yell
-					fmt.Printf("Part %s is dead\n", p.Id())
-				} else {
-					fmt.Printf("%s - All well\n", fmt.Sprint(now))
-				}
+func TestHeartBeat(t *testing.T) {
+	server := startCounterServer(t)
+	for i := 0; i < 3; i++ {
+		if !server.HeartBeat_sync() {
+			t.Fatalf("Server did not respond to heart beat")
+		}
+	}
 
-			}
+	respch := make(chan []interface{}, 1)
+	if err := server.HeartBeat_async(respch, time.Now()); err != nil {
+		t.Fatalf("Failed to send heart beat. err=%v", err)
+	}
+	select {
+	case resp := <-respch:
+		if !resp[0].(bool) {
+			t.Errorf("Unexpected heart beat response %v", resp)
 		}
+	case <-time.After(testWaitTime):
+		t.Fatalf("Server did not respond to heart beat")
 	}
 
+	server.Stop_server()
+	if server.HeartBeat_sync() {
+		t.Errorf("Stopped server responded to heart beat")
+	}
 }
 
-func lifeKiller(p *example_part, finchan chan bool, lifespan time.Duration, t *testing.T, waitGrp *sync.WaitGroup) {
-	defer waitGrp.Done()
-	time.Sleep(lifespan)
+func TestResponsive(t *testing.T) {
+	server := startCounterServer(t)
+	if !server.Responsive(testWaitTime) {
+		t.Fatalf("Idle server is not responsive")
+	}
 
-	fmt.Println("Wakeup to kill")
+	// the server routine does not take heart beats while a callback is running
+	done := make(chan struct{})
+	go func() {
+		server.Call(context.Background(), sleep{500 * time.Millisecond})
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if server.Responsive(50 * time.Millisecond) {
+		t.Errorf("Busy server is responsive")
+	}
+	<-done
+	if !server.Responsive(testWaitTime) {
+		t.Errorf("Server is not responsive after the callback returns")
+	}
 
-	err := p.Stop()
-	if err != nil {
-		t.Errorf("Failed to stop %s", p.Id())
+	server.Stop_server()
+	if server.Responsive(50 * time.Millisecond) {
+		t.Errorf("Stopped server is responsive")
 	}
-	finchan <- true
-	fmt.Println("Killer is done")
 }
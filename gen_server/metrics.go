@@ -0,0 +1,243 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package gen_server
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+//upper bounds of the buckets of duration histograms. durations beyond the last bound go to an overflow bucket
+var histogramBounds = []time.Duration{100 * time.Microsecond, time.Millisecond, 10 * time.Millisecond,
+	100 * time.Millisecond, time.Second, 10 * time.Second}
+var histogramLabels = []string{"le_100us", "le_1ms", "le_10ms", "le_100ms", "le_1s", "le_10s", "inf"}
+
+//separates the group, e.g., the replication topic, from the id of a server in metrics names
+const MetricsNameDelimiter = "/"
+
+//MetricsName is the name of the metrics of server id in group, e.g., of a part in a pipeline
+func MetricsName(group string, id string) string {
+	return group + MetricsNameDelimiter + id
+}
+
+/************************************
+/* struct Histogram
+*************************************/
+//Histogram counts durations in buckets with fixed bounds. It is not thread safe
+type Histogram struct {
+	counts []uint64
+	count  uint64
+	sum    time.Duration
+	max    time.Duration
+}
+
+func newHistogram() *Histogram {
+	return &Histogram{counts: make([]uint64, len(histogramLabels))}
+}
+
+func (h *Histogram) Observe(d time.Duration) {
+	i := 0
+	for i < len(histogramBounds) && d > histogramBounds[i] {
+		i++
+	}
+	h.counts[i]++
+	h.count++
+	h.sum += d
+	if d > h.max {
+		h.max = d
+	}
+}
+
+//HistogramSnapshot is the state of a histogram at a point in time, with durations in milliseconds.
+//Buckets are keyed by their upper bounds, e.g., le_10ms, and are not cumulative
+type HistogramSnapshot struct {
+	Count   uint64            `json:"count"`
+	SumMs   float64           `json:"sum_ms"`
+	MaxMs   float64           `json:"max_ms"`
+	Buckets map[string]uint64 `json:"buckets"`
+}
+
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	buckets := make(map[string]uint64)
+	for i, label := range histogramLabels {
+		buckets[label] = h.counts[i]
+	}
+	return HistogramSnapshot{Count: h.count,
+		SumMs:   toMs(h.sum),
+		MaxMs:   toMs(h.max),
+		Buckets: buckets}
+}
+
+func toMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+/************************************
+/* struct ServerMetrics
+*************************************/
+//ServerMetrics instruments the run loop of a GenServer: the depth of its mailbox, how long
+//commands wait in the mailbox before they are handled, how long the callbacks take, the latency
+//of heartbeats and the time since the last command
+type ServerMetrics struct {
+	name    string
+	mailbox chan *command
+
+	//the deepest the mailbox has been when a command is taken from it
+	max_mailbox_depth int
+	//number of commands handled
+	commands uint64
+	//time since the last command is computed from it
+	last_command time.Time
+
+	queue_wait         *Histogram
+	callback_durations map[commandType]*Histogram
+	heartbeat_latency  *Histogram
+	lock               sync.Mutex
+}
+
+func newServerMetrics(name string, mailbox chan *command) *ServerMetrics {
+	return &ServerMetrics{name: name,
+		mailbox:            mailbox,
+		last_command:       time.Now(),
+		queue_wait:         newHistogram(),
+		callback_durations: make(map[commandType]*Histogram),
+		heartbeat_latency:  newHistogram()}
+}
+
+func (m *ServerMetrics) Name() string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.name
+}
+
+func (m *ServerMetrics) setName(name string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.name = name
+}
+
+//called when the server routine takes cmd from the mailbox
+func (m *ServerMetrics) commandReceived(cmd *command) {
+	now := time.Now()
+	depth := len(m.mailbox) + 1
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if depth > m.max_mailbox_depth {
+		m.max_mailbox_depth = depth
+	}
+	m.commands++
+	m.last_command = now
+	m.queue_wait.Observe(now.Sub(cmd.timestamp))
+}
+
+func (m *ServerMetrics) callbackDone(cmd commandType, duration time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	histogram, ok := m.callback_durations[cmd]
+	if !ok {
+		histogram = newHistogram()
+		m.callback_durations[cmd] = histogram
+	}
+	histogram.Observe(duration)
+}
+
+func (m *ServerMetrics) heartBeatResponded(latency time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.heartbeat_latency.Observe(latency)
+}
+
+//MetricsSnapshot is the state of the metrics of a server at a point in time.
+//Callback durations are keyed by command type, e.g., call, cast or msg
+type MetricsSnapshot struct {
+	Name               string                       `json:"name"`
+	MailboxDepth       int                          `json:"mailbox_depth"`
+	MailboxCapacity    int                          `json:"mailbox_capacity"`
+	MaxMailboxDepth    int                          `json:"max_mailbox_depth"`
+	Commands           uint64                       `json:"commands"`
+	SinceLastCommandMs float64                      `json:"since_last_command_ms"`
+	QueueWait          HistogramSnapshot            `json:"queue_wait"`
+	CallbackDurations  map[string]HistogramSnapshot `json:"callback_durations"`
+	HeartbeatLatency   HistogramSnapshot            `json:"heartbeat_latency"`
+}
+
+func (m *ServerMetrics) Snapshot() *MetricsSnapshot {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	callbackDurations := make(map[string]HistogramSnapshot)
+	for cmd, histogram := range m.callback_durations {
+		callbackDurations[cmd.String()] = histogram.Snapshot()
+	}
+	return &MetricsSnapshot{Name: m.name,
+		MailboxDepth:       len(m.mailbox),
+		MailboxCapacity:    cap(m.mailbox),
+		MaxMailboxDepth:    m.max_mailbox_depth,
+		Commands:           m.commands,
+		SinceLastCommandMs: toMs(time.Since(m.last_command)),
+		QueueWait:          m.queue_wait.Snapshot(),
+		CallbackDurations:  callbackDurations,
+		HeartbeatLatency:   m.heartbeat_latency.Snapshot()}
+}
+
+/************************************
+/* struct MetricsRegistry
+*************************************/
+//MetricsRegistry holds the metrics of the running servers, keyed by name. A server is registered
+//when it starts and unregistered when it stops
+type MetricsRegistry struct {
+	metrics map[string]*ServerMetrics
+	lock    sync.RWMutex
+}
+
+//the registry that the servers register with
+var DefaultMetricsRegistry = NewMetricsRegistry()
+
+func NewMetricsRegistry() *MetricsRegistry {
+	return &MetricsRegistry{metrics: make(map[string]*ServerMetrics)}
+}
+
+//Register registers the metrics under their name, replacing the metrics registered under the same name
+func (registry *MetricsRegistry) Register(m *ServerMetrics) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	registry.metrics[m.Name()] = m
+}
+
+//Unregister unregisters the metrics, if they are still the ones registered under their name
+func (registry *MetricsRegistry) Unregister(m *ServerMetrics) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	if registry.metrics[m.Name()] == m {
+		delete(registry.metrics, m.Name())
+	}
+}
+
+//Snapshots returns the snapshots of the metrics in group, keyed by the ids of the servers in group,
+//e.g., the snapshots of the parts of a pipeline keyed by part id. All metrics are returned, keyed
+//by their full names, when group is empty
+func (registry *MetricsRegistry) Snapshots(group string) map[string]*MetricsSnapshot {
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+
+	prefix := ""
+	if len(group) > 0 {
+		prefix = group + MetricsNameDelimiter
+	}
+	snapshots := make(map[string]*MetricsSnapshot)
+	for name, m := range registry.metrics {
+		if strings.HasPrefix(name, prefix) {
+			snapshots[name[len(prefix):]] = m.Snapshot()
+		}
+	}
+	return snapshots
+}
@@ -0,0 +1,77 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package gen_server
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram()
+	for _, d := range []time.Duration{50 * time.Microsecond, time.Millisecond, 5 * time.Millisecond, 20 * time.Second} {
+		h.Observe(d)
+	}
+	snapshot := h.Snapshot()
+	if snapshot.Count != 4 || snapshot.MaxMs != 20000 {
+		t.Errorf("Unexpected count %v or max %v", snapshot.Count, snapshot.MaxMs)
+	}
+	// the bounds are inclusive
+	expected := map[string]uint64{"le_100us": 1, "le_1ms": 1, "le_10ms": 1, "le_100ms": 0, "le_1s": 0, "le_10s": 0, "inf": 1}
+	for label, count := range expected {
+		if snapshot.Buckets[label] != count {
+			t.Errorf("Expected %v in bucket %v, got %v", count, label, snapshot.Buckets[label])
+		}
+	}
+}
+
+func TestServerMetrics(t *testing.T) {
+	server := newCounterServer()
+	server.SetMetricsName(MetricsName("test_group", "counter"))
+	if err := server.Start_server(); err != nil {
+		t.Fatalf("Failed to start server. err=%v", err)
+	}
+
+	for i := 0; i < 5; i++ {
+		server.Cast(addToCounter{1})
+	}
+	server.Call(context.Background(), sleep{20 * time.Millisecond})
+	if !server.HeartBeat_sync() {
+		t.Fatalf("Server did not respond to heart beat")
+	}
+
+	snapshots := DefaultMetricsRegistry.Snapshots("test_group")
+	snapshot, ok := snapshots["counter"]
+	if !ok {
+		t.Fatalf("Metrics are not registered, got %v", snapshots)
+	}
+	if snapshot.Commands != 6 || snapshot.QueueWait.Count != 6 || snapshot.MailboxCapacity != 1 {
+		t.Errorf("Unexpected commands %v, queue wait count %v or mailbox capacity %v", snapshot.Commands, snapshot.QueueWait.Count, snapshot.MailboxCapacity)
+	}
+	if casts := snapshot.CallbackDurations["cast"]; casts.Count != 5 {
+		t.Errorf("Expected 5 cast callbacks, got %v", casts.Count)
+	}
+	if calls := snapshot.CallbackDurations["call"]; calls.Count != 1 || calls.MaxMs < 20 || calls.Buckets["le_100ms"] != 1 {
+		t.Errorf("Unexpected call callback durations %v", calls)
+	}
+	if snapshot.HeartbeatLatency.Count != 1 {
+		t.Errorf("Expected 1 heart beat, got %v", snapshot.HeartbeatLatency.Count)
+	}
+	if snapshot.SinceLastCommandMs < 0 || snapshot.SinceLastCommandMs > float64(testWaitTime/time.Millisecond) {
+		t.Errorf("Unexpected time since last command %v", snapshot.SinceLastCommandMs)
+	}
+
+	// the metrics are unregistered once the server stops
+	server.Stop_server()
+	if _, ok := DefaultMetricsRegistry.Snapshots("test_group")["counter"]; ok {
+		t.Errorf("Metrics are still registered after the server stops")
+	}
+}
@@ -0,0 +1,302 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package gen_server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Xiaomei-Zhang/goxdcr/log"
+	"sync"
+	"time"
+)
+
+// which children a supervisor restarts when a child fails
+type RestartStrategy int
+
+const (
+	//only the failed child is restarted
+	OneForOne RestartStrategy = iota
+	//all children are restarted
+	OneForAll
+	//the failed child and the children added after it are restarted
+	RestForOne
+)
+
+func (strategy RestartStrategy) String() string {
+	switch strategy {
+	case OneForOne:
+		return "one_for_one"
+	case OneForAll:
+		return "one_for_all"
+	case RestForOne:
+		return "rest_for_one"
+	}
+	return fmt.Sprintf("unknown strategy %d", int(strategy))
+}
+
+var ErrorRestartLimitExceeded = errors.New("Restart limit of supervisor is exceeded.")
+var ErrorDuplicateChild = errors.New("Child with the same id has been added.")
+var ErrorUnknownChild = errors.New("Child is not supervised by the supervisor.")
+
+//ChildSpec describes how a supervisor starts and stops a child.
+//Start is also called for a child that is already running when the supervisor starts, and Stop
+//for a child that has already stopped, so both need to be no-ops in those cases
+type ChildSpec struct {
+	Id    string
+	Start func() error
+	Stop  func() error
+}
+
+//Escalation_Func is called with the id of the supervisor when it gives up restarting its children
+type Escalation_Func func(id string, err error)
+
+//reported failure of a child
+type childFailure struct {
+	id          string
+	err         error
+	report_time time.Time
+}
+
+/************************************
+/* struct Supervisor
+*************************************/
+//Supervisor restarts its children when they fail, according to its restart strategy. When the
+//children have been restarted more than max_restarts times within restart_window, it stops all
+//of them and escalates the failure instead. A supervisor can be the child of another supervisor,
+//which then restarts it, with all its children, on escalation.
+//Failures are handled on the supervisor's own routine, in the order they are reported
+type Supervisor struct {
+	GenServer
+	id             string
+	strategy       RestartStrategy
+	max_restarts   int
+	restart_window time.Duration
+	escalate       Escalation_Func
+
+	//children in the order they are started
+	children []*ChildSpec
+	//the last time each child is started. failures reported before it are stale, e.g., errors
+	//raised by a child while it is being stopped for a restart
+	start_times map[string]time.Time
+	//times of the restarts within the restart window
+	restarts []time.Time
+	//whether the supervisor has given up and escalated. failures are ignored till it is started again
+	escalated bool
+	lock      sync.RWMutex
+}
+
+//escalate is called when the restart limit is exceeded. It can be nil, in which case the failure is logged
+func NewSupervisor(id string, strategy RestartStrategy, max_restarts int, restart_window time.Duration,
+	escalate Escalation_Func, logger_context *log.LoggerContext) *Supervisor {
+	var cast_callback_func Cast_Callback_Func
+	sup := &Supervisor{GenServer: NewGenServer(nil, nil, nil, nil, logger_context, "Supervisor"),
+		id:             id,
+		strategy:       strategy,
+		max_restarts:   max_restarts,
+		restart_window: restart_window,
+		escalate:       escalate,
+		children:       make([]*ChildSpec, 0),
+		start_times:    make(map[string]time.Time)}
+	cast_callback_func = sup.handleFailure
+	sup.SetCastHandler(&cast_callback_func)
+	sup.SetMetricsName(id)
+	return sup
+}
+
+func (sup *Supervisor) Id() string {
+	return sup.id
+}
+
+//AddChild adds a child to be supervised. Children are started in the order they are added
+func (sup *Supervisor) AddChild(spec *ChildSpec) error {
+	sup.lock.Lock()
+	defer sup.lock.Unlock()
+	if sup.childIndex(spec.Id) >= 0 {
+		return ErrorDuplicateChild
+	}
+	sup.children = append(sup.children, spec)
+	return nil
+}
+
+//AddSupervisor adds a supervisor as a child, which escalates to this supervisor
+func (sup *Supervisor) AddSupervisor(child *Supervisor) error {
+	child.escalate = func(id string, err error) {
+		if reportErr := sup.ReportFailure(id, err); reportErr != nil {
+			sup.Logger().Errorf("Failed to report failure of supervisor %v to %v. err=%v\n", id, sup.id, reportErr)
+		}
+	}
+	return sup.AddChild(&ChildSpec{Id: child.Id(), Start: child.Start, Stop: child.Stop})
+}
+
+func (sup *Supervisor) HasChild(id string) bool {
+	sup.lock.RLock()
+	defer sup.lock.RUnlock()
+	return sup.childIndex(id) >= 0
+}
+
+//Start starts the children in order, and then the supervisor. If a child fails to start, the children
+//started before it are stopped
+func (sup *Supervisor) Start() error {
+	sup.lock.Lock()
+	sup.escalated = false
+	sup.restarts = nil
+	children := append([]*ChildSpec{}, sup.children...)
+	sup.lock.Unlock()
+
+	for i, child := range children {
+		if err := sup.startChild(child); err != nil {
+			sup.Logger().Errorf("Supervisor %v failed to start child %v. err=%v\n", sup.id, child.Id, err)
+			sup.stopChildren(children[:i])
+			return err
+		}
+	}
+	sup.Logger().Infof("Supervisor %v is started with %v children, strategy=%v\n", sup.id, len(children), sup.strategy)
+	return sup.Start_server()
+}
+
+//Stop stops the supervisor, and then its children in the reverse order they are started
+func (sup *Supervisor) Stop() error {
+	err := sup.Stop_server()
+	sup.lock.RLock()
+	children := append([]*ChildSpec{}, sup.children...)
+	sup.lock.RUnlock()
+	sup.stopChildren(children)
+	sup.Logger().Infof("Supervisor %v is stopped\n", sup.id)
+	return err
+}
+
+//ReportFailure reports the failure of a child, which is then handled on the supervisor's routine.
+//It does not wait for the supervisor, as a child may report failures while the supervisor is stopping it
+func (sup *Supervisor) ReportFailure(id string, err error) error {
+	if !sup.IsStarted() {
+		return ErrorServerNotStarted
+	}
+	failure := &childFailure{id: id, err: err, report_time: time.Now()}
+	go func() {
+		if castErr := sup.Cast(failure); castErr != nil {
+			sup.Logger().Errorf("Supervisor %v dropped failure of child %v. err=%v, castErr=%v\n", sup.id, id, err, castErr)
+		}
+	}()
+	return nil
+}
+
+func (sup *Supervisor) handleFailure(request interface{}) error {
+	failure := request.(*childFailure)
+	sup.lock.Lock()
+	defer sup.lock.Unlock()
+
+	if sup.escalated {
+		sup.Logger().Infof("Supervisor %v has escalated, ignore failure of child %v. err=%v\n", sup.id, failure.id, failure.err)
+		return nil
+	}
+	index := sup.childIndex(failure.id)
+	if index < 0 {
+		return ErrorUnknownChild
+	}
+	if failure.report_time.Before(sup.start_times[failure.id]) {
+		sup.Logger().Infof("Child %v of supervisor %v has been restarted since it reported failure. err=%v\n", failure.id, sup.id, failure.err)
+		return nil
+	}
+	sup.Logger().Errorf("Child %v of supervisor %v failed. err=%v\n", failure.id, sup.id, failure.err)
+
+	err := failure.err
+	for {
+		if !sup.allowRestart() {
+			sup.Logger().Errorf("Supervisor %v exceeded %v restarts in %v, escalating. err=%v\n", sup.id, sup.max_restarts, sup.restart_window, err)
+			sup.escalated = true
+			sup.stopChildren(sup.children)
+			if sup.escalate != nil {
+				//escalated on another routine, as the parent may stop this supervisor
+				go sup.escalate(sup.id, ErrorRestartLimitExceeded)
+			}
+			return nil
+		}
+
+		//a child that fails to start again counts as another failure
+		index, err = sup.restartChildren(sup.childrenToRestart(index), index)
+		if err == nil {
+			return nil
+		}
+	}
+}
+
+//check whether another restart is within the restart limit, and record it if it is
+func (sup *Supervisor) allowRestart() bool {
+	now := time.Now()
+	restarts := make([]time.Time, 0, len(sup.restarts)+1)
+	for _, restart := range sup.restarts {
+		if now.Sub(restart) < sup.restart_window {
+			restarts = append(restarts, restart)
+		}
+	}
+	sup.restarts = restarts
+	if len(sup.restarts) >= sup.max_restarts {
+		return false
+	}
+	sup.restarts = append(sup.restarts, now)
+	return true
+}
+
+//indexes of the children to restart for the failure of the child at index
+func (sup *Supervisor) childrenToRestart(index int) []int {
+	indexes := make([]int, 0)
+	for i := range sup.children {
+		if i == index || sup.strategy == OneForAll || (sup.strategy == RestForOne && i > index) {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
+
+//stop the children at indexes in reverse order, then start them in order. returns the index of
+//the child that fails to start, and the error
+func (sup *Supervisor) restartChildren(indexes []int, failed int) (int, error) {
+	children := make([]*ChildSpec, 0, len(indexes))
+	for _, i := range indexes {
+		children = append(children, sup.children[i])
+	}
+	sup.stopChildren(children)
+
+	for _, i := range indexes {
+		child := sup.children[i]
+		if err := sup.startChild(child); err != nil {
+			sup.Logger().Errorf("Supervisor %v failed to restart child %v. err=%v\n", sup.id, child.Id, err)
+			return i, err
+		}
+		sup.Logger().Infof("Supervisor %v restarted child %v\n", sup.id, child.Id)
+	}
+	return failed, nil
+}
+
+func (sup *Supervisor) startChild(child *ChildSpec) error {
+	err := child.Start()
+	if err == nil {
+		sup.start_times[child.Id] = time.Now()
+	}
+	return err
+}
+
+//stop the children in reverse order. errors are logged, so that the other children still get stopped
+func (sup *Supervisor) stopChildren(children []*ChildSpec) {
+	for i := len(children) - 1; i >= 0; i-- {
+		if err := children[i].Stop(); err != nil {
+			sup.Logger().Errorf("Supervisor %v failed to stop child %v. err=%v\n", sup.id, children[i].Id, err)
+		}
+	}
+}
+
+func (sup *Supervisor) childIndex(id string) int {
+	for i, child := range sup.children {
+		if child.Id == id {
+			return i
+		}
+	}
+	return -1
+}
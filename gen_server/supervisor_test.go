@@ -0,0 +1,181 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package gen_server
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+var errChildFailed = errors.New("child failed")
+
+// a child that counts how many times it is started and stopped
+type testChild struct {
+	id      string
+	running bool
+	starts  int
+	stops   int
+	lock    sync.Mutex
+}
+
+func (child *testChild) spec() *ChildSpec {
+	return &ChildSpec{Id: child.id, Start: child.start, Stop: child.stop}
+}
+
+func (child *testChild) start() error {
+	child.lock.Lock()
+	defer child.lock.Unlock()
+	if !child.running {
+		child.running = true
+		child.starts++
+	}
+	return nil
+}
+
+func (child *testChild) stop() error {
+	child.lock.Lock()
+	defer child.lock.Unlock()
+	if child.running {
+		child.running = false
+		child.stops++
+	}
+	return nil
+}
+
+func (child *testChild) counts() (int, int, bool) {
+	child.lock.Lock()
+	defer child.lock.Unlock()
+	return child.starts, child.stops, child.running
+}
+
+func newTestSupervisor(t *testing.T, strategy RestartStrategy, max_restarts int, escalate Escalation_Func, ids ...string) (*Supervisor, []*testChild) {
+	sup := NewSupervisor("test_supervisor", strategy, max_restarts, time.Minute, escalate, nil)
+	children := make([]*testChild, 0, len(ids))
+	for _, id := range ids {
+		child := &testChild{id: id}
+		if err := sup.AddChild(child.spec()); err != nil {
+			t.Fatalf("Failed to add child %v. err=%v", id, err)
+		}
+		children = append(children, child)
+	}
+	return sup, children
+}
+
+func waitFor(t *testing.T, desc string, cond func() bool) {
+	deadline := time.Now().Add(testWaitTime)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %v", desc)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func failChild(t *testing.T, sup *Supervisor, child *testChild) {
+	if err := sup.ReportFailure(child.id, errChildFailed); err != nil {
+		t.Fatalf("Failed to report failure. err=%v", err)
+	}
+}
+
+// wait till each child has been started the expected number of times, and is running
+func expectStarts(t *testing.T, children []*testChild, expected ...int) {
+	waitFor(t, "children to be restarted", func() bool {
+		for i, child := range children {
+			if starts, _, running := child.counts(); starts != expected[i] || !running {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func TestRestartStrategies(t *testing.T) {
+	for strategy, expected := range map[RestartStrategy][]int{OneForOne: {1, 2, 1}, OneForAll: {2, 2, 2}, RestForOne: {1, 2, 2}} {
+		sup, children := newTestSupervisor(t, strategy, 3, nil, "a", "b", "c")
+		if err := sup.Start(); err != nil {
+			t.Fatalf("Failed to start supervisor. err=%v", err)
+		}
+		expectStarts(t, children, 1, 1, 1)
+
+		failChild(t, sup, children[1])
+		expectStarts(t, children, expected...)
+
+		if err := sup.Stop(); err != nil {
+			t.Errorf("Failed to stop supervisor. err=%v", err)
+		}
+		for _, child := range children {
+			if _, _, running := child.counts(); running {
+				t.Errorf("Child %v is still running after supervisor %v stops", child.id, strategy)
+			}
+		}
+	}
+}
+
+func TestRestartLimit(t *testing.T) {
+	escalations := make(chan error, 1)
+	sup, children := newTestSupervisor(t, OneForOne, 2, func(id string, err error) { escalations <- err }, "a", "b")
+	if err := sup.Start(); err != nil {
+		t.Fatalf("Failed to start supervisor. err=%v", err)
+	}
+	defer sup.Stop()
+
+	failChild(t, sup, children[0])
+	expectStarts(t, children, 2, 1)
+	failChild(t, sup, children[1])
+	expectStarts(t, children, 2, 2)
+	select {
+	case err := <-escalations:
+		t.Fatalf("Escalated within restart limit. err=%v", err)
+	default:
+	}
+
+	// the third restart within the window exceeds the limit
+	sup.ReportFailure("a", errChildFailed)
+	select {
+	case err := <-escalations:
+		if err != ErrorRestartLimitExceeded {
+			t.Errorf("Expected %v, got %v", ErrorRestartLimitExceeded, err)
+		}
+	case <-time.After(testWaitTime):
+		t.Fatalf("Supervisor did not escalate")
+	}
+	for _, child := range children {
+		if _, _, running := child.counts(); running {
+			t.Errorf("Child %v is still running after escalation", child.id)
+		}
+	}
+}
+
+func TestNestedSupervisor(t *testing.T) {
+	parent, siblings := newTestSupervisor(t, OneForOne, 1, nil, "sibling")
+	// the child supervisor gives up on the first failure, and is restarted by the parent
+	child, children := newTestSupervisor(t, OneForOne, 0, nil, "a", "b")
+	child.id = "child_supervisor"
+	if err := parent.AddSupervisor(child); err != nil {
+		t.Fatalf("Failed to add child supervisor. err=%v", err)
+	}
+	if err := parent.AddSupervisor(child); err != ErrorDuplicateChild {
+		t.Errorf("Expected %v, got %v", ErrorDuplicateChild, err)
+	}
+	if err := parent.Start(); err != nil {
+		t.Fatalf("Failed to start supervisor. err=%v", err)
+	}
+	defer parent.Stop()
+	if !child.IsStarted() {
+		t.Fatalf("Child supervisor is not started")
+	}
+
+	failChild(t, child, children[0])
+	// all children of the child supervisor are restarted with it, and its siblings are left alone
+	expectStarts(t, children, 2, 2)
+	expectStarts(t, siblings, 1)
+}
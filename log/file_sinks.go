@@ -0,0 +1,102 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package log
+
+import (
+	"io"
+	"sync"
+)
+
+// FileSinkConfig tells which files the log streams are written to, and how the files are rotated
+type FileSinkConfig struct {
+	// file of the process-wide loggers. Logs go to stdout when it is empty
+	LogFile string
+	// file of the admin and audit stream, i.e., the loggers of the rest service. defaults to LogFile
+	AdminLogFile string
+	// file of the loggers of pipelines. defaults to LogFile
+	PipelineLogFile string
+	// file that the messages at error level of all streams are also written to. none if it is empty
+	ErrorLogFile string
+	Rotation     RotationConfig
+}
+
+// the files opened by ConfigureFileSinks, keyed by path
+var file_sinks = make(map[string]*RotatingFile)
+var file_sinks_lock sync.Mutex
+
+// ConfigureFileSinks opens the files in config, and points DefaultLoggerContext, AdminLoggerContext
+// and PipelineLoggerContext to them. Streams that go to the same file share one RotatingFile. It needs
+// to be called before loggers and pipelines are created with the contexts
+func ConfigureFileSinks(config *FileSinkConfig) error {
+	file_sinks_lock.Lock()
+	defer file_sinks_lock.Unlock()
+
+	sink := func(path string) (io.Writer, error) {
+		if rf, ok := file_sinks[path]; ok {
+			return rf, nil
+		}
+		rf, err := NewRotatingFile(path, config.Rotation)
+		if err != nil {
+			return nil, err
+		}
+		file_sinks[path] = rf
+		return rf, nil
+	}
+
+	logFile := DefaultLoggerContext.Log_file
+	if len(config.LogFile) > 0 {
+		writer, err := sink(config.LogFile)
+		if err != nil {
+			return err
+		}
+		logFile = writer
+	}
+	adminFile, pipelineFile := logFile, logFile
+	if len(config.AdminLogFile) > 0 {
+		writer, err := sink(config.AdminLogFile)
+		if err != nil {
+			return err
+		}
+		adminFile = writer
+	}
+	if len(config.PipelineLogFile) > 0 {
+		writer, err := sink(config.PipelineLogFile)
+		if err != nil {
+			return err
+		}
+		pipelineFile = writer
+	}
+	var errorFile io.Writer
+	if len(config.ErrorLogFile) > 0 {
+		writer, err := sink(config.ErrorLogFile)
+		if err != nil {
+			return err
+		}
+		errorFile = writer
+	}
+
+	DefaultLoggerContext.Log_file = logFile
+	AdminLoggerContext.Log_file = adminFile
+	PipelineLoggerContext.Log_file = pipelineFile
+	for _, ctx := range []*LoggerContext{DefaultLoggerContext, AdminLoggerContext, PipelineLoggerContext} {
+		ctx.Error_file = errorFile
+	}
+	return nil
+}
+
+// CloseFileSinks closes the files opened by ConfigureFileSinks
+func CloseFileSinks() {
+	file_sinks_lock.Lock()
+	defer file_sinks_lock.Unlock()
+	for path, rf := range file_sinks {
+		rf.Close()
+		delete(file_sinks, path)
+	}
+}
@@ -10,11 +10,17 @@
 package log
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 type LogLevel int
@@ -36,44 +42,151 @@ const (
 	LOG_LEVEL_TRACE_STR string = "Trace"
 )
 
+type LogFormat int
+
+const (
+	// free text prefixed with the module, with the fields appended as key=value
+	LogFormatText LogFormat = iota
+	// one line of key=value pairs per message
+	LogFormatLogfmt
+	// one json object per message
+	LogFormatJSON
+)
+
+const (
+	LOG_FORMAT_TEXT_STR   string = "text"
+	LOG_FORMAT_LOGFMT_STR string = "logfmt"
+	LOG_FORMAT_JSON_STR   string = "json"
+)
+
+// keys of the fields that loggers carry as context
+const (
+	FIELD_TOPIC          = "topic"
+	FIELD_PART_ID        = "part_id"
+	FIELD_VBUCKET        = "vbno"
+	FIELD_REPLICATION_ID = "replication_id"
+)
+
+// Fields are key/value pairs logged along with messages
+type Fields map[string]interface{}
+
 type CommonLogger struct {
-	logger  *log.Logger
+	module  string
 	context *LoggerContext
+	// fields of the logger on top of the fields of its context, e.g., the id of a part
+	fields Fields
 }
 
 type LoggerContext struct {
-	Log_file  io.Writer
-	Log_level LogLevel
+	Log_file io.Writer
+	// error stream, which messages at error level are also written to. nil if there is none
+	Error_file io.Writer
+	Log_level  LogLevel
+	Log_format LogFormat
+	// fields logged with everything logged under the context, e.g., the topic of a pipeline
+	Fields Fields
 }
 
 func CopyCtx(ctx_to_copy *LoggerContext) *LoggerContext {
+	fields := make(Fields)
+	for key, val := range ctx_to_copy.Fields {
+		fields[key] = val
+	}
 	return &LoggerContext{Log_file: ctx_to_copy.Log_file,
-		Log_level: ctx_to_copy.Log_level}
+		Error_file: ctx_to_copy.Error_file,
+		Log_level:  ctx_to_copy.Log_level,
+		Log_format: ctx_to_copy.Log_format,
+		Fields:     fields}
 }
 
-var DefaultLoggerContext = &LoggerContext{os.Stdout, LogLevelInfo}
+// context of the process-wide loggers
+var DefaultLoggerContext = &LoggerContext{Log_file: os.Stdout, Log_level: LogLevelInfo, Log_format: LogFormatText}
+
+// context of the loggers of the rest service, which log the requests and who made them
+var AdminLoggerContext = &LoggerContext{Log_file: os.Stdout, Log_level: LogLevelInfo, Log_format: LogFormatText}
+
+// context that the logger contexts of pipelines are copied from
+var PipelineLoggerContext = &LoggerContext{Log_file: os.Stdout, Log_level: LogLevelInfo, Log_format: LogFormatText}
+
+// serializes the messages written to log files
+var write_lock sync.Mutex
 
 func NewLogger(module string, logger_context *LoggerContext) *CommonLogger {
 	context := DefaultLoggerContext
 	if logger_context != nil {
 		context = logger_context
 	}
-	l := log.New(context.Log_file, module, log.Lmicroseconds)
-	return &CommonLogger{l, context}
+	return &CommonLogger{module: module, context: context}
+}
+
+// With returns a logger that logs the key/value pairs in keyvals, e.g., log.FIELD_VBUCKET, vbno,
+// on top of the fields of l. The returned logger shares the context of l
+func (l *CommonLogger) With(keyvals ...interface{}) *CommonLogger {
+	fields := make(Fields)
+	for key, val := range l.fields {
+		fields[key] = val
+	}
+	for _, field := range toFields(keyvals) {
+		fields[field.key] = field.val
+	}
+	return &CommonLogger{module: l.module, context: l.context, fields: fields}
+}
+
+// SetField sets a field on l, which is logged by all users of l, e.g., the part and the gen_server
+// that share the logger. It needs to be set before l is in use
+func (l *CommonLogger) SetField(key string, val interface{}) {
+	fields := make(Fields)
+	for k, v := range l.fields {
+		fields[k] = v
+	}
+	fields[key] = val
+	l.fields = fields
+}
+
+// whether messages at level are logged, by the log level of the module of l if it is overridden,
+// or else by the log level of the context of l
+func (l *CommonLogger) enabled(level LogLevel) bool {
+	if moduleLevel, ok := moduleLogLevel(l.module); ok {
+		return moduleLevel >= level
+	}
+	return l.context.Log_level >= level
 }
 
 func (l *CommonLogger) logMsgf(level LogLevel, prefix string, format string, v ...interface{}) {
-	if l.context.Log_level >= level {
-		l.logger.Printf(prefix + format, v...)
+	if l.enabled(level) {
+		l.output(level, prefix, fmt.Sprintf(format, v...), nil)
 	}
 }
 
 func (l *CommonLogger) logMsg(level LogLevel, prefix string, msg string) {
-	if l.context.Log_level >= level {
-		l.logger.Println(prefix + msg)
+	if l.enabled(level) {
+		l.output(level, prefix, msg, nil)
 	}
 }
 
+func (l *CommonLogger) logMsgw(level LogLevel, prefix string, msg string, keyvals []interface{}) {
+	if l.enabled(level) {
+		l.output(level, prefix, msg, keyvals)
+	}
+}
+
+// Infow logs msg with the key/value pairs in keyvals, e.g., Infow("Stream is opened", log.FIELD_VBUCKET, vbno)
+func (l *CommonLogger) Infow(msg string, keyvals ...interface{}) {
+	l.logMsgw(LogLevelInfo, "[INFO] ", msg, keyvals)
+}
+
+func (l *CommonLogger) Debugw(msg string, keyvals ...interface{}) {
+	l.logMsgw(LogLevelDebug, "[DEBUG] ", msg, keyvals)
+}
+
+func (l *CommonLogger) Tracew(msg string, keyvals ...interface{}) {
+	l.logMsgw(LogLevelTrace, "[TRACE] ", msg, keyvals)
+}
+
+func (l *CommonLogger) Errorw(msg string, keyvals ...interface{}) {
+	l.logMsgw(LogLevelError, "[ERROR] ", msg, keyvals)
+}
+
 func (l *CommonLogger) Infof(format string, v ...interface{}) {
 	l.logMsgf(LogLevelInfo, "[INFO] ", format, v...)
 }
@@ -110,6 +223,159 @@ func (l *CommonLogger) LoggerContext() *LoggerContext {
 	return l.context
 }
 
+type field struct {
+	key string
+	val interface{}
+}
+
+// fields from key/value pairs. A key without value is logged with nil value
+func toFields(keyvals []interface{}) []field {
+	fields := make([]field, 0, (len(keyvals)+1)/2)
+	for i := 0; i < len(keyvals); i += 2 {
+		key, ok := keyvals[i].(string)
+		if !ok {
+			key = fmt.Sprint(keyvals[i])
+		}
+		var val interface{}
+		if i+1 < len(keyvals) {
+			val = keyvals[i+1]
+		}
+		fields = append(fields, field{key, val})
+	}
+	return fields
+}
+
+// fields of the context, then of the logger, in the order of their keys, then keyvals. Fields
+// override earlier fields with the same key
+func (l *CommonLogger) allFields(keyvals []interface{}) []field {
+	fields := []field{}
+	index := make(map[string]int)
+	add := func(f field) {
+		if i, ok := index[f.key]; ok {
+			fields[i] = f
+		} else {
+			index[f.key] = len(fields)
+			fields = append(fields, f)
+		}
+	}
+	for _, fieldMap := range []Fields{l.context.Fields, l.fields} {
+		keys := make([]string, 0, len(fieldMap))
+		for key, _ := range fieldMap {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			add(field{key, fieldMap[key]})
+		}
+	}
+	for _, f := range toFields(keyvals) {
+		add(f)
+	}
+	return fields
+}
+
+func (l *CommonLogger) output(level LogLevel, prefix string, msg string, keyvals []interface{}) {
+	fields := l.allFields(keyvals)
+	msg = strings.TrimSuffix(msg, "\n")
+	var line []byte
+	switch l.context.Log_format {
+	case LogFormatLogfmt:
+		line = formatLogfmt(time.Now(), level, l.module, msg, fields)
+	case LogFormatJSON:
+		line = formatJSON(time.Now(), level, l.module, msg, fields)
+	default:
+		line = formatText(time.Now(), prefix, l.module, msg, fields)
+	}
+	l.write(level, line)
+}
+
+func (l *CommonLogger) write(level LogLevel, line []byte) {
+	write_lock.Lock()
+	defer write_lock.Unlock()
+	l.context.Log_file.Write(line)
+	if level == LogLevelError && l.context.Error_file != nil {
+		l.context.Error_file.Write(line)
+	}
+}
+
+// module, time and message, e.g., "XmemNozzle15:04:05.000000 [INFO] msg", followed by the fields
+func formatText(t time.Time, prefix string, module string, msg string, fields []field) []byte {
+	var buffer bytes.Buffer
+	buffer.WriteString(module)
+	buffer.WriteString(t.Format("15:04:05.000000 "))
+	buffer.WriteString(prefix)
+	buffer.WriteString(msg)
+	for _, f := range fields {
+		buffer.WriteString(" ")
+		writeLogfmtPair(&buffer, f.key, f.val)
+	}
+	buffer.WriteString("\n")
+	return buffer.Bytes()
+}
+
+const time_format = "2006-01-02T15:04:05.000000Z07:00"
+
+func formatLogfmt(t time.Time, level LogLevel, module string, msg string, fields []field) []byte {
+	var buffer bytes.Buffer
+	writeLogfmtPair(&buffer, "time", t.Format(time_format))
+	buffer.WriteString(" ")
+	writeLogfmtPair(&buffer, "level", strings.ToLower(level.String()))
+	buffer.WriteString(" ")
+	writeLogfmtPair(&buffer, "module", module)
+	for _, f := range fields {
+		buffer.WriteString(" ")
+		writeLogfmtPair(&buffer, f.key, f.val)
+	}
+	buffer.WriteString(" ")
+	writeLogfmtPair(&buffer, "msg", msg)
+	buffer.WriteString("\n")
+	return buffer.Bytes()
+}
+
+// key=value, where value is quoted when it is empty or has spaces, quotes or equal signs
+func writeLogfmtPair(buffer *bytes.Buffer, key string, val interface{}) {
+	buffer.WriteString(key)
+	buffer.WriteString("=")
+	str := fmt.Sprint(val)
+	if len(str) == 0 || strings.ContainsAny(str, " \t\r\n\"=") {
+		str = strconv.Quote(str)
+	}
+	buffer.WriteString(str)
+}
+
+func formatJSON(t time.Time, level LogLevel, module string, msg string, fields []field) []byte {
+	var buffer bytes.Buffer
+	buffer.WriteString("{")
+	writeJSONPair(&buffer, "time", t.Format(time_format))
+	buffer.WriteString(",")
+	writeJSONPair(&buffer, "level", strings.ToLower(level.String()))
+	buffer.WriteString(",")
+	writeJSONPair(&buffer, "module", module)
+	buffer.WriteString(",")
+	writeJSONPair(&buffer, "msg", msg)
+	for _, f := range fields {
+		buffer.WriteString(",")
+		writeJSONPair(&buffer, f.key, f.val)
+	}
+	buffer.WriteString("}\n")
+	return buffer.Bytes()
+}
+
+// values that can't be marshalled, e.g., errors, are logged as strings
+func writeJSONPair(buffer *bytes.Buffer, key string, val interface{}) {
+	keyBytes, _ := json.Marshal(key)
+	buffer.Write(keyBytes)
+	buffer.WriteString(":")
+	if err, ok := val.(error); ok {
+		val = err.Error()
+	}
+	valBytes, err := json.Marshal(val)
+	if err != nil {
+		valBytes, _ = json.Marshal(fmt.Sprint(val))
+	}
+	buffer.Write(valBytes)
+}
+
 func LogLevelFromStr(levelStr string) (LogLevel, error) {
 	var level LogLevel
 	switch levelStr {
@@ -127,6 +393,30 @@ func LogLevelFromStr(levelStr string) (LogLevel, error) {
 	return level, nil
 }
 
+func LogFormatFromStr(formatStr string) (LogFormat, error) {
+	switch formatStr {
+	case LOG_FORMAT_TEXT_STR:
+		return LogFormatText, nil
+	case LOG_FORMAT_LOGFMT_STR:
+		return LogFormatLogfmt, nil
+	case LOG_FORMAT_JSON_STR:
+		return LogFormatJSON, nil
+	}
+	return -1, errors.New(fmt.Sprintf("%v is not a valid log format", formatStr))
+}
+
+func (format LogFormat) String() string {
+	switch format {
+	case LogFormatText:
+		return LOG_FORMAT_TEXT_STR
+	case LogFormatLogfmt:
+		return LOG_FORMAT_LOGFMT_STR
+	case LogFormatJSON:
+		return LOG_FORMAT_JSON_STR
+	}
+	return ""
+}
+
 func (level LogLevel) String() string {
 	switch level {
 	case LogLevelError:
@@ -0,0 +1,115 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestStructuredLogging(t *testing.T) {
+	var buffer bytes.Buffer
+	ctx := CopyCtx(&LoggerContext{Log_file: &buffer, Log_level: LogLevelInfo})
+	ctx.Fields[FIELD_TOPIC] = "repl 1"
+	logger := NewLogger("XmemNozzle", ctx)
+	logger.SetField(FIELD_PART_ID, "xmem_1")
+
+	// text
+	logger.With(FIELD_VBUCKET, 12).Infof("Batch is sent, count=%v\n", 3)
+	if line := buffer.String(); !strings.HasSuffix(line, `[INFO] Batch is sent, count=3 topic="repl 1" part_id=xmem_1 vbno=12`+"\n") {
+		t.Errorf("Unexpected text line %q", line)
+	}
+
+	// logfmt
+	buffer.Reset()
+	ctx.Log_format = LogFormatLogfmt
+	logger.Errorw("Send failed", "err", errors.New("connection reset"))
+	line := buffer.String()
+	if !strings.Contains(line, ` level=error module=XmemNozzle topic="repl 1" part_id=xmem_1 err="connection reset" msg="Send failed"`) {
+		t.Errorf("Unexpected logfmt line %q", line)
+	}
+
+	// json
+	buffer.Reset()
+	ctx.Log_format = LogFormatJSON
+	logger.Infow("Stream is opened", FIELD_VBUCKET, 7)
+	entry := make(map[string]interface{})
+	if err := json.Unmarshal(buffer.Bytes(), &entry); err != nil {
+		t.Fatalf("Invalid json line %q, err=%v", buffer.String(), err)
+	}
+	expected := map[string]interface{}{"level": "info", "module": "XmemNozzle", "msg": "Stream is opened",
+		FIELD_TOPIC: "repl 1", FIELD_PART_ID: "xmem_1", FIELD_VBUCKET: float64(7)}
+	for key, val := range expected {
+		if entry[key] != val {
+			t.Errorf("Expected %v=%v, got %v", key, val, entry[key])
+		}
+	}
+
+	// messages over the log level are not logged
+	buffer.Reset()
+	logger.Debugw("Not logged")
+	if buffer.Len() != 0 {
+		t.Errorf("Debug message is logged at info level, %q", buffer.String())
+	}
+}
+
+func TestModuleLogLevels(t *testing.T) {
+	var buffer bytes.Buffer
+	ctx := &LoggerContext{Log_file: &buffer, Log_level: LogLevelInfo}
+	xmem := NewLogger("XmemNozzle", ctx)
+	dcp := NewLogger("DcpNozzle", ctx)
+
+	SetModuleLogLevel("XmemNozzle", LogLevelDebug)
+	defer ClearModuleLogLevel("XmemNozzle")
+	xmem.Debug("xmem debug")
+	dcp.Debug("dcp debug")
+	if !strings.Contains(buffer.String(), "xmem debug") || strings.Contains(buffer.String(), "dcp debug") {
+		t.Errorf("Unexpected output with module log level, %q", buffer.String())
+	}
+	if levels := ModuleLogLevels(); len(levels) != 1 || levels["XmemNozzle"] != LogLevelDebug {
+		t.Errorf("Unexpected module log levels %v", levels)
+	}
+
+	buffer.Reset()
+	ClearModuleLogLevel("XmemNozzle")
+	xmem.Debug("xmem debug")
+	if buffer.Len() != 0 {
+		t.Errorf("Module log level is not cleared, %q", buffer.String())
+	}
+}
+
+func TestRedaction(t *testing.T) {
+	defer SetRedactionMode(RedactionNone)
+
+	key := UserData([]byte("doc_1"))
+	if key.String() != "doc_1" {
+		t.Errorf("Expected user data as it is, got %v", key)
+	}
+	SetRedactionMode(RedactionTag)
+	if key.String() != "<ud>doc_1</ud>" {
+		t.Errorf("Expected tagged user data, got %v", key)
+	}
+	SetRedactionMode(RedactionHash)
+	// hex of sha1
+	if len(key.String()) != 40 || strings.Contains(key.String(), "doc_1") {
+		t.Errorf("Expected hashed user data, got %v", key)
+	}
+
+	// user data is redacted in json output too
+	var buffer bytes.Buffer
+	logger := NewLogger("Router", &LoggerContext{Log_file: &buffer, Log_level: LogLevelInfo, Log_format: LogFormatJSON})
+	logger.Infow("Data is filtered out", "key", key)
+	if strings.Contains(buffer.String(), "doc_1") {
+		t.Errorf("User data is logged, %q", buffer.String())
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package log
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// module -> log level that overrides the log levels of the contexts of the loggers of the module,
+// e.g., XmemNozzle -> Debug. The map is replaced on every change, so that loggers read it without locking
+var module_levels atomic.Value
+
+// serializes changes to module_levels
+var module_levels_lock sync.Mutex
+
+func init() {
+	module_levels.Store(make(map[string]LogLevel))
+}
+
+func moduleLogLevel(module string) (LogLevel, bool) {
+	level, ok := module_levels.Load().(map[string]LogLevel)[module]
+	return level, ok
+}
+
+// SetModuleLogLevel overrides the log level of all loggers of module, in all pipelines and
+// process-wide, till the override is cleared
+func SetModuleLogLevel(module string, level LogLevel) {
+	updateModuleLogLevels(func(levels map[string]LogLevel) {
+		levels[module] = level
+	})
+}
+
+// ClearModuleLogLevel removes the override of the log level of module, after which its loggers
+// go back to the log levels of their contexts
+func ClearModuleLogLevel(module string) {
+	updateModuleLogLevels(func(levels map[string]LogLevel) {
+		delete(levels, module)
+	})
+}
+
+// ModuleLogLevels returns the overridden log levels, keyed by module
+func ModuleLogLevels() map[string]LogLevel {
+	levels := make(map[string]LogLevel)
+	for module, level := range module_levels.Load().(map[string]LogLevel) {
+		levels[module] = level
+	}
+	return levels
+}
+
+func updateModuleLogLevels(update func(levels map[string]LogLevel)) {
+	module_levels_lock.Lock()
+	defer module_levels_lock.Unlock()
+	levels := ModuleLogLevels()
+	update(levels)
+	module_levels.Store(levels)
+}
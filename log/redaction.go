@@ -0,0 +1,102 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package log
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// RedactionMode is how user data, e.g., document keys and values, is logged
+type RedactionMode int32
+
+const (
+	// user data is logged as it is
+	RedactionNone RedactionMode = iota
+	// user data is logged wrapped in <ud></ud> tags, so that it can be removed from log files later
+	RedactionTag
+	// user data is replaced by its sha1 hash, which tells whether two messages are about the same
+	// data without showing the data
+	RedactionHash
+)
+
+const (
+	REDACTION_NONE_STR string = "none"
+	REDACTION_TAG_STR  string = "tag"
+	REDACTION_HASH_STR string = "hash"
+)
+
+var redaction_mode int32 = int32(RedactionNone)
+
+func SetRedactionMode(mode RedactionMode) {
+	atomic.StoreInt32(&redaction_mode, int32(mode))
+}
+
+func GetRedactionMode() RedactionMode {
+	return RedactionMode(atomic.LoadInt32(&redaction_mode))
+}
+
+func RedactionModeFromStr(modeStr string) (RedactionMode, error) {
+	switch modeStr {
+	case REDACTION_NONE_STR:
+		return RedactionNone, nil
+	case REDACTION_TAG_STR:
+		return RedactionTag, nil
+	case REDACTION_HASH_STR:
+		return RedactionHash, nil
+	}
+	return -1, errors.New(fmt.Sprintf("%v is not a valid redaction mode", modeStr))
+}
+
+func (mode RedactionMode) String() string {
+	switch mode {
+	case RedactionNone:
+		return REDACTION_NONE_STR
+	case RedactionTag:
+		return REDACTION_TAG_STR
+	case RedactionHash:
+		return REDACTION_HASH_STR
+	}
+	return ""
+}
+
+// userData is user data that is redacted, by the redaction mode at the time it is logged
+type userData struct {
+	data interface{}
+}
+
+// UserData marks data, e.g., a document key, as user data, which is redacted wherever it is logged,
+// e.g., logger.Debugf("key=%v", log.UserData(key)). []byte is logged as string
+func UserData(data interface{}) fmt.Stringer {
+	if bytes, ok := data.([]byte); ok {
+		data = string(bytes)
+	}
+	return &userData{data}
+}
+
+func (ud *userData) String() string {
+	str := fmt.Sprint(ud.data)
+	switch GetRedactionMode() {
+	case RedactionTag:
+		return "<ud>" + str + "</ud>"
+	case RedactionHash:
+		hash := sha1.Sum([]byte(str))
+		return hex.EncodeToString(hash[:])
+	}
+	return str
+}
+
+func (ud *userData) MarshalJSON() ([]byte, error) {
+	return json.Marshal(ud.String())
+}
@@ -0,0 +1,259 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package log
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrorRotatingFileClosed = errors.New("Rotating file is closed")
+
+// suffix of rotated files, which is the time of the rotation
+const rotated_time_format = "20060102T150405.000000"
+
+const compressed_suffix = ".gz"
+
+// how long to wait before trying again after a rotation fails
+var rotation_retry_interval = time.Minute
+
+// RotationConfig tells when a log file is rotated, and which of the rotated files are kept
+type RotationConfig struct {
+	// the file is rotated when it would grow over MaxSize bytes. 0 for no limit
+	MaxSize int64
+	// the file is rotated when it has been written to for RotateInterval. 0 for no limit
+	RotateInterval time.Duration
+	// whether rotated files are compressed with gzip
+	Compress bool
+	// number of rotated files that are kept. 0 for no limit
+	MaxFiles int
+	// rotated files older than MaxAge are removed. 0 for no limit
+	MaxAge time.Duration
+}
+
+/************************************
+/* struct RotatingFile
+*************************************/
+// RotatingFile is a log file that is renamed to <path>.<time of rotation> and replaced by a new
+// file when it gets too big or too old. Rotated files are compressed and removed in the background.
+// It is thread safe
+type RotatingFile struct {
+	path   string
+	config RotationConfig
+	file   *os.File
+	size   int64
+	// when the current file was opened
+	opened time.Time
+	// no rotation is tried before then, after a rotation has failed
+	retry_rotation time.Time
+	closed         bool
+	lock           sync.Mutex
+	// serializes the compression and removal of rotated files
+	cleanup_lock sync.Mutex
+	cleanup_wait sync.WaitGroup
+}
+
+func NewRotatingFile(path string, config RotationConfig) (*RotatingFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	rf := &RotatingFile{path: path, config: config}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+// open the file at path for appending. A file that is already there is carried on with
+func (rf *RotatingFile) open() error {
+	file, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	rf.file = file
+	rf.size = info.Size()
+	rf.opened = time.Now()
+	return nil
+}
+
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+	if rf.closed {
+		return 0, ErrorRotatingFileClosed
+	}
+
+	if rf.needsRotation(int64(len(p))) {
+		if err := rf.rotate(); err != nil {
+			// carry on writing to the current file
+			os.Stderr.WriteString("Failed to rotate log file " + rf.path + ". err=" + err.Error() + "\n")
+		}
+	}
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// whether the file needs to be rotated before size more bytes are written. An empty file is
+// not rotated, so that messages bigger than MaxSize are still written
+func (rf *RotatingFile) needsRotation(size int64) bool {
+	if rf.size == 0 || time.Now().Before(rf.retry_rotation) {
+		return false
+	}
+	if rf.config.MaxSize > 0 && rf.size+size > rf.config.MaxSize {
+		return true
+	}
+	return rf.config.RotateInterval > 0 && time.Since(rf.opened) >= rf.config.RotateInterval
+}
+
+// Rotate rotates the file now, e.g., when it is asked to by an external log rotation tool
+func (rf *RotatingFile) Rotate() error {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+	if rf.closed {
+		return ErrorRotatingFileClosed
+	}
+	return rf.rotate()
+}
+
+// rotate the file. The file is renamed while it is still open, and is only closed once the new file
+// is opened. If the rotation fails, the file is left under its name, and logging carries on in it
+func (rf *RotatingFile) rotate() error {
+	rotated := rf.path + "." + time.Now().Format(rotated_time_format)
+	if err := os.Rename(rf.path, rotated); err != nil {
+		rf.retry_rotation = time.Now().Add(rotation_retry_interval)
+		return err
+	}
+	old_file := rf.file
+	if err := rf.open(); err != nil {
+		rf.retry_rotation = time.Now().Add(rotation_retry_interval)
+		if renameErr := os.Rename(rotated, rf.path); renameErr != nil {
+			// the file is still written to, under the name it is rotated to
+			os.Stderr.WriteString("Failed to restore log file " + rf.path + ". err=" + renameErr.Error() + "\n")
+		}
+		return err
+	}
+	if err := old_file.Close(); err != nil {
+		os.Stderr.WriteString("Failed to close rotated log file " + rotated + ". err=" + err.Error() + "\n")
+	}
+
+	rf.cleanup_wait.Add(1)
+	go rf.cleanup(rotated)
+	return nil
+}
+
+// compress the rotated file, and remove the rotated files that are over the limits
+func (rf *RotatingFile) cleanup(rotated string) {
+	defer rf.cleanup_wait.Done()
+	rf.cleanup_lock.Lock()
+	defer rf.cleanup_lock.Unlock()
+
+	if rf.config.Compress {
+		if err := compressFile(rotated); err != nil {
+			// the rotated file is kept uncompressed
+			os.Stderr.WriteString("Failed to compress log file " + rotated + ". err=" + err.Error() + "\n")
+		}
+	}
+	rf.removeOldFiles()
+}
+
+func compressFile(rotated string) error {
+	src, err := os.Open(rotated)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	// the file is written under a temporary name, so that no partial file is taken for a compressed one
+	tmp := rotated + compressed_suffix + ".tmp"
+	dst, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	writer := gzip.NewWriter(dst)
+	_, err = io.Copy(writer, src)
+	if err == nil {
+		err = writer.Close()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, rotated+compressed_suffix)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Remove(rotated)
+}
+
+// RotatedFiles returns the paths of the rotated files, oldest first
+func (rf *RotatingFile) RotatedFiles() ([]string, error) {
+	matches, err := filepath.Glob(rf.path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	rotated := []string{}
+	for _, match := range matches {
+		suffix := strings.TrimSuffix(match[len(rf.path)+1:], compressed_suffix)
+		if _, err := time.Parse(rotated_time_format, suffix); err == nil {
+			rotated = append(rotated, match)
+		}
+	}
+	// the time suffixes sort in the order of time
+	sort.Strings(rotated)
+	return rotated, nil
+}
+
+func (rf *RotatingFile) removeOldFiles() {
+	rotated, err := rf.RotatedFiles()
+	if err != nil {
+		return
+	}
+	for i, path := range rotated {
+		remove := rf.config.MaxFiles > 0 && len(rotated)-i > rf.config.MaxFiles
+		if !remove && rf.config.MaxAge > 0 {
+			suffix := strings.TrimSuffix(path[len(rf.path)+1:], compressed_suffix)
+			rotatedAt, _ := time.ParseInLocation(rotated_time_format, suffix, time.Local)
+			remove = time.Since(rotatedAt) > rf.config.MaxAge
+		}
+		if remove {
+			os.Remove(path)
+		}
+	}
+}
+
+// Close closes the file, after the rotated files have been cleaned up
+func (rf *RotatingFile) Close() error {
+	rf.lock.Lock()
+	if rf.closed {
+		rf.lock.Unlock()
+		return nil
+	}
+	rf.closed = true
+	err := rf.file.Close()
+	rf.lock.Unlock()
+
+	rf.cleanup_wait.Wait()
+	return err
+}
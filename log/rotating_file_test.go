@@ -0,0 +1,155 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package log
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotating_file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "xdcr.log")
+	rf, err := NewRotatingFile(path, RotationConfig{MaxSize: 1024, Compress: true, MaxFiles: 3})
+	if err != nil {
+		t.Fatalf("Failed to create rotating file. err=%v", err)
+	}
+
+	// pipelines log at the same time
+	line := strings.Repeat("x", 99) + "\n"
+	var wait sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for j := 0; j < 50; j++ {
+				if _, err := rf.Write([]byte(line)); err != nil {
+					t.Errorf("Failed to write. err=%v", err)
+					return
+				}
+			}
+		}()
+	}
+	wait.Wait()
+	if err = rf.Close(); err != nil {
+		t.Fatalf("Failed to close. err=%v", err)
+	}
+
+	rotated, err := rf.RotatedFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rotated) != 3 {
+		t.Errorf("Expected 3 rotated files to be kept, got %v", rotated)
+	}
+	for _, file := range rotated {
+		if !strings.HasSuffix(file, compressed_suffix) {
+			t.Errorf("Rotated file %v is not compressed", file)
+		}
+	}
+	for _, file := range append(rotated, path) {
+		lines, err := readLines(file)
+		if err != nil {
+			t.Fatalf("Failed to read %v. err=%v", file, err)
+		}
+		if len(lines)*len(line) > 1024 {
+			t.Errorf("%v has grown over the max size, with %v lines", file, len(lines))
+		}
+		for _, l := range lines {
+			if l+"\n" != line {
+				t.Errorf("%v has an interleaved line %q", file, l)
+				break
+			}
+		}
+	}
+}
+
+func TestRotatingFileKeepsLoggingWhenRotationFails(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("Files in a read-only directory can be renamed by root")
+	}
+	dir, err := ioutil.TempDir("", "rotating_file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Chmod(dir, 0755)
+
+	path := filepath.Join(dir, "xdcr.log")
+	rf, err := NewRotatingFile(path, RotationConfig{MaxSize: 100})
+	if err != nil {
+		t.Fatalf("Failed to create rotating file. err=%v", err)
+	}
+	defer rf.Close()
+
+	line := strings.Repeat("x", 59) + "\n"
+	if _, err = rf.Write([]byte(line)); err != nil {
+		t.Fatalf("Failed to write. err=%v", err)
+	}
+
+	// the file can't be renamed in a read-only directory
+	if err = os.Chmod(dir, 0555); err != nil {
+		t.Fatal(err)
+	}
+	if err = rf.Rotate(); err == nil {
+		t.Fatalf("Rotation in a read-only directory succeeded")
+	}
+	// needs rotation, which fails as well
+	for i := 0; i < 2; i++ {
+		if _, err = rf.Write([]byte(line)); err != nil {
+			t.Fatalf("Failed to write after the rotation failed. err=%v", err)
+		}
+	}
+
+	lines, err := readLines(path)
+	if err != nil {
+		t.Fatalf("Failed to read %v. err=%v", path, err)
+	}
+	if len(lines) != 3 {
+		t.Errorf("Expected 3 lines in the unrotated file, got %v", len(lines))
+	}
+	if rotated, _ := rf.RotatedFiles(); len(rotated) != 0 {
+		t.Errorf("Expected no rotated files, got %v", rotated)
+	}
+}
+
+// lines of a log file, which is decompressed if it is compressed
+func readLines(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	if strings.HasSuffix(path, compressed_suffix) {
+		reader, err := gzip.NewReader(file)
+		if err != nil {
+			return nil, err
+		}
+		scanner = bufio.NewScanner(reader)
+	}
+	lines := []string{}
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines, scanner.Err()
+}
@@ -10,13 +10,19 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"time"
 
 	ap "github.com/Xiaomei-Zhang/goxdcr/adminport"
+	"github.com/Xiaomei-Zhang/goxdcr/base"
+	"github.com/Xiaomei-Zhang/goxdcr/log"
 	rm "github.com/Xiaomei-Zhang/goxdcr/replication_manager"
-	c "github.com/Xiaomei-Zhang/goxdcr/mock_services"
 	s "github.com/Xiaomei-Zhang/goxdcr/services"
 	"github.com/Xiaomei-Zhang/goxdcr/utils"
 )
@@ -29,6 +35,28 @@ var options struct {
 	gometaPortNumber  int
 	username        string //username on source cluster
 	password        string //password on source cluster	
+	userFile        string //json file with users allowed to access adminport
+	internalUser     string //user name of the credential used between xdcr nodes
+	internalPassword string //password of the credential used between xdcr nodes
+	certFile          string //certificate file for https
+	keyFile           string //private key file for https
+	clientCAFile      string //CA file used to verify client certificates
+	requireClientCert bool   //whether client certificates are required
+	clusterCAFile     string //CA file used to verify other xdcr nodes
+	queueOverflowDir  string //local directory that replication queues overflow to
+	spoolDir          string //local directory that mutations are spooled to while targets are unreachable
+	logFormat         string //format of log messages
+	logRedaction      string //how user data is redacted in log messages
+	logFile           string //log file of the process-wide loggers
+	adminLogFile      string //log file of the admin and audit stream
+	pipelineLogFile   string //log file of pipelines
+	errorLogFile      string //log file that errors of all streams are also written to
+	logMaxSizeMb      int           //log files are rotated when they grow over this size
+	logRotateInterval time.Duration //log files are rotated when they have been written to for this long
+	logCompress       bool          //whether rotated log files are compressed
+	logMaxFiles       int           //number of rotated log files that are kept
+	logMaxAge         time.Duration //how long rotated log files are kept
+	configFile        string        //json file with values of the options
 }
 
 func argParse() {
@@ -40,9 +68,91 @@ func argParse() {
 		"port number for gometa requests")
 	flag.StringVar(&options.username, "username", "Administrator", "username to cluster admin console")
 	flag.StringVar(&options.password, "password", "welcome", "password to Cluster admin console")
+	flag.StringVar(&options.userFile, "userFile", "",
+		"json file with the users allowed to access xdcr rest service. if not specified, only username/password is allowed, with admin role")
+	flag.StringVar(&options.internalUser, "internalUser", "@xdcr", "user name used to forward requests between xdcr nodes")
+	flag.StringVar(&options.internalPassword, "internalPassword", "", "password used to forward requests between xdcr nodes. required, and needs to differ from password")
+	flag.StringVar(&options.certFile, "certFile", "", "certificate file. xdcr rest service is served on https when it is specified along with keyFile")
+	flag.StringVar(&options.keyFile, "keyFile", "", "private key file for https")
+	flag.StringVar(&options.clientCAFile, "clientCAFile", "", "CA file used to verify client certificates")
+	flag.BoolVar(&options.requireClientCert, "requireClientCert", false, "reject https clients without a certificate signed by clientCAFile")
+	flag.StringVar(&options.clusterCAFile, "clusterCAFile", "", "CA file used to verify other xdcr nodes when forwarding requests to them over https")
+	flag.StringVar(&options.queueOverflowDir, "queueOverflowDir", "", "local directory that the queues in front of target nozzles overflow to when their memory is full. overflow is disabled when it is not specified")
+	flag.StringVar(&options.spoolDir, "spoolDir", "", "local directory that target nozzles spool mutations to while the target is unreachable. spooling is disabled when it is not specified")
+	flag.StringVar(&options.logFormat, "logFormat", log.LOG_FORMAT_TEXT_STR, "format of log messages: text, logfmt or json")
+	flag.StringVar(&options.logRedaction, "logRedaction", log.REDACTION_NONE_STR, "how user data, e.g., document keys, is logged: none, tag or hash")
+	flag.StringVar(&options.logFile, "logFile", "", "log file. logs go to stdout when it is not specified")
+	flag.StringVar(&options.adminLogFile, "adminLogFile", "", "log file of the rest service, including the audit of the requests. defaults to logFile")
+	flag.StringVar(&options.pipelineLogFile, "pipelineLogFile", "", "log file of replication pipelines. defaults to logFile")
+	flag.StringVar(&options.errorLogFile, "errorLogFile", "", "log file that the errors of all log files are also written to")
+	flag.IntVar(&options.logMaxSizeMb, "logMaxSizeMb", 100, "log files are rotated when they grow over this size in MB. 0 for no limit")
+	flag.DurationVar(&options.logRotateInterval, "logRotateInterval", 24*time.Hour, "log files are rotated when they have been written to for this long. 0 for no limit")
+	flag.BoolVar(&options.logCompress, "logCompress", true, "whether rotated log files are compressed with gzip")
+	flag.IntVar(&options.logMaxFiles, "logMaxFiles", 10, "number of rotated files kept for each log file. 0 for no limit")
+	flag.DurationVar(&options.logMaxAge, "logMaxAge", 7*24*time.Hour, "rotated log files older than this are removed. 0 for no limit")
+	flag.StringVar(&options.configFile, "configFile", "",
+		"json file with the values of the options above keyed by their names, e.g., {\"logFile\": \"/var/log/xdcr.log\"}. options on the command line take precedence")
 	flag.Parse()
 }
 
+// set the options in the config file that are not set on the command line
+func applyConfigFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	config := make(map[string]interface{})
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	// keep numbers as they are written, e.g., 1000000 instead of 1e+06
+	decoder.UseNumber()
+	if err = decoder.Decode(&config); err != nil {
+		return err
+	}
+
+	onCommandLine := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		onCommandLine[f.Name] = true
+	})
+	for name, val := range config {
+		if flag.Lookup(name) == nil {
+			return errors.New(fmt.Sprintf("Unknown option %v in config file %v", name, path))
+		}
+		if onCommandLine[name] {
+			continue
+		}
+		if err = flag.Set(name, fmt.Sprint(val)); err != nil {
+			return errors.New(fmt.Sprintf("Invalid value of option %v in config file %v. err=%v", name, path, err))
+		}
+	}
+	return nil
+}
+
+// set the format, redaction and files of logs from command line options
+func configureLogging() error {
+	logFormat, err := log.LogFormatFromStr(options.logFormat)
+	if err != nil {
+		return err
+	}
+	for _, ctx := range []*log.LoggerContext{log.DefaultLoggerContext, log.AdminLoggerContext, log.PipelineLoggerContext} {
+		ctx.Log_format = logFormat
+	}
+	redaction, err := log.RedactionModeFromStr(options.logRedaction)
+	if err != nil {
+		return err
+	}
+	log.SetRedactionMode(redaction)
+
+	return log.ConfigureFileSinks(&log.FileSinkConfig{LogFile: options.logFile,
+		AdminLogFile:    options.adminLogFile,
+		PipelineLogFile: options.pipelineLogFile,
+		ErrorLogFile:    options.errorLogFile,
+		Rotation: log.RotationConfig{MaxSize: int64(options.logMaxSizeMb) * 1024 * 1024,
+			RotateInterval: options.logRotateInterval,
+			Compress:       options.logCompress,
+			MaxFiles:       options.logMaxFiles,
+			MaxAge:         options.logMaxAge}})
+}
+
 func usage() {
 	fmt.Fprintf(os.Stderr, "Usage : %s [OPTIONS] \n", os.Args[0])
 	flag.PrintDefaults()
@@ -50,6 +160,19 @@ func usage() {
 
 func main() {
 	argParse()
+	if len(options.configFile) > 0 {
+		if err := applyConfigFile(options.configFile); err != nil {
+			fmt.Println("Error loading config file. ", err.Error())
+			os.Exit(1)
+		}
+	}
+	if err := configureLogging(); err != nil {
+		fmt.Println("Error configuring logs. ", err.Error())
+		os.Exit(1)
+	}
+	defer log.CloseFileSinks()
+	base.QueueOverflowDir = options.queueOverflowDir
+	base.SpoolDir = options.spoolDir
 	
 	cmd, err := s.StartGometaService()
 	if err != nil {
@@ -58,9 +181,12 @@ func main() {
 	}
 	defer s.KillGometaService(cmd)
 	
-	c.SetTestOptions(options.sourceClusterAddr, options.sourceKVHost, options.username, options.password)
-		
-	xdcrTopologyService := new(c.MockXDCRTopologySvc)
+	clusterInfoService := s.NewClusterInfoSvc(s.DefaultClusterInfoCacheTTL, nil)
+	xdcrTopologyService, err := s.NewXDCRTopologySvc(options.sourceKVHost, options.sourceClusterAddr, options.username, options.password, clusterInfoService, nil)
+	if err != nil {
+		fmt.Println("Error starting xdcr topology service. ", err.Error())
+		os.Exit(1)
+	}
 	hostAddr, err := xdcrTopologyService.MyHost()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error getting host address \n")
@@ -73,7 +199,55 @@ func main() {
 		os.Exit(1)
 	}
 	
-	rm.Initialize(metadata_svc, new(c.MockClusterInfoSvc), xdcrTopologyService, new(c.MockReplicationSettingsSvc))
-	go ap.MainAdminPort(hostAddr)
+	replicationSettingsSvc, err := s.NewReplicationSettingsSvc(metadata_svc, nil)
+	if err != nil {
+		fmt.Println("Error starting replication settings service. ", err.Error())
+		os.Exit(1)
+	}
+	
+	topologyWatcher := s.NewTopologyWatcher(clusterInfoService, time.Duration(base.TopologyPollInterval)*time.Millisecond, nil)
+	leaderElector := s.NewLeaderElector(s.NewMetadataLeaseStore(metadata_svc), utils.GetHostAddr(hostAddr, base.AdminportNumber),
+		time.Duration(base.LeaderLeaseDuration)*time.Millisecond, time.Duration(base.LeaderLeaseRenewInterval)*time.Millisecond, nil)
+	rm.Initialize(metadata_svc, clusterInfoService, xdcrTopologyService, replicationSettingsSvc, topologyWatcher, leaderElector)
+
+	auth, err := authConfig()
+	if err != nil {
+		fmt.Println("Error loading users for xdcr rest service. ", err.Error())
+		os.Exit(1)
+	}
+
+	var tlsConfig *ap.TLSConfig
+	if len(options.certFile) > 0 || len(options.keyFile) > 0 {
+		tlsConfig, err = ap.NewTLSConfig(options.certFile, options.keyFile, options.clientCAFile, options.requireClientCert, options.clusterCAFile)
+		if err != nil {
+			fmt.Println("Error loading certificates for xdcr rest service. ", err.Error())
+			os.Exit(1)
+		}
+	}
+	go ap.MainAdminPort(hostAddr, auth, tlsConfig)
 	<-done
 }
+
+// construct authentication settings of adminport from command line options
+func authConfig() (*ap.AuthConfig, error) {
+	var userStore *ap.MemoryUserStore
+	var err error
+	if len(options.userFile) > 0 {
+		userStore, err = ap.NewUserStoreFromFile(options.userFile)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		userStore = ap.NewMemoryUserStore()
+		userStore.AddUser(options.username, options.password, ap.RoleAdmin)
+	}
+
+	// the internal credential can do anything on any node, so it is not derived from the credential of a user
+	if len(options.internalPassword) == 0 {
+		return nil, errors.New("internalPassword needs to be specified, and to be the same on all xdcr nodes")
+	}
+	if options.internalPassword == options.password {
+		return nil, errors.New("internalPassword needs to differ from password")
+	}
+	return ap.NewAuthConfig(options.internalUser, options.internalPassword, ap.NewBasicAuthenticator(userStore)), nil
+}
@@ -10,10 +10,7 @@
 package metadata
 
 import (
-	"errors"
-	"fmt"
 	"github.com/Xiaomei-Zhang/goxdcr/log"
-	"github.com/Xiaomei-Zhang/goxdcr/utils"
 )
 
 const (
@@ -27,9 +24,18 @@ const (
 	default_target_nozzle_per_node                        = 2
 	default_max_expected_replication_lag                  = 1000
 	default_timeout_percentage_cap                        = 80 // TODO is this ok?
+	default_queue_size                                    = 10240
+	default_queue_high_watermark                          = 10240
+	default_spool_max_size                                = 0
+	default_compression_threshold                         = 256
 	default_filter_expression                string       = ""
-	default_replication_type                 string       = "capi"
+	default_replication_type                 string       = ReplicationTypeCapi
+	default_spool_overflow_policy            string       = SpoolOverflowPolicyBlock
+	default_timeout_cap_policy               string       = TimeoutCapPolicyDegrade
+	default_error_policies                   string       = ""
 	default_active                           bool         = true
+	default_deduplication                    bool         = false
+	default_compression                      bool         = false
 	default_pipeline_log_level               log.LogLevel = log.LogLevelInfo
 )
 
@@ -47,6 +53,15 @@ const (
 	TargetNozzlePerNode            = "target_nozzle_per_node"
 	MaxExpectedReplicationLag      = "max_expected_replication_lag"
 	TimeoutPercentageCap           = "timeout_percentage_cap"
+	TimeoutCapPolicy               = "timeout_cap_policy"
+	ErrorPolicies                  = "error_policies"
+	QueueSize                      = "queue_size"
+	QueueHighWatermark             = "queue_high_watermark"
+	SpoolMaxSize                   = "spool_max_size"
+	SpoolOverflowPolicy            = "spool_overflow_policy"
+	Deduplication                  = "deduplication"
+	Compression                    = "compression"
+	CompressionThreshold           = "compression_threshold"
 	PipelineLogLevel               = "log_level"
 )
 
@@ -116,24 +131,60 @@ type ReplicationSettings struct {
 	// condisered as not healthy
 	TimeoutPercentageCap int `json:"timeout_percentage_cap"`
 
+	//what to do when the timeout percentage cap is exceeded - degrade or restart
+	//default: degrade
+	TimeoutCapPolicy string `json:"timeout_cap_policy"`
+
+	//how the errors of each class are handled, as comma separated class=policy pairs,
+	//e.g., transient=ignore,fatal=pause. the classes that are not listed get the default policies
+	//default: ""
+	ErrorPolicies string `json:"error_policies"`
+
+	//the max size (kb) of the mutations held in memory by the queue in front of each target nozzle
+	//default: 10240
+	//range: 64-1048576
+	QueueSize int `json:"queue_size"`
+
+	//the size (kb) of the mutations queued in front of a target nozzle, in memory and on disk,
+	//at which the queue holds up the source nozzles
+	//default: 10240
+	//range: 64-104857600
+	QueueHighWatermark int `json:"queue_high_watermark"`
+
+	//the max size (mb) of the spool that each target nozzle appends mutations to while the target is unreachable.
+	//0 disables spooling
+	//default: 0
+	//range: 0-1048576
+	SpoolMaxSize int `json:"spool_max_size"`
+
+	//what to do when the spool is full - block or drop
+	//default: block
+	SpoolOverflowPolicy string `json:"spool_overflow_policy"`
+
+	//if only the latest mutation of each key in a batch is sent to the target
+	//default: false
+	Deduplication bool `json:"deduplication"`
+
+	//if the bodies of mutations are compressed with snappy when the target supports it
+	//default: false
+	Compression bool `json:"compression"`
+
+	//the min size (bytes) of the mutation bodies that are compressed
+	//default: 256
+	//range: 0-20971520
+	CompressionThreshold int `json:"compression_threshold"`
+
 	//log level
 	LogLevel log.LogLevel  `json:"log_level"`
 }
 
+// settings with the default values in ReplicationSettingsSchema
 func DefaultSettings() *ReplicationSettings {
-	return &ReplicationSettings{FilterExpression: default_filter_expression,
-		Active:                           default_active,
-		CheckpointInterval:              default_checkpoint_interval,
-		BatchCount:                      default_batch_count,
-		BatchSize:                       default_batch_size,
-		FailureRestartInterval:         default_failure_restart_interval,
-		OptimisticReplicationThreshold: default_optimistic_replication_threshold,
-		HttpConnection:                  default_http_connection,
-		SourceNozzlePerNode:           default_source_nozzle_per_node,
-		TargetNozzlePerNode:           default_target_nozzle_per_node,
-		MaxExpectedReplicationLag:     default_max_expected_replication_lag,
-		TimeoutPercentageCap:           default_timeout_percentage_cap,
-		LogLevel:                        default_pipeline_log_level}
+	settings := &ReplicationSettings{}
+	for _, spec := range ReplicationSettingsSchema.Specs() {
+		spec.set(settings, spec.Default)
+	}
+	return settings
 }
 
 func (s *ReplicationSettings) SetLogLevel(log_level string) error {
@@ -155,117 +206,24 @@ func SettingsFromMap(settingsMap map[string]interface{}) (*ReplicationSettings,
 	}
 }
 
+// update settings with the values in settingsMap, which is keyed by internal keys.
+// settings are left unchanged if any value is invalid, and the returned base.SettingsError
+// has the error on each invalid setting
 func (s *ReplicationSettings) UpdateSettingsFromMap(settingsMap map[string]interface{}) error {
-	for key, val := range settingsMap {
-		switch key {
-		case ReplicationType:
-			repType, ok := val.(string)
-			if !ok {
-				return utils.IncorrectValueTypeInMapError(key, val, "string")
-			}
-			s.RepType = repType
-		case FilterExpression:
-			filterExpression, ok := val.(string)
-			if !ok {
-				return utils.IncorrectValueTypeInMapError(key, val, "string")
-			}
-			s.FilterExpression = filterExpression
-		case Active:
-			active, ok := val.(bool)
-			if !ok {
-				return utils.IncorrectValueTypeInMapError(key, val, "bool")
-			}
-			s.Active = active
-		case CheckpointInterval:
-			checkpointInterval, ok := val.(int)
-			if !ok {
-				return utils.IncorrectValueTypeInMapError(key, val, "int")
-			}
-			s.CheckpointInterval = checkpointInterval
-		case BatchCount:
-			batchCount, ok := val.(int)
-			if !ok {
-				return utils.IncorrectValueTypeInMapError(key, val, "int")
-			}
-			s.BatchCount = batchCount
-		case BatchSize:
-			batchSize, ok := val.(int)
-			if !ok {
-				return utils.IncorrectValueTypeInMapError(key, val, "int")
-			}
-			s.BatchSize = batchSize
-		case FailureRestartInterval:
-			failureRestartInterval, ok := val.(int)
-			if !ok {
-				return utils.IncorrectValueTypeInMapError(key, val, "int")
-			}
-			s.FailureRestartInterval = failureRestartInterval
-		case OptimisticReplicationThreshold:
-			optimisticReplicationThreshold, ok := val.(int)
-			if !ok {
-				return utils.IncorrectValueTypeInMapError(key, val, "int")
-			}
-			s.OptimisticReplicationThreshold = optimisticReplicationThreshold
-		case HttpConnection:
-			httpConnection, ok := val.(int)
-			if !ok {
-				return utils.IncorrectValueTypeInMapError(key, val, "int")
-			}
-			s.HttpConnection = httpConnection
-		case SourceNozzlePerNode:
-			sourceNozzlePerNode, ok := val.(int)
-			if !ok {
-				return utils.IncorrectValueTypeInMapError(key, val, "int")
-			}
-			s.SourceNozzlePerNode = sourceNozzlePerNode
-		case TargetNozzlePerNode:
-			targetNozzlePerNode, ok := val.(int)
-			if !ok {
-				return utils.IncorrectValueTypeInMapError(key, val, "int")
-			}
-			s.TargetNozzlePerNode = targetNozzlePerNode
-		case MaxExpectedReplicationLag:
-			maxExpectedReplicationLag, ok := val.(int)
-			if !ok {
-				return utils.IncorrectValueTypeInMapError(key, val, "int")
-			}
-			s.MaxExpectedReplicationLag = maxExpectedReplicationLag
-		case TimeoutPercentageCap:
-			timeoutPercentageCap, ok := val.(int)
-			if !ok {
-				return utils.IncorrectValueTypeInMapError(key, val, "int")
-			}
-			s.TimeoutPercentageCap = timeoutPercentageCap
-		case PipelineLogLevel:
-			l, ok := val.(string)
-			if !ok {
-				return utils.IncorrectValueTypeInMapError(key, val, "string")
-			}
-			s.SetLogLevel(l)
-		default:
-			return errors.New(fmt.Sprintf("Invalid key in map, %v", key))
-
-		}
+	if err := ReplicationSettingsSchema.Validate(settingsMap); err != nil {
+		return err
 	}
 
+	for key, val := range settingsMap {
+		ReplicationSettingsSchema.Spec(key).set(s, val)
+	}
 	return nil
 }
 
 func (s *ReplicationSettings) ToMap() map[string]interface{} {
 	settings_map := make(map[string]interface{})
-	settings_map[ReplicationType] = s.RepType
-	settings_map[FilterExpression] = s.FilterExpression
-	settings_map[Active] = s.Active
-	settings_map[CheckpointInterval] = s.CheckpointInterval
-	settings_map[BatchCount] = s.BatchCount
-	settings_map[BatchSize] = s.BatchSize
-	settings_map[FailureRestartInterval] = s.FailureRestartInterval
-	settings_map[OptimisticReplicationThreshold] = s.OptimisticReplicationThreshold
-	settings_map[HttpConnection] = s.HttpConnection
-	settings_map[SourceNozzlePerNode] = s.SourceNozzlePerNode
-	settings_map[TargetNozzlePerNode] = s.TargetNozzlePerNode
-	settings_map[MaxExpectedReplicationLag] = s.MaxExpectedReplicationLag
-	settings_map[TimeoutPercentageCap] = s.TimeoutPercentageCap
-	settings_map[PipelineLogLevel] = s.LogLevel.String()
+	for _, spec := range ReplicationSettingsSchema.Specs() {
+		settings_map[spec.Key] = spec.get(s)
+	}
 	return settings_map
 }
@@ -41,6 +41,12 @@ type ReplicationSpecification struct {
 	FilterName string `json:"filterName"`
 
 	Settings *ReplicationSettings `json:"replicationSettings"`
+
+	//internal keys of the settings that have been explicitly set on the replication.
+	//the other settings are inherited from the default replication settings, and follow
+	//changes to the defaults. nil for replications created before settings could be inherited,
+	//in which case all settings are considered as explicitly set
+	OverriddenSettings map[string]bool `json:"overriddenSettings"`
 }
 
 func NewReplicationSpecification(sourceClusterUUID string, sourceBucketName string, targetClusterUUID string, targetBucketName string, filterName string) *ReplicationSpecification {
@@ -50,7 +56,38 @@ func NewReplicationSpecification(sourceClusterUUID string, sourceBucketName stri
 		TargetClusterUUID: targetClusterUUID,
 		TargetBucketName: targetBucketName,
 		FilterName: filterName,
-		Settings:    DefaultSettings()}
+		Settings:    DefaultSettings(),
+		OverriddenSettings: make(map[string]bool)}
+}
+
+// whether the setting with the specified internal key has been explicitly set on the replication
+func (spec *ReplicationSpecification) IsSettingOverridden(key string) bool {
+	if spec.OverriddenSettings == nil {
+		return true
+	}
+	return spec.OverriddenSettings[key]
+}
+
+// apply new default replication settings to the settings that are inherited.
+// per-replication settings, e.g., whether the replication is active, are never inherited.
+// returns true if any setting has changed
+func (spec *ReplicationSpecification) InheritDefaultSettings(defaultSettings *ReplicationSettings) bool {
+	inheritedSettings := make(map[string]interface{})
+	currentSettings := spec.Settings.ToMap()
+	for key, val := range defaultSettings.ToMap() {
+		if settingSpec := ReplicationSettingsSchema.Spec(key); settingSpec == nil || settingSpec.PerReplication {
+			continue
+		}
+		if !spec.IsSettingOverridden(key) && currentSettings[key] != val {
+			inheritedSettings[key] = val
+		}
+	}
+	if len(inheritedSettings) == 0 {
+		return false
+	}
+	// default settings have been validated
+	spec.Settings.UpdateSettingsFromMap(inheritedSettings)
+	return true
 }
 
 func ReplicationId(sourceClusterUUID string, sourceBucketName string, targetClusterUUID string, targetBucketName string, filterName string) string {
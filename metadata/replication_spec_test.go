@@ -0,0 +1,42 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package metadata
+
+import (
+	"testing"
+)
+
+func TestInheritDefaultSettingsKeepsPerReplicationSettings(t *testing.T) {
+	spec := NewReplicationSpecification("source", "default", "target", "default", "")
+	// paused, and nothing has been explicitly set on it
+	spec.Settings.Active = false
+
+	defaultSettings := DefaultSettings()
+	defaultSettings.BatchCount = spec.Settings.BatchCount + 1
+	defaultSettings.FilterExpression = "^doc"
+
+	if !spec.InheritDefaultSettings(defaultSettings) {
+		t.Fatalf("changed default batch count is not inherited")
+	}
+	if spec.Settings.BatchCount != defaultSettings.BatchCount {
+		t.Errorf("batch count is %v, expected %v", spec.Settings.BatchCount, defaultSettings.BatchCount)
+	}
+	if spec.Settings.Active {
+		t.Errorf("paused replication is reactivated by default settings")
+	}
+	if spec.Settings.FilterExpression != default_filter_expression {
+		t.Errorf("filter expression %q is inherited from default settings", spec.Settings.FilterExpression)
+	}
+
+	// nothing else to inherit
+	if spec.InheritDefaultSettings(defaultSettings) {
+		t.Errorf("per-replication settings are reported as inherited")
+	}
+}
@@ -0,0 +1,395 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+// schema of replication settings.
+//
+// Every replication setting is described once here, with its internal key, rest key, type,
+// default value, range and description. Validation, default values, ToMap, rest decoding
+// and api documentation are all driven from the schema.
+
+package metadata
+
+import (
+	"errors"
+	"fmt"
+	base "github.com/Xiaomei-Zhang/goxdcr/base"
+	"github.com/Xiaomei-Zhang/goxdcr/log"
+	"github.com/Xiaomei-Zhang/goxdcr/utils"
+	"regexp"
+	"strconv"
+)
+
+// replication settings keys in rest api
+const (
+	ReplicationTypeRestKey                = "xdcrReplicationType"
+	FilterExpressionRestKey               = "xdcrFilterExpression"
+	ActiveRestKey                         = "xdcrActive"
+	CheckpointIntervalRestKey             = "xdcrCheckpointInterval"
+	BatchCountRestKey                     = "xdcrWorkerBatchSize"
+	BatchSizeRestKey                      = "xdcrDocBatchSizeKb"
+	FailureRestartIntervalRestKey         = "xdcrFailureRestartInterval"
+	OptimisticReplicationThresholdRestKey = "xdcrOptimisticReplicationThreshold"
+	HttpConnectionRestKey                 = "httpConnections"
+	SourceNozzlePerNodeRestKey            = "xdcrSourceNozzlePerNode"
+	TargetNozzlePerNodeRestKey            = "xdcrTargetNozzlePerNode"
+	MaxExpectedReplicationLagRestKey      = "xdcrMaxExpectedReplicationLag"
+	TimeoutPercentageCapRestKey           = "xdcrTimeoutPercentageCap"
+	TimeoutCapPolicyRestKey               = "xdcrTimeoutCapPolicy"
+	ErrorPoliciesRestKey                  = "xdcrErrorPolicies"
+	QueueSizeRestKey                      = "xdcrQueueSizeKb"
+	QueueHighWatermarkRestKey             = "xdcrQueueHighWatermarkKb"
+	SpoolMaxSizeRestKey                   = "xdcrSpoolMaxSizeMb"
+	SpoolOverflowPolicyRestKey            = "xdcrSpoolOverflowPolicy"
+	DeduplicationRestKey                  = "xdcrDeduplication"
+	CompressionRestKey                    = "xdcrCompression"
+	CompressionThresholdRestKey           = "xdcrCompressionThreshold"
+	PipelineLogLevelRestKey               = "xdcrLogLevel"
+)
+
+// valid replication types
+const (
+	ReplicationTypeCapi = "capi"
+	ReplicationTypeXmem = "xmem"
+)
+
+// valid spool overflow policies
+const (
+	SpoolOverflowPolicyBlock = "block"
+	SpoolOverflowPolicyDrop  = "drop"
+)
+
+// valid timeout cap policies
+const (
+	TimeoutCapPolicyDegrade = "degrade"
+	TimeoutCapPolicyRestart = "restart"
+)
+
+// data types of replication settings, as they appear in settings maps
+type SettingType int
+
+const (
+	SettingTypeString SettingType = iota
+	SettingTypeBool
+	SettingTypeInt
+)
+
+func (settingType SettingType) String() string {
+	switch settingType {
+	case SettingTypeBool:
+		return "bool"
+	case SettingTypeInt:
+		return "int"
+	}
+	return "string"
+}
+
+/************************************
+/* struct SettingSpec
+*************************************/
+// SettingSpec describes one replication setting
+type SettingSpec struct {
+	// key in settings maps and in metadata
+	Key string
+	// key in rest api
+	RestKey string
+	Type    SettingType
+	Default interface{}
+	// range of int settings, inclusive. only checked when HasRange is true
+	HasRange bool
+	Min      int
+	Max      int
+	// whether the setting is state of the replication itself, e.g., whether it is running.
+	// such settings are set on each replication, and are never inherited from default replication settings
+	PerReplication bool
+	Description    string
+
+	// additional validation beyond type and range, e.g., for enums and regular expressions
+	validator func(val interface{}) error
+	// accessors of the field in ReplicationSettings
+	get func(s *ReplicationSettings) interface{}
+	set func(s *ReplicationSettings, val interface{})
+}
+
+// validate the type, range and content of a value of the setting
+func (spec *SettingSpec) Validate(val interface{}) error {
+	switch spec.Type {
+	case SettingTypeString:
+		if _, ok := val.(string); !ok {
+			return utils.IncorrectValueTypeInMapError(spec.Key, val, spec.Type.String())
+		}
+	case SettingTypeBool:
+		if _, ok := val.(bool); !ok {
+			return utils.IncorrectValueTypeInMapError(spec.Key, val, spec.Type.String())
+		}
+	case SettingTypeInt:
+		intVal, ok := val.(int)
+		if !ok {
+			return utils.IncorrectValueTypeInMapError(spec.Key, val, spec.Type.String())
+		}
+		if spec.HasRange && (intVal < spec.Min || intVal > spec.Max) {
+			return errors.New(fmt.Sprintf("Value, %v, is out of range. Valid range: %v-%v.", intVal, spec.Min, spec.Max))
+		}
+	}
+
+	if spec.validator != nil {
+		return spec.validator(val)
+	}
+	return nil
+}
+
+// parse the string form of a value of the setting, e.g., from a form-encoded http request.
+// the returned value has not been validated against range and content
+func (spec *SettingSpec) ParseString(strVal string) (interface{}, error) {
+	switch spec.Type {
+	case SettingTypeBool:
+		return strconv.ParseBool(strVal)
+	case SettingTypeInt:
+		intVal, err := strconv.ParseInt(strVal, base.ParseIntBase, base.ParseIntBitSize)
+		if err != nil {
+			return nil, err
+		}
+		return int(intVal), nil
+	}
+	return strVal, nil
+}
+
+/************************************
+/* struct SettingsSchema
+*************************************/
+type SettingsSchema struct {
+	// specs in the order they are defined
+	specs []*SettingSpec
+	// internal key -> spec
+	specsByKey map[string]*SettingSpec
+	// rest key -> spec
+	specsByRestKey map[string]*SettingSpec
+}
+
+func NewSettingsSchema(specs ...*SettingSpec) *SettingsSchema {
+	schema := &SettingsSchema{specs: specs,
+		specsByKey:     make(map[string]*SettingSpec),
+		specsByRestKey: make(map[string]*SettingSpec)}
+	for _, spec := range specs {
+		schema.specsByKey[spec.Key] = spec
+		schema.specsByRestKey[spec.RestKey] = spec
+	}
+	return schema
+}
+
+func (schema *SettingsSchema) Specs() []*SettingSpec {
+	return schema.specs
+}
+
+// spec with the specified internal key, or nil if not found
+func (schema *SettingsSchema) Spec(key string) *SettingSpec {
+	return schema.specsByKey[key]
+}
+
+// spec with the specified rest key, or nil if not found
+func (schema *SettingsSchema) SpecByRestKey(restKey string) *SettingSpec {
+	return schema.specsByRestKey[restKey]
+}
+
+// validate all values in a settings map keyed by internal keys.
+// returns a base.SettingsError with the error on each invalid setting
+func (schema *SettingsSchema) Validate(settingsMap map[string]interface{}) error {
+	var settingsErr *base.SettingsError = nil
+	for key, val := range settingsMap {
+		var err error
+		if spec := schema.Spec(key); spec == nil {
+			err = errors.New("Invalid key in map.")
+		} else {
+			err = spec.Validate(val)
+		}
+		if err != nil {
+			if settingsErr == nil {
+				settingsErr = base.NewSettingsError()
+			}
+			settingsErr.Add(key, err)
+		}
+	}
+
+	if settingsErr != nil {
+		return *settingsErr
+	}
+	return nil
+}
+
+func validateReplicationType(val interface{}) error {
+	repType := val.(string)
+	if repType != ReplicationTypeCapi && repType != ReplicationTypeXmem {
+		return errors.New(fmt.Sprintf("Invalid replication type, %v. Valid types: %v, %v.", repType, ReplicationTypeCapi, ReplicationTypeXmem))
+	}
+	return nil
+}
+
+func validateFilterExpression(val interface{}) error {
+	if _, err := regexp.Compile(val.(string)); err != nil {
+		return errors.New(fmt.Sprintf("It needs to be a valid regular expression. %v", err))
+	}
+	return nil
+}
+
+func validateSpoolOverflowPolicy(val interface{}) error {
+	policy := val.(string)
+	if policy != SpoolOverflowPolicyBlock && policy != SpoolOverflowPolicyDrop {
+		return errors.New(fmt.Sprintf("Invalid spool overflow policy, %v. Valid policies: %v, %v.", policy, SpoolOverflowPolicyBlock, SpoolOverflowPolicyDrop))
+	}
+	return nil
+}
+
+func validateTimeoutCapPolicy(val interface{}) error {
+	policy := val.(string)
+	if policy != TimeoutCapPolicyDegrade && policy != TimeoutCapPolicyRestart {
+		return errors.New(fmt.Sprintf("Invalid timeout cap policy, %v. Valid policies: %v, %v.", policy, TimeoutCapPolicyDegrade, TimeoutCapPolicyRestart))
+	}
+	return nil
+}
+
+func validateErrorPolicies(val interface{}) error {
+	_, err := base.ParseErrorPolicies(val.(string))
+	return err
+}
+
+func validateLogLevel(val interface{}) error {
+	_, err := log.LogLevelFromStr(val.(string))
+	return err
+}
+
+func newIntSettingSpec(key, restKey string, defaultVal, min, max int, description string,
+	get func(s *ReplicationSettings) *int) *SettingSpec {
+	return &SettingSpec{Key: key,
+		RestKey:     restKey,
+		Type:        SettingTypeInt,
+		Default:     defaultVal,
+		HasRange:    true,
+		Min:         min,
+		Max:         max,
+		Description: description,
+		get:         func(s *ReplicationSettings) interface{} { return *get(s) },
+		set:         func(s *ReplicationSettings, val interface{}) { *get(s) = val.(int) }}
+}
+
+// the schema of replication settings
+var ReplicationSettingsSchema = NewSettingsSchema(
+	&SettingSpec{Key: ReplicationType,
+		RestKey:        ReplicationTypeRestKey,
+		Type:           SettingTypeString,
+		Default:        default_replication_type,
+		PerReplication: true,
+		Description:    "Type of the replication, capi or xmem.",
+		validator:      validateReplicationType,
+		get:            func(s *ReplicationSettings) interface{} { return s.RepType },
+		set:            func(s *ReplicationSettings, val interface{}) { s.RepType = val.(string) }},
+	&SettingSpec{Key: FilterExpression,
+		RestKey:        FilterExpressionRestKey,
+		Type:           SettingTypeString,
+		Default:        default_filter_expression,
+		PerReplication: true,
+		Description:    "Regular expression on document keys. Only matching documents are replicated.",
+		validator:      validateFilterExpression,
+		get:            func(s *ReplicationSettings) interface{} { return s.FilterExpression },
+		set:            func(s *ReplicationSettings, val interface{}) { s.FilterExpression = val.(string) }},
+	&SettingSpec{Key: Active,
+		RestKey:        ActiveRestKey,
+		Type:           SettingTypeBool,
+		Default:        default_active,
+		PerReplication: true,
+		Description:    "Whether the replication is running.",
+		get:            func(s *ReplicationSettings) interface{} { return s.Active },
+		set:            func(s *ReplicationSettings, val interface{}) { s.Active = val.(bool) }},
+	newIntSettingSpec(CheckpointInterval, CheckpointIntervalRestKey, default_checkpoint_interval, 60, 14400,
+		"Interval between two checkpoints, in seconds.",
+		func(s *ReplicationSettings) *int { return &s.CheckpointInterval }),
+	newIntSettingSpec(BatchCount, BatchCountRestKey, default_batch_count, 500, 10000,
+		"Number of mutations in a batch.",
+		func(s *ReplicationSettings) *int { return &s.BatchCount }),
+	newIntSettingSpec(BatchSize, BatchSizeRestKey, default_batch_size, 10, 10000,
+		"Size of a batch, in kb.",
+		func(s *ReplicationSettings) *int { return &s.BatchSize }),
+	newIntSettingSpec(FailureRestartInterval, FailureRestartIntervalRestKey, default_failure_restart_interval, 1, 300,
+		"Number of seconds to wait after a failure before restarting the replication.",
+		func(s *ReplicationSettings) *int { return &s.FailureRestartInterval }),
+	newIntSettingSpec(OptimisticReplicationThreshold, OptimisticReplicationThresholdRestKey, default_optimistic_replication_threshold, 0, 20*1024*1024,
+		"Documents smaller than this size, in kb, are replicated optimistically.",
+		func(s *ReplicationSettings) *int { return &s.OptimisticReplicationThreshold }),
+	newIntSettingSpec(HttpConnection, HttpConnectionRestKey, default_http_connection, 1, 100,
+		"Max number of simultaneous http connections used for rest protocol.",
+		func(s *ReplicationSettings) *int { return &s.HttpConnection }),
+	newIntSettingSpec(SourceNozzlePerNode, SourceNozzlePerNodeRestKey, default_source_nozzle_per_node, 1, 10,
+		"Number of source nozzles per source cluster node.",
+		func(s *ReplicationSettings) *int { return &s.SourceNozzlePerNode }),
+	newIntSettingSpec(TargetNozzlePerNode, TargetNozzlePerNodeRestKey, default_target_nozzle_per_node, 1, 10,
+		"Number of target nozzles per target cluster node.",
+		func(s *ReplicationSettings) *int { return &s.TargetNozzlePerNode }),
+	newIntSettingSpec(MaxExpectedReplicationLag, MaxExpectedReplicationLagRestKey, default_max_expected_replication_lag, 100, 60*60*1000,
+		"Max replication lag, in ms, that can be tolerated. Mutations replicated with longer lag are considered as timed out.",
+		func(s *ReplicationSettings) *int { return &s.MaxExpectedReplicationLag }),
+	newIntSettingSpec(TimeoutPercentageCap, TimeoutPercentageCapRestKey, default_timeout_percentage_cap, 0, 100,
+		"Max percentage of timed out mutations before the replication is considered as unhealthy.",
+		func(s *ReplicationSettings) *int { return &s.TimeoutPercentageCap }),
+	&SettingSpec{Key: TimeoutCapPolicy,
+		RestKey:     TimeoutCapPolicyRestKey,
+		Type:        SettingTypeString,
+		Default:     default_timeout_cap_policy,
+		Description: "What to do when the percentage of timed out mutations exceeds the cap, mark the replication as degraded, or also restart it.",
+		validator:   validateTimeoutCapPolicy,
+		get:         func(s *ReplicationSettings) interface{} { return s.TimeoutCapPolicy },
+		set:         func(s *ReplicationSettings, val interface{}) { s.TimeoutCapPolicy = val.(string) }},
+	&SettingSpec{Key: ErrorPolicies,
+		RestKey:     ErrorPoliciesRestKey,
+		Type:        SettingTypeString,
+		Default:     default_error_policies,
+		Description: "How the errors of each class are handled, as comma separated class=policy pairs, e.g., transient=ignore,fatal=pause. Classes: transient, topology_change, authentication, configuration, fatal. Policies: ignore, restart_part, restart_pipeline, pause. Classes that are not listed get the default policies, which restart the part on transient errors, pause the replication on authentication and configuration errors, and restart the pipeline on the others.",
+		validator:   validateErrorPolicies,
+		get:         func(s *ReplicationSettings) interface{} { return s.ErrorPolicies },
+		set:         func(s *ReplicationSettings, val interface{}) { s.ErrorPolicies = val.(string) }},
+	newIntSettingSpec(QueueSize, QueueSizeRestKey, default_queue_size, 64, 1024*1024,
+		"Max size, in kb, of the mutations held in memory by the queue in front of each target nozzle. Mutations beyond it overflow to disk when -queueOverflowDir is specified.",
+		func(s *ReplicationSettings) *int { return &s.QueueSize }),
+	newIntSettingSpec(QueueHighWatermark, QueueHighWatermarkRestKey, default_queue_high_watermark, 64, 100*1024*1024,
+		"Size, in kb, of the mutations queued in front of a target nozzle, in memory and on disk, at which the queue holds up the source nozzles. It is capped at the queue size when mutations do not overflow to disk.",
+		func(s *ReplicationSettings) *int { return &s.QueueHighWatermark }),
+	newIntSettingSpec(SpoolMaxSize, SpoolMaxSizeRestKey, default_spool_max_size, 0, 1024*1024,
+		"Max size, in mb, of the spool that each target nozzle appends mutations to while the target is unreachable. Spooling is disabled when it is 0 or when -spoolDir is not specified.",
+		func(s *ReplicationSettings) *int { return &s.SpoolMaxSize }),
+	&SettingSpec{Key: SpoolOverflowPolicy,
+		RestKey:     SpoolOverflowPolicyRestKey,
+		Type:        SettingTypeString,
+		Default:     default_spool_overflow_policy,
+		Description: "What to do when the spool is full, block the source nozzles, or drop the spooled mutations and restart the replication from the last checkpoint.",
+		validator:   validateSpoolOverflowPolicy,
+		get:         func(s *ReplicationSettings) interface{} { return s.SpoolOverflowPolicy },
+		set:         func(s *ReplicationSettings, val interface{}) { s.SpoolOverflowPolicy = val.(string) }},
+	&SettingSpec{Key: Deduplication,
+		RestKey:     DeduplicationRestKey,
+		Type:        SettingTypeBool,
+		Default:     default_deduplication,
+		Description: "Whether target nozzles send only the latest mutation of each key in a batch, and drop the older ones.",
+		get:         func(s *ReplicationSettings) interface{} { return s.Deduplication },
+		set:         func(s *ReplicationSettings, val interface{}) { s.Deduplication = val.(bool) }},
+	&SettingSpec{Key: Compression,
+		RestKey:     CompressionRestKey,
+		Type:        SettingTypeBool,
+		Default:     default_compression,
+		Description: "Whether target nozzles compress the bodies of mutations with snappy when the target supports it.",
+		get:         func(s *ReplicationSettings) interface{} { return s.Compression },
+		set:         func(s *ReplicationSettings, val interface{}) { s.Compression = val.(bool) }},
+	newIntSettingSpec(CompressionThreshold, CompressionThresholdRestKey, default_compression_threshold, 0, 20*1024*1024,
+		"Min size, in bytes, of the mutation bodies that are compressed.",
+		func(s *ReplicationSettings) *int { return &s.CompressionThreshold }),
+	&SettingSpec{Key: PipelineLogLevel,
+		RestKey:     PipelineLogLevelRestKey,
+		Type:        SettingTypeString,
+		Default:     default_pipeline_log_level.String(),
+		Description: "Log level of the replication, Error, Info, Debug or Trace.",
+		validator:   validateLogLevel,
+		get:         func(s *ReplicationSettings) interface{} { return s.LogLevel.String() },
+		set:         func(s *ReplicationSettings, val interface{}) { s.SetLogLevel(val.(string)) }},
+)
@@ -0,0 +1,45 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package metadata_svc
+
+import (
+	"time"
+)
+
+// the lease held by the leader among xdcr nodes
+type LeaderInfo struct {
+	// id of the xdcr node holding the lease
+	NodeId string `json:"nodeId"`
+	// term of the lease, which increases every time the leadership changes hands.
+	// duties run by the leader pass it along as fencing token, so that the writes from
+	// a former leader that has not noticed losing its lease can be told apart
+	Term uint64 `json:"term"`
+	// the lease is valid until expiry, unless the leader renews it
+	Expiry time.Time `json:"leaseExpiry"`
+}
+
+// called when the leader changes. leader is nil when there is no valid lease.
+// isLeader tells whether the current node is the new leader
+type LeaderChangeCallback func(leader *LeaderInfo, isLeader bool)
+
+// LeaderElector elects one xdcr node in the cluster to run the duties that should
+// run once per cluster, e.g., garbage-collecting orphaned checkpoints
+type LeaderElector interface {
+	Start() error
+	// the current node gives up its lease, if it is the leader
+	Stop() error
+
+	// the leader as last observed by the current node, nil if there is no valid lease
+	Leader() *LeaderInfo
+	// whether the current node holds a valid lease, and the fencing token of the lease
+	IsLeader() (bool, uint64)
+
+	RegisterLeaderChangeCallback(callback LeaderChangeCallback)
+}
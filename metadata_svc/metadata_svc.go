@@ -19,4 +19,5 @@ type MetadataSvc interface {
 	SetReplicationSpec(spec metadata.ReplicationSpecification) error
 	DelReplicationSpec(replicationId string) error
 	ActiveReplicationSpecs() (map[string]*metadata.ReplicationSpecification, error)
+	ReplicationSpecs() (map[string]*metadata.ReplicationSpecification, error)
 }
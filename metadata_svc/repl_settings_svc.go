@@ -13,7 +13,8 @@ import (
 	metadata "github.com/Xiaomei-Zhang/goxdcr/metadata"
 )
 
-// this service is likely provided by exposing an erlang rest api in ns_server
+// default settings of new replications, which existing replications inherit
+// unless the settings are explicitly set on them
 type ReplicationSettingsSvc interface {
 	GetReplicationSettings() (*metadata.ReplicationSettings, error)
 	SetReplicationSettings(*metadata.ReplicationSettings) error
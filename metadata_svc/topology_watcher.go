@@ -0,0 +1,79 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package metadata_svc
+
+import (
+	"fmt"
+)
+
+type TopologyChangeEventType int
+
+const (
+	// a kv node starts to host active vbuckets of the bucket
+	NodeAdded TopologyChangeEventType = iota
+	// a kv node no longer hosts active vbuckets of the bucket
+	NodeRemoved TopologyChangeEventType = iota
+	// active vbuckets of the bucket moved between kv nodes
+	VBucketsMoved TopologyChangeEventType = iota
+)
+
+func (eventType TopologyChangeEventType) String() string {
+	switch eventType {
+	case NodeAdded:
+		return "NodeAdded"
+	case NodeRemoved:
+		return "NodeRemoved"
+	case VBucketsMoved:
+		return "VBucketsMoved"
+	}
+	return fmt.Sprintf("TopologyChangeEventType(%d)", int(eventType))
+}
+
+// the kv nodes, host:port, which hosted and hosts an active vbucket.
+// From or To is empty when the vbucket did not have or does not have an active kv node
+type VBucketMove struct {
+	From string
+	To   string
+}
+
+type TopologyChangeEvent struct {
+	EventType   TopologyChangeEventType
+	ClusterUUID string
+	Bucket      string
+	// kv node added or removed. Only set on NodeAdded and NodeRemoved events
+	Node string
+	// vbucket -> move. Only set on VBucketsMoved event
+	VBucketMoves map[uint16]*VBucketMove
+}
+
+func (event *TopologyChangeEvent) String() string {
+	if event.EventType == VBucketsMoved {
+		return fmt.Sprintf("%v on bucket %v of cluster %v, %v vbuckets moved", event.EventType, event.Bucket, event.ClusterUUID, len(event.VBucketMoves))
+	}
+	return fmt.Sprintf("%v on bucket %v of cluster %v, node=%v", event.EventType, event.Bucket, event.ClusterUUID, event.Node)
+}
+
+// TopologyChangeListener abstracts anybody who is interested in topology changes of a bucket
+type TopologyChangeListener interface {
+	// called with all the changes detected on a bucket at once, so that the listener can react to them together
+	OnTopologyChange(clusterUUID, bucket string, events []*TopologyChangeEvent)
+}
+
+// TopologyWatcher watches the vbucket server maps of the buckets that listeners subscribe to,
+// and notifies the listeners of the changes
+type TopologyWatcher interface {
+	Start() error
+	Stop() error
+
+	// subscribing the same listener to the same bucket more than once has no further effect.
+	// a bucket is watched as long as there are listeners subscribed to it
+	Subscribe(clusterUUID, bucket string, listener TopologyChangeListener) error
+	Unsubscribe(clusterUUID, bucket string, listener TopologyChangeListener) error
+}
@@ -17,6 +17,7 @@ import (
 	base "github.com/Xiaomei-Zhang/goxdcr/base"
 	gen_server "github.com/Xiaomei-Zhang/goxdcr/gen_server"
 	"github.com/couchbase/gomemcached"
+	mcc "github.com/couchbase/gomemcached/client"
 	"github.com/Xiaomei-Zhang/goxdcr/utils"
 	"github.com/couchbaselabs/go-couchbase"
 	"reflect"
@@ -32,6 +33,9 @@ const (
 var dcp_setting_defs base.SettingDefinitions = base.SettingDefinitions{DCP_SETTINGS_KEY: base.NewSettingDef(reflect.TypeOf((*map[uint16]*base.VBTimestamp)(nil)), true)}
 
 var ErrorEmptyVBList = errors.New("Invalid configuration for DCP nozzle. VB list cannot be empty.")
+var ErrorDcpNozzleNotStarted = errors.New("DCP nozzle is not started.")
+var ErrorVBNotOwned = errors.New("The vbucket is not streamed by the DCP nozzle.")
+var ErrorVBAlreadyOwned = errors.New("The vbucket is already streamed by the DCP nozzle.")
 
 /************************************
 /* struct DcpNozzle
@@ -45,6 +49,14 @@ type DcpNozzle struct {
 	// the list of vbuckets that the kvfeed is responsible for
 	// this allows multiple kvfeeds to be created for a kv node
 	vbnos []uint16
+	// vbno -> the position in the stream of the vbucket up to which mutations have been processed.
+	// used to hand vbuckets over to another dcp nozzle while streaming
+	vb_timestamps map[uint16]*base.VBTimestamp
+	// lock on vbnos and vb_timestamps, which change when vbuckets are moved between dcp nozzles
+	lock_vbs sync.RWMutex
+	// held while a mutation is forwarded and recorded in vb_timestamps, so that a vbucket is not
+	// released between the two, and is picked up by another dcp nozzle right after the last mutation forwarded
+	lock_forward sync.Mutex
 	// immutable fields
 	bucket  *couchbase.Bucket
 	uprFeed *couchbase.UprFeed
@@ -82,6 +94,7 @@ func NewDcpNozzle(id string,
 	dcp := &DcpNozzle{
 		bucket:          bucket,
 		vbnos:           vbnos,
+		vb_timestamps:   make(map[uint16]*base.VBTimestamp),
 		GenServer:       server,           /*gen_server.GenServer*/
 		AbstractPart:    part,             /*AbstractPart*/
 		bOpen:           true,             /*bOpen	bool*/
@@ -126,14 +139,15 @@ func (dcp *DcpNozzle) Start(settings map[string]interface{}) error {
 
 	err := utils.ValidateSettings(dcp_setting_defs, settings, dcp.Logger())
 	if err != nil {
-		return err
+		//restarting does not help with invalid settings
+		return base.NewClassifiedError(base.ErrorClassConfiguration, "validating dcp settings", err)
 	}
 
 	dcp.Logger().Info("Dcp nozzle starting ....")
 	err = dcp.initialize(settings)
 	dcp.Logger().Info("....Finished dcp nozzle initialization....")
 	if err != nil {
-		return err
+		return base.ClassifyError("starting upr feed", err)
 	}
 
 	// start gen_server
@@ -151,7 +165,7 @@ func (dcp *DcpNozzle) Start(settings map[string]interface{}) error {
 	err = dcp.startUprStream(settings)
 	if err != nil {
 		dcp.Stop()
-		return err
+		return base.ClassifyError("starting vb streams", err)
 	}
 
 	dcp.Logger().Info("Dcp nozzle is started")
@@ -219,21 +233,28 @@ func (dcp *DcpNozzle) processData() (err error) {
 					goto done
 				}
 				if m.Status == gomemcached.NOT_MY_VBUCKET {
-					dcp.Logger().Errorf("Raise error condition %v\n", base.ErrorNotMyVbucket)
-					otherInfo := utils.WrapError(base.ErrorNotMyVbucket)
-					dcp.RaiseEvent(common.ErrorEncountered, nil, dcp, nil, otherInfo)
+					dcp.raiseError("streaming mutations from source", base.ErrorNotMyVbucket)
 					return base.ErrorNotMyVbucket
 				}
+				dcp.lock_forward.Lock()
+				if !dcp.ownsVBucket(m.VBucket) {
+					//the vbucket has been released to another dcp nozzle, which streams it again after the mutations
+					//forwarded so far. drop what is left of the closed stream, so that none of it is sent twice or out of order
+					dcp.lock_forward.Unlock()
+					continue
+				}
 				dcp.counter++
-				dcp.Logger().Tracef("%v, Mutation %v:%v:%v <%v>, counter=%v, ops_per_sec=%v\n",
-					dcp.Id(), m.VBucket, m.Seqno, m.Opcode, m.Key, dcp.counter, float64(dcp.counter)/time.Since(dcp.start_time).Seconds())
+				dcp.Logger().Tracew("Mutation", log.FIELD_VBUCKET, m.VBucket, "seqno", m.Seqno, "opcode", m.Opcode, "key", log.UserData(m.Key),
+					"counter", dcp.counter, "ops_per_sec", float64(dcp.counter)/time.Since(dcp.start_time).Seconds())
 
 				// forward mutation downstream through connector
 				if err := dcp.Connector().Forward(m); err != nil {
-					dcp.handleGeneralError(err)
+					dcp.raiseError("forwarding mutations downstream", err)
 				}
-				// raise event for statistics collection
-				dcp.RaiseEvent(common.DataProcessed, nil /*item*/, dcp, nil /*derivedItems*/, nil /*otherInfos*/)
+				dcp.updateVBTimestamp(m)
+				dcp.lock_forward.Unlock()
+				// raise event for statistics collection and load balancing
+				dcp.RaiseEvent(common.DataProcessed, m /*item*/, dcp, nil /*derivedItems*/, nil /*otherInfos*/)
 			}
 		}
 	}
@@ -252,9 +273,20 @@ func (dcp *DcpNozzle) StatusSummary() string {
 	return fmt.Sprintf("Dcp %v streamed %v items", dcp.Id(), dcp.counter)
 }
 
+func (dcp *DcpNozzle) HealthCheck(timeout time.Duration) common.Health {
+	return serverHealth(&dcp.GenServer, timeout)
+}
+
+//errors reported by the server routine, e.g., panics in callbacks
 func (dcp *DcpNozzle) handleGeneralError(err error) {
-	dcp.Logger().Errorf("Raise error condition %v\n", err)
-	otherInfo := utils.WrapError(err)
+	dcp.raiseError("running server routine", err)
+}
+
+//raise err, classified with what the nozzle was doing, to the pipeline supervisor
+func (dcp *DcpNozzle) raiseError(context string, err error) {
+	classified := base.ClassifyError(context, err)
+	dcp.Logger().Errorf("Raise error condition %v\n", classified)
+	otherInfo := utils.WrapError(classified)
 	dcp.RaiseEvent(common.ErrorEncountered, nil, dcp, nil, otherInfo)
 }
 
@@ -264,13 +296,10 @@ func (dcp *DcpNozzle) startUprStream(settings map[string]interface{}) error {
 	// fetch restart-timestamp from settings
 	ts := settings[DCP_SETTINGS_KEY].(map[uint16]*base.VBTimestamp)
 
-	opaque := newOpaque()
-	flags := uint32(0)
-	seqEnd := uint64(0xFFFFFFFFFFFFFFFF)
+	dcp.lock_uprFeed.Lock()
+	defer dcp.lock_uprFeed.Unlock()
 	for _, vbts := range ts {
-		dcp.Logger().Infof("%v starting vb stream for vb=%v\n", dcp.Id(), vbts.Vbno)
-		err := dcp.uprFeed.UprRequestStream(vbts.Vbno, opaque, flags, vbts.Vbuuid, vbts.Seqno, seqEnd, vbts.SnapshotStart, vbts.SnapshotEnd)
-		if err != nil {
+		if err := dcp.requestStream(vbts); err != nil {
 			return err
 		}
 	}
@@ -278,17 +307,150 @@ func (dcp *DcpNozzle) startUprStream(settings map[string]interface{}) error {
 	return nil
 }
 
-// Set vb list in dcp nozzle
+// request the stream of a vbucket starting from the timestamp. lock_uprFeed needs to be held
+func (dcp *DcpNozzle) requestStream(vbts *base.VBTimestamp) error {
+	if dcp.uprFeed == nil {
+		return ErrorDcpNozzleNotStarted
+	}
+
+	opaque := newOpaque()
+	flags := uint32(0)
+	seqEnd := uint64(0xFFFFFFFFFFFFFFFF)
+	dcp.Logger().Infow("Starting vb stream", log.FIELD_VBUCKET, vbts.Vbno, "seqno", vbts.Seqno)
+
+	// the vbucket is owned before the stream is requested, so that its first mutations are not dropped
+	vbtsCopy := *vbts
+	dcp.lock_vbs.Lock()
+	dcp.vb_timestamps[vbts.Vbno] = &vbtsCopy
+	dcp.lock_vbs.Unlock()
+
+	err := dcp.uprFeed.UprRequestStream(vbts.Vbno, opaque, flags, vbts.Vbuuid, vbts.Seqno, seqEnd, vbts.SnapshotStart, vbts.SnapshotEnd)
+	if err != nil {
+		dcp.lock_vbs.Lock()
+		delete(dcp.vb_timestamps, vbts.Vbno)
+		dcp.lock_vbs.Unlock()
+		return err
+	}
+	return nil
+}
+
+// whether the vbucket is streamed by the dcp nozzle
+func (dcp *DcpNozzle) ownsVBucket(vbno uint16) bool {
+	dcp.lock_vbs.RLock()
+	defer dcp.lock_vbs.RUnlock()
+	_, ok := dcp.vb_timestamps[vbno]
+	return ok
+}
+
+// record the position in the stream of a vbucket that has been processed
+func (dcp *DcpNozzle) updateVBTimestamp(m *mcc.UprEvent) {
+	dcp.lock_vbs.Lock()
+	defer dcp.lock_vbs.Unlock()
+	vbts, ok := dcp.vb_timestamps[m.VBucket]
+	if !ok {
+		return
+	}
+	switch m.Opcode {
+	case gomemcached.UPR_MUTATION, gomemcached.UPR_DELETION, gomemcached.UPR_EXPIRATION:
+		vbts.Seqno = m.Seqno
+	case gomemcached.UPR_SNAPSHOT:
+		vbts.SnapshotStart = m.SnapstartSeq
+		vbts.SnapshotEnd = m.SnapendSeq
+	}
+}
+
+// Set vb list in dcp nozzle. This is for a dcp nozzle that has not been started.
+// Use ReleaseVBuckets and AcquireVBuckets to move vbuckets between started dcp nozzles
 func (dcp *DcpNozzle) SetVBList(vbnos []uint16) error {
 	if len(vbnos) == 0 {
 		return ErrorEmptyVBList
 	}
+	dcp.lock_vbs.Lock()
+	defer dcp.lock_vbs.Unlock()
 	dcp.vbnos = vbnos
 	return nil
 }
 
 func (dcp *DcpNozzle) GetVBList() []uint16 {
-	return dcp.vbnos
+	dcp.lock_vbs.RLock()
+	defer dcp.lock_vbs.RUnlock()
+	vbnos := make([]uint16, len(dcp.vbnos))
+	copy(vbnos, dcp.vbnos)
+	return vbnos
+}
+
+// stop streaming the vbuckets, and return the positions in their streams that have been processed,
+// from which another dcp nozzle can pick up the streams with AcquireVBuckets.
+// mutations received on the closed streams but not yet forwarded are dropped, since the other nozzle streams them again.
+// if an error is returned along with timestamps, the vbuckets in the timestamps have still been released
+func (dcp *DcpNozzle) ReleaseVBuckets(vbnos []uint16) (map[uint16]*base.VBTimestamp, error) {
+	// wait for the mutation being forwarded, if any, to be recorded in vb_timestamps
+	dcp.lock_forward.Lock()
+	defer dcp.lock_forward.Unlock()
+	dcp.lock_uprFeed.Lock()
+	defer dcp.lock_uprFeed.Unlock()
+	if dcp.uprFeed == nil {
+		return nil, ErrorDcpNozzleNotStarted
+	}
+
+	dcp.lock_vbs.Lock()
+	defer dcp.lock_vbs.Unlock()
+	released := make(map[uint16]bool)
+	for _, vbno := range vbnos {
+		if _, ok := dcp.vb_timestamps[vbno]; !ok {
+			return nil, ErrorVBNotOwned
+		}
+		released[vbno] = true
+	}
+	if len(released) >= len(dcp.vbnos) {
+		return nil, ErrorEmptyVBList
+	}
+
+	// on error, the streams closed so far are still released, so that the caller can hand them over
+	var err error
+	ts := make(map[uint16]*base.VBTimestamp)
+	for vbno, _ := range released {
+		if err = dcp.uprFeed.UprCloseStream(vbno, newOpaque()); err != nil {
+			break
+		}
+		ts[vbno] = dcp.vb_timestamps[vbno]
+		delete(dcp.vb_timestamps, vbno)
+	}
+	remaining := make([]uint16, 0, len(dcp.vbnos))
+	for _, vbno := range dcp.vbnos {
+		if _, ok := ts[vbno]; !ok {
+			remaining = append(remaining, vbno)
+		}
+	}
+	dcp.vbnos = remaining
+	dcp.Logger().Infof("%v released %v of vbuckets %v\n", dcp.Id(), len(ts), vbnos)
+	return ts, err
+}
+
+// start streaming the vbuckets from the specified positions, which are usually released by another dcp nozzle
+func (dcp *DcpNozzle) AcquireVBuckets(ts map[uint16]*base.VBTimestamp) error {
+	dcp.lock_uprFeed.Lock()
+	defer dcp.lock_uprFeed.Unlock()
+
+	dcp.lock_vbs.RLock()
+	for vbno, _ := range ts {
+		if _, ok := dcp.vb_timestamps[vbno]; ok {
+			dcp.lock_vbs.RUnlock()
+			return ErrorVBAlreadyOwned
+		}
+	}
+	dcp.lock_vbs.RUnlock()
+
+	for vbno, vbts := range ts {
+		if err := dcp.requestStream(vbts); err != nil {
+			return err
+		}
+		dcp.lock_vbs.Lock()
+		dcp.vbnos = append(dcp.vbnos, vbno)
+		dcp.lock_vbs.Unlock()
+	}
+	dcp.Logger().Infof("%v acquired vbuckets %v\n", dcp.Id(), dcp.GetVBList())
+	return nil
 }
 
 // generate a new 16 bit opaque value set as MSB.
@@ -0,0 +1,198 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package parts
+
+import (
+	"encoding/binary"
+	mc "github.com/couchbase/gomemcached"
+	"github.com/golang/snappy"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// what the fake memcached server does with a request
+type fakeAction struct {
+	// the request is lost, it is neither applied nor responded
+	drop bool
+	// the request is responded with the status instead of being applied, e.g., TMPFAIL
+	status mc.Status
+	// the connection stalls for the duration before the request is processed
+	delay time.Duration
+}
+
+/************************************
+/* struct fakeMemcached
+*************************************/
+// fakeMemcached is a memcached server for tests. It applies set_with_meta and delete_with_meta
+// requests to an in-memory store, and can be told to delay, drop or fail requests.
+// Requests on a connection are processed in order, as memcached does
+type fakeMemcached struct {
+	listener net.Listener
+	// decides what to do with each request. nil applies every request
+	inject func(req *mc.MCRequest) fakeAction
+	// HELLO features the server enables when they are requested. HELLO is an unknown command when it is nil
+	features []uint16
+
+	// values of each key, in the order they are applied. snappy compressed values are decompressed
+	applied map[string][][]byte
+	// number of requests applied with snappy compressed values
+	compressed int
+	conns      []net.Conn
+	lock       sync.Mutex
+	wg         sync.WaitGroup
+}
+
+func startFakeMemcached(t *testing.T, inject func(req *mc.MCRequest) fakeAction) *fakeMemcached {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen. err=%v", err)
+	}
+	server := &fakeMemcached{listener: listener,
+		inject:  inject,
+		applied: make(map[string][][]byte)}
+	server.wg.Add(1)
+	go server.accept()
+	return server
+}
+
+func (server *fakeMemcached) addr() string {
+	return server.listener.Addr().String()
+}
+
+func (server *fakeMemcached) accept() {
+	defer server.wg.Done()
+	for {
+		conn, err := server.listener.Accept()
+		if err != nil {
+			return
+		}
+		server.lock.Lock()
+		server.conns = append(server.conns, conn)
+		server.lock.Unlock()
+		server.wg.Add(1)
+		go server.serve(conn)
+	}
+}
+
+func (server *fakeMemcached) serve(conn net.Conn) {
+	defer server.wg.Done()
+	defer conn.Close()
+	for {
+		req, err := readFakeRequest(conn)
+		if err != nil {
+			return
+		}
+		action := fakeAction{}
+		if server.inject != nil {
+			action = server.inject(req)
+		}
+		time.Sleep(action.delay)
+		if action.drop {
+			continue
+		}
+
+		res := &mc.MCResponse{Opcode: req.Opcode, Opaque: req.Opaque, Status: action.status}
+		if req.Opcode == mc.HELLO {
+			server.hello(req, res)
+		} else if action.status == mc.SUCCESS {
+			server.apply(req)
+		}
+		if _, err = conn.Write(res.Bytes()); err != nil {
+			return
+		}
+	}
+}
+
+func readFakeRequest(conn net.Conn) (*mc.MCRequest, error) {
+	header := make([]byte, mc.HDR_LEN)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	keyLen := int(binary.BigEndian.Uint16(header[2:]))
+	extrasLen := int(header[4])
+	data := make([]byte, binary.BigEndian.Uint32(header[8:]))
+	if _, err := io.ReadFull(conn, data); err != nil {
+		return nil, err
+	}
+	return &mc.MCRequest{Opcode: mc.CommandCode(header[1]),
+		DataType: header[5],
+		VBucket:  binary.BigEndian.Uint16(header[6:]),
+		Opaque:   binary.BigEndian.Uint32(header[12:]),
+		Cas:      binary.BigEndian.Uint64(header[16:]),
+		Extras:   data[:extrasLen],
+		Key:      data[extrasLen : extrasLen+keyLen],
+		Body:     data[extrasLen+keyLen:]}, nil
+}
+
+// reply with the requested features that the server supports
+func (server *fakeMemcached) hello(req *mc.MCRequest, res *mc.MCResponse) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	if server.features == nil {
+		res.Status = mc.UNKNOWN_COMMAND
+		return
+	}
+	for i := 0; i+2 <= len(req.Body); i += 2 {
+		requested := binary.BigEndian.Uint16(req.Body[i:])
+		for _, feature := range server.features {
+			if feature == requested {
+				res.Body = append(res.Body, req.Body[i:i+2]...)
+			}
+		}
+	}
+}
+
+func (server *fakeMemcached) apply(req *mc.MCRequest) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	switch req.Opcode {
+	case SET_WITH_META:
+		value := req.Body
+		if req.DataType&mc.DatatypeFlagSnappy != 0 {
+			value, _ = snappy.Decode(nil, req.Body)
+			server.compressed++
+		}
+		server.applied[string(req.Key)] = append(server.applied[string(req.Key)], value)
+	case DELETE_WITH_META:
+		server.applied[string(req.Key)] = append(server.applied[string(req.Key)], nil)
+	}
+}
+
+// the values of the key, in the order they have been applied
+func (server *fakeMemcached) appliedValues(key string) [][]byte {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	return append([][]byte{}, server.applied[key]...)
+}
+
+func (server *fakeMemcached) setFeatures(features ...uint16) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	server.features = features
+}
+
+func (server *fakeMemcached) compressedCount() int {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	return server.compressed
+}
+
+func (server *fakeMemcached) stop() {
+	server.listener.Close()
+	server.lock.Lock()
+	for _, conn := range server.conns {
+		conn.Close()
+	}
+	server.lock.Unlock()
+	server.wg.Wait()
+}
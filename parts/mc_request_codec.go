@@ -0,0 +1,63 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package parts
+
+import (
+	"encoding/binary"
+	"errors"
+	mc "github.com/couchbase/gomemcached"
+)
+
+// encoding of requests that are written to local files, e.g., by queue parts and spools.
+// the header has the opcode, datatype, vbucket, opaque, cas, and the lengths of extras, key and body,
+// which are followed by extras, key and body
+const encoded_request_header_len = 1 + 1 + 2 + 4 + 8 + 4 + 4 + 4
+
+var ErrorInvalidEncodedRequest = errors.New("Encoded request is invalid.")
+
+func encodeMCRequest(req *mc.MCRequest) []byte {
+	buf := make([]byte, encoded_request_header_len+len(req.Extras)+len(req.Key)+len(req.Body))
+	buf[0] = byte(req.Opcode)
+	buf[1] = req.DataType
+	binary.BigEndian.PutUint16(buf[2:], req.VBucket)
+	binary.BigEndian.PutUint32(buf[4:], req.Opaque)
+	binary.BigEndian.PutUint64(buf[8:], req.Cas)
+	binary.BigEndian.PutUint32(buf[16:], uint32(len(req.Extras)))
+	binary.BigEndian.PutUint32(buf[20:], uint32(len(req.Key)))
+	binary.BigEndian.PutUint32(buf[24:], uint32(len(req.Body)))
+	pos := encoded_request_header_len
+	pos += copy(buf[pos:], req.Extras)
+	pos += copy(buf[pos:], req.Key)
+	copy(buf[pos:], req.Body)
+	return buf
+}
+
+// length of the encoded request that starts with the header
+func encodedRequestLen(header []byte) int {
+	return encoded_request_header_len + int(binary.BigEndian.Uint32(header[16:])) +
+		int(binary.BigEndian.Uint32(header[20:])) + int(binary.BigEndian.Uint32(header[24:]))
+}
+
+// the returned request refers to data instead of copying it
+func decodeMCRequest(data []byte) (*mc.MCRequest, error) {
+	if len(data) < encoded_request_header_len || len(data) != encodedRequestLen(data) {
+		return nil, ErrorInvalidEncodedRequest
+	}
+	extrasEnd := encoded_request_header_len + int(binary.BigEndian.Uint32(data[16:]))
+	keyEnd := extrasEnd + int(binary.BigEndian.Uint32(data[20:]))
+	return &mc.MCRequest{Opcode: mc.CommandCode(data[0]),
+		DataType: data[1],
+		VBucket:  binary.BigEndian.Uint16(data[2:]),
+		Opaque:   binary.BigEndian.Uint32(data[4:]),
+		Cas:      binary.BigEndian.Uint64(data[8:]),
+		Extras:   data[encoded_request_header_len:extrasEnd],
+		Key:      data[extrasEnd:keyEnd],
+		Body:     data[keyEnd:]}, nil
+}
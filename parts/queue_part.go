@@ -0,0 +1,455 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package parts
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	base "github.com/Xiaomei-Zhang/goxdcr/base"
+	common "github.com/Xiaomei-Zhang/goxdcr/common"
+	gen_server "github.com/Xiaomei-Zhang/goxdcr/gen_server"
+	"github.com/Xiaomei-Zhang/goxdcr/log"
+	"github.com/Xiaomei-Zhang/goxdcr/utils"
+	mc "github.com/couchbase/gomemcached"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const (
+	// start settings key names
+	// max size, in bytes, of the requests held in memory
+	QUEUE_SETTING_SIZE = "queue_size"
+	// size, in bytes, of the requests queued in memory and on disk at which back-pressure is applied upstream
+	QUEUE_SETTING_HIGH_WATERMARK = "queue_high_watermark"
+	// the local file that requests overflow to when the memory is full. overflow is disabled when it is not specified
+	QUEUE_SETTING_OVERFLOW_FILE = "queue_overflow_file"
+
+	default_queue_size = 10 * 1024 * 1024
+	// back-pressure is released when the queue drains to this ratio of the high watermark
+	queue_low_watermark_ratio = 0.5
+)
+
+// statistics names
+const (
+	QUEUE_STATS_DOCS         = "docs_rep_queue"
+	QUEUE_STATS_SIZE         = "size_rep_queue"
+	QUEUE_STATS_DOCS_ON_DISK = "docs_rep_queue_on_disk"
+	QUEUE_STATS_SIZE_ON_DISK = "size_rep_queue_on_disk"
+	// 1 if the queue applies back-pressure upstream, 0 otherwise
+	QUEUE_STATS_BACK_PRESSURE = "queues_back_pressure"
+)
+
+var queue_setting_defs base.SettingDefinitions = base.SettingDefinitions{QUEUE_SETTING_SIZE: base.NewSettingDef(reflect.TypeOf((*int)(nil)), false),
+	QUEUE_SETTING_HIGH_WATERMARK: base.NewSettingDef(reflect.TypeOf((*int)(nil)), false),
+	QUEUE_SETTING_OVERFLOW_FILE:  base.NewSettingDef(reflect.TypeOf((*string)(nil)), false)}
+
+var ErrorInvalidDataForQueuePart = errors.New("Input data to queue part is invalid.")
+var ErrorQueuePartStopped = errors.New("Queue part is stopped.")
+var ErrorCorruptedQueueOverflow = errors.New("Queue overflow file is corrupted.")
+
+/************************************
+/* struct queueOverflowFile
+*************************************/
+// the requests that overflow the memory of a queue part. they are appended to a local file,
+// and read back in the order they were appended
+type queueOverflowFile struct {
+	file         *os.File
+	write_offset int64
+	read_offset  int64
+	// number and total size of the requests in the file
+	count int
+	size  int
+}
+
+func openQueueOverflowFile(path string) (*queueOverflowFile, error) {
+	// requests left over by an earlier run are discarded. they are streamed again from the last checkpoint
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &queueOverflowFile{file: file}, nil
+}
+
+func (overflow *queueOverflowFile) append(req *mc.MCRequest) error {
+	buf := encodeMCRequest(req)
+	if _, err := overflow.file.WriteAt(buf, overflow.write_offset); err != nil {
+		return err
+	}
+	overflow.write_offset += int64(len(buf))
+	overflow.count++
+	overflow.size += req.Size()
+	return nil
+}
+
+// read back the oldest request in the file
+func (overflow *queueOverflowFile) next() (*mc.MCRequest, error) {
+	header := make([]byte, encoded_request_header_len)
+	if _, err := overflow.file.ReadAt(header, overflow.read_offset); err != nil {
+		return nil, err
+	}
+	reqLen := encodedRequestLen(header)
+	if overflow.read_offset+int64(reqLen) > overflow.write_offset {
+		return nil, ErrorCorruptedQueueOverflow
+	}
+	data := make([]byte, reqLen)
+	if _, err := overflow.file.ReadAt(data, overflow.read_offset); err != nil {
+		return nil, err
+	}
+	req, err := decodeMCRequest(data)
+	if err != nil {
+		return nil, err
+	}
+	overflow.read_offset += int64(reqLen)
+	overflow.count--
+	overflow.size -= req.Size()
+
+	if overflow.count == 0 {
+		// reclaim the disk space once all requests are read back
+		overflow.write_offset = 0
+		overflow.read_offset = 0
+		return req, overflow.file.Truncate(0)
+	}
+	return req, nil
+}
+
+func (overflow *queueOverflowFile) close() error {
+	if err := overflow.file.Close(); err != nil {
+		return err
+	}
+	return os.Remove(overflow.file.Name())
+}
+
+/************************************
+/* struct QueuePart
+*************************************/
+// QueuePart sits between the router and an outgoing nozzle. It buffers the requests routed to
+// the nozzle, so that a slow nozzle does not hold up the dcp nozzles feeding the other nozzles.
+//
+// Requests are held in memory up to the queue size. Beyond that, they overflow to a local file
+// when overflow is enabled, or otherwise wait for room in memory. Once the requests queued in memory
+// and on disk reach the high watermark, Receive blocks until the queue drains to the low watermark,
+// which holds up the upstream parts. BackPressureRaised and BackPressureReleased events are raised
+// when the queue starts and stops applying back-pressure.
+type QueuePart struct {
+
+	//parent inheritance
+	gen_server.GenServer
+	*AbstractPart
+
+	// requests held in memory, oldest first. requests in memory are always older than the ones
+	// on disk, since requests go to disk while there are any on disk
+	items *list.List
+	// total size of the requests in items
+	mem_size int
+	// nil if overflow is disabled
+	overflow *queueOverflowFile
+
+	max_size       int
+	high_watermark int
+	low_watermark  int
+	back_pressure  bool
+
+	// lock on the queue. cond is broadcast when requests are added or removed, and when the part is stopped
+	lock    sync.Mutex
+	cond    *sync.Cond
+	stopped bool
+
+	childrenWaitGrp sync.WaitGroup
+
+	counter_received  int
+	counter_forwarded int
+}
+
+func NewQueuePart(id string,
+	logger_context *log.LoggerContext) *QueuePart {
+
+	//callback functions from GenServer
+	var msg_callback_func gen_server.Msg_Callback_Func
+	var exit_callback_func gen_server.Exit_Callback_Func
+	var error_handler_func gen_server.Error_Handler_Func
+
+	var isStarted_callback_func IsStarted_Callback_Func
+
+	server := gen_server.NewGenServer(&msg_callback_func,
+		nil, &exit_callback_func, &error_handler_func, logger_context, "QueuePart")
+	isStarted_callback_func = server.IsStarted
+	part := NewAbstractPartWithLogger(id, &isStarted_callback_func, server.Logger())
+
+	queue := &QueuePart{GenServer: server, /*gen_server.GenServer*/
+		AbstractPart:   &part, /*AbstractPart*/
+		items:          list.New(),
+		max_size:       default_queue_size,
+		high_watermark: default_queue_size,
+	}
+	queue.cond = sync.NewCond(&queue.lock)
+
+	msg_callback_func = nil
+	exit_callback_func = queue.onExit
+	error_handler_func = queue.handleGeneralError
+	return queue
+}
+
+func (queue *QueuePart) initialize(settings map[string]interface{}) error {
+	err := utils.ValidateSettings(queue_setting_defs, settings, queue.Logger())
+	if err != nil {
+		return err
+	}
+
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	if val, ok := settings[QUEUE_SETTING_SIZE]; ok {
+		queue.max_size = val.(int)
+	}
+	queue.high_watermark = queue.max_size
+	if val, ok := settings[QUEUE_SETTING_HIGH_WATERMARK]; ok {
+		queue.high_watermark = val.(int)
+	}
+	if val, ok := settings[QUEUE_SETTING_OVERFLOW_FILE]; ok && len(val.(string)) > 0 {
+		queue.overflow, err = openQueueOverflowFile(val.(string))
+		if err != nil {
+			return err
+		}
+	} else if queue.high_watermark > queue.max_size {
+		// without overflow, the queue cannot grow beyond the memory
+		queue.high_watermark = queue.max_size
+	}
+	queue.low_watermark = int(float64(queue.high_watermark) * queue_low_watermark_ratio)
+
+	queue.items.Init()
+	queue.mem_size = 0
+	queue.back_pressure = false
+	queue.stopped = false
+	return nil
+}
+
+func (queue *QueuePart) Start(settings map[string]interface{}) error {
+	queue.Logger().Infof("Queue part %v starting ....\n", queue.Id())
+	err := queue.initialize(settings)
+	if err != nil {
+		return err
+	}
+
+	err = queue.Start_server()
+	if err != nil {
+		return err
+	}
+
+	queue.childrenWaitGrp.Add(1)
+	go queue.processData()
+
+	queue.Logger().Infof("Queue part %v is started with size=%v, high watermark=%v, overflow=%v\n", queue.Id(), queue.max_size, queue.high_watermark, queue.overflow != nil)
+	return nil
+}
+
+func (queue *QueuePart) Stop() error {
+	queue.Logger().Infof("Stop QueuePart %v\n", queue.Id())
+	err := queue.Stop_server()
+	queue.Logger().Debugf("QueuePart %v is stopped\n", queue.Id())
+	return err
+}
+
+func (queue *QueuePart) onExit() {
+	//notify the data processing routine and the blocked upstream
+	queue.lock.Lock()
+	queue.stopped = true
+	queue.cond.Broadcast()
+	queue.lock.Unlock()
+	queue.childrenWaitGrp.Wait()
+
+	//cleanup. the requests left in the queue are streamed again from the last checkpoint
+	//when the pipeline is restarted
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	discarded := queue.items.Len()
+	queue.items.Init()
+	queue.mem_size = 0
+	if queue.overflow != nil {
+		discarded += queue.overflow.count
+		if err := queue.overflow.close(); err != nil {
+			queue.Logger().Errorf("Failed to remove overflow file of %v. err=%v\n", queue.Id(), err)
+		}
+		queue.overflow = nil
+	}
+	if discarded > 0 {
+		queue.Logger().Infof("%v discarded %v queued requests\n", queue.Id(), discarded)
+	}
+}
+
+func (queue *QueuePart) Receive(data interface{}) error {
+	req, ok := data.(*mc.MCRequest)
+	if !ok {
+		return ErrorInvalidDataForQueuePart
+	}
+	size := req.Size()
+
+	queue.lock.Lock()
+	for !queue.stopped && (queue.back_pressure || !queue.hasRoom(size)) {
+		queue.cond.Wait()
+	}
+	if queue.stopped {
+		queue.lock.Unlock()
+		return ErrorQueuePartStopped
+	}
+
+	if queue.overflow != nil && (queue.overflow.count > 0 || (queue.items.Len() > 0 && queue.mem_size+size > queue.max_size)) {
+		if err := queue.overflow.append(req); err != nil {
+			queue.lock.Unlock()
+			return err
+		}
+	} else {
+		queue.items.PushBack(req)
+		queue.mem_size += size
+	}
+	queue.counter_received++
+
+	raised := false
+	if queue.queuedSize() >= queue.high_watermark {
+		queue.back_pressure = true
+		raised = true
+	}
+	queue.cond.Broadcast()
+	queue.lock.Unlock()
+
+	if raised {
+		queue.Logger().Infof("%v reached high watermark, applying back-pressure\n", queue.Id())
+		queue.RaiseEvent(common.BackPressureRaised, nil, queue, nil, nil)
+	}
+	return nil
+}
+
+// whether a request of the size can be queued right away. lock needs to be held
+func (queue *QueuePart) hasRoom(size int) bool {
+	// a request larger than the queue size is let in when the memory is empty
+	return queue.overflow != nil || queue.items.Len() == 0 || queue.mem_size+size <= queue.max_size
+}
+
+// total size of the requests in memory and on disk. lock needs to be held
+func (queue *QueuePart) queuedSize() int {
+	size := queue.mem_size
+	if queue.overflow != nil {
+		size += queue.overflow.size
+	}
+	return size
+}
+
+// remove the oldest request from the queue, waiting for one if the queue is empty.
+// returns nil when the part is stopped
+func (queue *QueuePart) dequeue() (*mc.MCRequest, error) {
+	queue.lock.Lock()
+	for !queue.stopped && queue.items.Len() == 0 && (queue.overflow == nil || queue.overflow.count == 0) {
+		queue.cond.Wait()
+	}
+	if queue.stopped {
+		queue.lock.Unlock()
+		return nil, nil
+	}
+
+	var req *mc.MCRequest
+	var err error
+	if queue.items.Len() > 0 {
+		req = queue.items.Remove(queue.items.Front()).(*mc.MCRequest)
+		queue.mem_size -= req.Size()
+	} else {
+		req, err = queue.overflow.next()
+	}
+
+	released := false
+	if err == nil && queue.back_pressure && queue.queuedSize() <= queue.low_watermark {
+		queue.back_pressure = false
+		released = true
+	}
+	queue.cond.Broadcast()
+	queue.lock.Unlock()
+
+	if released {
+		queue.Logger().Infof("%v drained to low watermark, releasing back-pressure\n", queue.Id())
+		queue.RaiseEvent(common.BackPressureReleased, nil, queue, nil, nil)
+	}
+	return req, err
+}
+
+func (queue *QueuePart) processData() {
+	queue.Logger().Infof("%v processData starts..........\n", queue.Id())
+	defer queue.childrenWaitGrp.Done()
+
+	for {
+		req, err := queue.dequeue()
+		if err != nil {
+			// the requests on disk cannot be read back. let the pipeline supervisor restart the pipeline
+			queue.raiseError("reading overflowed requests from disk", err)
+			break
+		}
+		if req == nil {
+			break
+		}
+
+		// forward request downstream through connector
+		if err = queue.Connector().Forward(req); err != nil {
+			queue.raiseError("forwarding requests downstream", err)
+		}
+		queue.counter_forwarded++
+	}
+	queue.Logger().Infof("%v processData exits\n", queue.Id())
+}
+
+// depth of the queue
+func (queue *QueuePart) Statistics() map[string]interface{} {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	var docsOnDisk, sizeOnDisk, backPressure int
+	if queue.overflow != nil {
+		docsOnDisk = queue.overflow.count
+		sizeOnDisk = queue.overflow.size
+	}
+	if queue.back_pressure {
+		backPressure = 1
+	}
+	return map[string]interface{}{QUEUE_STATS_DOCS: queue.items.Len() + docsOnDisk,
+		QUEUE_STATS_SIZE:          queue.mem_size + sizeOnDisk,
+		QUEUE_STATS_DOCS_ON_DISK:  docsOnDisk,
+		QUEUE_STATS_SIZE_ON_DISK:  sizeOnDisk,
+		QUEUE_STATS_BACK_PRESSURE: backPressure}
+}
+
+// the queue is degraded while it holds up the upstream parts
+func (queue *QueuePart) HealthCheck(timeout time.Duration) common.Health {
+	if health := serverHealth(&queue.GenServer, timeout); health.Status != common.HealthOk {
+		return health
+	}
+
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	if queue.back_pressure {
+		return common.NewHealth(common.HealthDegraded, "back pressure is raised")
+	}
+	return common.Healthy
+}
+
+func (queue *QueuePart) StatusSummary() string {
+	return fmt.Sprintf("Queue %v received %v items, forwarded %v items", queue.Id(), queue.counter_received, queue.counter_forwarded)
+}
+
+//errors reported by the server routine, e.g., panics in callbacks
+func (queue *QueuePart) handleGeneralError(err error) {
+	queue.raiseError("running server routine", err)
+}
+
+//raise err, classified with what the queue was doing, to the pipeline supervisor
+func (queue *QueuePart) raiseError(context string, err error) {
+	classified := base.ClassifyError(context, err)
+	queue.Logger().Errorf("Raise error condition %v\n", classified)
+	otherInfo := utils.WrapError(classified)
+	queue.RaiseEvent(common.ErrorEncountered, nil, queue, nil, otherInfo)
+}
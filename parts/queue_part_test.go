@@ -0,0 +1,280 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package parts
+
+import (
+	"bytes"
+	"fmt"
+	common "github.com/Xiaomei-Zhang/goxdcr/common"
+	connector "github.com/Xiaomei-Zhang/goxdcr/connector"
+	mc "github.com/couchbase/gomemcached"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testWaitTime = 2 * time.Second
+
+// downstream part that only takes requests in when it is let go
+type slowPart struct {
+	AbstractPart
+	gate     chan bool
+	received chan *mc.MCRequest
+	started  bool
+	lock     sync.Mutex
+}
+
+func newSlowPart() *slowPart {
+	part := &slowPart{gate: make(chan bool), received: make(chan *mc.MCRequest, 1000)}
+	var isStarted_callback_func IsStarted_Callback_Func = part.IsStarted
+	part.AbstractPart = NewAbstractPart("slow", &isStarted_callback_func)
+	return part
+}
+
+func (part *slowPart) Start(settings map[string]interface{}) error {
+	part.lock.Lock()
+	defer part.lock.Unlock()
+	part.started = true
+	return nil
+}
+
+func (part *slowPart) Stop() error {
+	part.lock.Lock()
+	defer part.lock.Unlock()
+	part.started = false
+	return nil
+}
+
+func (part *slowPart) IsStarted() bool {
+	part.lock.Lock()
+	defer part.lock.Unlock()
+	return part.started
+}
+
+func (part *slowPart) Receive(data interface{}) error {
+	<-part.gate
+	part.received <- data.(*mc.MCRequest)
+	return nil
+}
+
+func (part *slowPart) letGo() {
+	close(part.gate)
+}
+
+// listener that records back-pressure events
+type backPressureListener struct {
+	events chan common.ComponentEventType
+}
+
+func (listener *backPressureListener) OnEvent(eventType common.ComponentEventType,
+	item interface{},
+	component common.Component,
+	derivedItems []interface{},
+	otherInfos map[string]interface{}) {
+	listener.events <- eventType
+}
+
+func newTestRequest(i int) *mc.MCRequest {
+	return &mc.MCRequest{Opcode: mc.SET,
+		DataType: mc.DatatypeFlagJSON,
+		VBucket:  uint16(i % 4),
+		Opaque:   uint32(i),
+		Cas:      uint64(i) << 32,
+		Extras:   []byte{byte(i), 0, 0, 0, 0, 0, 0, 0},
+		Key:      []byte(fmt.Sprintf("key%03d", i)),
+		Body:     bytes.Repeat([]byte{'v'}, 60)}
+}
+
+func startTestQueue(t *testing.T, downstream *slowPart, settings map[string]interface{}) (*QueuePart, *backPressureListener) {
+	queue := NewQueuePart("queue_test", nil)
+	if err := queue.SetConnector(connector.NewSimpleConnector("queue_test_connector", downstream, nil)); err != nil {
+		t.Fatalf("Failed to set connector. err=%v", err)
+	}
+	listener := &backPressureListener{events: make(chan common.ComponentEventType, 10)}
+	queue.RegisterComponentEventListener(common.BackPressureRaised, listener)
+	queue.RegisterComponentEventListener(common.BackPressureReleased, listener)
+	if err := queue.Start(settings); err != nil {
+		t.Fatalf("Failed to start queue part. err=%v", err)
+	}
+	return queue, listener
+}
+
+// queue the first request, and wait for the downstream part to take it and hold on to it
+func queueFirstRequest(t *testing.T, queue *QueuePart) {
+	if err := queue.Receive(newTestRequest(0)); err != nil {
+		t.Fatalf("Failed to queue request 0. err=%v", err)
+	}
+	deadline := time.Now().Add(testWaitTime)
+	for queue.Statistics()[QUEUE_STATS_DOCS] != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Request 0 was not taken by the downstream part")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func expectEvent(t *testing.T, listener *backPressureListener, expected common.ComponentEventType) {
+	select {
+	case eventType := <-listener.events:
+		if eventType != expected {
+			t.Errorf("Expected event %v, got %v", expected, eventType)
+		}
+	case <-time.After(testWaitTime):
+		t.Errorf("Event %v was not raised", expected)
+	}
+}
+
+// check that the downstream part receives the requests from first to last, in order and intact
+func expectReceived(t *testing.T, downstream *slowPart, first, last int) {
+	for i := first; i <= last; i++ {
+		select {
+		case req := <-downstream.received:
+			expected := newTestRequest(i)
+			if req.Opaque != expected.Opaque || req.VBucket != expected.VBucket || req.Cas != expected.Cas || req.Opcode != expected.Opcode || req.DataType != expected.DataType ||
+				!bytes.Equal(req.Extras, expected.Extras) || !bytes.Equal(req.Key, expected.Key) || !bytes.Equal(req.Body, expected.Body) {
+				t.Fatalf("Expected request %v, got request %v with key %s", i, req.Opaque, req.Key)
+			}
+		case <-time.After(testWaitTime):
+			t.Fatalf("Request %v was not received", i)
+		}
+	}
+}
+
+func TestQueuePartBackPressure(t *testing.T) {
+	reqSize := newTestRequest(0).Size()
+	downstream := newSlowPart()
+	queue, listener := startTestQueue(t, downstream, map[string]interface{}{QUEUE_SETTING_SIZE: 10 * reqSize})
+	defer queue.Stop()
+
+	queueFirstRequest(t, queue)
+	for i := 1; i < 11; i++ {
+		if err := queue.Receive(newTestRequest(i)); err != nil {
+			t.Fatalf("Failed to queue request %v. err=%v", i, err)
+		}
+	}
+	expectEvent(t, listener, common.BackPressureRaised)
+	stats := queue.Statistics()
+	if stats[QUEUE_STATS_DOCS] != 10 || stats[QUEUE_STATS_SIZE] != 10*reqSize || stats[QUEUE_STATS_BACK_PRESSURE] != 1 {
+		t.Errorf("Unexpected statistics %v", stats)
+	}
+
+	// the upstream is held up by the full queue
+	blocked := make(chan error)
+	go func() {
+		blocked <- queue.Receive(newTestRequest(11))
+	}()
+	select {
+	case <-blocked:
+		t.Fatalf("Receive did not block when the queue is full")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	downstream.letGo()
+	select {
+	case err := <-blocked:
+		if err != nil {
+			t.Errorf("Failed to queue request 11. err=%v", err)
+		}
+	case <-time.After(testWaitTime):
+		t.Fatalf("Receive was not unblocked when the queue drained")
+	}
+	expectEvent(t, listener, common.BackPressureReleased)
+	expectReceived(t, downstream, 0, 11)
+}
+
+func TestQueuePartOverflow(t *testing.T) {
+	reqSize := newTestRequest(0).Size()
+	overflowFile := filepath.Join(t.TempDir(), "queue_test")
+	downstream := newSlowPart()
+	queue, listener := startTestQueue(t, downstream, map[string]interface{}{QUEUE_SETTING_SIZE: 5 * reqSize,
+		QUEUE_SETTING_HIGH_WATERMARK: 100 * reqSize,
+		QUEUE_SETTING_OVERFLOW_FILE:  overflowFile})
+
+	// requests beyond the queue size overflow to disk instead of holding up the upstream
+	queueFirstRequest(t, queue)
+	for i := 1; i < 51; i++ {
+		if err := queue.Receive(newTestRequest(i)); err != nil {
+			t.Fatalf("Failed to queue request %v. err=%v", i, err)
+		}
+	}
+	stats := queue.Statistics()
+	if stats[QUEUE_STATS_DOCS] != 50 || stats[QUEUE_STATS_DOCS_ON_DISK] != 45 || stats[QUEUE_STATS_SIZE_ON_DISK] != 45*reqSize || stats[QUEUE_STATS_BACK_PRESSURE] != 0 {
+		t.Errorf("Unexpected statistics %v", stats)
+	}
+	select {
+	case eventType := <-listener.events:
+		t.Errorf("Unexpected event %v below high watermark", eventType)
+	default:
+	}
+
+	// requests are delivered in order, including the ones received while earlier requests are on disk
+	downstream.letGo()
+	expectReceived(t, downstream, 0, 20)
+	for i := 51; i < 60; i++ {
+		if err := queue.Receive(newTestRequest(i)); err != nil {
+			t.Fatalf("Failed to queue request %v. err=%v", i, err)
+		}
+	}
+	expectReceived(t, downstream, 21, 59)
+
+	// the disk space is reclaimed once the requests on disk are read back
+	if info, err := os.Stat(overflowFile); err != nil || info.Size() != 0 {
+		t.Errorf("Expected overflow file to be truncated, info=%v, err=%v", info, err)
+	}
+
+	queue.Stop()
+	if _, err := os.Stat(overflowFile); !os.IsNotExist(err) {
+		t.Errorf("Expected overflow file to be removed after stop, err=%v", err)
+	}
+}
+
+func TestQueuePartStop(t *testing.T) {
+	reqSize := newTestRequest(0).Size()
+	downstream := newSlowPart()
+	queue, _ := startTestQueue(t, downstream, map[string]interface{}{QUEUE_SETTING_SIZE: 2 * reqSize})
+
+	queueFirstRequest(t, queue)
+	for i := 1; i < 3; i++ {
+		if err := queue.Receive(newTestRequest(i)); err != nil {
+			t.Fatalf("Failed to queue request %v. err=%v", i, err)
+		}
+	}
+	blocked := make(chan error)
+	go func() {
+		blocked <- queue.Receive(newTestRequest(3))
+	}()
+
+	// the request held by the downstream part is let go, so that the queue part can stop
+	stopped := make(chan error)
+	go func() {
+		stopped <- queue.Stop()
+	}()
+	time.Sleep(100 * time.Millisecond)
+	downstream.letGo()
+
+	select {
+	case err := <-blocked:
+		if err != ErrorQueuePartStopped {
+			t.Errorf("Expected %v from blocked Receive, got %v", ErrorQueuePartStopped, err)
+		}
+	case <-time.After(testWaitTime):
+		t.Fatalf("Receive was not unblocked when the queue part stopped")
+	}
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Errorf("Failed to stop queue part. err=%v", err)
+		}
+	case <-time.After(testWaitTime):
+		t.Fatalf("Queue part did not stop")
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package parts
+
+import (
+	"sync"
+	"time"
+)
+
+//the span of the sliding window over which target nozzles count timed out and acknowledged requests
+var RequestStatsWindow = 60 * time.Second
+
+//number of buckets the window is made of. Requests leave the window one bucket at a time
+const request_window_buckets = 12
+
+/************************************
+/* struct RequestStats
+*************************************/
+//RequestStats are the requests that target nozzles have sent over a sliding window
+type RequestStats struct {
+	//requests that timed out and were resent, counted when they first time out
+	TimedOut uint64
+	//requests acknowledged by the target, and those of them that never timed out
+	Acked       uint64
+	AckedInTime uint64
+	//time from when the acknowledged requests were first sent till they were acknowledged
+	TotalLatency time.Duration
+	MaxLatency   time.Duration
+}
+
+func (stats *RequestStats) Add(other *RequestStats) {
+	stats.TimedOut += other.TimedOut
+	stats.Acked += other.Acked
+	stats.AckedInTime += other.AckedInTime
+	stats.TotalLatency += other.TotalLatency
+	if other.MaxLatency > stats.MaxLatency {
+		stats.MaxLatency = other.MaxLatency
+	}
+}
+
+//Requests is the number of requests that either timed out or were acknowledged in time.
+//each request is counted once
+func (stats *RequestStats) Requests() uint64 {
+	return stats.TimedOut + stats.AckedInTime
+}
+
+//TimeoutPercentage is the percentage of the requests that timed out
+func (stats *RequestStats) TimeoutPercentage() float64 {
+	if stats.Requests() == 0 {
+		return 0
+	}
+	return float64(stats.TimedOut) * 100 / float64(stats.Requests())
+}
+
+func (stats *RequestStats) AvgLatency() time.Duration {
+	if stats.Acked == 0 {
+		return 0
+	}
+	return stats.TotalLatency / time.Duration(stats.Acked)
+}
+
+/************************************
+/* struct requestWindow
+*************************************/
+//requestWindow counts requests over a sliding window made of buckets, each of which covers an
+//equal part of the window. It is thread safe
+type requestWindow struct {
+	window  time.Duration
+	span    time.Duration
+	buckets []*requestBucket
+	lock    sync.Mutex
+}
+
+type requestBucket struct {
+	start time.Time
+	stats RequestStats
+}
+
+func newRequestWindow(window time.Duration, num_of_buckets int) *requestWindow {
+	buckets := make([]*requestBucket, num_of_buckets)
+	for i := range buckets {
+		buckets[i] = &requestBucket{}
+	}
+	return &requestWindow{window: window,
+		span:    window / time.Duration(num_of_buckets),
+		buckets: buckets}
+}
+
+//the bucket that now falls in, which is emptied if it was last used in an earlier round of the window
+func (w *requestWindow) bucket(now time.Time) *requestBucket {
+	start := now.Truncate(w.span)
+	bucket := w.buckets[int(start.UnixNano()/int64(w.span))%len(w.buckets)]
+	if !bucket.start.Equal(start) {
+		bucket.start = start
+		bucket.stats = RequestStats{}
+	}
+	return bucket
+}
+
+func (w *requestWindow) timedOut() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.bucket(time.Now()).stats.TimedOut++
+}
+
+func (w *requestWindow) acked(latency time.Duration, timed_out bool) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	stats := &w.bucket(time.Now()).stats
+	stats.Acked++
+	if !timed_out {
+		stats.AckedInTime++
+	}
+	stats.TotalLatency += latency
+	if latency > stats.MaxLatency {
+		stats.MaxLatency = latency
+	}
+}
+
+//stats of the buckets that are still in the window
+func (w *requestWindow) stats() *RequestStats {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	stats := &RequestStats{}
+	oldest := time.Now().Truncate(w.span).Add(-w.window)
+	for _, bucket := range w.buckets {
+		if bucket.start.After(oldest) {
+			stats.Add(&bucket.stats)
+		}
+	}
+	return stats
+}
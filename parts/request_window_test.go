@@ -0,0 +1,44 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package parts
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRequestWindow(t *testing.T) {
+	window := newRequestWindow(200*time.Millisecond, 4)
+	// two requests time out, one of which is acknowledged later, and two are acknowledged in time
+	window.timedOut()
+	window.timedOut()
+	window.acked(30*time.Millisecond, true)
+	window.acked(10*time.Millisecond, false)
+	window.acked(20*time.Millisecond, false)
+
+	stats := window.stats()
+	if stats.TimedOut != 2 || stats.Acked != 3 || stats.AckedInTime != 2 || stats.Requests() != 4 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+	if stats.TimeoutPercentage() != 50 {
+		t.Errorf("Expected 50%% of the requests to time out, got %v", stats.TimeoutPercentage())
+	}
+	if stats.AvgLatency() != 20*time.Millisecond || stats.MaxLatency != 30*time.Millisecond {
+		t.Errorf("Unexpected average latency %v or max latency %v", stats.AvgLatency(), stats.MaxLatency)
+	}
+
+	// the requests leave the window once it has passed
+	time.Sleep(250 * time.Millisecond)
+	window.acked(10*time.Millisecond, false)
+	stats = window.stats()
+	if stats.TimedOut != 0 || stats.Acked != 1 || stats.TimeoutPercentage() != 0 {
+		t.Errorf("Unexpected stats after the window has passed %+v", stats)
+	}
+}
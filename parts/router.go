@@ -77,23 +77,34 @@ func ComposeMCRequest(event *mcc.UprEvent) *mc.MCRequest {
 		Extras:  make([]byte, 224)}
 	//opCode
 	req.Opcode = event.Opcode
+	//datatype, which flags values that are already compressed
+	req.DataType = event.Datatype
 
 	//extra
 	if event.Opcode == mc.UPR_MUTATION || event.Opcode == mc.UPR_DELETION ||
 		event.Opcode == mc.UPR_EXPIRATION {
 		binary.BigEndian.PutUint64(req.Extras, event.Seqno)
-		binary.BigEndian.PutUint32(req.Extras, event.Flags)
-		binary.BigEndian.PutUint32(req.Extras, event.Expiry)
+		binary.BigEndian.PutUint32(req.Extras[8:], event.Flags)
+		binary.BigEndian.PutUint32(req.Extras[12:], event.Expiry)
 	} else if event.Opcode == mc.UPR_SNAPSHOT {
 		binary.BigEndian.PutUint64(req.Extras, event.Seqno)
-		binary.BigEndian.PutUint64(req.Extras, event.SnapstartSeq)
-		binary.BigEndian.PutUint64(req.Extras, event.SnapendSeq)
-		binary.BigEndian.PutUint32(req.Extras, event.SnapshotType)
+		binary.BigEndian.PutUint64(req.Extras[8:], event.SnapstartSeq)
+		binary.BigEndian.PutUint64(req.Extras[16:], event.SnapendSeq)
+		binary.BigEndian.PutUint32(req.Extras[24:], event.SnapshotType)
 	}
 
 	return req
 }
 
+// seqno of a mutation, deletion or expiration composed by ComposeMCRequest.
+// It is lost once the request is adjusted to be sent to the target
+func SeqnoOfMCRequest(req *mc.MCRequest) uint64 {
+	if len(req.Extras) < 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(req.Extras)
+}
+
 // Implementation of the routing algorithm
 // Currently doing static dispatching based on vbucket number.
 func (router *Router) route(data interface{}) (map[string]interface{}, error) {
@@ -110,7 +121,7 @@ func (router *Router) route(data interface{}) (map[string]interface{}, error) {
 		if !router.filterRegexp.Match(uprEvent.Key) {
 			// if data does not match filter expression, drop it. return empty result
 			router.RaiseEvent(common.DataFiltered, uprEvent, router, nil, nil)
-			router.Logger().Debugf("Data with key=%v has been filtered out", string(uprEvent.Key))
+			router.Logger().Debugf("Data with key=%v has been filtered out", log.UserData(uprEvent.Key))
 			return result, nil
 		}
 	}
@@ -0,0 +1,456 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package parts
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/Xiaomei-Zhang/goxdcr/log"
+	mc "github.com/couchbase/gomemcached"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// what to do when a request is appended to a full spool
+type SpoolOverflowPolicy int
+
+const (
+	// the appending goroutine, and in turn the source, is blocked until the spool drains
+	SpoolOverflowBlock SpoolOverflowPolicy = iota
+	// the spooled requests are dropped. the replication falls back to streaming from the last checkpoint
+	SpoolOverflowDrop
+)
+
+const (
+	spool_segment_prefix = "spool_"
+	spool_segment_suffix = ".seg"
+	// where the read position is kept when the spool is closed
+	spool_read_offset_file     = "read_offset"
+	default_spool_segment_size = 64 * 1024 * 1024
+
+	// a record in a segment is the checksum and the length of the encoded request, followed by the encoded request
+	spool_record_header_len = 4 + 4
+)
+
+var ErrorSpoolFull = errors.New("Spool is full.")
+var ErrorSpoolClosed = errors.New("Spool is closed.")
+var ErrorCorruptedSpoolRecord = errors.New("Spool record is corrupted.")
+
+/************************************
+/* struct spoolSegment
+*************************************/
+type spoolSegment struct {
+	seqno uint64
+	file  *os.File
+	// bytes of the valid records in the file
+	size int64
+}
+
+/************************************
+/* struct Spool
+*************************************/
+// Spool is a durable queue of requests in a local directory. Requests are appended to segment
+// files, each record carrying a checksum, and are read back in the order they were appended,
+// which keeps the requests of each vbucket in order. Segments are removed once they are read
+// through. Segments left over by an earlier run are picked up when the spool is opened; a torn
+// or corrupted record, and everything after it in its segment, is discarded.
+//
+// Segments are synced to disk when they are full and when the spool is closed, along with the
+// read position. After a crash, the records popped from the oldest segment are read back again.
+type Spool struct {
+	dir          string
+	max_size     int64
+	policy       SpoolOverflowPolicy
+	segment_size int64
+
+	// segments, oldest first. records are appended to the last segment and read from the first one
+	segments    []*spoolSegment
+	next_seqno  uint64
+	read_offset int64
+	// the oldest request, which is read back but not popped yet, and the length of its record
+	head     *mc.MCRequest
+	head_len int64
+
+	// number and total size of the records not popped yet
+	count     int
+	size      int64
+	vb_counts map[uint16]int
+
+	closed bool
+	lock   sync.Mutex
+	cond   *sync.Cond
+	logger *log.CommonLogger
+}
+
+func OpenSpool(dir string, max_size int64, policy SpoolOverflowPolicy, logger *log.CommonLogger) (*Spool, error) {
+	spool := &Spool{dir: dir,
+		max_size:     max_size,
+		policy:       policy,
+		segment_size: default_spool_segment_size,
+		segments:     make([]*spoolSegment, 0),
+		next_seqno:   1,
+		vb_counts:    make(map[uint16]int),
+		logger:       logger}
+	spool.cond = sync.NewCond(&spool.lock)
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	seqnos, err := spool.segmentSeqnos()
+	if err != nil {
+		return nil, err
+	}
+	readSeqno, readOffset := spool.loadReadOffset()
+	for _, seqno := range seqnos {
+		spool.next_seqno = seqno + 1
+		var start int64 = 0
+		if len(spool.segments) == 0 && seqno == readSeqno {
+			start = readOffset
+		}
+		segment, start, err := spool.recoverSegment(seqno, start)
+		if err != nil {
+			spool.closeSegments()
+			return nil, err
+		}
+		if segment.size == start {
+			segment.file.Close()
+			os.Remove(segment.file.Name())
+			continue
+		}
+		if len(spool.segments) == 0 {
+			spool.read_offset = start
+		}
+		spool.segments = append(spool.segments, segment)
+	}
+	if len(spool.segments) == 0 {
+		if _, err = spool.newSegment(); err != nil {
+			return nil, err
+		}
+	}
+	spool.logger.Infof("Spool %v is opened with %v requests of %v bytes\n", dir, spool.count, spool.size)
+	return spool, nil
+}
+
+// seqnos of the segments in the spool directory, in ascending order
+func (spool *Spool) segmentSeqnos() ([]uint64, error) {
+	infos, err := ioutil.ReadDir(spool.dir)
+	if err != nil {
+		return nil, err
+	}
+	seqnos := make([]uint64, 0)
+	for _, info := range infos {
+		name := info.Name()
+		if !strings.HasPrefix(name, spool_segment_prefix) || !strings.HasSuffix(name, spool_segment_suffix) {
+			continue
+		}
+		seqno, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, spool_segment_prefix), spool_segment_suffix), 10, 64)
+		if err == nil {
+			seqnos = append(seqnos, seqno)
+		}
+	}
+	sort.Sort(uint64Slice(seqnos))
+	return seqnos, nil
+}
+
+func (spool *Spool) segmentPath(seqno uint64) string {
+	return filepath.Join(spool.dir, fmt.Sprintf("%v%020d%v", spool_segment_prefix, seqno, spool_segment_suffix))
+}
+
+// the read position kept by the last Close, if any. it is removed once loaded, since it goes stale
+// as soon as records are popped
+func (spool *Spool) loadReadOffset() (uint64, int64) {
+	path := filepath.Join(spool.dir, spool_read_offset_file)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, 0
+	}
+	os.Remove(path)
+
+	var seqno uint64
+	var offset int64
+	if _, err = fmt.Sscanf(string(data), "%d %d", &seqno, &offset); err != nil {
+		spool.logger.Errorf("Ignore invalid read offset of spool %v. err=%v\n", spool.dir, err)
+		return 0, 0
+	}
+	return seqno, offset
+}
+
+// open a segment left over by an earlier run, and count its valid records from the start offset.
+// returns the start offset actually used, which is 0 if the one passed in is not on a record boundary
+func (spool *Spool) recoverSegment(seqno uint64, start int64) (*spoolSegment, int64, error) {
+	file, err := os.OpenFile(spool.segmentPath(seqno), os.O_RDWR, 0600)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	segment := &spoolSegment{seqno: seqno, file: file, size: info.Size()}
+
+	offsets := make([]int64, 0)
+	vbnos := make([]uint16, 0)
+	var offset int64 = 0
+	for offset < segment.size {
+		req, recordLen, err := readSpoolRecord(segment, offset)
+		if err != nil {
+			spool.logger.Errorf("Discard %v bytes from offset %v of spool segment %v. err=%v\n", segment.size-offset, offset, file.Name(), err)
+			if err = file.Truncate(offset); err != nil {
+				file.Close()
+				return nil, 0, err
+			}
+			segment.size = offset
+			break
+		}
+		offsets = append(offsets, offset)
+		vbnos = append(vbnos, req.VBucket)
+		offset += recordLen
+	}
+	offsets = append(offsets, segment.size)
+
+	startIndex := sort.Search(len(offsets), func(i int) bool { return offsets[i] >= start })
+	if startIndex == len(offsets) || offsets[startIndex] != start {
+		spool.logger.Errorf("Read offset %v of spool segment %v is not on a record boundary, read it from the start\n", start, file.Name())
+		startIndex = 0
+	}
+	for i := startIndex; i < len(vbnos); i++ {
+		spool.count++
+		spool.size += offsets[i+1] - offsets[i]
+		spool.vb_counts[vbnos[i]]++
+	}
+	return segment, offsets[startIndex], nil
+}
+
+func (spool *Spool) newSegment() (*spoolSegment, error) {
+	file, err := os.OpenFile(spool.segmentPath(spool.next_seqno), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	segment := &spoolSegment{seqno: spool.next_seqno, file: file}
+	spool.next_seqno++
+	spool.segments = append(spool.segments, segment)
+	return segment, nil
+}
+
+func readSpoolRecord(segment *spoolSegment, offset int64) (*mc.MCRequest, int64, error) {
+	if offset+spool_record_header_len > segment.size {
+		return nil, 0, ErrorCorruptedSpoolRecord
+	}
+	header := make([]byte, spool_record_header_len)
+	if _, err := segment.file.ReadAt(header, offset); err != nil {
+		return nil, 0, err
+	}
+	dataLen := int64(binary.BigEndian.Uint32(header[4:]))
+	if offset+spool_record_header_len+dataLen > segment.size {
+		return nil, 0, ErrorCorruptedSpoolRecord
+	}
+	data := make([]byte, dataLen)
+	if _, err := segment.file.ReadAt(data, offset+spool_record_header_len); err != nil {
+		return nil, 0, err
+	}
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header) {
+		return nil, 0, ErrorCorruptedSpoolRecord
+	}
+	req, err := decodeMCRequest(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	return req, spool_record_header_len + dataLen, nil
+}
+
+// Append appends the request to the spool. When the spool is full, it either blocks until the
+// spool drains, or drops all spooled requests and returns ErrorSpoolFull, depending on the
+// overflow policy
+func (spool *Spool) Append(req *mc.MCRequest) error {
+	data := encodeMCRequest(req)
+	record := make([]byte, spool_record_header_len+len(data))
+	binary.BigEndian.PutUint32(record, crc32.ChecksumIEEE(data))
+	binary.BigEndian.PutUint32(record[4:], uint32(len(data)))
+	copy(record[spool_record_header_len:], data)
+	recordLen := int64(len(record))
+
+	spool.lock.Lock()
+	defer spool.lock.Unlock()
+
+	// a request is always let in when the spool is empty, however large it is
+	for !spool.closed && spool.count > 0 && spool.size+recordLen > spool.max_size {
+		if spool.policy == SpoolOverflowDrop {
+			spool.logger.Errorf("Spool %v is full, drop %v requests of %v bytes\n", spool.dir, spool.count, spool.size)
+			if err := spool.clear(); err != nil {
+				return err
+			}
+			return ErrorSpoolFull
+		}
+		spool.cond.Wait()
+	}
+	if spool.closed {
+		return ErrorSpoolClosed
+	}
+
+	var err error
+	segment := spool.segments[len(spool.segments)-1]
+	if segment.size > 0 && segment.size+recordLen > spool.segment_size {
+		if err = segment.file.Sync(); err != nil {
+			return err
+		}
+		if segment, err = spool.newSegment(); err != nil {
+			return err
+		}
+	}
+	if _, err = segment.file.WriteAt(record, segment.size); err != nil {
+		return err
+	}
+	segment.size += recordLen
+	spool.count++
+	spool.size += recordLen
+	spool.vb_counts[req.VBucket]++
+	return nil
+}
+
+// Peek returns the oldest request in the spool without removing it, or nil when the spool is empty
+func (spool *Spool) Peek() (*mc.MCRequest, error) {
+	spool.lock.Lock()
+	defer spool.lock.Unlock()
+
+	if spool.closed {
+		return nil, ErrorSpoolClosed
+	}
+	if spool.head == nil && spool.count > 0 {
+		req, recordLen, err := readSpoolRecord(spool.segments[0], spool.read_offset)
+		if err != nil {
+			return nil, err
+		}
+		spool.head = req
+		spool.head_len = recordLen
+	}
+	return spool.head, nil
+}
+
+// Pop removes the oldest request in the spool, which has been returned by Peek
+func (spool *Spool) Pop() error {
+	spool.lock.Lock()
+	defer spool.lock.Unlock()
+
+	if spool.closed {
+		return ErrorSpoolClosed
+	}
+	if spool.head == nil {
+		return nil
+	}
+	vbno := spool.head.VBucket
+	spool.vb_counts[vbno]--
+	if spool.vb_counts[vbno] == 0 {
+		delete(spool.vb_counts, vbno)
+	}
+	spool.read_offset += spool.head_len
+	spool.count--
+	spool.size -= spool.head_len
+	spool.head = nil
+	spool.head_len = 0
+	spool.cond.Broadcast()
+
+	// reclaim the disk space of the segment once it is read through
+	segment := spool.segments[0]
+	if spool.read_offset < segment.size {
+		return nil
+	}
+	spool.read_offset = 0
+	if len(spool.segments) > 1 {
+		spool.segments = spool.segments[1:]
+		segment.file.Close()
+		return os.Remove(segment.file.Name())
+	}
+	segment.size = 0
+	return segment.file.Truncate(0)
+}
+
+// HasVB returns whether there are spooled requests of the vbucket. Requests of such a vbucket
+// need to be spooled behind them to stay in order
+func (spool *Spool) HasVB(vbno uint16) bool {
+	spool.lock.Lock()
+	defer spool.lock.Unlock()
+	return spool.vb_counts[vbno] > 0
+}
+
+func (spool *Spool) Count() int {
+	spool.lock.Lock()
+	defer spool.lock.Unlock()
+	return spool.count
+}
+
+func (spool *Spool) Size() int64 {
+	spool.lock.Lock()
+	defer spool.lock.Unlock()
+	return spool.size
+}
+
+// drop all spooled requests. the caller holds the lock
+func (spool *Spool) clear() error {
+	for _, segment := range spool.segments {
+		segment.file.Close()
+		if err := os.Remove(segment.file.Name()); err != nil {
+			return err
+		}
+	}
+	spool.segments = spool.segments[:0]
+	spool.read_offset = 0
+	spool.head = nil
+	spool.head_len = 0
+	spool.count = 0
+	spool.size = 0
+	spool.vb_counts = make(map[uint16]int)
+	spool.cond.Broadcast()
+	_, err := spool.newSegment()
+	return err
+}
+
+// Close syncs the spooled requests to disk and unblocks the goroutines waiting to append.
+// The segments are kept, and are picked up when the spool is opened again
+func (spool *Spool) Close() error {
+	spool.lock.Lock()
+	defer spool.lock.Unlock()
+
+	if spool.closed {
+		return nil
+	}
+	spool.closed = true
+	spool.cond.Broadcast()
+	err := spool.closeSegments()
+	if err == nil && spool.read_offset > 0 {
+		err = ioutil.WriteFile(filepath.Join(spool.dir, spool_read_offset_file),
+			[]byte(fmt.Sprintf("%d %d", spool.segments[0].seqno, spool.read_offset)), 0600)
+	}
+	return err
+}
+
+func (spool *Spool) closeSegments() error {
+	var err error
+	for _, segment := range spool.segments {
+		if syncErr := segment.file.Sync(); syncErr != nil && err == nil {
+			err = syncErr
+		}
+		segment.file.Close()
+	}
+	return err
+}
+
+type uint64Slice []uint64
+
+func (s uint64Slice) Len() int           { return len(s) }
+func (s uint64Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s uint64Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,182 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package parts
+
+import (
+	"bytes"
+	"github.com/Xiaomei-Zhang/goxdcr/log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var spoolTestLogger = log.NewLogger("SpoolTest", nil)
+
+func openTestSpool(t *testing.T, dir string, max_size int64, policy SpoolOverflowPolicy) *Spool {
+	spool, err := OpenSpool(dir, max_size, policy, spoolTestLogger)
+	if err != nil {
+		t.Fatalf("Failed to open spool. err=%v", err)
+	}
+	// a few requests per segment
+	spool.segment_size = 1024
+	return spool
+}
+
+func appendTestRequests(t *testing.T, spool *Spool, first, last int) {
+	for i := first; i <= last; i++ {
+		if err := spool.Append(newTestRequest(i)); err != nil {
+			t.Fatalf("Failed to spool request %v. err=%v", i, err)
+		}
+	}
+}
+
+// check that the spool gives back the requests from first to last, in order and intact
+func expectSpooled(t *testing.T, spool *Spool, first, last int) {
+	for i := first; i <= last; i++ {
+		req, err := spool.Peek()
+		if err != nil || req == nil {
+			t.Fatalf("Failed to read back request %v. req=%v, err=%v", i, req, err)
+		}
+		expected := newTestRequest(i)
+		if req.Opaque != expected.Opaque || req.VBucket != expected.VBucket || req.Cas != expected.Cas || req.Opcode != expected.Opcode || req.DataType != expected.DataType ||
+			!bytes.Equal(req.Extras, expected.Extras) || !bytes.Equal(req.Key, expected.Key) || !bytes.Equal(req.Body, expected.Body) {
+			t.Fatalf("Expected request %v, got request %v with key %s", i, req.Opaque, req.Key)
+		}
+		if err = spool.Pop(); err != nil {
+			t.Fatalf("Failed to pop request %v. err=%v", i, err)
+		}
+	}
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, spool_segment_prefix+"*"+spool_segment_suffix))
+	if err != nil {
+		t.Fatalf("Failed to list segments. err=%v", err)
+	}
+	return files
+}
+
+func TestSpoolOrderAcrossRestarts(t *testing.T) {
+	dir := t.TempDir()
+	spool := openTestSpool(t, dir, 1024*1024, SpoolOverflowBlock)
+	appendTestRequests(t, spool, 0, 49)
+	if len(segmentFiles(t, dir)) < 5 {
+		t.Errorf("Expected requests to be spread over segments, got %v", segmentFiles(t, dir))
+	}
+	// requests of vbuckets 0 to 3 are spooled
+	if !spool.HasVB(3) || spool.HasVB(4) {
+		t.Errorf("Unexpected vbuckets in spool")
+	}
+
+	expectSpooled(t, spool, 0, 9)
+	if err := spool.Close(); err != nil {
+		t.Fatalf("Failed to close spool. err=%v", err)
+	}
+
+	// the spool picks up from where it was closed
+	spool = openTestSpool(t, dir, 1024*1024, SpoolOverflowBlock)
+	if spool.Count() != 40 {
+		t.Errorf("Expected 40 requests after reopening, got %v", spool.Count())
+	}
+	appendTestRequests(t, spool, 50, 59)
+	expectSpooled(t, spool, 10, 59)
+	if req, err := spool.Peek(); req != nil || err != nil {
+		t.Errorf("Expected spool to be empty, got req=%v, err=%v", req, err)
+	}
+	if spool.HasVB(0) || spool.Size() != 0 {
+		t.Errorf("Unexpected vbuckets or size in empty spool")
+	}
+	// segments are removed once they are read through
+	if files := segmentFiles(t, dir); len(files) != 1 {
+		t.Errorf("Expected a single segment left, got %v", files)
+	}
+	spool.Close()
+}
+
+func TestSpoolDiscardsTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	spool := openTestSpool(t, dir, 1024*1024, SpoolOverflowBlock)
+	spool.segment_size = default_spool_segment_size
+	appendTestRequests(t, spool, 0, 9)
+	spool.Close()
+
+	// a crash in the middle of appending the last request
+	files := segmentFiles(t, dir)
+	info, _ := os.Stat(files[0])
+	if err := os.Truncate(files[0], info.Size()-10); err != nil {
+		t.Fatalf("Failed to truncate segment. err=%v", err)
+	}
+
+	spool = openTestSpool(t, dir, 1024*1024, SpoolOverflowBlock)
+	defer spool.Close()
+	if spool.Count() != 9 {
+		t.Errorf("Expected 9 intact requests, got %v", spool.Count())
+	}
+	appendTestRequests(t, spool, 10, 10)
+	expectSpooled(t, spool, 0, 8)
+	expectSpooled(t, spool, 10, 10)
+}
+
+func TestSpoolOverflowPolicies(t *testing.T) {
+	recordLen := int64(spool_record_header_len + len(encodeMCRequest(newTestRequest(0))))
+
+	// drop policy
+	spool := openTestSpool(t, t.TempDir(), 5*recordLen, SpoolOverflowDrop)
+	appendTestRequests(t, spool, 0, 4)
+	if err := spool.Append(newTestRequest(5)); err != ErrorSpoolFull {
+		t.Errorf("Expected %v, got %v", ErrorSpoolFull, err)
+	}
+	if spool.Count() != 0 || spool.HasVB(0) {
+		t.Errorf("Expected spooled requests to be dropped, got %v requests", spool.Count())
+	}
+	appendTestRequests(t, spool, 6, 6)
+	expectSpooled(t, spool, 6, 6)
+	spool.Close()
+
+	// block policy
+	spool = openTestSpool(t, t.TempDir(), 5*recordLen, SpoolOverflowBlock)
+	appendTestRequests(t, spool, 0, 4)
+	blocked := make(chan error)
+	go func() {
+		blocked <- spool.Append(newTestRequest(5))
+	}()
+	select {
+	case <-blocked:
+		t.Fatalf("Append did not block when the spool is full")
+	case <-time.After(100 * time.Millisecond):
+	}
+	expectSpooled(t, spool, 0, 0)
+	select {
+	case err := <-blocked:
+		if err != nil {
+			t.Errorf("Failed to spool request 5. err=%v", err)
+		}
+	case <-time.After(testWaitTime):
+		t.Fatalf("Append was not unblocked when the spool drained")
+	}
+	expectSpooled(t, spool, 1, 5)
+
+	// closing the spool unblocks appends
+	appendTestRequests(t, spool, 0, 4)
+	go func() {
+		blocked <- spool.Append(newTestRequest(5))
+	}()
+	time.Sleep(100 * time.Millisecond)
+	spool.Close()
+	select {
+	case err := <-blocked:
+		if err != ErrorSpoolClosed {
+			t.Errorf("Expected %v, got %v", ErrorSpoolClosed, err)
+		}
+	case <-time.After(testWaitTime):
+		t.Fatalf("Append was not unblocked when the spool closed")
+	}
+}
@@ -11,6 +11,8 @@ package parts
 
 import (
 	"github.com/Xiaomei-Zhang/goxdcr/common"
+	"github.com/Xiaomei-Zhang/goxdcr/gen_server"
+	"time"
 )
 
 type XDCRPart interface {
@@ -18,3 +20,15 @@ type XDCRPart interface {
 	HeartBeat_sync() bool
 	HeartBeat_async(respchan chan []interface{}) error
 }
+
+//health of a part based on its gen_server, which fails when the part is not started,
+//or when its server routine does not respond to a heartbeat within timeout
+func serverHealth(server *gen_server.GenServer, timeout time.Duration) common.Health {
+	if !server.IsStarted() {
+		return common.NewHealth(common.HealthFailed, "not started")
+	}
+	if !server.Responsive(timeout) {
+		return common.NewHealth(common.HealthFailed, "not responding")
+	}
+	return common.Healthy
+}
@@ -20,6 +20,7 @@ import (
 	"github.com/Xiaomei-Zhang/goxdcr/utils"
 	mc "github.com/couchbase/gomemcached"
 	mcc "github.com/couchbase/gomemcached/client"
+	"github.com/golang/snappy"
 	"io"
 	//	"math"
 	"math/rand"
@@ -42,6 +43,17 @@ const (
 	XMEM_SETTING_WRITE_TIMEOUT         = "write_timeout"
 	XMEM_SETTING_BATCH_EXPIRATION_TIME = "batch_expiration_time"
 	XMEM_SETTING_MAX_RETRY_INTERVAL    = "max_retry_interval"
+	//the local directory of the spool that requests are appended to while the target is unreachable.
+	//spooling is disabled when it is not specified
+	XMEM_SETTING_SPOOL_DIR             = "spool_dir"
+	XMEM_SETTING_SPOOL_MAX_SIZE        = "spool_max_size"
+	XMEM_SETTING_SPOOL_OVERFLOW_POLICY = "spool_overflow_policy"
+	//whether only the mutation with the highest seqno of each key in a batch is sent
+	XMEM_SETTING_DEDUP                 = "dedup"
+	//whether the bodies of mutations are compressed with snappy when the target supports it,
+	//and the min size of the bodies that are compressed
+	XMEM_SETTING_COMPRESSION           = "compression"
+	XMEM_SETTING_COMPRESSION_THRESHOLD = "compression_threshold"
 
 	//default configuration
 	default_batchcount int = 500
@@ -53,8 +65,27 @@ const (
 	default_batchExpirationTime               = 400 * time.Millisecond
 	default_maxRetryInterval                  = 30 * time.Second
 	default_writeTimeOut        time.Duration = time.Duration(1) * time.Second
+	default_spoolMaxSize                      = 1024 * 1024 * 1024
+	default_compressionThreshold              = 256
 )
 
+//statistics names
+const (
+	XMEM_STATS_DOCS_SPOOLED = "docs_spooled"
+	XMEM_STATS_SIZE_SPOOLED = "size_spooled"
+	//mutations that have gone through deduplication, and those dropped by it
+	XMEM_STATS_DOCS_DEDUP_CHECKED = "docs_dedup_checked"
+	XMEM_STATS_DOCS_DEDUPED       = "docs_deduped"
+
+	//sizes of the mutation bodies compressed by xmem, before and after compression
+	XMEM_STATS_SIZE_BEFORE_COMPRESSION = "size_before_compression"
+	XMEM_STATS_SIZE_AFTER_COMPRESSION  = "size_after_compression"
+)
+
+//key in the otherInfos of DataSent and DataDeduped events, with the seqno of the mutation in its
+//source vbucket. The seqno in the extras of the request is gone once it is adjusted to be sent
+const XMEM_EVENT_ADDI_SEQNO = "seqno"
+
 const (
 	SET_WITH_META    = mc.CommandCode(0xa2)
 	DELETE_WITH_META = mc.CommandCode(0xa8)
@@ -67,6 +98,12 @@ var xmem_setting_defs base.SettingDefinitions = base.SettingDefinitions{XMEM_SET
 	XMEM_SETTING_RESP_TIMEOUT:          base.NewSettingDef(reflect.TypeOf((*time.Duration)(nil)), false),
 	XMEM_SETTING_WRITE_TIMEOUT:         base.NewSettingDef(reflect.TypeOf((*time.Duration)(nil)), false),
 	XMEM_SETTING_MAX_RETRY_INTERVAL:    base.NewSettingDef(reflect.TypeOf((*time.Duration)(nil)), false),
+	XMEM_SETTING_SPOOL_DIR:             base.NewSettingDef(reflect.TypeOf((*string)(nil)), false),
+	XMEM_SETTING_SPOOL_MAX_SIZE:        base.NewSettingDef(reflect.TypeOf((*int)(nil)), false),
+	XMEM_SETTING_SPOOL_OVERFLOW_POLICY: base.NewSettingDef(reflect.TypeOf((*SpoolOverflowPolicy)(nil)), false),
+	XMEM_SETTING_DEDUP:                 base.NewSettingDef(reflect.TypeOf((*bool)(nil)), false),
+	XMEM_SETTING_COMPRESSION:           base.NewSettingDef(reflect.TypeOf((*bool)(nil)), false),
+	XMEM_SETTING_COMPRESSION_THRESHOLD: base.NewSettingDef(reflect.TypeOf((*int)(nil)), false),
 	XMEM_SETTING_BATCH_EXPIRATION_TIME: base.NewSettingDef(reflect.TypeOf((*time.Duration)(nil)), false)}
 
 /************************************
@@ -75,10 +112,14 @@ var xmem_setting_defs base.SettingDefinitions = base.SettingDefinitions{XMEM_SET
 
 type bufferedMCRequest struct {
 	req          *mc.MCRequest
+	//seqno of the request in its source vbucket, which is zeroed in req by adjustRequest
+	seqno        uint64
 	sent_time    time.Time
 	num_of_retry int
 	err          error
 	reservation  int
+	//whether the request has timed out and been resent
+	timed_out    bool
 }
 
 func newBufferedMCRequest(request *mc.MCRequest, reservationNum int) *bufferedMCRequest {
@@ -95,10 +136,11 @@ func newBufferedMCRequest(request *mc.MCRequest, reservationNum int) *bufferedMC
 ************************************************************/
 type requestBuffer struct {
 	slots           []*bufferedMCRequest /*slots to store the data*/
+	slot_locks      []sync.Mutex         /*lock of each slot, guarding the slot and the request in it*/
 	sequences       []uint16
 	empty_slots_pos chan uint16 /*empty slot pos in the buffer*/
 	size            uint16      /*the size of the buffer*/
-	notifych        chan bool   /*notify channel is set when the buffer is below threshold*/
+	notifych        chan bool   /*notified when the buffer is below threshold*/
 	//	notify_allowed  bool   /*notify is allowed*/
 	notify_threshold uint16
 	logger           *log.CommonLogger
@@ -108,10 +150,11 @@ func newReqBuffer(size uint16, threshold uint16, logger *log.CommonLogger) *requ
 	logger.Debugf("Create a new request buffer of size %d\n", size)
 	buf := &requestBuffer{
 		make([]*bufferedMCRequest, size, size),
+		make([]sync.Mutex, size),
 		make([]uint16, size),
 		make(chan uint16, size),
 		size,
-		nil,
+		make(chan bool, 1),
 		threshold,
 		logger}
 
@@ -140,16 +183,27 @@ func (buf *requestBuffer) initializeEmptySlotPos() error {
 
 //blocking until the occupied slots are below threshold
 func (buf *requestBuffer) flowControl() {
+	//drop the notification left from the last time the buffer went below threshold
+	select {
+	case <-buf.notifych:
+	default:
+	}
 	ret := buf.size-uint16(len(buf.empty_slots_pos)) <= buf.notify_threshold
 	if ret {
 		return
 	}
-	buf.notifych = make(chan bool, 1)
 	<-buf.notifych
-	buf.notifych = nil
 	return
 }
 
+//unblock the caller waiting in flowControl
+func (buf *requestBuffer) releaseFlowControl() {
+	select {
+	case buf.notifych <- true:
+	default:
+	}
+}
+
 func (buf *requestBuffer) validatePos(pos uint16) (err error) {
 	err = nil
 	if pos < 0 || int(pos) >= len(buf.slots) {
@@ -159,7 +213,7 @@ func (buf *requestBuffer) validatePos(pos uint16) (err error) {
 	return
 }
 
-//slot allow caller to get hold of the content in the slot without locking the slot
+//slot allow caller to get hold of the content in the slot. The slot is only locked while it is read
 //@pos - the position of the slot
 func (buf *requestBuffer) slot(pos uint16) (*mc.MCRequest, error) {
 	buf.logger.Debugf("Getting the content in slot %d\n", pos)
@@ -169,7 +223,9 @@ func (buf *requestBuffer) slot(pos uint16) (*mc.MCRequest, error) {
 		return nil, err
 	}
 
+	buf.slot_locks[pos].Lock()
 	req := buf.slots[pos]
+	buf.slot_locks[pos].Unlock()
 
 	if req == nil {
 		return nil, nil
@@ -179,9 +235,26 @@ func (buf *requestBuffer) slot(pos uint16) (*mc.MCRequest, error) {
 
 }
 
+//slotSeqno returns the seqno in its source vbucket of the request in the slot
+//@pos - the position of the slot
+func (buf *requestBuffer) slotSeqno(pos uint16) (uint64, error) {
+	err := buf.validatePos(pos)
+	if err != nil {
+		return 0, err
+	}
+
+	buf.slot_locks[pos].Lock()
+	defer buf.slot_locks[pos].Unlock()
+	if buf.slots[pos] == nil {
+		return 0, nil
+	}
+	return buf.slots[pos].seqno, nil
+}
+
 //modSlot allow caller to do book-keeping on the slot, like updating num_of_retry, err
 //@pos - the position of the slot
-//@modFunc - the callback function which is going to update the slot
+//@modFunc - the callback function which is going to update the slot. It is called with the slot locked,
+//so it must not call back into the buffer
 func (buf *requestBuffer) modSlot(pos uint16, modFunc func(req *bufferedMCRequest, p uint16) (bool, error)) (bool, error) {
 	var err error = nil
 	err = buf.validatePos(pos)
@@ -189,6 +262,8 @@ func (buf *requestBuffer) modSlot(pos uint16, modFunc func(req *bufferedMCReques
 		return false, err
 	}
 
+	buf.slot_locks[pos].Lock()
+	defer buf.slot_locks[pos].Unlock()
 	req := buf.slots[pos]
 
 	var modified bool
@@ -203,35 +278,35 @@ func (buf *requestBuffer) modSlot(pos uint16, modFunc func(req *bufferedMCReques
 
 //evictSlot allow caller to empty the slot
 //@pos - the position of the slot
-//note: not concurrency safe, should be called only in one goroutine
+//note: should be called only in one goroutine
 func (buf *requestBuffer) evictSlot(pos uint16) error {
 
 	err := buf.validatePos(pos)
 	if err != nil {
 		return err
 	}
+	buf.slot_locks[pos].Lock()
 	req := buf.slots[pos]
 	buf.slots[pos] = nil
 
 	if req != nil {
-		buf.empty_slots_pos <- pos
-
 		//increase sequence
 		if buf.sequences[pos]+1 > 65535 {
 			buf.sequences[pos] = 0
 		} else {
 			buf.sequences[pos] = buf.sequences[pos] + 1
 		}
+	}
+	buf.slot_locks[pos].Unlock()
+
+	if req != nil {
+		buf.empty_slots_pos <- pos
 
 		if buf.size-uint16(len(buf.empty_slots_pos)) <= buf.notify_threshold {
-			if buf.notifych != nil {
-				select {
-				case buf.notifych <- true:
-					buf.logger.Debugf("buffer's occupied slots is below threshold %v, notify", buf.notify_threshold)
-				default:
-				}
-			} else {
-				buf.logger.Debugf("buffer's occupied slots is below threshold %v, no notify channel is specified though", buf.notify_threshold)
+			select {
+			case buf.notifych <- true:
+				buf.logger.Debugf("buffer's occupied slots is below threshold %v, notify", buf.notify_threshold)
+			default:
 			}
 		}
 	}
@@ -250,7 +325,9 @@ func (buf *requestBuffer) reserveSlot() (error, uint16, int) {
 	//generate a random number
 	reservation_num = rand.Int()
 	req := newBufferedMCRequest(nil, reservation_num)
+	buf.slot_locks[index].Lock()
 	buf.slots[index] = req
+	buf.slot_locks[index].Unlock()
 	return nil, uint16(index), reservation_num
 }
 
@@ -258,8 +335,7 @@ func (buf *requestBuffer) cancelReservation(index uint16, reservation_num int) e
 
 	err := buf.validatePos(index)
 	if err == nil {
-		buf.empty_slots_pos <- index
-
+		buf.slot_locks[index].Lock()
 		req := buf.slots[index]
 		var reservation_num int
 
@@ -270,17 +346,22 @@ func (buf *requestBuffer) cancelReservation(index uint16, reservation_num int) e
 		} else {
 			err = errors.New("Cancel reservation failed, reservation number doesn't match")
 		}
+		buf.slot_locks[index].Unlock()
+
+		buf.empty_slots_pos <- index
 	}
 	return err
 }
 
-func (buf *requestBuffer) enSlot(pos uint16, req *mc.MCRequest, reservationNum int) error {
+func (buf *requestBuffer) enSlot(pos uint16, req *mc.MCRequest, seqno uint64, reservationNum int) error {
 	buf.logger.Debugf("enSlot: pos=%d\n", pos)
 
 	err := buf.validatePos(pos)
 	if err != nil {
 		return err
 	}
+	buf.slot_locks[pos].Lock()
+	defer buf.slot_locks[pos].Unlock()
 	r := buf.slots[pos]
 
 	if r == nil {
@@ -291,6 +372,7 @@ func (buf *requestBuffer) enSlot(pos uint16, req *mc.MCRequest, reservationNum i
 			return errors.New(fmt.Sprintf("Can't enSlot %d, doesn't have the reservation", pos))
 		}
 		r.req = req
+		r.seqno = seqno
 	}
 	buf.logger.Debugf("slot %d is occupied\n", pos)
 	return nil
@@ -300,6 +382,106 @@ func (buf *requestBuffer) bufferSize() uint16 {
 	return buf.size
 }
 
+/************************************
+/* struct keySequencer
+*************************************/
+type sequencerKey struct {
+	vbno uint16
+	key  string
+}
+
+//keySequencer keeps the mutations of each key in the order they are received, across resends
+//and reconnects. A mutation is only sent when no earlier mutation of its key is waiting for
+//response. The mutations behind it are held until the response comes, so that an earlier
+//mutation resent after a timeout, TMPFAIL or reconnect never lands on the target after a later one
+type keySequencer struct {
+	//keys with a mutation waiting for response -> mutations of the key held behind it
+	keys map[sequencerKey][]*mc.MCRequest
+	//mutations whose turn has come, to be sent by the sending routine
+	released []*mc.MCRequest
+	//notified when mutations are released
+	release_ch chan bool
+	lock       sync.Mutex
+}
+
+func newKeySequencer() *keySequencer {
+	return &keySequencer{keys: make(map[sequencerKey][]*mc.MCRequest),
+		released:   make([]*mc.MCRequest, 0),
+		release_ch: make(chan bool, 1)}
+}
+
+//acquire returns true if the mutation can be sent now. Otherwise, the mutation is held, and is
+//released once the earlier mutations of its key are responded
+func (seq *keySequencer) acquire(req *mc.MCRequest) bool {
+	seq.lock.Lock()
+	defer seq.lock.Unlock()
+
+	key := sequencerKey{req.VBucket, string(req.Key)}
+	if held, ok := seq.keys[key]; ok {
+		seq.keys[key] = append(held, req)
+		return false
+	}
+	seq.keys[key] = nil
+	return true
+}
+
+//tryAcquire returns true if the mutation can be sent now. Unlike acquire, the mutation is not held
+//otherwise, so that the caller keeps it and tries again later
+func (seq *keySequencer) tryAcquire(req *mc.MCRequest) bool {
+	seq.lock.Lock()
+	defer seq.lock.Unlock()
+
+	key := sequencerKey{req.VBucket, string(req.Key)}
+	if _, ok := seq.keys[key]; ok {
+		return false
+	}
+	seq.keys[key] = nil
+	return true
+}
+
+//release is called when the mutation is responded. The next mutation of its key, if any, is released
+func (seq *keySequencer) release(req *mc.MCRequest) {
+	seq.lock.Lock()
+	defer seq.lock.Unlock()
+
+	key := sequencerKey{req.VBucket, string(req.Key)}
+	held, ok := seq.keys[key]
+	if !ok {
+		return
+	}
+	if len(held) == 0 {
+		delete(seq.keys, key)
+		return
+	}
+	seq.keys[key] = held[1:]
+	seq.released = append(seq.released, held[0])
+	seq.notify()
+}
+
+//requeue puts back a released mutation that could not be sent, so that it is sent again before the
+//later mutations of its key
+func (seq *keySequencer) requeue(req *mc.MCRequest) {
+	seq.lock.Lock()
+	defer seq.lock.Unlock()
+	seq.released = append(seq.released, req)
+}
+
+//takeReleased returns the released mutations, which are the sender's to send from then on
+func (seq *keySequencer) takeReleased() []*mc.MCRequest {
+	seq.lock.Lock()
+	defer seq.lock.Unlock()
+	released := seq.released
+	seq.released = make([]*mc.MCRequest, 0)
+	return released
+}
+
+func (seq *keySequencer) notify() {
+	select {
+	case seq.release_ch <- true:
+	default:
+	}
+}
+
 /************************************
 /* struct xmemConfig
 *************************************/
@@ -316,7 +498,17 @@ type xmemConfig struct {
 	connectStr string
 	bucketName string
 	password   string
-	logger     *log.CommonLogger
+	//spooling is disabled when spoolDir is empty
+	spoolDir            string
+	spoolMaxSize        int
+	spoolOverflowPolicy SpoolOverflowPolicy
+	dedup               bool
+
+	//compression only takes effect when the target supports snappy
+	compression          bool
+	compressionThreshold int
+
+	logger *log.CommonLogger
 }
 
 func newConfig(logger *log.CommonLogger) xmemConfig {
@@ -328,9 +520,15 @@ func newConfig(logger *log.CommonLogger) xmemConfig {
 		maxRetryInterval:    default_maxRetryInterval,
 		maxRetry:            default_numofretry,
 		//		mode:                default_mode,
-		connectStr: "",
-		bucketName: "",
-		password:   "",
+		connectStr:          "",
+		bucketName:          "",
+		password:            "",
+		spoolDir:            "",
+		spoolMaxSize:        default_spoolMaxSize,
+		spoolOverflowPolicy: SpoolOverflowBlock,
+		dedup:               false,
+		compression:          false,
+		compressionThreshold: default_compressionThreshold,
 	}
 
 }
@@ -358,6 +556,24 @@ func (config *xmemConfig) initializeConfig(settings map[string]interface{}) erro
 	if val, ok := settings[XMEM_SETTING_MAX_RETRY_INTERVAL]; ok {
 		config.maxRetryInterval = val.(time.Duration)
 	}
+	if val, ok := settings[XMEM_SETTING_SPOOL_DIR]; ok {
+		config.spoolDir = val.(string)
+	}
+	if val, ok := settings[XMEM_SETTING_SPOOL_MAX_SIZE]; ok {
+		config.spoolMaxSize = val.(int)
+	}
+	if val, ok := settings[XMEM_SETTING_SPOOL_OVERFLOW_POLICY]; ok {
+		config.spoolOverflowPolicy = val.(SpoolOverflowPolicy)
+	}
+	if val, ok := settings[XMEM_SETTING_DEDUP]; ok {
+		config.dedup = val.(bool)
+	}
+	if val, ok := settings[XMEM_SETTING_COMPRESSION]; ok {
+		config.compression = val.(bool)
+	}
+	if val, ok := settings[XMEM_SETTING_COMPRESSION_THRESHOLD]; ok {
+		config.compressionThreshold = val.(int)
+	}
 	return err
 }
 
@@ -429,6 +645,8 @@ type XmemNozzle struct {
 	//memcached client connected to the target bucket
 	lock_connection sync.RWMutex
 	memClient       *mcc.Client
+	//whether the target accepts snappy compressed bodies, as negotiated when memClient is opened
+	target_snappy bool
 
 	//configurable parameter
 	config xmemConfig
@@ -447,13 +665,39 @@ type XmemNozzle struct {
 	//buffer for the sent, but not yet confirmed data
 	buf *requestBuffer
 
+	//keeps the mutations of each key in order
+	sequencer *keySequencer
+
 	sender_finch   chan bool
 	receiver_finch chan bool
 	checker_finch  chan bool
-
+	spool_finch    chan bool
+
+	//spool for the requests that can't be sent while the target is unreachable. nil if spooling is disabled
+	spool *Spool
+	//whether the request at the head of the spool has acquired its key from the sequencer. it keeps
+	//the key across failed sends, so that no later mutation of the key is sent before it.
+	//only accessed by the routine draining the spool
+	spool_head_acquired bool
+	target_down         bool
+	lock_target sync.RWMutex
+
+	//guarded by lock_stats, since they are read by the checking routine
 	counter_sent     int
 	counter_received int
 	start_time       time.Time
+
+	//statistics of deduplication, read by Statistics() from other routines
+	counter_dedup_checked int
+	counter_deduped       int
+
+	//statistics of compression
+	counter_size_before_compression int
+	counter_size_after_compression  int
+	lock_stats                      sync.RWMutex
+
+	//requests that timed out and those acknowledged, over a sliding window
+	request_window *requestWindow
 }
 
 func NewXmemNozzle(id string,
@@ -493,7 +737,8 @@ func NewXmemNozzle(id string,
 		sender_finch:    make(chan bool),
 		//		send_allow_ch:    make(chan bool, 1), /*send_allow_ch chan bool*/
 		counter_sent:     0,
-		counter_received: 0}
+		counter_received: 0,
+		request_window:   newRequestWindow(RequestStatsWindow, request_window_buckets)}
 
 	xmem.config.connectStr = connectString
 	xmem.config.bucketName = bucketName
@@ -507,6 +752,8 @@ func NewXmemNozzle(id string,
 }
 
 func (xmem *XmemNozzle) Open() error {
+	xmem.lock_bOpen.Lock()
+	defer xmem.lock_bOpen.Unlock()
 	if !xmem.bOpen {
 		xmem.bOpen = true
 
@@ -515,6 +762,8 @@ func (xmem *XmemNozzle) Open() error {
 }
 
 func (xmem *XmemNozzle) Close() error {
+	xmem.lock_bOpen.Lock()
+	defer xmem.lock_bOpen.Unlock()
 	if xmem.bOpen {
 		xmem.bOpen = false
 	}
@@ -534,6 +783,11 @@ func (xmem *XmemNozzle) Start(settings map[string]interface{}) error {
 
 		xmem.childrenWaitGrp.Add(1)
 		go xmem.processData_batch(xmem.sender_finch, &xmem.childrenWaitGrp)
+
+		if xmem.spool != nil {
+			xmem.childrenWaitGrp.Add(1)
+			go xmem.drainSpool(xmem.spool_finch, &xmem.childrenWaitGrp)
+		}
 	}
 	xmem.start_time = time.Now()
 	if err == nil {
@@ -551,11 +805,11 @@ func (xmem *XmemNozzle) getReadyToShutdown() {
 		if len(xmem.dataChan) == 0 && len(xmem.batches_ready) == 0 {
 			xmem.Logger().Debug("Ready to stop")
 			break
-		} else if len(xmem.batches_ready) == 0 && xmem.batch.count() > 0 {
+		} else if len(xmem.batches_ready) == 0 && xmem.batchCount() > 0 {
 			xmem.batchReady()
 
 		} else {
-			xmem.Logger().Debugf("%d in data channel, %d batches ready, % data in current batch \n", len(xmem.dataChan), len(xmem.batches_ready), xmem.batch.count())
+			xmem.Logger().Debugf("%d in data channel, %d batches ready, % data in current batch \n", len(xmem.dataChan), len(xmem.batches_ready), xmem.batchCount())
 		}
 	}
 
@@ -569,7 +823,8 @@ func (xmem *XmemNozzle) Stop() error {
 	conn := xmem.memClient.Hijack()
 	conn.(*net.TCPConn).SetReadDeadline(time.Now())
 
-	xmem.Logger().Debugf("XmemNozzle %v processed %v items\n", xmem.Id(), xmem.counter_sent)
+	_, counter_sent := xmem.counters()
+	xmem.Logger().Debugf("XmemNozzle %v processed %v items\n", xmem.Id(), counter_sent)
 	err := xmem.Stop_server()
 
 	conn.(*net.TCPConn).SetReadDeadline(time.Date(1, time.January, 0, 0, 0, 0, 0, time.UTC))
@@ -578,6 +833,8 @@ func (xmem *XmemNozzle) Stop() error {
 }
 
 func (xmem *XmemNozzle) IsOpen() bool {
+	xmem.lock_bOpen.RLock()
+	defer xmem.lock_bOpen.RUnlock()
 	ret := xmem.bOpen
 	return ret
 }
@@ -601,23 +858,55 @@ func (xmem *XmemNozzle) batchReady() {
 
 }
 
+//the current batch is swapped by batchReady, which can be called from the checking routine as well.
+//it is only accessed while holding batch_move_ch
+
+//accumulate a request in the current batch. returns true if the batch is full
+func (xmem *XmemNozzle) accumuBatch(size int) bool {
+	<-xmem.batch_move_ch
+	defer func() { xmem.batch_move_ch <- true }()
+	return xmem.batch.accumuBatch(size)
+}
+
+func (xmem *XmemNozzle) batchCount() int {
+	<-xmem.batch_move_ch
+	defer func() { xmem.batch_move_ch <- true }()
+	return xmem.batch.count()
+}
+
+//returns whether the current batch has expired, and the time it expires at
+func (xmem *XmemNozzle) batchExpired() (bool, time.Time) {
+	<-xmem.batch_move_ch
+	defer func() { xmem.batch_move_ch <- true }()
+	expire_time := xmem.batch.start_time.Add(xmem.batch.expiring_duration)
+	select {
+	case <-xmem.batch.expire_ch:
+		return true, expire_time
+	default:
+		return false, expire_time
+	}
+}
+
 func (xmem *XmemNozzle) Receive(data interface{}) error {
-	xmem.Logger().Debugf("data key=%v is received", data.(*mc.MCRequest).Key)
+	xmem.Logger().Debugf("data key=%v is received", log.UserData(data.(*mc.MCRequest).Key))
 	xmem.Logger().Debugf("data channel len is %d\n", len(xmem.dataChan))
 
 	request := data.(*mc.MCRequest)
 
 	xmem.dataChan <- request
 
+	xmem.lock_stats.Lock()
 	xmem.counter_received++
+	counter_received := xmem.counter_received
+	xmem.lock_stats.Unlock()
 
 	//accumulate the batchCount and batchSize
-	if xmem.batch.accumuBatch(data.(*mc.MCRequest).Size()) {
+	if xmem.accumuBatch(data.(*mc.MCRequest).Size()) {
 		xmem.batchReady()
 	}
 	//raise DataReceived event
 	xmem.RaiseEvent(common.DataReceived, data.(*mc.MCRequest), xmem, nil, nil)
-	xmem.Logger().Debugf("Xmem %v received %v items\n", xmem.Id(), xmem.counter_received)
+	xmem.Logger().Debugf("Xmem %v received %v items\n", xmem.Id(), counter_received)
 
 	return nil
 }
@@ -632,12 +921,24 @@ func (xmem *XmemNozzle) processData_batch(finch chan bool, waitGrp *sync.WaitGro
 			case <-finch:
 				goto done
 			case batch := <-xmem.batches_ready:
-				xmem.buf.flowControl()
-				xmem.Logger().Debugf("%v Batch Send..., %v batches ready, %v items in queue, count_recieved=%v, count_sent=%v\n", xmem.Id(), len(xmem.batches_ready), len(xmem.dataChan), xmem.counter_received, xmem.counter_sent)
+				if !xmem.isTargetDown() {
+					xmem.buf.flowControl()
+				}
+				counter_received, counter_sent := xmem.counters()
+				xmem.Logger().Debugf("%v Batch Send..., %v batches ready, %v items in queue, count_recieved=%v, count_sent=%v\n", xmem.Id(), len(xmem.batches_ready), len(xmem.dataChan), counter_received, counter_sent)
 				err = xmem.send_internal(batch)
 				if err != nil {
-					xmem.handleGeneralError(err)
+					xmem.raiseError("sending batch to target", err)
 				}
+			case <-xmem.sequencer.release_ch:
+				xmem.sendReleased()
+			}
+		} else {
+			//nothing is sent while the nozzle is closed, but the routine still exits when asked to
+			select {
+			case <-finch:
+				goto done
+			case <-time.After(100 * time.Millisecond):
 			}
 		}
 	}
@@ -647,6 +948,14 @@ done:
 }
 
 func (xmem *XmemNozzle) onExit() {
+	//unblock the routines waiting on the spool. the spooled requests are kept for the next run
+	if xmem.spool != nil {
+		if err := xmem.spool.Close(); err != nil {
+			xmem.Logger().Errorf("%v Failed to close spool. err=%v\n", xmem.Id(), err)
+		}
+		xmem.spool_finch <- true
+	}
+
 	//notify the data processing routine
 	xmem.sender_finch <- true
 	xmem.receiver_finch <- true
@@ -662,52 +971,132 @@ func (xmem *XmemNozzle) onExit() {
 }
 
 func (xmem *XmemNozzle) batchSendWithRetry(batch *xmemBatch, numOfRetry int) error {
-	var err error
 	count := batch.count()
 
+	items := make([]*mc.MCRequest, count)
 	for i := 0; i < count; i++ {
+		items[i] = <-xmem.dataChan
+	}
+	if xmem.config.dedup {
+		items = xmem.dedup(items)
+	}
 
-		item := <-xmem.dataChan
-		//blocking
-		err, index, reserv_num := xmem.buf.reserveSlot()
-		if err != nil {
-			return err
+	for _, item := range items {
+		if xmem.spool != nil && (xmem.isTargetDown() || xmem.spool.HasVB(item.VBucket)) {
+			//requests of the vbucket stay behind the ones already spooled
+			xmem.spoolRequest(item)
+			continue
 		}
 
-		xmem.adjustRequest(item, index)
-		item_byte := item.Bytes()
+		if !xmem.sequencer.acquire(item) {
+			//sent once the earlier mutations of its key are responded
+			continue
+		}
+		xmem.sendWithRetry(item, numOfRetry)
+	}
 
-		for j := 0; j < numOfRetry; j++ {
-			conn := xmem.memClient.Hijack()
-			conn.(*net.TCPConn).SetWriteDeadline(time.Now().Add(xmem.config.writeTimeout * time.Second))
-			_, err = conn.Write(item_byte)
-			if err == nil {
-				break
-			} else {
-				xmem.Logger().Errorf("%v batchSend: transmit error: %s\n", xmem.Id(), fmt.Sprint(err))
+	//log the data
+	return nil
+}
 
-				if !isSeriousError(err) {
-					xmem.Logger().Errorf("%v batchSend Failed, retry later\n", xmem.Id())
-					time.Sleep(time.Duration(2^(j+1)) * xmem.config.writeTimeout * time.Second)
-				} else {
-					xmem.repairConn(xmem.memClient)
-				}
-			}
+//dedup keeps only the mutation with the highest seqno of each key in the batch, in its place in the batch.
+//The dropped mutations are superseded by the kept one. A DataDeduped event is raised for each of them,
+//so that their seqnos are counted as processed, as a later seqno of the vbucket is sent in their place
+func (xmem *XmemNozzle) dedup(items []*mc.MCRequest) []*mc.MCRequest {
+	latest := make(map[sequencerKey]int)
+	for i, item := range items {
+		key := sequencerKey{item.VBucket, string(item.Key)}
+		if j, ok := latest[key]; !ok || SeqnoOfMCRequest(item) >= SeqnoOfMCRequest(items[j]) {
+			latest[key] = i
 		}
+	}
 
-		if err == nil {
-			err = xmem.buf.enSlot(index, item, reserv_num)
+	kept := make([]*mc.MCRequest, 0, len(latest))
+	for i, item := range items {
+		if latest[sequencerKey{item.VBucket, string(item.Key)}] == i {
+			kept = append(kept, item)
+		} else {
+			xmem.RaiseEvent(common.DataDeduped, item, xmem, nil, map[string]interface{}{XMEM_EVENT_ADDI_SEQNO: SeqnoOfMCRequest(item)})
 		}
+	}
 
-		if err != nil {
-			xmem.Logger().Errorf("%v Failed to send. err=%v\n", xmem.Id(), err)
-			xmem.buf.cancelReservation(index, reserv_num)
+	xmem.lock_stats.Lock()
+	xmem.counter_dedup_checked += len(items)
+	xmem.counter_deduped += len(items) - len(kept)
+	xmem.lock_stats.Unlock()
+	xmem.Logger().Debugf("%v dropped %v of %v mutations in batch\n", xmem.Id(), len(items)-len(kept), len(items))
+	return kept
+}
+
+//send a mutation acquired from the sequencer
+func (xmem *XmemNozzle) sendWithRetry(item *mc.MCRequest, numOfRetry int) {
+	//blocking
+	err, index, reserv_num := xmem.buf.reserveSlot()
+	if err != nil {
+		xmem.Logger().Errorf("%v Failed to reserve slot. err=%v\n", xmem.Id(), err)
+		xmem.sequencer.release(item)
+		return
+	}
+
+	//adjustRequest replaces the extras that hold the seqno. The original extras are put back if
+	//the request is not sent, so that it keeps its seqno when it is sent again or spooled
+	seqno := SeqnoOfMCRequest(item)
+	extras := item.Extras
+	xmem.encodeBody(item)
+	xmem.adjustRequest(item, index)
+	item_byte := item.Bytes()
+
+	for j := 0; j < numOfRetry; j++ {
+		conn := xmem.memClient.Hijack()
+		conn.(*net.TCPConn).SetWriteDeadline(time.Now().Add(xmem.config.writeTimeout * time.Second))
+		_, err = conn.Write(item_byte)
+		if err == nil {
+			break
+		} else {
+			xmem.Logger().Errorf("%v batchSend: transmit error: %s\n", xmem.Id(), fmt.Sprint(err))
+
+			if !isSeriousError(err) {
+				xmem.Logger().Errorf("%v batchSend Failed, retry later\n", xmem.Id())
+				time.Sleep(time.Duration(2^(j+1)) * xmem.config.writeTimeout * time.Second)
+			} else {
+				xmem.repairConn(xmem.memClient)
+				if xmem.isTargetDown() {
+					break
+				}
+			}
 		}
+	}
 
+	if err == nil {
+		err = xmem.buf.enSlot(index, item, seqno, reserv_num)
 	}
 
-	//log the data
-	return err
+	if err != nil {
+		xmem.Logger().Errorf("%v Failed to send. err=%v\n", xmem.Id(), err)
+		xmem.buf.cancelReservation(index, reserv_num)
+		item.Extras = extras
+		if xmem.spool != nil {
+			//kept in memory, ahead of the later mutations of its key, which may be spooled meanwhile.
+			//it is sent again once the target recovers
+			xmem.sequencer.requeue(item)
+			if !xmem.isTargetDown() {
+				xmem.sequencer.notify()
+			}
+		} else {
+			xmem.sequencer.release(item)
+		}
+	}
+}
+
+//send the mutations released by the sequencer
+func (xmem *XmemNozzle) sendReleased() {
+	if xmem.isTargetDown() {
+		//sent once the target recovers
+		return
+	}
+	for _, item := range xmem.sequencer.takeReleased() {
+		xmem.sendWithRetry(item, xmem.config.maxRetry)
+	}
 }
 
 func (xmem *XmemNozzle) send_internal(batch *xmemBatch) error {
@@ -717,8 +1106,11 @@ func (xmem *XmemNozzle) send_internal(batch *xmemBatch) error {
 
 		xmem.Logger().Infof("Send batch count=%d\n", count)
 
+		xmem.lock_stats.Lock()
 		xmem.counter_sent = xmem.counter_sent + count
-		xmem.Logger().Debugf("So far, xmem %v processed %d items", xmem.Id(), xmem.counter_sent)
+		counter_sent := xmem.counter_sent
+		xmem.lock_stats.Unlock()
+		xmem.Logger().Debugf("So far, xmem %v processed %d items", xmem.Id(), counter_sent)
 
 		//batch send
 		err = xmem.batchSendWithRetry(batch, xmem.config.maxRetry)
@@ -745,10 +1137,22 @@ func (xmem *XmemNozzle) sendSingleWithRetry(adjustRequest bool, item *mc.MCReque
 }
 
 func (xmem *XmemNozzle) sendSingle(adjustRequest bool, item *mc.MCRequest, index uint16) error {
+	err := xmem.transmit(adjustRequest, item, index)
+	if err != nil && isSeriousError(err) {
+		xmem.repairConn(xmem.memClient)
+	}
+	return err
+}
+
+//write the request to the target without repairing the connection on error. It is called by the
+//callbacks of modSlot, with the slot locked, which can't repair the connection since the repair
+//resends the requests in all the slots
+func (xmem *XmemNozzle) transmit(adjustRequest bool, item *mc.MCRequest, index uint16) error {
 	if xmem.memClient != nil {
+		xmem.encodeBody(item)
 		if adjustRequest {
 			xmem.adjustRequest(item, index)
-			xmem.Logger().Debugf("key=%v\n", item.Key)
+			xmem.Logger().Debugf("key=%v\n", log.UserData(item.Key))
 			xmem.Logger().Debugf("opcode=%v\n", item.Opcode)
 		}
 		bytes := item.Bytes()
@@ -759,16 +1163,47 @@ func (xmem *XmemNozzle) sendSingle(adjustRequest bool, item *mc.MCRequest, index
 
 		if err != nil {
 			xmem.Logger().Errorf("%v sendSingle: transmit error: %s\n", xmem.Id(), fmt.Sprint(err))
-			if isSeriousError(err) {
-
-				xmem.repairConn(xmem.memClient)
-			}
 			return err
 		}
 	}
 	return nil
 }
 
+//encodeBody compresses the body of a mutation with snappy when compression is on, the target
+//supports snappy, and the body is at least compressionThreshold long. A body that is already
+//compressed is passed through to a target that supports snappy, and is decompressed for a target
+//that does not, e.g., after reconnecting to a target that no longer negotiates snappy
+func (xmem *XmemNozzle) encodeBody(item *mc.MCRequest) {
+	compressed := item.DataType&mc.DatatypeFlagSnappy != 0
+	if compressed && !xmem.target_snappy {
+		body, err := snappy.Decode(nil, item.Body)
+		if err != nil {
+			xmem.Logger().Errorf("%v Failed to decompress body of key %v. err=%v\n", xmem.Id(), log.UserData(item.Key), err)
+			return
+		}
+		item.Body = body
+		item.DataType &^= mc.DatatypeFlagSnappy
+		return
+	}
+
+	if compressed || !xmem.target_snappy || !xmem.config.compression ||
+		len(item.Body) < xmem.config.compressionThreshold || (item.Opcode != mc.UPR_MUTATION && item.Opcode != SET_WITH_META) {
+		return
+	}
+	body := snappy.Encode(nil, item.Body)
+	if len(body) >= len(item.Body) {
+		//not worth it
+		return
+	}
+
+	xmem.lock_stats.Lock()
+	xmem.counter_size_before_compression += len(item.Body)
+	xmem.counter_size_after_compression += len(body)
+	xmem.lock_stats.Unlock()
+	item.Body = body
+	item.DataType |= mc.DatatypeFlagSnappy
+}
+
 //TODO: who will release the pool? maybe it should be replication manager
 //
 func (xmem *XmemNozzle) initializeConnection() (err error) {
@@ -778,7 +1213,12 @@ func (xmem *XmemNozzle) initializeConnection() (err error) {
 	if err == nil {
 		xmem.memClient, err = pool.Get()
 	}
-	return err
+	if err != nil {
+		//errors from the pool are already classified, e.g., when the target bucket is missing
+		return base.ClassifyError("connecting to target bucket "+xmem.config.bucketName, err)
+	}
+	xmem.target_snappy = pool.Features().Snappy
+	return nil
 }
 
 func (xmem *XmemNozzle) getPoolName(connectionStr string) string {
@@ -792,6 +1232,10 @@ func (xmem *XmemNozzle) initNewBatch() {
 
 func (xmem *XmemNozzle) initialize(settings map[string]interface{}) error {
 	err := xmem.config.initializeConfig(settings)
+	if err != nil {
+		//restarting does not help with invalid settings
+		err = base.NewClassifiedError(base.ErrorClassConfiguration, "initializing xmem settings", err)
+	}
 	xmem.dataChan = make(chan *mc.MCRequest, xmem.config.maxCount*100)
 	xmem.batches_ready = make(chan *xmemBatch, 100)
 
@@ -805,9 +1249,16 @@ func (xmem *XmemNozzle) initialize(settings map[string]interface{}) error {
 	xmem.batch_move_ch <- true
 
 	xmem.buf = newReqBuffer(uint16(xmem.config.maxCount*100), uint16(float64(xmem.config.maxCount)*0.2), xmem.Logger())
+	xmem.sequencer = newKeySequencer()
+	xmem.spool_head_acquired = false
 
 	xmem.receiver_finch = make(chan bool, 1)
 	xmem.checker_finch = make(chan bool, 1)
+	xmem.spool_finch = make(chan bool, 1)
+
+	if err == nil && xmem.config.spoolDir != "" {
+		xmem.spool, err = OpenSpool(xmem.config.spoolDir, int64(xmem.config.spoolMaxSize), xmem.config.spoolOverflowPolicy, xmem.Logger())
+	}
 
 	xmem.Logger().Debug("About to start initializing connection")
 	if err == nil {
@@ -823,27 +1274,47 @@ func (xmem *XmemNozzle) repairConn(client *mcc.Client) {
 	xmem.lock_connection.Lock()
 	defer xmem.lock_connection.Unlock()
 
-	if client == xmem.memClient {
+	//while the target is down, drainSpool is the one reconnecting to it
+	if client == xmem.memClient && !xmem.isTargetDown() {
 		xmem.Logger().Infof("%v connection is broken, try to repair...\n", xmem.Id())
-		pool, err := base.ConnPoolMgr().GetOrCreatePool(xmem.getPoolName(xmem.config.connectStr), xmem.config.connectStr, xmem.config.bucketName, xmem.config.password, base.DefaultConnectionSize)
-		xmem.memClient.Close()
-		if err == nil {
-			xmem.memClient, err = pool.Get()
-		}
-		if err == nil {
-			xmem.Logger().Infof("%v - The connection is repaired\n", xmem.Id())
-			size := xmem.buf.bufferSize()
-			for i := 0; i < int(size); i++ {
-				xmem.buf.modSlot(uint16(i), xmem.resend)
+		if err := xmem.reconnect(); err != nil {
+			if xmem.spool != nil {
+				xmem.Logger().Errorf("%v - Connection repair failed, spool the requests until the target recovers. err=%v\n", xmem.Id(), err)
+				xmem.setTargetDown(true)
+				//processData doesn't wait for responses which won't come until the target recovers
+				xmem.buf.releaseFlowControl()
+			} else {
+				xmem.Logger().Infof("%v - Connection repair failed\n", xmem.Id())
+				xmem.raiseError("reconnecting to target", err)
 			}
-			xmem.Logger().Infof("%v - The unresponded items are resent\n", xmem.Id())
-		} else {
-			xmem.Logger().Infof("%v - Connection repair failed\n", xmem.Id())
-			xmem.handleGeneralError(err)
 		}
 	}
 }
 
+//replace the broken connection, and resend the unresponded items on the new connection.
+//the caller holds lock_connection
+func (xmem *XmemNozzle) reconnect() error {
+	pool, err := base.ConnPoolMgr().GetOrCreatePool(xmem.getPoolName(xmem.config.connectStr), xmem.config.connectStr, xmem.config.bucketName, xmem.config.password, base.DefaultConnectionSize)
+	xmem.memClient.Close()
+	var client *mcc.Client
+	if err == nil {
+		client, err = pool.Get()
+	}
+	if err != nil {
+		return err
+	}
+
+	xmem.memClient = client
+	xmem.target_snappy = pool.Features().Snappy
+	xmem.Logger().Infof("%v - The connection is repaired\n", xmem.Id())
+	size := xmem.buf.bufferSize()
+	for i := 0; i < int(size); i++ {
+		xmem.buf.modSlot(uint16(i), xmem.resend)
+	}
+	xmem.Logger().Infof("%v - The unresponded items are resent\n", xmem.Id())
+	return nil
+}
+
 func (xmem *XmemNozzle) receiveResponse(finch chan bool, waitGrp *sync.WaitGroup) {
 	defer waitGrp.Done()
 
@@ -854,12 +1325,20 @@ func (xmem *XmemNozzle) receiveResponse(finch chan bool, waitGrp *sync.WaitGroup
 			case <-finch:
 				goto done
 			default:
+		if xmem.isTargetDown() {
+			//responses can't come until drainSpool reconnects to the target
+			time.Sleep(xmem.config.respTimeout)
+			continue
+		}
 		conn := xmem.memClient.Hijack()
 		conn.(*net.TCPConn).SetReadDeadline(time.Now().Add(300 * time.Millisecond))
 		response, err := xmem.memClient.Receive()
 		count++
 
-		if err == io.EOF {
+		if err == io.EOF && xmem.spool != nil {
+			//the target may have gone away. stay on for the responses once it recovers
+			xmem.repairConn(xmem.memClient)
+		} else if err == io.EOF {
 			xmem.Logger().Errorf("%v Quit receiveResponse. err=%v\n", xmem.Id(), err)
 			goto done
 		} else if err != nil && isNetError(err) {
@@ -878,8 +1357,11 @@ func (xmem *XmemNozzle) receiveResponse(finch chan bool, waitGrp *sync.WaitGroup
 			pos := xmem.getPosFromOpaque(response.Opaque)
 			xmem.Logger().Infof("%v pos=%d, Received error = %v in response, err = %v, response=%v\n", xmem.Id(), pos, response.Status.String(), err, response.Bytes())
 			_, err = xmem.buf.modSlot(pos, xmem.resend)
+			if err != nil && isSeriousError(err) {
+				xmem.repairConn(xmem.memClient)
+			}
 		} else if err != nil && mc.IsFatal(err) {
-			xmem.handleGeneralError(err)
+			xmem.raiseError("receiving responses from target", err)
 			return
 		} else {
 			//raiseEvent
@@ -887,11 +1369,15 @@ func (xmem *XmemNozzle) receiveResponse(finch chan bool, waitGrp *sync.WaitGroup
 			req, _ := xmem.buf.slot(pos)
 			if req != nil && req.Opaque == response.Opaque {
 				xmem.Logger().Debugf("%v Got the response, response.Opaque=%v, req.Opaque=%v\n", xmem.Id(), response.Opaque, req.Opaque)
-				xmem.RaiseEvent(common.DataSent, req, xmem, nil, nil)
+				seqno, _ := xmem.buf.slotSeqno(pos)
+				xmem.RaiseEvent(common.DataSent, req, xmem, nil, map[string]interface{}{XMEM_EVENT_ADDI_SEQNO: seqno})
+				xmem.buf.modSlot(pos, xmem.recordAck)
 				//empty the slot in the buffer
 				if xmem.buf.evictSlot(pos) != nil {
 					xmem.Logger().Errorf("Failed to evict slot %d\n", pos)
 				}
+				//the next mutation of the key can go now
+				xmem.sequencer.release(req)
 			} else {
 				if req != nil {
 					xmem.Logger().Debugf("%v Got the response, response.Opaque=%v, req.Opaque=%v\n", xmem.Id(), response.Opaque, req.Opaque)
@@ -948,20 +1434,23 @@ func (xmem *XmemNozzle) check(finch chan bool, waitGrp *sync.WaitGroup) {
 			goto done
 		case <-ticker:
 
-			select {
-			case <-xmem.batch.expire_ch:
+			expired, expire_time := xmem.batchExpired()
+			if expired {
 				xmem.Logger().Infof("%v batch expired, moving it to ready queue\n", xmem.Id())
 				xmem.batchReady()
-			default:
 			}
 			count++
-			xmem.Logger().Debugf("%v open=%v checking..., %v item unsent, received %v items, sent %v items, %v items waiting for response, %v batches ready, current batch timeout at %v, current batch expire_ch size is %v\n", xmem.Id(), xmem.IsOpen(), len(xmem.dataChan), xmem.counter_received, xmem.counter_sent, int(xmem.buf.bufferSize())-len(xmem.buf.empty_slots_pos), len(xmem.batches_ready), xmem.batch.start_time.Add(xmem.batch.expiring_duration), len(xmem.batch.expire_ch))
+			counter_received, counter_sent := xmem.counters()
+			xmem.Logger().Debugf("%v open=%v checking..., %v item unsent, received %v items, sent %v items, %v items waiting for response, %v batches ready, current batch timeout at %v\n", xmem.Id(), xmem.IsOpen(), len(xmem.dataChan), counter_received, counter_sent, int(xmem.buf.bufferSize())-len(xmem.buf.empty_slots_pos), len(xmem.batches_ready), expire_time)
 			size := xmem.buf.bufferSize()
 			timeoutCheckFunc := xmem.checkTimeout
 			for i := 0; i < int(size); i++ {
 				_, err := xmem.buf.modSlot(uint16(i), timeoutCheckFunc)
 				if err != nil {
 					xmem.Logger().Errorf("%v Failed to check timeout this round, try later - %v\n", xmem.Id(), err)
+					if isSeriousError(err) {
+						xmem.repairConn(xmem.memClient)
+					}
 					break
 				}
 			}
@@ -973,13 +1462,33 @@ done:
 }
 
 func (xmem *XmemNozzle) checkTimeout(req *bufferedMCRequest, pos uint16) (bool, error) {
+	if xmem.isTargetDown() {
+		//the unresponded items are resent when the target recovers
+		return false, nil
+	}
 	if time.Since(req.sent_time) > xmem.timeoutDuration(req.num_of_retry) {
+		if !req.timed_out {
+			req.timed_out = true
+			xmem.request_window.timedOut()
+		}
 		modified, err := xmem.resend(req, pos)
 		return modified, err
 	}
 	return false, nil
 }
 
+//count the acknowledgement of the request in the slot, before the slot is emptied
+func (xmem *XmemNozzle) recordAck(req *bufferedMCRequest, pos uint16) (bool, error) {
+	xmem.request_window.acked(time.Since(req.sent_time), req.timed_out)
+	return false, nil
+}
+
+//RequestStats returns the requests that timed out and were resent, and those acknowledged,
+//over the last RequestStatsWindow
+func (xmem *XmemNozzle) RequestStats() *RequestStats {
+	return xmem.request_window.stats()
+}
+
 func (xmem *XmemNozzle) timeoutDuration(numofRetry int) time.Duration {
 	duration := xmem.config.respTimeout
 	for i := 1; i <= numofRetry; i++ {
@@ -994,7 +1503,7 @@ func (xmem *XmemNozzle) timeoutDuration(numofRetry int) time.Duration {
 
 func (xmem *XmemNozzle) resend(req *bufferedMCRequest, pos uint16) (bool, error) {
 	xmem.Logger().Debugf("%v Retry sending ....", xmem.Id())
-	err := xmem.sendSingle(false, req.req, pos)
+	err := xmem.transmit(false, req.req, pos)
 
 	if err != nil {
 		req.err = err
@@ -1004,6 +1513,153 @@ func (xmem *XmemNozzle) resend(req *bufferedMCRequest, pos uint16) (bool, error)
 	return false, err
 }
 
+//spool the request that can't be sent now. it is sent by drainSpool once the target recovers
+func (xmem *XmemNozzle) spoolRequest(item *mc.MCRequest) {
+	err := xmem.spool.Append(item)
+	if err != nil && err != ErrorSpoolClosed {
+		//with ErrorSpoolFull, the spooled requests are dropped, and the replication restarts from the last checkpoint
+		xmem.raiseError("spooling requests", err)
+	}
+}
+
+//drainSpool reconnects to the target while it is unreachable, and sends the spooled
+//requests in order once the target recovers
+func (xmem *XmemNozzle) drainSpool(finch chan bool, waitGrp *sync.WaitGroup) {
+	defer waitGrp.Done()
+
+	var last_reconnect time.Time
+	ticker := time.NewTicker(xmem.config.respTimeout)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-finch:
+			goto done
+		case <-ticker.C:
+			if xmem.isTargetDown() {
+				if time.Since(last_reconnect) < xmem.config.maxRetryInterval {
+					continue
+				}
+				last_reconnect = time.Now()
+				if !xmem.recoverTarget() {
+					continue
+				}
+			}
+			if err := xmem.sendSpooled(); err != nil && err != ErrorSpoolClosed {
+				xmem.raiseError("sending spooled requests to target", err)
+			}
+		}
+	}
+done:
+	xmem.Logger().Infof("%v drainSpool exits\n", xmem.Id())
+}
+
+//reconnect to the unreachable target. returns whether the target has recovered
+func (xmem *XmemNozzle) recoverTarget() bool {
+	xmem.lock_connection.Lock()
+	defer xmem.lock_connection.Unlock()
+
+	if err := xmem.reconnect(); err != nil {
+		xmem.Logger().Infof("%v target is still unreachable. err=%v\n", xmem.Id(), err)
+		return false
+	}
+	xmem.Logger().Infof("%v target has recovered, %v spooled items to send\n", xmem.Id(), xmem.spool.Count())
+	xmem.setTargetDown(false)
+	//the mutations that failed to be sent go before the spooled ones
+	xmem.sequencer.notify()
+	return true
+}
+
+//send the spooled requests in order, until the spool is empty or the target is unreachable again.
+//a request is only removed from the spool after it is sent, so that the requests of its vbucket
+//keep being spooled behind it till then, and it is not lost if the nozzle goes down before that
+func (xmem *XmemNozzle) sendSpooled() error {
+	for !xmem.isTargetDown() {
+		item, err := xmem.spool.Peek()
+		if err != nil || item == nil {
+			return err
+		}
+		if !xmem.spool_head_acquired {
+			if !xmem.sequencer.tryAcquire(item) {
+				//an earlier mutation of its key is waiting for response. it stays at the head
+				//of the spool and is tried again in the next round
+				return nil
+			}
+			xmem.spool_head_acquired = true
+		}
+
+		//blocking
+		err, index, reserv_num := xmem.buf.reserveSlot()
+		if err != nil {
+			//the key stays acquired till the request is sent
+			return err
+		}
+		//the original extras, with the seqno, are put back if the item is not sent
+		seqno := SeqnoOfMCRequest(item)
+		extras := item.Extras
+		err = xmem.sendSingle(true, item, index)
+		if err == nil {
+			err = xmem.buf.enSlot(index, item, seqno, reserv_num)
+		}
+		if err != nil {
+			//try again in the next round. the key stays acquired, so that no later mutation
+			//of the key is sent before it
+			xmem.Logger().Errorf("%v Failed to send spooled item. err=%v\n", xmem.Id(), err)
+			xmem.buf.cancelReservation(index, reserv_num)
+			item.Extras = extras
+			return nil
+		}
+
+		//the key is released when the response comes
+		xmem.spool_head_acquired = false
+		if err = xmem.spool.Pop(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (xmem *XmemNozzle) setTargetDown(down bool) {
+	xmem.lock_target.Lock()
+	defer xmem.lock_target.Unlock()
+	xmem.target_down = down
+}
+
+func (xmem *XmemNozzle) isTargetDown() bool {
+	xmem.lock_target.RLock()
+	defer xmem.lock_target.RUnlock()
+	return xmem.target_down
+}
+
+func (xmem *XmemNozzle) Statistics() map[string]interface{} {
+	xmem.lock_stats.RLock()
+	stats := map[string]interface{}{XMEM_STATS_DOCS_SPOOLED: 0,
+		XMEM_STATS_SIZE_SPOOLED:            0,
+		XMEM_STATS_DOCS_DEDUP_CHECKED:      xmem.counter_dedup_checked,
+		XMEM_STATS_DOCS_DEDUPED:            xmem.counter_deduped,
+		XMEM_STATS_SIZE_BEFORE_COMPRESSION: xmem.counter_size_before_compression,
+		XMEM_STATS_SIZE_AFTER_COMPRESSION:  xmem.counter_size_after_compression}
+	xmem.lock_stats.RUnlock()
+	if xmem.spool != nil {
+		stats[XMEM_STATS_DOCS_SPOOLED] = xmem.spool.Count()
+		stats[XMEM_STATS_SIZE_SPOOLED] = int(xmem.spool.Size())
+	}
+	return stats
+}
+
+//the nozzle is degraded while its target is unreachable
+func (xmem *XmemNozzle) HealthCheck(timeout time.Duration) common.Health {
+	if health := serverHealth(&xmem.GenServer, timeout); health.Status != common.HealthOk {
+		return health
+	}
+	if xmem.isTargetDown() {
+		if xmem.spool != nil {
+			return common.NewHealth(common.HealthDegraded, fmt.Sprintf("target is unreachable, %v mutations are spooled", xmem.spool.Count()))
+		}
+		return common.NewHealth(common.HealthDegraded, "target is unreachable")
+	}
+	return common.Healthy
+}
+
 func (xmem *XmemNozzle) adjustRequest(mc_req *mc.MCRequest, index uint16) {
 	mc_req.Opcode = xmem.encodeOpCode(mc_req.Opcode)
 	mc_req.Cas = 0
@@ -1041,11 +1697,26 @@ func (xmem *XmemNozzle) encodeOpCode(code mc.CommandCode) mc.CommandCode {
 }
 
 func (xmem *XmemNozzle) StatusSummary() string {
-	return fmt.Sprintf("Xmem %v received %v items, sent %v items", xmem.Id(), xmem.counter_received, xmem.counter_sent)
+	counter_received, counter_sent := xmem.counters()
+	return fmt.Sprintf("Xmem %v received %v items, sent %v items", xmem.Id(), counter_received, counter_sent)
 }
 
+//the numbers of items received and sent
+func (xmem *XmemNozzle) counters() (int, int) {
+	xmem.lock_stats.RLock()
+	defer xmem.lock_stats.RUnlock()
+	return xmem.counter_received, xmem.counter_sent
+}
+
+//errors reported by the server routine, e.g., panics in callbacks
 func (xmem *XmemNozzle) handleGeneralError(err error) {
-	xmem.Logger().Errorf("Raise error condition %v\n", err)
-	otherInfo := utils.WrapError(err)
+	xmem.raiseError("running server routine", err)
+}
+
+//raise err, classified with what the nozzle was doing, to the pipeline supervisor
+func (xmem *XmemNozzle) raiseError(context string, err error) {
+	classified := base.ClassifyError(context, err)
+	xmem.Logger().Errorf("Raise error condition %v\n", classified)
+	otherInfo := utils.WrapError(classified)
 	xmem.RaiseEvent(common.ErrorEncountered, nil, xmem, nil, otherInfo)
 }
@@ -0,0 +1,341 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package parts
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	common "github.com/Xiaomei-Zhang/goxdcr/common"
+	mc "github.com/couchbase/gomemcached"
+	"github.com/golang/snappy"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	xmemTestKeys     = 5
+	xmemTestVersions = 40
+)
+
+// extraSettings are added to, or override, the test settings
+func startTestXmem(t *testing.T, server *fakeMemcached, extraSettings map[string]interface{}) *XmemNozzle {
+	xmem := NewXmemNozzle("xmem_test", server.addr(), "default", "", nil)
+	err := xmem.Start(testXmemSettings(extraSettings))
+	if err != nil {
+		t.Fatalf("Failed to start xmem nozzle. err=%v", err)
+	}
+	return xmem
+}
+
+func testXmemSettings(extraSettings map[string]interface{}) map[string]interface{} {
+	settings := map[string]interface{}{XMEM_SETTING_BATCHCOUNT: 10,
+		XMEM_SETTING_RESP_TIMEOUT:          20 * time.Millisecond,
+		XMEM_SETTING_MAX_RETRY_INTERVAL:    100 * time.Millisecond,
+		XMEM_SETTING_BATCH_EXPIRATION_TIME: 10 * time.Millisecond}
+	for key, val := range extraSettings {
+		settings[key] = val
+	}
+	return settings
+}
+
+func newXmemTestMutation(key, version int) *mc.MCRequest {
+	return &mc.MCRequest{Opcode: mc.UPR_MUTATION,
+		VBucket: uint16(key),
+		Key:     []byte(fmt.Sprintf("key%v", key)),
+		Body:    []byte(fmt.Sprintf("v%03d", version)),
+		Extras:  make([]byte, 24)}
+}
+
+// wait for the last version of every key to be applied, and check that the versions of each key
+// are applied in order. a version may be applied more than once
+func expectAppliedInOrder(t *testing.T, server *fakeMemcached) {
+	last := []byte(fmt.Sprintf("v%03d", xmemTestVersions-1))
+	deadline := time.Now().Add(10 * testWaitTime)
+	for key := 0; key < xmemTestKeys; key++ {
+		keyStr := fmt.Sprintf("key%v", key)
+		for {
+			values := server.appliedValues(keyStr)
+			if len(values) > 0 && bytes.Equal(values[len(values)-1], last) {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Last version of %v was not applied, applied %q", keyStr, values)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		values := server.appliedValues(keyStr)
+		for i := 1; i < len(values); i++ {
+			if bytes.Compare(values[i], values[i-1]) < 0 {
+				t.Fatalf("Versions of %v are applied out of order: %q", keyStr, values)
+			}
+		}
+	}
+}
+
+func TestXmemNozzleKeyOrderAcrossResends(t *testing.T) {
+	// the first delivery of some versions is dropped, or fails with TMPFAIL, so that they are
+	// resent after later versions of their keys would have been sent. the connection also
+	// stalls past the response timeout once in a while
+	seen := make(map[string]bool)
+	var lock sync.Mutex
+	requests := 0
+	server := startFakeMemcached(t, func(req *mc.MCRequest) fakeAction {
+		lock.Lock()
+		defer lock.Unlock()
+		requests++
+		id := string(req.Key) + string(req.Body)
+		first := !seen[id]
+		seen[id] = true
+
+		var version int
+		fmt.Sscanf(string(req.Body), "v%d", &version)
+		switch {
+		case first && version%4 == 1:
+			return fakeAction{drop: true}
+		case first && version%7 == 2:
+			return fakeAction{status: mc.TMPFAIL}
+		case requests%50 == 0:
+			return fakeAction{delay: 50 * time.Millisecond}
+		}
+		return fakeAction{}
+	})
+	defer server.stop()
+
+	xmem := startTestXmem(t, server, nil)
+	for version := 0; version < xmemTestVersions; version++ {
+		for key := 0; key < xmemTestKeys; key++ {
+			if err := xmem.Receive(newXmemTestMutation(key, version)); err != nil {
+				t.Fatalf("Failed to send version %v of key %v. err=%v", version, key, err)
+			}
+		}
+	}
+
+	expectAppliedInOrder(t, server)
+	if err := xmem.Stop(); err != nil {
+		t.Errorf("Failed to stop xmem nozzle. err=%v", err)
+	}
+}
+
+// send the versions in [from, to) of all the test keys
+func sendXmemTestVersions(t *testing.T, xmem *XmemNozzle, from, to int) {
+	for version := from; version < to; version++ {
+		for key := 0; key < xmemTestKeys; key++ {
+			if err := xmem.Receive(newXmemTestMutation(key, version)); err != nil {
+				t.Fatalf("Failed to send version %v of key %v. err=%v", version, key, err)
+			}
+		}
+	}
+}
+
+// run f, failing the test if it does not return in time
+func runWithTimeout(t *testing.T, what string, f func() error) {
+	errch := make(chan error, 1)
+	go func() { errch <- f() }()
+	select {
+	case err := <-errch:
+		if err != nil {
+			t.Fatalf("Failed to %v. err=%v", what, err)
+		}
+	case <-time.After(testWaitTime):
+		t.Fatalf("%v hangs", what)
+	}
+}
+
+func TestXmemNozzleRestartInPlace(t *testing.T) {
+	server := startFakeMemcached(t, nil)
+	defer server.stop()
+
+	xmem := startTestXmem(t, server, nil)
+	sendXmemTestVersions(t, xmem, 0, xmemTestVersions/2)
+	for key := 0; key < xmemTestKeys; key++ {
+		keyStr := fmt.Sprintf("key%v", key)
+		last := fmt.Sprintf("v%03d", xmemTestVersions/2-1)
+		for deadline := time.Now().Add(testWaitTime); ; time.Sleep(10 * time.Millisecond) {
+			values := server.appliedValues(keyStr)
+			if len(values) > 0 && string(values[len(values)-1]) == last {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%v of %v was not applied, applied %q", last, keyStr, values)
+			}
+		}
+	}
+
+	// the nozzle is stopped and started again, whether it is closed before or after it is stopped
+	runWithTimeout(t, "close xmem nozzle", xmem.Close)
+	runWithTimeout(t, "stop closed xmem nozzle", xmem.Stop)
+	runWithTimeout(t, "restart xmem nozzle", func() error { return xmem.Start(testXmemSettings(nil)) })
+	runWithTimeout(t, "open xmem nozzle", xmem.Open)
+
+	sendXmemTestVersions(t, xmem, xmemTestVersions/2, xmemTestVersions)
+	expectAppliedInOrder(t, server)
+	runWithTimeout(t, "stop xmem nozzle", xmem.Stop)
+	runWithTimeout(t, "close xmem nozzle", xmem.Close)
+}
+
+// listener that records the seqnos of deduped and sent mutations
+type seqnoListener struct {
+	deduped []uint64
+	sent    []uint64
+	lock    sync.Mutex
+}
+
+func (listener *seqnoListener) OnEvent(eventType common.ComponentEventType,
+	item interface{}, component common.Component, derivedItems []interface{}, otherInfos map[string]interface{}) {
+	listener.lock.Lock()
+	defer listener.lock.Unlock()
+	seqno := otherInfos[XMEM_EVENT_ADDI_SEQNO].(uint64)
+	if eventType == common.DataDeduped {
+		listener.deduped = append(listener.deduped, seqno)
+	} else {
+		listener.sent = append(listener.sent, seqno)
+	}
+}
+
+func TestXmemNozzleDedup(t *testing.T) {
+	server := startFakeMemcached(t, nil)
+	defer server.stop()
+
+	// the batch is only sent when it is full
+	xmem := startTestXmem(t, server, map[string]interface{}{XMEM_SETTING_DEDUP: true,
+		XMEM_SETTING_BATCH_EXPIRATION_TIME: time.Minute})
+	defer xmem.Stop()
+	listener := &seqnoListener{}
+	xmem.RegisterComponentEventListener(common.DataDeduped, listener)
+	xmem.RegisterComponentEventListener(common.DataSent, listener)
+
+	// a batch with 5 versions of each of 2 keys, with increasing seqnos
+	for version := 0; version < 5; version++ {
+		for key := 0; key < 2; key++ {
+			req := newXmemTestMutation(key, version)
+			binary.BigEndian.PutUint64(req.Extras, uint64(version+1))
+			if err := xmem.Receive(req); err != nil {
+				t.Fatalf("Failed to send version %v of key %v. err=%v", version, key, err)
+			}
+		}
+	}
+
+	// only the last version of each key is sent
+	deadline := time.Now().Add(testWaitTime)
+	for key := 0; key < 2; key++ {
+		keyStr := fmt.Sprintf("key%v", key)
+		for len(server.appliedValues(keyStr)) == 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("%v was not applied", keyStr)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if values := server.appliedValues(keyStr); len(values) != 1 || string(values[0]) != "v004" {
+			t.Errorf("Expected only the last version of %v to be applied, got %q", keyStr, values)
+		}
+	}
+
+	stats := xmem.Statistics()
+	if stats[XMEM_STATS_DOCS_DEDUP_CHECKED] != 10 || stats[XMEM_STATS_DOCS_DEDUPED] != 8 {
+		t.Errorf("Expected 8 of 10 mutations to be deduped, got %v", stats)
+	}
+	// the seqnos of the dropped versions are reported, and so are those of the sent ones,
+	// though their extras are zeroed before they are sent
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		listener.lock.Lock()
+		sent := len(listener.sent)
+		listener.lock.Unlock()
+		if sent >= 2 || time.Since(start) > testWaitTime {
+			break
+		}
+	}
+	listener.lock.Lock()
+	defer listener.lock.Unlock()
+	if len(listener.deduped) != 8 {
+		t.Fatalf("Expected 8 DataDeduped events, got %v", listener.deduped)
+	}
+	for _, seqno := range listener.deduped {
+		if seqno < 1 || seqno > 4 {
+			t.Errorf("Unexpected seqno %v of deduped mutation", seqno)
+		}
+	}
+	if len(listener.sent) != 2 || listener.sent[0] != 5 || listener.sent[1] != 5 {
+		t.Errorf("Expected 2 DataSent events with seqno 5, got %v", listener.sent)
+	}
+}
+
+// wait for a value of the key to be applied, and return the values applied
+func waitForApplied(t *testing.T, server *fakeMemcached, key string) [][]byte {
+	deadline := time.Now().Add(testWaitTime)
+	for len(server.appliedValues(key)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%v was not applied", key)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return server.appliedValues(key)
+}
+
+func TestXmemNozzleCompression(t *testing.T) {
+	large := bytes.Repeat([]byte(`{"field":"value"}`), 100)
+	small := []byte(`{"a":1}`)
+	settings := map[string]interface{}{XMEM_SETTING_COMPRESSION: true,
+		XMEM_SETTING_COMPRESSION_THRESHOLD: 100}
+
+	// a target that supports snappy gets the large body compressed, and the already compressed
+	// body as it is
+	server := startFakeMemcached(t, nil)
+	defer server.stop()
+	server.setFeatures(0x01, 0x0a)
+	xmem := startTestXmem(t, server, settings)
+	defer xmem.Stop()
+
+	requests := []*mc.MCRequest{newXmemTestMutation(0, 0), newXmemTestMutation(1, 0), newXmemTestMutation(2, 0)}
+	requests[0].Body = large
+	requests[1].Body = small
+	requests[2].Body = snappy.Encode(nil, large)
+	requests[2].DataType = mc.DatatypeFlagSnappy
+	for _, req := range requests {
+		xmem.Receive(req)
+	}
+	for key, expected := range [][]byte{large, small, large} {
+		if values := waitForApplied(t, server, fmt.Sprintf("key%v", key)); !bytes.Equal(values[0], expected) {
+			t.Errorf("Unexpected value of key%v, %s", key, values[0])
+		}
+	}
+	if server.compressedCount() != 2 {
+		t.Errorf("Expected 2 compressed values, got %v", server.compressedCount())
+	}
+	stats := xmem.Statistics()
+	before := stats[XMEM_STATS_SIZE_BEFORE_COMPRESSION].(int)
+	after := stats[XMEM_STATS_SIZE_AFTER_COMPRESSION].(int)
+	if before != len(large) || after <= 0 || after >= before {
+		t.Errorf("Unexpected compression statistics %v", stats)
+	}
+
+	// a target that does not know HELLO gets all bodies uncompressed
+	server2 := startFakeMemcached(t, nil)
+	defer server2.stop()
+	xmem2 := startTestXmem(t, server2, settings)
+	defer xmem2.Stop()
+
+	requests = []*mc.MCRequest{newXmemTestMutation(0, 0), newXmemTestMutation(1, 0)}
+	requests[0].Body = large
+	requests[1].Body = snappy.Encode(nil, large)
+	requests[1].DataType = mc.DatatypeFlagSnappy
+	for _, req := range requests {
+		xmem2.Receive(req)
+	}
+	for key := 0; key < 2; key++ {
+		if values := waitForApplied(t, server2, fmt.Sprintf("key%v", key)); !bytes.Equal(values[0], large) {
+			t.Errorf("Unexpected value of key%v, %s", key, values[0])
+		}
+	}
+	if server2.compressedCount() != 0 {
+		t.Errorf("Expected no compressed values, got %v", server2.compressedCount())
+	}
+}
@@ -57,6 +57,11 @@ type GenericPipeline struct {
 	//it only populated when GetAllConnectors called the first time
 	connectorsMap map[string]common.Connector
 
+	//the settings each part is last started with, which is used to start
+	//the part again when it is restarted on its own
+	partSettings     map[string]map[string]interface{}
+	partSettingsLock sync.RWMutex
+
 	logger *log.CommonLogger
 }
 
@@ -93,6 +98,10 @@ func (genericPipeline *GenericPipeline) startPart(part common.Part, settings map
 
 	}
 
+	genericPipeline.partSettingsLock.Lock()
+	genericPipeline.partSettings[part.Id()] = partSettings
+	genericPipeline.partSettingsLock.Unlock()
+
 	if !part.IsStarted() {
 		err = part.Start(partSettings)
 	} else {
@@ -185,6 +194,84 @@ func (genericPipeline *GenericPipeline) stopPart(part common.Part) error {
 	return err
 }
 
+//StartPart starts a single part of the pipeline again with the settings it was last
+//started with, e.g., when the part is restarted by the pipeline supervisor after it fails.
+//It is a no-op if the part is running, or if the pipeline is not active, as the pipeline may be
+//stopping its parts
+func (genericPipeline *GenericPipeline) StartPart(partId string) error {
+	part, err := genericPipeline.findPart(partId)
+	if err != nil {
+		return err
+	}
+	if part.IsStarted() {
+		genericPipeline.logger.Debugf("part %v is already started\n", partId)
+		return nil
+	}
+	if !genericPipeline.isActive {
+		genericPipeline.logger.Infof("Pipeline %v is not active, part %v is not started\n", genericPipeline.Topic(), partId)
+		return nil
+	}
+
+	genericPipeline.partSettingsLock.RLock()
+	settings, ok := genericPipeline.partSettings[partId]
+	genericPipeline.partSettingsLock.RUnlock()
+	if !ok {
+		return fmt.Errorf("Part %v of pipeline %v has never been started", partId, genericPipeline.Topic())
+	}
+
+	err = part.Start(settings)
+	if err != nil {
+		genericPipeline.logger.Errorf("Failed to start part %v, err=%v\n", partId, err)
+		return err
+	}
+	if nozzle, ok := part.(common.Nozzle); ok {
+		err = nozzle.Open()
+		if err != nil {
+			genericPipeline.logger.Errorf("Failed to open nozzle %v, err=%v\n", partId, err)
+			return err
+		}
+	}
+	genericPipeline.logger.Infof("part %v is started\n", partId)
+	return nil
+}
+
+//StopPart stops a single part of the pipeline, leaving the other parts running. Unlike
+//stopping the pipeline, the part is stopped even if its upstreams are still running.
+//A nozzle is only closed after it is stopped, since it drains the data it holds while stopping.
+//It is a no-op if the part is already stopped
+func (genericPipeline *GenericPipeline) StopPart(partId string) error {
+	part, err := genericPipeline.findPart(partId)
+	if err != nil {
+		return err
+	}
+	if !part.IsStarted() {
+		genericPipeline.logger.Debugf("part %v is already stopped\n", partId)
+		return nil
+	}
+	err = part.Stop()
+	if err != nil {
+		genericPipeline.logger.Errorf("Failed to stop part %v, err=%v\n", partId, err)
+		return err
+	}
+	if nozzle, ok := part.(common.Nozzle); ok {
+		err = nozzle.Close()
+		if err != nil {
+			genericPipeline.logger.Errorf("Failed to close nozzle %v, err=%v\n", partId, err)
+			return err
+		}
+	}
+	genericPipeline.logger.Infof("part %v is stopped\n", partId)
+	return nil
+}
+
+func (genericPipeline *GenericPipeline) findPart(partId string) (common.Part, error) {
+	part, ok := GetAllParts(genericPipeline)[partId]
+	if !ok {
+		return nil, fmt.Errorf("Part %v is not in pipeline %v", partId, genericPipeline.Topic())
+	}
+	return part, nil
+}
+
 //part can't be stopped if one of its upstreams is still running
 func (genericPipeline *GenericPipeline) canStop(part common.Part) bool {
 	parents := genericPipeline.findUpstreams(part)
@@ -255,6 +342,9 @@ func (genericPipeline *GenericPipeline) Stop() error {
 //	genericPipeline.stateLock.Lock()
 //	defer genericPipeline.stateLock.Unlock()
 
+	//parts are not restarted once the pipeline starts stopping
+	genericPipeline.isActive = false
+
 	//close the sources
 	for _, source := range genericPipeline.sources {
 		err = source.Close()
@@ -281,13 +371,16 @@ func (genericPipeline *GenericPipeline) Stop() error {
 
 	err = genericPipeline.context.Stop()
 
-	genericPipeline.isActive = false
-
 	genericPipeline.logger.Infof("Pipeline %v is stopped\n", genericPipeline.Topic())
 	return err
 
 }
 
+//IsActive returns true if the pipeline is started and is not stopping
+func (genericPipeline *GenericPipeline) IsActive() bool {
+	return genericPipeline.isActive
+}
+
 func (genericPipeline *GenericPipeline) Sources() map[string]common.Nozzle {
 	return genericPipeline.sources
 }
@@ -320,10 +413,11 @@ func NewGenericPipeline(t string,
 	sources map[string]common.Nozzle,
 	targets map[string]common.Nozzle) *GenericPipeline {
 	pipeline := &GenericPipeline{topic: t,
-		sources:  sources,
-		targets:  targets,
-		isActive: false,
-		logger:   log.NewLogger("GenericPipeline", nil)}
+		sources:      sources,
+		targets:      targets,
+		isActive:     false,
+		partSettings: make(map[string]map[string]interface{}),
+		logger:       log.NewLogger("GenericPipeline", nil)}
 	return pipeline
 }
 
@@ -337,6 +431,7 @@ func NewPipelineWithSettingConstructor(t string,
 		targets:                 targets,
 		isActive:                false,
 		partSetting_constructor: partsSettingsConstructor,
+		partSettings:            make(map[string]map[string]interface{}),
 		logger:                  log.NewLogger("GenericPipeline", logger_context)}
 	pipeline.logger.Debugf("Pipeline %s is initialized with a part setting constructor %v", t, partsSettingsConstructor)
 
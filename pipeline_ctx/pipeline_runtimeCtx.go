@@ -104,6 +104,10 @@ func (ctx *PipelineRuntimeCtx) Service(svc_name string) common.PipelineService {
 	return ctx.runtime_svcs[svc_name]
 }
 
+func (ctx *PipelineRuntimeCtx) Services() map[string]common.PipelineService {
+	return ctx.runtime_svcs
+}
+
 func (ctx *PipelineRuntimeCtx) RegisterService(svc_name string, svc common.PipelineService) error {
 
 	if ctx.isRunning {
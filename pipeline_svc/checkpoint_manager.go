@@ -12,26 +12,90 @@ package pipeline_svc
 import (
 	common "github.com/Xiaomei-Zhang/goxdcr/common"
 	base "github.com/Xiaomei-Zhang/goxdcr/base"
+	"github.com/Xiaomei-Zhang/goxdcr/parts"
+	mc "github.com/couchbase/gomemcached"
+	"sync"
+	"time"
 )
 
 type CheckpointManager struct {
+	started bool
+
+	//vbno -> the highest seqno that out nozzles have sent to the target, or have dropped as it is
+	//superseded by a later mutation of its key. Checkpoints are to be taken from it
+	sent_seqnos      map[uint16]uint64
+	sent_seqnos_lock sync.Mutex
 }
 
 func (ckmgr *CheckpointManager) Attach(pipeline common.Pipeline) error {
-	//TODO:
+	ckmgr.sent_seqnos_lock.Lock()
+	ckmgr.sent_seqnos = make(map[uint16]uint64)
+	ckmgr.sent_seqnos_lock.Unlock()
+
+	for _, target := range pipeline.Targets() {
+		target.RegisterComponentEventListener(common.DataSent, ckmgr)
+		target.RegisterComponentEventListener(common.DataDeduped, ckmgr)
+	}
+	//TODO: persist checkpoints
 	return nil
 }
 
+//record the seqnos of the mutations that are sent or deduped by out nozzles
+func (ckmgr *CheckpointManager) OnEvent(eventType common.ComponentEventType,
+	item interface{},
+	component common.Component,
+	derivedItems []interface{},
+	otherInfos map[string]interface{}) {
+	if eventType != common.DataSent && eventType != common.DataDeduped {
+		return
+	}
+	req, ok := item.(*mc.MCRequest)
+	if !ok {
+		return
+	}
+	//the seqno in the extras of a sent request has been zeroed
+	seqno, ok := otherInfos[parts.XMEM_EVENT_ADDI_SEQNO].(uint64)
+	if !ok {
+		return
+	}
+
+	ckmgr.sent_seqnos_lock.Lock()
+	defer ckmgr.sent_seqnos_lock.Unlock()
+	if seqno > ckmgr.sent_seqnos[req.VBucket] {
+		ckmgr.sent_seqnos[req.VBucket] = seqno
+	}
+}
+
+//SentSeqnos returns the highest seqno of each vbucket that has been sent or deduped
+func (ckmgr *CheckpointManager) SentSeqnos() map[uint16]uint64 {
+	ckmgr.sent_seqnos_lock.Lock()
+	defer ckmgr.sent_seqnos_lock.Unlock()
+	seqnos := make(map[uint16]uint64)
+	for vbno, seqno := range ckmgr.sent_seqnos {
+		seqnos[vbno] = seqno
+	}
+	return seqnos
+}
+
 func (ckmgr *CheckpointManager) Start(settings map[string]interface{}) error {
 	//TODO:
+	ckmgr.started = true
 	return nil
 }
 
 func (ckmgr *CheckpointManager) Stop() error {
 	//TODO:
+	ckmgr.started = false
 	return nil
 }
 
+func (ckmgr *CheckpointManager) HealthCheck(timeout time.Duration) common.Health {
+	if !ckmgr.started {
+		return common.NewHealth(common.HealthFailed, "not started")
+	}
+	return common.Healthy
+}
+
 func (ckmgr *CheckpointManager) StartSequenceNum(topic string) []uint64 {
 	//TODO: implement
 	ret := make([]uint64, 1024)
@@ -0,0 +1,45 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package pipeline_svc
+
+import (
+	"github.com/Xiaomei-Zhang/goxdcr/common"
+	"github.com/Xiaomei-Zhang/goxdcr/parts"
+	mc "github.com/couchbase/gomemcached"
+	"reflect"
+	"testing"
+)
+
+func TestCheckpointManagerSentSeqnos(t *testing.T) {
+	ckmgr := &CheckpointManager{sent_seqnos: make(map[uint16]uint64)}
+	events := []struct {
+		eventType common.ComponentEventType
+		vbno      uint16
+		seqno     uint64
+	}{
+		{common.DataDeduped, 1, 3},
+		{common.DataSent, 1, 5},
+		// responses of a vbucket can come out of order
+		{common.DataSent, 1, 4},
+		{common.DataDeduped, 2, 7},
+	}
+	for _, event := range events {
+		// the extras of sent requests are zeroed, and the seqno only comes in otherInfos
+		req := &mc.MCRequest{VBucket: event.vbno, Extras: make([]byte, 24)}
+		ckmgr.OnEvent(event.eventType, req, nil, nil, map[string]interface{}{parts.XMEM_EVENT_ADDI_SEQNO: event.seqno})
+	}
+	// other events are not counted
+	ckmgr.OnEvent(common.DataReceived, &mc.MCRequest{VBucket: 2}, nil, nil, map[string]interface{}{parts.XMEM_EVENT_ADDI_SEQNO: uint64(9)})
+
+	expected := map[uint16]uint64{1: 5, 2: 7}
+	if seqnos := ckmgr.SentSeqnos(); !reflect.DeepEqual(seqnos, expected) {
+		t.Errorf("Expected sent seqnos %v, got %v", expected, seqnos)
+	}
+}
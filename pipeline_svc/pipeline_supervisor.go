@@ -11,6 +11,7 @@ package pipeline_svc
 
 import (
 	"errors"
+	"fmt"
 	"github.com/Xiaomei-Zhang/goxdcr/common"
 	"github.com/Xiaomei-Zhang/goxdcr/log"
 	generic_p "github.com/Xiaomei-Zhang/goxdcr/pipeline"
@@ -19,38 +20,95 @@ import (
 	"github.com/Xiaomei-Zhang/goxdcr/parts"
 	"github.com/Xiaomei-Zhang/goxdcr/utils"
 	"reflect"
-	//	"sync"
+	"sort"
+	"sync"
 	"time"
 )
 
 //configuration settings
 const (
+	//the interval of health checks on the components of the pipeline, and how long a check can take
 	HEARTBEAT_INTERVAL     = "heartbeat_interval"
 	PART_HEARTBEAT_TIMEOUT = "heartbeat_timeout"
 	PIPELINE_LOG_LEVEL     = "pipeline_loglevel"
+	//a failed part is restarted on its own, unless it has been restarted part_max_restarts
+	//times within part_restart_window, in which case the failure is reported for the pipeline
+	PART_MAX_RESTARTS   = "part_max_restarts"
+	PART_RESTART_WINDOW = "part_restart_window"
+	//the pipeline is degraded when more than timeout_percentage_cap percent of the requests of its target
+	//nozzles time out over parts.RequestStatsWindow, or when their average lag is over max_expected_lag.
+	//timeout_cap_policy tells whether the pipeline is also restarted when the cap is exceeded
+	TIMEOUT_PERCENTAGE_CAP = "timeout_percentage_cap"
+	MAX_EXPECTED_LAG       = "max_expected_lag"
+	TIMEOUT_CAP_POLICY     = "timeout_cap_policy"
+	//how the errors raised by the components are handled, by error class
+	ERROR_POLICIES         = "error_policies"
 
 	default_heartbeat_interval     time.Duration = 400 * time.Millisecond
 	default_part_heartbeat_timeout time.Duration = 400 * time.Millisecond
 	default_pipeline_log_level                   = log.LogLevelInfo
+	default_part_max_restarts                    = 3
+	default_part_restart_window    time.Duration = 60 * time.Second
+	default_timeout_percentage_cap               = 80
+	default_max_expected_lag       time.Duration = 1000 * time.Millisecond
+	default_timeout_cap_policy                   = TimeoutCapDegrade
 )
 
+//what to do when the timeout percentage cap is exceeded
+type TimeoutCapPolicy int
+
 const (
-	CMD_CHANGE_LOG_LEVEL int = 2
+	//the pipeline is marked as degraded
+	TimeoutCapDegrade TimeoutCapPolicy = iota
+	//the pipeline is marked as degraded, and restarted
+	TimeoutCapRestart
 )
 
-var supervisor_setting_defs base.SettingDefinitions = base.SettingDefinitions{PART_HEARTBEAT_TIMEOUT: base.NewSettingDef(reflect.TypeOf((*time.Duration)(nil)), false),
-	PIPELINE_LOG_LEVEL: base.NewSettingDef(reflect.TypeOf((*log.LogLevel)(nil)), false),
-	HEARTBEAT_INTERVAL: base.NewSettingDef(reflect.TypeOf((*time.Duration)(nil)), false)}
+//id of the health of the requests of the target nozzles, among the health of the components
+const REQUEST_TIMEOUTS_HEALTH_ID = "RequestTimeouts"
+
+//the timeout percentage is not checked till the target nozzles have this many requests in the window
+const min_requests_for_timeout_cap = 100
 
-type heartbeatRespStatus int
+var ErrorTimeoutCapExceeded = errors.New("Timeout percentage cap is exceeded")
 
 const (
-	skip            heartbeatRespStatus = iota
-	notYetResponded heartbeatRespStatus = iota
-	respondedOk     heartbeatRespStatus = iota
-	respondedNotOk  heartbeatRespStatus = iota
+	CMD_CHANGE_LOG_LEVEL int = 2
 )
 
+var supervisor_setting_defs base.SettingDefinitions = base.SettingDefinitions{PART_HEARTBEAT_TIMEOUT: base.NewSettingDef(reflect.TypeOf((*time.Duration)(nil)), false),
+	PIPELINE_LOG_LEVEL:     base.NewSettingDef(reflect.TypeOf((*log.LogLevel)(nil)), false),
+	HEARTBEAT_INTERVAL:     base.NewSettingDef(reflect.TypeOf((*time.Duration)(nil)), false),
+	PART_MAX_RESTARTS:      base.NewSettingDef(reflect.TypeOf((*int)(nil)), false),
+	PART_RESTART_WINDOW:    base.NewSettingDef(reflect.TypeOf((*time.Duration)(nil)), false),
+	TIMEOUT_PERCENTAGE_CAP: base.NewSettingDef(reflect.TypeOf((*int)(nil)), false),
+	MAX_EXPECTED_LAG:       base.NewSettingDef(reflect.TypeOf((*time.Duration)(nil)), false),
+	TIMEOUT_CAP_POLICY:     base.NewSettingDef(reflect.TypeOf((*TimeoutCapPolicy)(nil)), false),
+	ERROR_POLICIES:         base.NewSettingDef(reflect.TypeOf((*base.ErrorPolicies)(nil)), false)}
+
+//pipeline whose parts can be restarted on their own, e.g., GenericPipeline
+type partController interface {
+	StartPart(partId string) error
+	StopPart(partId string) error
+}
+
+//pipeline that tells whether it is running, e.g., GenericPipeline. Components are expected to
+//fail while the pipeline is starting or stopping, which are not reported
+type activePipeline interface {
+	IsActive() bool
+}
+
+//target nozzles that count the requests that timed out and those acknowledged, e.g., XmemNozzle
+type requestStatsReporter interface {
+	RequestStats() *parts.RequestStats
+}
+
+//health of a component
+type componentHealth struct {
+	id     string
+	health common.Health
+}
+
 type PipelineSupervisor struct {
 	gen_server.GenServer
 	pipeline               common.Pipeline
@@ -61,15 +119,30 @@ type PipelineSupervisor struct {
 	failure_handler        base.PipelineFailureHandler
 	finch                  chan bool
 	//	children_waitGrp       sync.WaitGroup
-	pipeline_err_ch chan bool
-	resp_waiter_chs []chan bool
+
+	//component id -> health, as of the last health check, and the combined status of the pipeline
+	health      map[string]common.Health
+	status      common.HealthStatus
+	health_lock sync.RWMutex
+
+	timeout_percentage_cap int
+	max_expected_lag       time.Duration
+	timeout_cap_policy     TimeoutCapPolicy
+
+	error_policies base.ErrorPolicies
+	//error class -> number of errors raised by the components
+	error_counts map[base.ErrorClass]int
+	error_lock   sync.Mutex
+
+	//restarts the failed parts in place, when the pipeline supports it
+	part_supervisor     *gen_server.Supervisor
+	part_max_restarts   int
+	part_restart_window time.Duration
 }
 
 func NewPipelineSupervisor(logger_ctx *log.LoggerContext, failure_handler base.PipelineFailureHandler) *PipelineSupervisor {
-	var behavior_callback_func gen_server.Behavior_Callback_Func
-
 	server := gen_server.NewGenServer(nil,
-		&behavior_callback_func, nil, nil, logger_ctx, "PipelineSupervisor")
+		nil, nil, nil, logger_ctx, "PipelineSupervisor")
 	supervisor := &PipelineSupervisor{GenServer: server,
 		pipeline:               nil,
 		pipeline_loggerContext: logger_ctx,
@@ -78,10 +151,14 @@ func NewPipelineSupervisor(logger_ctx *log.LoggerContext, failure_handler base.P
 		failure_handler:        failure_handler,
 		finch:                  make(chan bool, 1),
 		//		children_waitGrp:       sync.WaitGroup{},
-		pipeline_err_ch: make(chan bool, 1),
-		resp_waiter_chs: []chan bool{}}
-
-	behavior_callback_func = supervisor.supervising
+		health:                 make(map[string]common.Health),
+		part_max_restarts:      default_part_max_restarts,
+		part_restart_window:    default_part_restart_window,
+		timeout_percentage_cap: default_timeout_percentage_cap,
+		max_expected_lag:       default_max_expected_lag,
+		timeout_cap_policy:     default_timeout_cap_policy,
+		error_policies:         base.DefaultErrorPolicies(),
+		error_counts:           make(map[base.ErrorClass]int)}
 	return supervisor
 }
 
@@ -89,6 +166,7 @@ func (supervisor *PipelineSupervisor) Attach(p common.Pipeline) error {
 	supervisor.Logger().Infof("Attaching pipeline supervior service")
 
 	supervisor.pipeline = p
+	supervisor.SetMetricsName(gen_server.MetricsName(p.Topic(), "PipelineSupervisor"))
 
 	//register itself with all parts' ErrorEncountered event
 	partsMap := generic_p.GetAllParts(p)
@@ -117,6 +195,13 @@ func (supervisor *PipelineSupervisor) Start(settings map[string]interface{}) err
 
 		//start the sever looping
 		supervisor.GenServer.Start_server()
+
+		if controller, ok := supervisor.pipeline.(partController); ok {
+			supervisor.part_supervisor = supervisor.newPartSupervisor(controller)
+			err = supervisor.part_supervisor.Start()
+		}
+
+		go supervisor.supervising(supervisor.finch, supervisor.heartbeat_ticker)
 	} else {
 		supervisor.Logger().Errorf("Failed to start PipelineSupervisor. error=%v\n", err)
 	}
@@ -125,6 +210,11 @@ func (supervisor *PipelineSupervisor) Start(settings map[string]interface{}) err
 
 func (supervisor *PipelineSupervisor) Stop() error {
 	supervisor.Logger().Info("stopping pipeline supervisor")
+	if supervisor.part_supervisor != nil {
+		if err := supervisor.part_supervisor.Stop(); err != nil {
+			supervisor.Logger().Errorf("Failed to stop part supervisor. err=%v\n", err)
+		}
+	}
 	err := supervisor.Stop_server()
 	close(supervisor.finch)
 
@@ -141,49 +231,167 @@ func (supervisor *PipelineSupervisor) OnEvent(eventType common.ComponentEventTyp
 	derivedItems []interface{},
 	otherInfos map[string]interface{}) {
 	if eventType == common.ErrorEncountered {
-		partsError := make(map[string]error)
-		partsError[component.Id()] = otherInfos["error"].(error)
-		supervisor.reportFailure(partsError)
+		supervisor.handleError(component.Id(), otherInfos["error"].(error))
 	} else {
 		supervisor.Logger().Errorf("Pipeline supervisor didn't register to recieve event %v for component %v", eventType, component.Id())
 	}
 }
 
-func (supervisor *PipelineSupervisor) supervising() error {
-	//heart beat
-	select {
-	case <-supervisor.finch:
-		return nil
-	case <-supervisor.heartbeat_ticker.C:
+//check the health of the components of the pipeline every heartbeat_interval, till the supervisor stops
+func (supervisor *PipelineSupervisor) supervising(finch chan bool, ticker *time.Ticker) {
+	for {
 		select {
-		case supervisor.pipeline_err_ch <- true:
-
-			supervisor.Logger().Info("Time to send heart beat msg")
-			partsMap := generic_p.GetAllParts(supervisor.pipeline)
-			heartbeat_report := make(map[string]heartbeatRespStatus)
-			heartbeat_resp_chs := make(map[string]chan []interface{})
-			for partId, part := range partsMap {
-				respch := make(chan []interface{})
-				xdcrPart, ok := part.(parts.XDCRPart)
-				if ok {
-					err := xdcrPart.HeartBeat_async(respch)
-					heartbeat_resp_chs[partId] = respch
-					if err != nil {
-						heartbeat_report[partId] = skip
-					} else {
-						heartbeat_report[partId] = notYetResponded
-					}
-				}
+		case <-finch:
+			return
+		case <-ticker.C:
+			supervisor.checkHealth()
+		}
+	}
+}
+
+//components whose health can be checked, i.e., parts, connectors and services other than the supervisor
+func (supervisor *PipelineSupervisor) healthCheckers() map[string]common.HealthChecker {
+	checkers := make(map[string]common.HealthChecker)
+	for id, part := range generic_p.GetAllParts(supervisor.pipeline) {
+		if checker, ok := part.(common.HealthChecker); ok {
+			checkers[id] = checker
+		}
+	}
+	for id, connector := range generic_p.GetAllConnectors(supervisor.pipeline) {
+		if checker, ok := connector.(common.HealthChecker); ok {
+			checkers[id] = checker
+		}
+	}
+	if ctx := supervisor.pipeline.RuntimeContext(); ctx != nil {
+		for name, service := range ctx.Services() {
+			if checker, ok := service.(common.HealthChecker); ok && service != supervisor {
+				checkers[name] = checker
 			}
-			//		supervisor.children_waitGrp.Add(1)
-			fin_ch := make(chan bool, 1)
-			supervisor.resp_waiter_chs = append(supervisor.resp_waiter_chs, fin_ch)
-			go supervisor.waitForResponse(heartbeat_report, heartbeat_resp_chs, fin_ch)
-		default:
 		}
-	default:
 	}
-	return nil
+	return checkers
+}
+
+//check the health of all components at once. A component whose check does not return within
+//part_heartbeat_timeout is failed. Failed parts are restarted, and the other failed components
+//are reported for the pipeline
+func (supervisor *PipelineSupervisor) checkHealth() {
+	checkers := supervisor.healthCheckers()
+	results := make(chan *componentHealth, len(checkers))
+	for id, checker := range checkers {
+		go func(id string, checker common.HealthChecker) {
+			results <- &componentHealth{id: id, health: checker.HealthCheck(supervisor.part_heartbeat_timeout)}
+		}(id, checker)
+	}
+
+	health := make(map[string]common.Health)
+	timeout := time.After(supervisor.part_heartbeat_timeout + supervisor.part_heartbeat_timeout/2)
+COLLECT:
+	for len(health) < len(checkers) {
+		select {
+		case result := <-results:
+			health[result.id] = result.health
+		case <-timeout:
+			break COLLECT
+		}
+	}
+	for id, _ := range checkers {
+		if _, ok := health[id]; !ok {
+			health[id] = common.NewHealth(common.HealthFailed, "health check did not return in time")
+		}
+	}
+	cap_exceeded := false
+	if stats := supervisor.requestStats(); stats != nil {
+		health[REQUEST_TIMEOUTS_HEALTH_ID], cap_exceeded = supervisor.requestTimeoutsHealth(stats)
+	}
+
+	supervisor.health_lock.Lock()
+	for id, componentHealth := range health {
+		if last, ok := supervisor.health[id]; !ok || last.Status != componentHealth.Status {
+			supervisor.Logger().Infof("Health of %v is %v. reason=%v\n", id, componentHealth.Status, componentHealth.Reason)
+		}
+	}
+	supervisor.health = health
+	pipelineHealth := common.NewPipelineHealth(health)
+	status_changed := pipelineHealth.Status != supervisor.status
+	supervisor.status = pipelineHealth.Status
+	supervisor.health_lock.Unlock()
+
+	if status_changed {
+		supervisor.onHealthChange(pipelineHealth)
+	}
+
+	if pipeline, ok := supervisor.pipeline.(activePipeline); ok && !pipeline.IsActive() {
+		return
+	}
+	failures := make(map[string]error)
+	for id, componentHealth := range health {
+		if componentHealth.Status == common.HealthFailed {
+			failures[id] = errors.New(componentHealth.Reason)
+		}
+	}
+	if cap_exceeded && supervisor.timeout_cap_policy == TimeoutCapRestart {
+		failures[REQUEST_TIMEOUTS_HEALTH_ID] = ErrorTimeoutCapExceeded
+	}
+	for id, err := range failures {
+		supervisor.recordError(id, err)
+	}
+	if len(failures) > 0 {
+		supervisor.reportPartsFailure(failures)
+	}
+}
+
+//the requests of the target nozzles over the request stats window. nil if no part reports requests
+func (supervisor *PipelineSupervisor) requestStats() *parts.RequestStats {
+	var stats *parts.RequestStats
+	for _, part := range generic_p.GetAllParts(supervisor.pipeline) {
+		if reporter, ok := part.(requestStatsReporter); ok {
+			if stats == nil {
+				stats = &parts.RequestStats{}
+			}
+			stats.Add(reporter.RequestStats())
+		}
+	}
+	return stats
+}
+
+//compare the requests of the target nozzles with the timeout percentage cap and the max expected lag.
+//returns whether the cap is exceeded too
+func (supervisor *PipelineSupervisor) requestTimeoutsHealth(stats *parts.RequestStats) (common.Health, bool) {
+	if stats.Requests() >= min_requests_for_timeout_cap {
+		if percentage := stats.TimeoutPercentage(); percentage > float64(supervisor.timeout_percentage_cap) {
+			return common.NewHealth(common.HealthDegraded, fmt.Sprintf("%.1f%% of the requests timed out in the last %v, over the cap of %v%%",
+				percentage, parts.RequestStatsWindow, supervisor.timeout_percentage_cap)), true
+		}
+	}
+	if lag := stats.AvgLatency(); lag > supervisor.max_expected_lag {
+		return common.NewHealth(common.HealthDegraded, fmt.Sprintf("average replication lag in the last %v is %v, over the max expected lag of %v",
+			parts.RequestStatsWindow, lag, supervisor.max_expected_lag)), false
+	}
+	return common.Healthy, false
+}
+
+//log the change of the status of the pipeline, and pass it on to the failure handler, if it handles health changes
+func (supervisor *PipelineSupervisor) onHealthChange(health *common.PipelineHealth) {
+	if health.Status == common.HealthOk {
+		supervisor.Logger().Infof("Pipeline %v is %v\n", supervisor.pipeline.Topic(), health.Status)
+	} else {
+		supervisor.Logger().Errorf("Pipeline %v is %v. reason=%v\n", supervisor.pipeline.Topic(), health.Status, health.Reason)
+	}
+	if handler, ok := supervisor.failure_handler.(base.PipelineHealthHandler); ok {
+		handler.OnHealthChange(supervisor.pipeline, health)
+	}
+}
+
+//Health returns the combined health of the components of the pipeline, as of the last health check
+func (supervisor *PipelineSupervisor) Health() *common.PipelineHealth {
+	supervisor.health_lock.RLock()
+	defer supervisor.health_lock.RUnlock()
+	components := make(map[string]common.Health)
+	for id, health := range supervisor.health {
+		components[id] = health
+	}
+	return common.NewPipelineHealth(components)
 }
 
 func (supervisor *PipelineSupervisor) init(settings map[string]interface{}) error {
@@ -203,81 +411,149 @@ func (supervisor *PipelineSupervisor) init(settings map[string]interface{}) erro
 	if val, ok := settings[PIPELINE_LOG_LEVEL]; ok {
 		supervisor.pipeline_loggerContext.Log_level = val.(log.LogLevel)
 	}
+	if val, ok := settings[PART_MAX_RESTARTS]; ok {
+		supervisor.part_max_restarts = val.(int)
+	}
+	if val, ok := settings[PART_RESTART_WINDOW]; ok {
+		supervisor.part_restart_window = val.(time.Duration)
+	}
+	if val, ok := settings[TIMEOUT_PERCENTAGE_CAP]; ok {
+		supervisor.timeout_percentage_cap = val.(int)
+	}
+	if val, ok := settings[MAX_EXPECTED_LAG]; ok {
+		supervisor.max_expected_lag = val.(time.Duration)
+	}
+	if val, ok := settings[TIMEOUT_CAP_POLICY]; ok {
+		supervisor.timeout_cap_policy = val.(TimeoutCapPolicy)
+	}
+	if val, ok := settings[ERROR_POLICIES]; ok {
+		for class, policy := range val.(base.ErrorPolicies) {
+			supervisor.error_policies[class] = policy
+		}
+	}
 
 	return nil
 }
 
-func (supervisor *PipelineSupervisor) waitForResponse(heartbeat_report map[string]heartbeatRespStatus, heartbeat_resp_chs map[string]chan []interface{}, finch chan bool) {
-	defer func() {
-		<-supervisor.pipeline_err_ch
-		supervisor.Logger().Debug("Exiting waitForResponse....")
-	}()
-
-	//start a timer
-	ping_time := time.Now()
-	heartbeat_timeout_ch := time.After(supervisor.part_heartbeat_timeout)
-	not_yet_resp_count := 0
+//one child per part, in the order of part ids, whose restart stops and starts the part in place.
+//Outgoing nozzles and queues are left out. They drop the mutations they hold, e.g., the ones sent but
+//not yet acknowledged, when they are stopped, and the source nozzles, which keep streaming forward,
+//would never send those mutations again. Their failures restart the whole pipeline, which streams
+//again from the last checkpoint
+func (supervisor *PipelineSupervisor) newPartSupervisor(controller partController) *gen_server.Supervisor {
+	part_supervisor := gen_server.NewSupervisor(gen_server.MetricsName(supervisor.pipeline.Topic(), "PartSupervisor"), gen_server.OneForOne,
+		supervisor.part_max_restarts, supervisor.part_restart_window, supervisor.onPartRestartsExceeded, supervisor.pipeline_loggerContext)
+
+	targets := supervisor.pipeline.Targets()
+	partIds := []string{}
+	for partId, part := range generic_p.GetAllParts(supervisor.pipeline) {
+		if _, ok := targets[partId]; ok {
+			continue
+		}
+		if _, ok := part.(*parts.QueuePart); ok {
+			continue
+		}
+		partIds = append(partIds, partId)
+	}
+	sort.Strings(partIds)
+	for _, partId := range partIds {
+		id := partId
+		part_supervisor.AddChild(&gen_server.ChildSpec{Id: id,
+			Start: func() error { return controller.StartPart(id) },
+			Stop:  func() error { return controller.StopPart(id) }})
+	}
+	return part_supervisor
+}
 
-	for {
-		select {
-		case <-finch:
-			//the supervisor is stopping
-			return
-		case <-heartbeat_timeout_ch:
-			//time is up
-			supervisor.Logger().Debugf("Heartbeat timeout! not_yet_resp_count=%v\n", not_yet_resp_count)
-			goto REPORT
-		default:
-			not_yet_resp_count := 0
-			for partId, status := range heartbeat_report {
-				if status == notYetResponded {
-					not_yet_resp_count++
-					select {
-					case <-heartbeat_resp_chs[partId]:
-						supervisor.Logger().Debugf("Part %v has responded the heartbeat ping sent at %v\n", partId, ping_time)
-						heartbeat_report[partId] = respondedOk
-					default:
-					}
-				}
-			}
+//count the error raised by component id, and handle it with the policy of its class. errors
+//that are not classified by the component are classified by base.ErrorClassOf
+func (supervisor *PipelineSupervisor) handleError(id string, err error) {
+	class := base.ErrorClassOf(err)
+	policy := supervisor.error_policies[class]
+
+	supervisor.error_lock.Lock()
+	supervisor.error_counts[class]++
+	supervisor.error_lock.Unlock()
+
+	supervisor.Logger().Errorf("%v raised %v error, which is handled with policy %v. err=%v\n", id, class, policy, err)
+	supervisor.recordError(id, err)
+	partsError := map[string]error{id: err}
+	switch policy {
+	case base.ErrorPolicyIgnore:
+	case base.ErrorPolicyRestartPart:
+		supervisor.reportPartsFailure(partsError)
+	case base.ErrorPolicyPause:
+		supervisor.pause(partsError)
+	default:
+		supervisor.reportFailure(partsError)
+	}
+}
 
-			if not_yet_resp_count == 0 {
-				goto REPORT
-			}
-		}
+//pass the error on to the failure handler, if it keeps the history of errors
+func (supervisor *PipelineSupervisor) recordError(id string, err error) {
+	if recorder, ok := supervisor.failure_handler.(base.PipelineErrorRecorder); ok {
+		recorder.RecordError(supervisor.pipeline, id, err)
 	}
+}
 
-	//process the result
-REPORT:
-	supervisor.processReport(heartbeat_report)
+//ErrorCounts returns the number of errors raised by the components of the pipeline, keyed by error class
+func (supervisor *PipelineSupervisor) ErrorCounts() map[string]int {
+	supervisor.error_lock.Lock()
+	defer supervisor.error_lock.Unlock()
+	counts := make(map[string]int)
+	for class := base.ErrorClassTransient; class <= base.ErrorClassFatal; class++ {
+		counts[class.String()] = supervisor.error_counts[class]
+	}
+	return counts
 }
 
-func (supervisor *PipelineSupervisor) processReport(heartbeat_report map[string]heartbeatRespStatus) {
-	supervisor.Logger().Debugf("***********ProcessReport*************")
-	supervisor.Logger().Debugf("len(heartbeat_report)=%v\n", len(heartbeat_report))
-	brokenParts := make(map[string]error)
-	for partId, status := range heartbeat_report {
-		supervisor.Logger().Debugf("PartId=%v, status=%v\n", partId, status)
-		if status == respondedNotOk || status == notYetResponded {
-			supervisor.Logger().Infof("Part %v is not responding\n", partId)
-			brokenParts[partId] = errors.New("Not responding")
-		}
+//the failures of parts are handled by the part supervisor, which restarts the parts.
+//other failures, e.g., of connectors, are reported for the pipeline
+func (supervisor *PipelineSupervisor) reportPartsFailure(partsError map[string]error) {
+	if supervisor.part_supervisor == nil {
+		supervisor.reportFailure(partsError)
+		return
 	}
 
-	if len(brokenParts) > 0 {
-		supervisor.reportFailure(brokenParts)
+	unsupervised := make(map[string]error)
+	for partId, err := range partsError {
+		if !supervisor.part_supervisor.HasChild(partId) || supervisor.part_supervisor.ReportFailure(partId, err) != nil {
+			unsupervised[partId] = err
+		}
+	}
+	if len(unsupervised) > 0 {
+		supervisor.reportFailure(unsupervised)
 	}
 }
 
+func (supervisor *PipelineSupervisor) onPartRestartsExceeded(id string, err error) {
+	supervisor.Logger().Errorf("Parts of pipeline %v keep failing after restarts, err=%v\n", supervisor.pipeline.Topic(), err)
+	supervisor.recordError(id, errors.New(fmt.Sprintf("Part keeps failing after %v restarts within %v, so the pipeline is restarted. err=%v",
+		supervisor.part_max_restarts, supervisor.part_restart_window, err)))
+	supervisor.reportFailure(map[string]error{id: err})
+}
+
 func (supervisor *PipelineSupervisor) reportFailure(partsError map[string]error) {
 	//report the failure to decision maker
 	if supervisor.heartbeat_ticker != nil {
 		supervisor.heartbeat_ticker.Stop()
 	}
-	supervisor.notifyWaitersToFinish()
 	supervisor.failure_handler.OnError(supervisor.pipeline, partsError)
 }
 
+//pause the replication when the failure handler can, instead of restarting the pipeline
+func (supervisor *PipelineSupervisor) pause(partsError map[string]error) {
+	handler, ok := supervisor.failure_handler.(base.PipelinePauseHandler)
+	if !ok {
+		supervisor.reportFailure(partsError)
+		return
+	}
+	if supervisor.heartbeat_ticker != nil {
+		supervisor.heartbeat_ticker.Stop()
+	}
+	handler.OnPause(supervisor.pipeline, partsError)
+}
+
 func (supervisor *PipelineSupervisor) SetPipelineLogLevel(log_level_str string) error {
 	level, err := log.LogLevelFromStr(log_level_str)
 	if err != nil {
@@ -286,13 +562,3 @@ func (supervisor *PipelineSupervisor) SetPipelineLogLevel(log_level_str string)
 	supervisor.pipeline_loggerContext.Log_level = level
 	return nil
 }
-
-func (supervisor *PipelineSupervisor) notifyWaitersToFinish() {
-	for _, ctrl_ch := range supervisor.resp_waiter_chs {
-		select {
-		case ctrl_ch <- true:
-		default:
-		}
-	}
-
-}
@@ -0,0 +1,97 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package pipeline_svc
+
+import (
+	"errors"
+	"github.com/Xiaomei-Zhang/goxdcr/base"
+	"github.com/Xiaomei-Zhang/goxdcr/common"
+	"github.com/Xiaomei-Zhang/goxdcr/parts"
+	"testing"
+	"time"
+)
+
+func TestRequestTimeoutsHealth(t *testing.T) {
+	supervisor := NewPipelineSupervisor(nil, nil)
+	err := supervisor.init(map[string]interface{}{TIMEOUT_PERCENTAGE_CAP: 20,
+		MAX_EXPECTED_LAG: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Failed to initialize supervisor. err=%v", err)
+	}
+
+	tests := []struct {
+		desc         string
+		stats        parts.RequestStats
+		status       common.HealthStatus
+		cap_exceeded bool
+	}{
+		{"within cap and lag", parts.RequestStats{TimedOut: 10, Acked: 100, AckedInTime: 90, TotalLatency: time.Second}, common.HealthOk, false},
+		{"over cap", parts.RequestStats{TimedOut: 30, Acked: 100, AckedInTime: 70, TotalLatency: time.Second}, common.HealthDegraded, true},
+		{"over cap with too few requests", parts.RequestStats{TimedOut: 5, Acked: 5, AckedInTime: 5, TotalLatency: 50 * time.Millisecond}, common.HealthOk, false},
+		{"over lag", parts.RequestStats{Acked: 100, AckedInTime: 100, TotalLatency: 20 * time.Second}, common.HealthDegraded, false},
+	}
+	for _, test := range tests {
+		health, cap_exceeded := supervisor.requestTimeoutsHealth(&test.stats)
+		if health.Status != test.status || cap_exceeded != test.cap_exceeded {
+			t.Errorf("%v: expected %v and cap exceeded %v, got %v and %v", test.desc, test.status, test.cap_exceeded, health, cap_exceeded)
+		}
+	}
+}
+
+// failure handler that records how failures are handled
+type testFailureHandler struct {
+	restarts int
+	pauses   int
+	recorded []string
+}
+
+func (handler *testFailureHandler) OnError(pipeline common.Pipeline, partsError map[string]error) {
+	handler.restarts++
+}
+
+func (handler *testFailureHandler) OnPause(pipeline common.Pipeline, partsError map[string]error) {
+	handler.pauses++
+}
+
+func (handler *testFailureHandler) RecordError(pipeline common.Pipeline, partId string, err error) {
+	handler.recorded = append(handler.recorded, partId)
+}
+
+func TestErrorPolicies(t *testing.T) {
+	handler := &testFailureHandler{}
+	supervisor := NewPipelineSupervisor(nil, handler)
+	policies, _ := base.ParseErrorPolicies("transient=ignore")
+	if err := supervisor.init(map[string]interface{}{ERROR_POLICIES: policies}); err != nil {
+		t.Fatalf("Failed to initialize supervisor. err=%v", err)
+	}
+
+	supervisor.handleError("xmem_1", base.NewClassifiedError(base.ErrorClassTransient, "sending batch to target", errors.New("timeout")))
+	if handler.restarts != 0 || handler.pauses != 0 {
+		t.Errorf("Ignored error is handled, restarts=%v, pauses=%v", handler.restarts, handler.pauses)
+	}
+	supervisor.handleError("xmem_1", base.NewClassifiedError(base.ErrorClassAuthentication, "reconnecting to target", errors.New("auth")))
+	if handler.pauses != 1 {
+		t.Errorf("Expected the replication to be paused on authentication error, pauses=%v", handler.pauses)
+	}
+	supervisor.handleError("dcp_1", errors.New("unclassified"))
+	if handler.restarts != 1 {
+		t.Errorf("Expected the pipeline to be restarted on fatal error, restarts=%v", handler.restarts)
+	}
+
+	// errors are recorded whether or not they are ignored
+	if len(handler.recorded) != 3 {
+		t.Errorf("Expected 3 recorded errors, got %v", handler.recorded)
+	}
+
+	counts := supervisor.ErrorCounts()
+	if counts["transient"] != 1 || counts["authentication"] != 1 || counts["fatal"] != 1 || counts["configuration"] != 0 {
+		t.Errorf("Unexpected error counts %v", counts)
+	}
+}
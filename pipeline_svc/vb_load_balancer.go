@@ -0,0 +1,432 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package pipeline_svc
+
+import (
+	"fmt"
+	"github.com/Xiaomei-Zhang/goxdcr/base"
+	"github.com/Xiaomei-Zhang/goxdcr/common"
+	"github.com/Xiaomei-Zhang/goxdcr/log"
+	"github.com/Xiaomei-Zhang/goxdcr/parts"
+	"github.com/Xiaomei-Zhang/goxdcr/utils"
+	mcc "github.com/couchbase/gomemcached/client"
+	"math"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+//configuration settings
+const (
+	LOAD_BALANCE_INTERVAL = "load_balance_interval"
+	// a nozzle is hot when its load is more than hot_ratio times the average load of the nozzles it can share vbuckets with
+	LOAD_BALANCE_HOT_RATIO = "load_balance_hot_ratio"
+	// vbuckets are moved off a nozzle only after it has been hot for hot_rounds consecutive intervals
+	LOAD_BALANCE_HOT_ROUNDS = "load_balance_hot_rounds"
+	// the max number of vbuckets moved in one interval, in the whole pipeline
+	LOAD_BALANCE_MAX_MOVES = "load_balance_max_moves"
+
+	default_load_balance_interval   time.Duration = 30 * time.Second
+	default_load_balance_hot_ratio                = 1.25
+	default_load_balance_hot_rounds               = 3
+	default_load_balance_max_moves                = 8
+
+	// the load of a mutation, in bytes, on top of the size of its key and value.
+	// it accounts for the per-mutation cost so that many small mutations weigh in
+	mutation_load_bytes = 256
+	// weight of the load of the latest interval in the moving average of the load of a vbucket
+	load_average_weight = 0.5
+)
+
+var load_balancer_setting_defs base.SettingDefinitions = base.SettingDefinitions{LOAD_BALANCE_INTERVAL: base.NewSettingDef(reflect.TypeOf((*time.Duration)(nil)), false),
+	LOAD_BALANCE_HOT_RATIO:  base.NewSettingDef(reflect.TypeOf((*float64)(nil)), false),
+	LOAD_BALANCE_HOT_ROUNDS: base.NewSettingDef(reflect.TypeOf((*int)(nil)), false),
+	LOAD_BALANCE_MAX_MOVES:  base.NewSettingDef(reflect.TypeOf((*int)(nil)), false)}
+
+// NozzleGroupFunc tells the group of a nozzle. vbuckets can only be moved between nozzles in
+// the same group, e.g., between dcp nozzles on the same source kv node
+type NozzleGroupFunc func(nozzleId string) string
+
+// mutations and bytes of a vbucket observed in the current interval
+type vbThroughput struct {
+	mutations uint64
+	bytes     uint64
+}
+
+type vbMove struct {
+	vbno uint16
+	from string
+	to   string
+}
+
+func (move *vbMove) String() string {
+	return fmt.Sprintf("vb %v: %v->%v", move.vbno, move.from, move.to)
+}
+
+/************************************
+/* struct VBLoadBalancer
+*************************************/
+// VBLoadBalancer moves vbuckets from hot dcp nozzles to the other dcp nozzles in their groups,
+// based on the throughput of vbuckets observed on dcp nozzles.
+// vbuckets are not moved between out nozzles, since the mutations of a vbucket held by the queue,
+// batches and spool of the old out nozzle could then be sent to the target after newer ones sent by the new out nozzle
+type VBLoadBalancer struct {
+	pipeline    common.Pipeline
+	dcp_nozzles map[string]*parts.DcpNozzle
+	nozzleGroup NozzleGroupFunc
+
+	interval   time.Duration
+	hot_ratio  float64
+	hot_rounds int
+	max_moves  int
+
+	// throughput of vbuckets in the current interval
+	throughput      map[uint16]*vbThroughput
+	throughput_lock sync.Mutex
+	// vbno -> moving average of load, in bytes per second
+	vb_loads map[uint16]float64
+	// nozzle id -> number of consecutive intervals in which the nozzle has been hot
+	hot_streaks map[string]int
+	// the last time balancing is done, or the balancer is started
+	last_balanced      time.Time
+	last_balanced_lock sync.Mutex
+
+	finch    chan bool
+	wait_grp sync.WaitGroup
+	logger   *log.CommonLogger
+}
+
+func NewVBLoadBalancer(nozzleGroup NozzleGroupFunc, logger_ctx *log.LoggerContext) *VBLoadBalancer {
+	return &VBLoadBalancer{nozzleGroup: nozzleGroup,
+		dcp_nozzles: make(map[string]*parts.DcpNozzle),
+		interval:    default_load_balance_interval,
+		hot_ratio:   default_load_balance_hot_ratio,
+		hot_rounds:  default_load_balance_hot_rounds,
+		max_moves:   default_load_balance_max_moves,
+		throughput:  make(map[uint16]*vbThroughput),
+		vb_loads:    make(map[uint16]float64),
+		hot_streaks: make(map[string]int),
+		logger:      log.NewLogger("VBLoadBalancer", logger_ctx)}
+}
+
+func (balancer *VBLoadBalancer) Attach(pipeline common.Pipeline) error {
+	balancer.pipeline = pipeline
+
+	for _, source := range pipeline.Sources() {
+		dcp, ok := source.(*parts.DcpNozzle)
+		if !ok {
+			continue
+		}
+		balancer.dcp_nozzles[dcp.Id()] = dcp
+		dcp.RegisterComponentEventListener(common.DataProcessed, balancer)
+	}
+	return nil
+}
+
+func (balancer *VBLoadBalancer) Start(settings map[string]interface{}) error {
+	err := utils.ValidateSettings(load_balancer_setting_defs, settings, balancer.logger)
+	if err != nil {
+		balancer.logger.Errorf("The setting for VBLoadBalancer is not valid. err=%v", err)
+		return err
+	}
+	if val, ok := settings[LOAD_BALANCE_INTERVAL]; ok {
+		balancer.interval = val.(time.Duration)
+	}
+	if val, ok := settings[LOAD_BALANCE_HOT_RATIO]; ok {
+		balancer.hot_ratio = val.(float64)
+	}
+	if val, ok := settings[LOAD_BALANCE_HOT_ROUNDS]; ok {
+		balancer.hot_rounds = val.(int)
+	}
+	if val, ok := settings[LOAD_BALANCE_MAX_MOVES]; ok {
+		balancer.max_moves = val.(int)
+	}
+
+	balancer.setLastBalanced()
+	balancer.finch = make(chan bool)
+	balancer.wait_grp.Add(1)
+	go balancer.balancing()
+	balancer.logger.Infof("VBLoadBalancer for pipeline %v is started with interval %v\n", balancer.pipeline.Topic(), balancer.interval)
+	return nil
+}
+
+func (balancer *VBLoadBalancer) Stop() error {
+	if balancer.finch != nil {
+		close(balancer.finch)
+		balancer.wait_grp.Wait()
+		balancer.finch = nil
+	}
+	balancer.last_balanced_lock.Lock()
+	balancer.last_balanced = time.Time{}
+	balancer.last_balanced_lock.Unlock()
+	balancer.logger.Info("VBLoadBalancer is stopped")
+	return nil
+}
+
+// collect the throughput of vbuckets from DataProcessed events of dcp nozzles
+func (balancer *VBLoadBalancer) OnEvent(eventType common.ComponentEventType,
+	item interface{},
+	component common.Component,
+	derivedItems []interface{},
+	otherInfos map[string]interface{}) {
+	if eventType != common.DataProcessed {
+		balancer.logger.Errorf("VBLoadBalancer didn't register to recieve event %v for component %v", eventType, component.Id())
+		return
+	}
+	event, ok := item.(*mcc.UprEvent)
+	if !ok {
+		return
+	}
+
+	balancer.throughput_lock.Lock()
+	defer balancer.throughput_lock.Unlock()
+	vbtp, ok := balancer.throughput[event.VBucket]
+	if !ok {
+		vbtp = &vbThroughput{}
+		balancer.throughput[event.VBucket] = vbtp
+	}
+	vbtp.mutations++
+	vbtp.bytes += uint64(len(event.Key) + len(event.Value))
+}
+
+func (balancer *VBLoadBalancer) balancing() {
+	defer balancer.wait_grp.Done()
+
+	ticker := time.NewTicker(balancer.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-balancer.finch:
+			return
+		case <-ticker.C:
+			balancer.updateLoads()
+			balancer.rebalance()
+			balancer.setLastBalanced()
+		}
+	}
+}
+
+func (balancer *VBLoadBalancer) setLastBalanced() {
+	balancer.last_balanced_lock.Lock()
+	defer balancer.last_balanced_lock.Unlock()
+	balancer.last_balanced = time.Now()
+}
+
+// the balancer fails when balancing has not been done for a few intervals, e.g., when it is stuck moving vbuckets
+func (balancer *VBLoadBalancer) HealthCheck(timeout time.Duration) common.Health {
+	balancer.last_balanced_lock.Lock()
+	defer balancer.last_balanced_lock.Unlock()
+	if balancer.last_balanced.IsZero() {
+		return common.NewHealth(common.HealthFailed, "not started")
+	}
+	if since := time.Since(balancer.last_balanced); since > 3*balancer.interval {
+		return common.NewHealth(common.HealthFailed, fmt.Sprintf("balancing has not been done for %v", since))
+	}
+	return common.Healthy
+}
+
+// fold the throughput of the last interval into the moving averages of vbucket loads
+func (balancer *VBLoadBalancer) updateLoads() {
+	balancer.throughput_lock.Lock()
+	throughput := balancer.throughput
+	balancer.throughput = make(map[uint16]*vbThroughput)
+	balancer.throughput_lock.Unlock()
+
+	seconds := balancer.interval.Seconds()
+	for vbno, load := range balancer.vb_loads {
+		if _, ok := throughput[vbno]; !ok {
+			balancer.vb_loads[vbno] = load * (1 - load_average_weight)
+		}
+	}
+	for vbno, vbtp := range throughput {
+		latest := float64(vbtp.bytes+vbtp.mutations*mutation_load_bytes) / seconds
+		balancer.vb_loads[vbno] = latest*load_average_weight + balancer.vb_loads[vbno]*(1-load_average_weight)
+	}
+}
+
+func (balancer *VBLoadBalancer) rebalance() {
+	// dcp nozzle id -> vbuckets
+	assignment := make(map[string][]uint16)
+	for id, dcp := range balancer.dcp_nozzles {
+		assignment[id] = dcp.GetVBList()
+	}
+
+	moves := balancer.planMoves(assignment, balancer.max_moves)
+	if len(moves) > 0 {
+		balancer.moveSourceVBuckets(moves)
+	}
+}
+
+// update hot streaks of the nozzles, and plan the moves off the nozzles that have stayed hot
+func (balancer *VBLoadBalancer) planMoves(assignment map[string][]uint16, maxMoves int) []*vbMove {
+	groups := make(map[string]map[string][]uint16)
+	for nozzleId, vbnos := range assignment {
+		group := balancer.nozzleGroup(nozzleId)
+		if groups[group] == nil {
+			groups[group] = make(map[string][]uint16)
+		}
+		groups[group][nozzleId] = vbnos
+	}
+
+	moves := make([]*vbMove, 0)
+	for _, groupAssignment := range groups {
+		hot := make(map[string]bool)
+		for _, nozzleId := range findHotNozzles(groupAssignment, balancer.vb_loads, balancer.hot_ratio) {
+			hot[nozzleId] = true
+		}
+		hotNozzles := make(map[string]bool)
+		for nozzleId, _ := range groupAssignment {
+			if !hot[nozzleId] {
+				delete(balancer.hot_streaks, nozzleId)
+				continue
+			}
+			balancer.hot_streaks[nozzleId]++
+			if balancer.hot_streaks[nozzleId] >= balancer.hot_rounds {
+				hotNozzles[nozzleId] = true
+			}
+		}
+
+		groupMoves := planVBMoves(groupAssignment, balancer.vb_loads, hotNozzles, maxMoves-len(moves))
+		for _, move := range groupMoves {
+			// the nozzle gets a fresh start after vbuckets are moved off it
+			delete(balancer.hot_streaks, move.from)
+		}
+		moves = append(moves, groupMoves...)
+	}
+	return moves
+}
+
+// hand vbuckets over between dcp nozzles, picking up the streams where they left off
+func (balancer *VBLoadBalancer) moveSourceVBuckets(moves []*vbMove) {
+	// (from, to) -> vbuckets
+	batches := make(map[[2]string][]uint16)
+	for _, move := range moves {
+		key := [2]string{move.from, move.to}
+		batches[key] = append(batches[key], move.vbno)
+	}
+
+	for key, vbnos := range batches {
+		from := balancer.dcp_nozzles[key[0]]
+		to := balancer.dcp_nozzles[key[1]]
+		ts, err := from.ReleaseVBuckets(vbnos)
+		if err != nil {
+			balancer.logger.Errorf("Failed to release vbuckets %v from %v. err=%v\n", vbnos, from.Id(), err)
+		}
+		if len(ts) == 0 {
+			continue
+		}
+		if err = to.AcquireVBuckets(ts); err != nil {
+			balancer.logger.Errorf("Failed to hand vbuckets %v over to %v, giving them back to %v. err=%v\n", vbnos, to.Id(), from.Id(), err)
+			if err = from.AcquireVBuckets(ts); err != nil {
+				// the streams cannot be picked up. let the pipeline supervisor restart the pipeline
+				from.RaiseEvent(common.ErrorEncountered, nil, from, nil, utils.WrapError(base.ClassifyError("moving vbuckets between source nozzles", err)))
+			}
+			continue
+		}
+		balancer.logger.Infof("Moved vbuckets %v from %v to %v\n", vbnos, from.Id(), to.Id())
+	}
+}
+
+// total load of the vbuckets of each nozzle
+func nozzleLoads(assignment map[string][]uint16, vbLoads map[uint16]float64) map[string]float64 {
+	loads := make(map[string]float64)
+	for nozzleId, vbnos := range assignment {
+		loads[nozzleId] = 0
+		for _, vbno := range vbnos {
+			loads[nozzleId] += vbLoads[vbno]
+		}
+	}
+	return loads
+}
+
+// nozzles whose load is more than hotRatio times the average load of the nozzles in assignment
+func findHotNozzles(assignment map[string][]uint16, vbLoads map[uint16]float64, hotRatio float64) []string {
+	loads := nozzleLoads(assignment, vbLoads)
+	var total float64
+	for _, load := range loads {
+		total += load
+	}
+	hotNozzles := make([]string, 0)
+	if len(loads) < 2 || total == 0 {
+		return hotNozzles
+	}
+	average := total / float64(len(loads))
+	for nozzleId, load := range loads {
+		if load > average*hotRatio {
+			hotNozzles = append(hotNozzles, nozzleId)
+		}
+	}
+	sort.Strings(hotNozzles)
+	return hotNozzles
+}
+
+// plan at most maxMoves moves of vbuckets from hot nozzles to the least loaded nozzles.
+// each move takes the vbucket whose load is closest to half of the gap between the hot nozzle
+// and the least loaded nozzle, so that the move narrows the gap without turning it around.
+// a nozzle keeps at least one vbucket
+func planVBMoves(assignment map[string][]uint16, vbLoads map[uint16]float64, hotNozzles map[string]bool, maxMoves int) []*vbMove {
+	moves := make([]*vbMove, 0)
+	if len(hotNozzles) == 0 || len(assignment) < 2 {
+		return moves
+	}
+
+	loads := nozzleLoads(assignment, vbLoads)
+	owned := make(map[string][]uint16)
+	for nozzleId, vbnos := range assignment {
+		owned[nozzleId] = append([]uint16{}, vbnos...)
+	}
+	// sorted for deterministic choice among nozzles with equal loads
+	nozzleIds := make([]string, 0, len(assignment))
+	for nozzleId, _ := range assignment {
+		nozzleIds = append(nozzleIds, nozzleId)
+	}
+	sort.Strings(nozzleIds)
+
+	for len(moves) < maxMoves {
+		var hottest, coldest string
+		for _, nozzleId := range nozzleIds {
+			if hotNozzles[nozzleId] && (hottest == "" || loads[nozzleId] > loads[hottest]) {
+				hottest = nozzleId
+			}
+			if coldest == "" || loads[nozzleId] < loads[coldest] {
+				coldest = nozzleId
+			}
+		}
+		if hottest == "" || hottest == coldest || len(owned[hottest]) <= 1 {
+			break
+		}
+
+		gap := loads[hottest] - loads[coldest]
+		bestIndex := -1
+		bestDistance := math.MaxFloat64
+		for index, vbno := range owned[hottest] {
+			load := vbLoads[vbno]
+			if load <= 0 || load >= gap {
+				continue
+			}
+			if distance := math.Abs(gap/2 - load); distance < bestDistance {
+				bestIndex = index
+				bestDistance = distance
+			}
+		}
+		if bestIndex < 0 {
+			break
+		}
+
+		vbno := owned[hottest][bestIndex]
+		owned[hottest] = append(owned[hottest][:bestIndex], owned[hottest][bestIndex+1:]...)
+		owned[coldest] = append(owned[coldest], vbno)
+		loads[hottest] -= vbLoads[vbno]
+		loads[coldest] += vbLoads[vbno]
+		moves = append(moves, &vbMove{vbno: vbno, from: hottest, to: coldest})
+	}
+	return moves
+}
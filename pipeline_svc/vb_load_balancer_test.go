@@ -0,0 +1,120 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package pipeline_svc
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFindHotNozzles(t *testing.T) {
+	assignment := map[string][]uint16{
+		"xmem_a_0": []uint16{0, 1},
+		"xmem_a_1": []uint16{2, 3},
+		"xmem_a_2": []uint16{4, 5},
+	}
+	vbLoads := map[uint16]float64{0: 100, 1: 100, 2: 10, 3: 10, 4: 10, 5: 10}
+	if hot := findHotNozzles(assignment, vbLoads, 1.25); !reflect.DeepEqual(hot, []string{"xmem_a_0"}) {
+		t.Errorf("Expected xmem_a_0 to be hot, got %v", hot)
+	}
+
+	// no nozzle is hot without load
+	if hot := findHotNozzles(assignment, map[uint16]float64{}, 1.25); len(hot) != 0 {
+		t.Errorf("Expected no hot nozzles without load, got %v", hot)
+	}
+}
+
+func TestPlanVBMoves(t *testing.T) {
+	assignment := map[string][]uint16{
+		"dcp_a_0": []uint16{0, 1, 2, 3},
+		"dcp_a_1": []uint16{4},
+		"dcp_a_2": []uint16{5},
+	}
+	vbLoads := map[uint16]float64{0: 40, 1: 30, 2: 20, 3: 10, 4: 5, 5: 5}
+	hot := map[string]bool{"dcp_a_0": true}
+
+	// the gap to dcp_a_1 is 95, and vb 0 is the closest to half of it. after vb 0 is moved,
+	// the gap to dcp_a_2 is 55, and vb 1 is the closest to half of it. after that dcp_a_0
+	// is the least loaded nozzle
+	moves := planVBMoves(assignment, vbLoads, hot, 10)
+	expected := []*vbMove{
+		&vbMove{vbno: 0, from: "dcp_a_0", to: "dcp_a_1"},
+		&vbMove{vbno: 1, from: "dcp_a_0", to: "dcp_a_2"},
+	}
+	if !reflect.DeepEqual(moves, expected) {
+		t.Errorf("Expected moves %v, got %v", expected, moves)
+	}
+
+	// the number of moves is limited
+	if moves := planVBMoves(assignment, vbLoads, hot, 1); len(moves) != 1 {
+		t.Errorf("Expected 1 move, got %v", moves)
+	}
+
+	// the assignment passed in is not modified
+	if len(assignment["dcp_a_0"]) != 4 || len(assignment["dcp_a_1"]) != 1 {
+		t.Errorf("Assignment was modified: %v", assignment)
+	}
+
+	// nothing is moved off nozzles that have not stayed hot
+	if moves := planVBMoves(assignment, vbLoads, map[string]bool{}, 10); len(moves) != 0 {
+		t.Errorf("Expected no moves without hot nozzles, got %v", moves)
+	}
+}
+
+func TestPlanVBMovesSingleVBucket(t *testing.T) {
+	// a single vbucket carrying all the load is not moved, which would only move the hot spot
+	assignment := map[string][]uint16{
+		"xmem_a_0": []uint16{0},
+		"xmem_a_1": []uint16{1},
+	}
+	vbLoads := map[uint16]float64{0: 100, 1: 1}
+	if moves := planVBMoves(assignment, vbLoads, map[string]bool{"xmem_a_0": true}, 10); len(moves) != 0 {
+		t.Errorf("Expected no moves, got %v", moves)
+	}
+
+	assignment = map[string][]uint16{
+		"xmem_a_0": []uint16{0, 2},
+		"xmem_a_1": []uint16{1},
+	}
+	vbLoads = map[uint16]float64{0: 100, 1: 1, 2: 0}
+	if moves := planVBMoves(assignment, vbLoads, map[string]bool{"xmem_a_0": true}, 10); len(moves) != 0 {
+		t.Errorf("Expected no moves, got %v", moves)
+	}
+}
+
+func TestPlanMovesWithinGroups(t *testing.T) {
+	nozzleGroup := func(nozzleId string) string {
+		return nozzleId[:strings.LastIndex(nozzleId, "_")]
+	}
+	balancer := NewVBLoadBalancer(nozzleGroup, nil)
+	balancer.hot_rounds = 2
+	balancer.vb_loads = map[uint16]float64{0: 50, 1: 50, 2: 1, 3: 50, 4: 50}
+	// out nozzles to kv a and kv b. the nozzle to kv b is only loaded more than
+	// the nozzle to kv a, which it cannot share vbuckets with
+	assignment := map[string][]uint16{
+		"xmem_a_0": []uint16{0, 1},
+		"xmem_a_1": []uint16{2},
+		"xmem_b_0": []uint16{3, 4},
+	}
+
+	// xmem_a_0 needs to stay hot for 2 intervals before vbuckets are moved off it
+	if moves := balancer.planMoves(assignment, 10); len(moves) != 0 {
+		t.Errorf("Expected no moves in the first interval, got %v", moves)
+	}
+	moves := balancer.planMoves(assignment, 10)
+	expected := []*vbMove{&vbMove{vbno: 0, from: "xmem_a_0", to: "xmem_a_1"}}
+	if !reflect.DeepEqual(moves, expected) {
+		t.Errorf("Expected moves %v, got %v", expected, moves)
+	}
+	if _, ok := balancer.hot_streaks["xmem_a_0"]; ok {
+		t.Errorf("Expected hot streak of xmem_a_0 to be reset after vbuckets are moved off it")
+	}
+}
@@ -19,9 +19,14 @@ import (
 	"github.com/Xiaomei-Zhang/goxdcr/pipeline_manager"
 	"github.com/Xiaomei-Zhang/goxdcr/base"
 	"github.com/Xiaomei-Zhang/goxdcr/factory"
+	"github.com/Xiaomei-Zhang/goxdcr/gen_server"
 	"github.com/Xiaomei-Zhang/goxdcr/metadata"
 	"github.com/Xiaomei-Zhang/goxdcr/metadata_svc"
+	"github.com/Xiaomei-Zhang/goxdcr/parts"
+	pp "github.com/Xiaomei-Zhang/goxdcr/pipeline"
 	"github.com/Xiaomei-Zhang/goxdcr/pipeline_svc"
+	"sort"
+	"strings"
 	"sync"
 )
 
@@ -35,7 +40,29 @@ type replicationManager struct {
 	cluster_info_svc         metadata_svc.ClusterInfoSvc
 	xdcr_topology_svc        metadata_svc.XDCRCompTopologySvc
 	replication_settings_svc metadata_svc.ReplicationSettingsSvc
+	// nil if topology changes are not watched
+	topology_watcher         metadata_svc.TopologyWatcher
+	// nil if the node does not take part in leader election
+	leader_elector           metadata_svc.LeaderElector
 	once                     sync.Once
+	// serializes changes to default replication settings and the settings in replication specs
+	settings_lock            sync.Mutex
+	// buckets of active replications, which replication manager subscribes to with topology watcher
+	watched_buckets          map[watchedBucket]bool
+	watched_buckets_lock     sync.Mutex
+	// replication id -> the error that the replication has been paused on, till it is resumed or deleted
+	pause_errors             map[string]error
+	pause_errors_lock        sync.Mutex
+	// replication id -> the most recent errors of the replication, which are kept across restarts of
+	// its pipeline till the replication is deleted
+	error_histories          map[string]*base.ErrorHistory
+	error_histories_lock     sync.Mutex
+}
+
+// a bucket that replication manager watches topology changes of
+type watchedBucket struct {
+	clusterUUID string
+	bucket      string
 }
 
 var replication_mgr replicationManager
@@ -43,21 +70,40 @@ var replication_mgr replicationManager
 func Initialize(metadata_svc metadata_svc.MetadataSvc,
 	cluster_info_svc metadata_svc.ClusterInfoSvc,
 	xdcr_topology_svc metadata_svc.XDCRCompTopologySvc,
-	replication_settings_svc metadata_svc.ReplicationSettingsSvc) {
+	replication_settings_svc metadata_svc.ReplicationSettingsSvc,
+	topology_watcher metadata_svc.TopologyWatcher,
+	leader_elector metadata_svc.LeaderElector) {
 	replication_mgr.once.Do(func() {
-		replication_mgr.init(metadata_svc, cluster_info_svc, xdcr_topology_svc, replication_settings_svc)
+		replication_mgr.init(metadata_svc, cluster_info_svc, xdcr_topology_svc, replication_settings_svc, topology_watcher, leader_elector)
 	})
 }
 
 func (rm *replicationManager) init(metadataSvc metadata_svc.MetadataSvc,
 	clusterSvc metadata_svc.ClusterInfoSvc,
 	topologySvc metadata_svc.XDCRCompTopologySvc,
-	replicationSettingsSvc metadata_svc.ReplicationSettingsSvc) {
+	replicationSettingsSvc metadata_svc.ReplicationSettingsSvc,
+	topologyWatcher metadata_svc.TopologyWatcher,
+	leaderElector metadata_svc.LeaderElector) {
 	rm.metadata_svc = metadataSvc
 	rm.cluster_info_svc = clusterSvc
 	rm.xdcr_topology_svc = topologySvc
 	rm.replication_settings_svc = replicationSettingsSvc
-	fac := factory.NewXDCRFactory(metadataSvc, clusterSvc, topologySvc, log.DefaultLoggerContext, log.DefaultLoggerContext, rm)
+	rm.topology_watcher = topologyWatcher
+	rm.leader_elector = leaderElector
+	rm.watched_buckets = make(map[watchedBucket]bool)
+	rm.pause_errors = make(map[string]error)
+	rm.error_histories = make(map[string]*base.ErrorHistory)
+	if topologyWatcher != nil {
+		if err := topologyWatcher.Start(); err != nil {
+			logger_rm.Errorf("Failed to start topology watcher. err=%v\n", err)
+		}
+	}
+	if leaderElector != nil {
+		if err := leaderElector.Start(); err != nil {
+			logger_rm.Errorf("Failed to start leader elector. err=%v\n", err)
+		}
+	}
+	fac := factory.NewXDCRFactory(metadataSvc, clusterSvc, topologySvc, log.PipelineLoggerContext, log.DefaultLoggerContext, rm)
 	pipeline_manager.PipelineManager(fac, log.DefaultLoggerContext)
 	
 	// start replications
@@ -83,13 +129,28 @@ func ReplicationSettingsService() metadata_svc.ReplicationSettingsSvc {
 	return replication_mgr.replication_settings_svc
 }
 
+func TopologyWatcher() metadata_svc.TopologyWatcher {
+	return replication_mgr.topology_watcher
+}
+
+func LeaderElector() metadata_svc.LeaderElector {
+	return replication_mgr.leader_elector
+}
+
 func CreateReplication(sourceClusterUUID, sourceBucket, targetClusterUUID, targetBucket, filterName string, settings map[string]interface{}, createReplSpec bool) (string, error) {
 	logger_rm.Infof("Creating replication - sourceCluterUUID=%s, sourceBucket=%s, targetClusterUUID=%s, targetBucket=%s, filterName=%s, settings=%v, createReplSpec=%v\n", sourceClusterUUID,
 	                sourceBucket, targetClusterUUID, targetBucket, filterName, settings, createReplSpec)
 
+	// settings that are not specified are inherited from default replication settings
+	explicitSettings := settings
+	settings, err := settingsWithDefaults(explicitSettings)
+	if err != nil {
+		return "", err
+	}
+
 	var topic string
 	if createReplSpec {
-		spec, err := replication_mgr.createAndPersistReplicationSpec(sourceClusterUUID, sourceBucket, targetClusterUUID, targetBucket, filterName, settings)
+		spec, err := replication_mgr.createAndPersistReplicationSpec(sourceClusterUUID, sourceBucket, targetClusterUUID, targetBucket, filterName, settings, explicitSettings)
 		if err != nil {
 			logger_rm.Errorf("%v\n", err)
 			return "", err
@@ -101,6 +162,7 @@ func CreateReplication(sourceClusterUUID, sourceBucket, targetClusterUUID, targe
 	
 	go pipeline_manager.StartPipeline(topic, settings)
 	logger_rm.Infof("Pipeline %s is created and started\n", topic)
+	replication_mgr.refreshTopologySubscriptions()
 
 	return topic, nil
 }
@@ -129,6 +191,8 @@ func PauseReplication(topic string, updateReplSpec bool, sync bool) error {
 		}
 	}
 
+	replication_mgr.refreshTopologySubscriptions()
+
 	if sync {
 		err := pipeline_manager.StopPipeline(topic)
 		logger_rm.Infof("Pipeline %s has been paused\n", topic)
@@ -144,6 +208,7 @@ func ResumeReplication(topic string, updateReplSpec bool, sync bool) error {
 	logger_rm.Infof("Resuming replication %s\n", topic)
 	
 	if updateReplSpec {
+		setPauseError(topic, nil)
 		// update replication spec
 		if err := validatePipelineExists(topic, "resuming", true); err != nil {
 			return err
@@ -163,6 +228,8 @@ func ResumeReplication(topic string, updateReplSpec bool, sync bool) error {
 		return err
 	}
 	
+	replication_mgr.refreshTopologySubscriptions()
+
 	settings := spec.Settings
 	settingsMap := settings.ToMap()
 	if sync {
@@ -194,23 +261,83 @@ func DeleteReplication(topic string, deleteReplSpec bool) error {
 		}
 	}
 	
-	go pipeline_manager.StopPipeline(topic)
+	if deleteReplSpec {
+		// the local files of the parts can only be removed once the parts are stopped
+		go func() {
+			pipeline_manager.StopPipeline(topic)
+			if err := factory.RemovePartFiles(topic); err != nil {
+				logger_rm.Errorf("Failed to remove local files of replication %s. err=%v\n", topic, err)
+			}
+		}()
+	} else {
+		go pipeline_manager.StopPipeline(topic)
+	}
+	replication_mgr.refreshTopologySubscriptions()
+	setPauseError(topic, nil)
+	deleteErrorHistory(topic)
 
 	logger_rm.Infof("Pipeline %s is deleted\n", topic)
 
 	return nil
 }
 
-func HandleChangesToReplicationSettings(topic string, settings map[string]interface{}) error {
+// change settings of a replication. 
+// settings in the settings map, keyed by internal keys, become explicitly set on the replication, 
+// and the settings in inheritedKeys go back to being inherited from default replication settings
+func HandleChangesToReplicationSettings(topic string, settings map[string]interface{}, inheritedKeys []string) error {
+	replication_mgr.settings_lock.Lock()
+	defer replication_mgr.settings_lock.Unlock()
+
 	// read replication spec with the specified replication id
 	replSpec, err := MetadataService().ReplicationSpec(topic)
 	if err != nil {
 		return err
 	}
 
+	changedSettings := make(map[string]interface{})
+	for key, val := range settings {
+		changedSettings[key] = val
+	}
+	if len(inheritedKeys) > 0 {
+		defaultSettings, err := ReplicationSettingsService().GetReplicationSettings()
+		if err != nil {
+			return err
+		}
+		defaultSettingsMap := defaultSettings.ToMap()
+		for _, key := range inheritedKeys {
+			if _, ok := settings[key]; ok {
+				return errors.New(fmt.Sprintf("Setting %v cannot be both set and inherited", key))
+			}
+			if spec := metadata.ReplicationSettingsSchema.Spec(key); spec != nil && spec.PerReplication {
+				return errors.New(fmt.Sprintf("Setting %v is set on each replication and cannot be inherited", key))
+			}
+			changedSettings[key] = defaultSettingsMap[key]
+		}
+	}
+
 	// update replication spec with input settings
-	replSpec.Settings.UpdateSettingsFromMap(settings)
+	if err = replSpec.Settings.UpdateSettingsFromMap(changedSettings); err != nil {
+		return err
+	}
+	if replSpec.OverriddenSettings == nil {
+		// all settings of legacy replications have been explicitly set
+		replSpec.OverriddenSettings = make(map[string]bool)
+		for key, _ := range replSpec.Settings.ToMap() {
+			replSpec.OverriddenSettings[key] = true
+		}
+	}
+	for key, _ := range settings {
+		replSpec.OverriddenSettings[key] = true
+	}
+	for _, key := range inheritedKeys {
+		delete(replSpec.OverriddenSettings, key)
+	}
 	err = MetadataService().SetReplicationSpec(*replSpec)
+
+	if err == nil && len(changedSettings) > 0 {
+		// running pipelines keep the settings they were started with
+		logger_rm.Infof("Settings %v of replication %v will take effect after the replication is restarted\n", changedSettings, topic)
+	}
 	
 	// TODO implement additional logic, e.g.,
 	// 1. reconstruct pipeline when source/targetNozzlePerNode is changed
@@ -219,13 +346,144 @@ func HandleChangesToReplicationSettings(topic string, settings map[string]interf
 	return err
 }
 
-// get statistics for all running replications
+// change default replication settings, and apply the changes to the replications that inherit them.
+// returns the resulting default replication settings
+func SetDefaultReplicationSettings(settings map[string]interface{}) (*metadata.ReplicationSettings, error) {
+	replication_mgr.settings_lock.Lock()
+	defer replication_mgr.settings_lock.Unlock()
+
+	defaultSettings, err := ReplicationSettingsService().GetReplicationSettings()
+	if err != nil {
+		return nil, err
+	}
+	if err = defaultSettings.UpdateSettingsFromMap(settings); err != nil {
+		return nil, err
+	}
+	if err = ReplicationSettingsService().SetReplicationSettings(defaultSettings); err != nil {
+		return nil, err
+	}
+
+	specs, err := MetadataService().ReplicationSpecs()
+	if err != nil {
+		return nil, err
+	}
+	for _, spec := range specs {
+		if spec.InheritDefaultSettings(defaultSettings) {
+			if err = MetadataService().SetReplicationSpec(*spec); err != nil {
+				// the replication will pick up the defaults the next time they are changed
+				logger_rm.Errorf("Failed to apply default replication settings to replication %v. err=%v\n", spec.Id, err)
+			} else {
+				logger_rm.Infof("Default replication settings have been applied to replication %v\n", spec.Id)
+			}
+		}
+	}
+	return defaultSettings, nil
+}
+
+// settings, keyed by internal keys, with the unspecified ones filled in from default replication settings
+func settingsWithDefaults(settings map[string]interface{}) (map[string]interface{}, error) {
+	defaultSettings, err := ReplicationSettingsService().GetReplicationSettings()
+	if err != nil {
+		return nil, err
+	}
+
+	settingsMap := defaultSettings.ToMap()
+	for key, val := range settings {
+		settingsMap[key] = val
+	}
+	return settingsMap, nil
+}
+
+// combined health of the components of a running replication, as of the last health check of its
+// pipeline supervisor. nil is returned if the replication is not running on the current node
+func GetReplicationHealth(topic string) *common.PipelineHealth {
+	ctx := pipeline_manager.RuntimeCtx(topic)
+	if ctx == nil {
+		// a replication paused on an error is failed till it is resumed
+		if err := pauseError(topic); err != nil {
+			return &common.PipelineHealth{Health: common.NewHealth(common.HealthFailed, fmt.Sprintf("paused on error, %v", err)),
+				Components: make(map[string]common.Health)}
+		}
+		return nil
+	}
+	supervisor, ok := ctx.Service(base.PIPELINE_SUPERVISOR_SVC).(*pipeline_svc.PipelineSupervisor)
+	if !ok {
+		return nil
+	}
+	return supervisor.Health()
+}
+
+// get statistics for all running replications, keyed by replication id
 func GetStatistics() (map[string]interface{}, error) {
-	// TODO implement
-	return nil, nil
+	stats := make(map[string]interface{})
+	for topic, pipeline := range pipeline_manager.Pipelines() {
+		stats[topic] = pipelineStatistics(pipeline)
+	}
+	return stats, nil
+}
+
+// statistics of a pipeline derived from those of its parts
+const (
+	DEDUP_HIT_RATE    = "dedup_hit_rate"
+	COMPRESSION_RATIO = "compression_ratio"
+	// metrics of the gen_servers of the pipeline, e.g., mailbox depths, keyed by part id
+	GEN_SERVERS = "gen_servers"
+	// number of errors raised by the components of the pipeline, keyed by error class
+	ERROR_COUNTS = "error_counts"
+)
+
+// parts that report statistics, e.g., queue parts and xmem nozzles
+type statisticsReporter interface {
+	Statistics() map[string]interface{}
 }
 
-func (rm *replicationManager) createAndPersistReplicationSpec(sourceClusterUUID, sourceBucket, targetClusterUUID, targetBucket, filterName string, settings map[string]interface{}) (*metadata.ReplicationSpecification, error) {
+// statistics of a pipeline, which are the sums of the statistics of its queue parts and xmem nozzles,
+// the deduplication hit rate and compression ratio, and the metrics of its gen_servers
+func pipelineStatistics(pipeline common.Pipeline) map[string]interface{} {
+	stats := map[string]interface{}{parts.QUEUE_STATS_DOCS: 0,
+		parts.QUEUE_STATS_SIZE:                   0,
+		parts.QUEUE_STATS_DOCS_ON_DISK:           0,
+		parts.QUEUE_STATS_SIZE_ON_DISK:           0,
+		parts.QUEUE_STATS_BACK_PRESSURE:          0,
+		parts.XMEM_STATS_DOCS_SPOOLED:            0,
+		parts.XMEM_STATS_SIZE_SPOOLED:            0,
+		parts.XMEM_STATS_DOCS_DEDUP_CHECKED:      0,
+		parts.XMEM_STATS_DOCS_DEDUPED:            0,
+		parts.XMEM_STATS_SIZE_BEFORE_COMPRESSION: 0,
+		parts.XMEM_STATS_SIZE_AFTER_COMPRESSION:  0}
+	for _, part := range pp.GetAllParts(pipeline) {
+		if reporter, ok := part.(statisticsReporter); ok {
+			for key, val := range reporter.Statistics() {
+				stats[key] = stats[key].(int) + val.(int)
+			}
+		}
+	}
+
+	// the fraction of the mutations dropped by deduplication
+	hitRate := 0.0
+	if checked := stats[parts.XMEM_STATS_DOCS_DEDUP_CHECKED].(int); checked > 0 {
+		hitRate = float64(stats[parts.XMEM_STATS_DOCS_DEDUPED].(int)) / float64(checked)
+	}
+	stats[DEDUP_HIT_RATE] = hitRate
+
+	// the original size of the compressed mutation bodies over their compressed size
+	compressionRatio := 0.0
+	if after := stats[parts.XMEM_STATS_SIZE_AFTER_COMPRESSION].(int); after > 0 {
+		compressionRatio = float64(stats[parts.XMEM_STATS_SIZE_BEFORE_COMPRESSION].(int)) / float64(after)
+	}
+	stats[COMPRESSION_RATIO] = compressionRatio
+
+	stats[GEN_SERVERS] = gen_server.DefaultMetricsRegistry.Snapshots(pipeline.Topic())
+	if ctx := pipeline.RuntimeContext(); ctx != nil {
+		if supervisor, ok := ctx.Service(base.PIPELINE_SUPERVISOR_SVC).(*pipeline_svc.PipelineSupervisor); ok {
+			stats[ERROR_COUNTS] = supervisor.ErrorCounts()
+		}
+	}
+	return stats
+}
+
+// settings are all settings of the replication, and explicitSettings are the ones explicitly specified
+func (rm *replicationManager) createAndPersistReplicationSpec(sourceClusterUUID, sourceBucket, targetClusterUUID, targetBucket, filterName string, settings, explicitSettings map[string]interface{}) (*metadata.ReplicationSpecification, error) {
 	logger_rm.Infof("Creating replication spec - sourceCluterUUID=%s, sourceBucket=%s, targetClusterUUID=%s, targetBucket=%s, filterName=%s, settings=%v\n", sourceClusterUUID,
 		sourceBucket, targetClusterUUID, targetBucket, filterName, settings)
 		
@@ -239,6 +497,9 @@ func (rm *replicationManager) createAndPersistReplicationSpec(sourceClusterUUID,
 	s, err := metadata.SettingsFromMap(settings)
 	if err == nil {
 		spec.Settings = s
+		for key, _ := range explicitSettings {
+			spec.OverriddenSettings[key] = true
+		}
 
 		//persist it
 		replication_mgr.metadata_svc.AddReplicationSpec(*spec)
@@ -251,6 +512,9 @@ func (rm *replicationManager) createAndPersistReplicationSpec(sourceClusterUUID,
 
 //update the replication specification's "active" setting
 func UpdateReplicationSpec(topic string, active bool, action string) error {	
+	replication_mgr.settings_lock.Lock()
+	defer replication_mgr.settings_lock.Unlock()
+
 	spec, err := replication_mgr.metadata_svc.ReplicationSpec(topic)
 	if err != nil {
 		logger_rm.Errorf("%v\n", err)
@@ -272,14 +536,21 @@ func UpdateReplicationSpec(topic string, active bool, action string) error {
 }
 
 func (rm *replicationManager) OnError(pipeline common.Pipeline, partsError map[string]error) {
-	logger_rm.Infof("Pipeline %v reported failure. The following parts are broken: %v\n", pipeline.Topic(), partsError)
+	logger := replicationLogger(pipeline.Topic())
+	logger.Infof("Pipeline %v reported failure. The following parts are broken: %v\n", pipeline.Topic(), partsError)
 	
 	// try to fix the pipeline
 	err := fixPipeline(pipeline)
 
 	if err != nil {
-		logger_rm.Infof("The effort of fixing pipeline %v has failed, err=%v; The retry will happen latter\n",
+		logger.Infof("The effort of fixing pipeline %v has failed, err=%v; The retry will happen latter\n",
 			pipeline.Topic(), err)
+		rm.RecordError(pipeline, "ReplicationManager", err)
+		if replicationErrorPolicy(pipeline.Topic(), err) == base.ErrorPolicyPause {
+			// restarting the pipeline again does not help, e.g., when the target bucket has been deleted
+			pauseOnError(pipeline.Topic(), map[string]error{"ReplicationManager": err})
+			return
+		}
 		panic("Failed to fix pipeline")
 		//TODO: propagate the error to ns_server
 
@@ -288,6 +559,113 @@ func (rm *replicationManager) OnError(pipeline common.Pipeline, partsError map[s
 
 }
 
+// the pipeline has failed in a way that restarting it does not fix, e.g., on authentication errors.
+// the replication is paused, and the error is shown in its health till it is resumed
+func (rm *replicationManager) OnPause(pipeline common.Pipeline, partsError map[string]error) {
+	if !checkPipelineOnFile(pipeline) {
+		return
+	}
+	pauseOnError(pipeline.Topic(), partsError)
+}
+
+// pause replication topic, and record the errors it is paused on
+func pauseOnError(topic string, partsError map[string]error) {
+	logger := replicationLogger(topic)
+	logger.Errorf("Pausing replication %v, as the following parts have failed: %v\n", topic, partsError)
+
+	errs := []string{}
+	for partId, err := range partsError {
+		errs = append(errs, fmt.Sprintf("%v: %v", partId, err))
+	}
+	sort.Strings(errs)
+	setPauseError(topic, errors.New(strings.Join(errs, "; ")))
+
+	if err := PauseReplication(topic, true/*updateReplSpec*/, true/*sync*/); err != nil {
+		logger.Errorf("Failed to pause replication %v, err=%v\n", topic, err)
+	}
+}
+
+// how replication topic handles err, by the error policies in its settings
+func replicationErrorPolicy(topic string, err error) base.ErrorPolicy {
+	policies := base.DefaultErrorPolicies()
+	if spec, specErr := MetadataService().ReplicationSpec(topic); specErr == nil {
+		if configured, parseErr := base.ParseErrorPolicies(spec.Settings.ErrorPolicies); parseErr == nil {
+			policies = configured
+		}
+	}
+	return policies[base.ErrorClassOf(err)]
+}
+
+// record the error that replication topic is paused on. nil clears it
+func setPauseError(topic string, err error) {
+	replication_mgr.pause_errors_lock.Lock()
+	defer replication_mgr.pause_errors_lock.Unlock()
+	if err == nil {
+		delete(replication_mgr.pause_errors, topic)
+	} else {
+		replication_mgr.pause_errors[topic] = err
+	}
+}
+
+func pauseError(topic string) error {
+	replication_mgr.pause_errors_lock.Lock()
+	defer replication_mgr.pause_errors_lock.Unlock()
+	return replication_mgr.pause_errors[topic]
+}
+
+// record an error of a pipeline in the error history of its replication
+func (rm *replicationManager) RecordError(pipeline common.Pipeline, partId string, err error) {
+	errorHistory(pipeline.Topic(), true).Add(base.NewErrorRecord(partId, err))
+}
+
+// the error history of replication topic. nil is returned if there is none and create is false
+func errorHistory(topic string, create bool) *base.ErrorHistory {
+	replication_mgr.error_histories_lock.Lock()
+	defer replication_mgr.error_histories_lock.Unlock()
+	history, ok := replication_mgr.error_histories[topic]
+	if !ok && create {
+		history = base.NewErrorHistory(base.ErrorHistorySize)
+		replication_mgr.error_histories[topic] = history
+	}
+	return history
+}
+
+func deleteErrorHistory(topic string) {
+	replication_mgr.error_histories_lock.Lock()
+	defer replication_mgr.error_histories_lock.Unlock()
+	delete(replication_mgr.error_histories, topic)
+}
+
+// the most recent errors of a replication on the current node, oldest first
+func GetReplicationErrors(topic string) []*base.ErrorRecord {
+	if history := errorHistory(topic, false); history != nil {
+		return history.Records()
+	}
+	return []*base.ErrorRecord{}
+}
+
+func ClearReplicationErrors(topic string) {
+	if history := errorHistory(topic, false); history != nil {
+		history.Clear()
+	}
+	logger_rm.Infof("Errors of replication %v are cleared\n", topic)
+}
+
+// the health of a pipeline changes, e.g., it is degraded as too many requests to the target time out
+func (rm *replicationManager) OnHealthChange(pipeline common.Pipeline, health *common.PipelineHealth) {
+	logger := replicationLogger(pipeline.Topic())
+	if health.Status == common.HealthOk {
+		logger.Infof("Replication %v is healthy again\n", pipeline.Topic())
+	} else {
+		logger.Infof("Replication %v is %v. reason=%v\n", pipeline.Topic(), health.Status, health.Reason)
+	}
+}
+
+// logger of replication manager that logs the id of replication topic with the messages about it
+func replicationLogger(topic string) *log.CommonLogger {
+	return logger_rm.With(log.FIELD_REPLICATION_ID, topic)
+}
+
 // start all replications with active replication spec 
 func (rm *replicationManager) startReplications() {
 	logger_rm.Infof("Replication manager init - starting existing replications")
@@ -301,6 +679,67 @@ func (rm *replicationManager) startReplications() {
 	for _, spec := range specs {
 		go pipeline_manager.StartPipeline(spec.Id, spec.Settings.ToMap())
 	}
+	rm.refreshTopologySubscriptions()
+}
+
+// subscribe to topology changes of the source and target buckets of active replications,
+// and unsubscribe from the buckets that are no longer replicated
+func (rm *replicationManager) refreshTopologySubscriptions() {
+	if rm.topology_watcher == nil {
+		return
+	}
+
+	specs, err := rm.metadata_svc.ActiveReplicationSpecs()
+	if err != nil {
+		logger_rm.Errorf("Failed to refresh topology subscriptions. err=%v\n", err)
+		return
+	}
+	buckets := make(map[watchedBucket]bool)
+	for _, spec := range specs {
+		buckets[watchedBucket{spec.SourceClusterUUID, spec.SourceBucketName}] = true
+		buckets[watchedBucket{spec.TargetClusterUUID, spec.TargetBucketName}] = true
+	}
+
+	rm.watched_buckets_lock.Lock()
+	defer rm.watched_buckets_lock.Unlock()
+	for bucket, _ := range rm.watched_buckets {
+		if !buckets[bucket] {
+			rm.topology_watcher.Unsubscribe(bucket.clusterUUID, bucket.bucket, rm)
+			delete(rm.watched_buckets, bucket)
+		}
+	}
+	for bucket, _ := range buckets {
+		if !rm.watched_buckets[bucket] {
+			if err := rm.topology_watcher.Subscribe(bucket.clusterUUID, bucket.bucket, rm); err != nil {
+				logger_rm.Errorf("Failed to subscribe to topology changes of bucket %v of cluster %v. err=%v\n", bucket.bucket, bucket.clusterUUID, err)
+				continue
+			}
+			rm.watched_buckets[bucket] = true
+		}
+	}
+}
+
+// restart the running pipelines that replicate from or to the bucket, so that
+// their nozzles are constructed again from the current vbucket server maps
+func (rm *replicationManager) OnTopologyChange(clusterUUID, bucket string, events []*metadata_svc.TopologyChangeEvent) {
+	logger_rm.Infof("Topology of bucket %v of cluster %v has changed. events=%v\n", bucket, clusterUUID, events)
+
+	specs, err := rm.metadata_svc.ActiveReplicationSpecs()
+	if err != nil {
+		logger_rm.Errorf("Failed to get active replications to react to topology changes. err=%v\n", err)
+		return
+	}
+	for _, spec := range specs {
+		if (spec.SourceClusterUUID == clusterUUID && spec.SourceBucketName == bucket) ||
+			(spec.TargetClusterUUID == clusterUUID && spec.TargetBucketName == bucket) {
+			pipeline := pipeline_manager.Pipeline(spec.Id)
+			if pipeline == nil {
+				continue
+			}
+			logger_rm.Infof("Restarting pipeline %v on topology changes\n", spec.Id)
+			go fixPipeline(pipeline)
+		}
+	}
 }
 
 func fixPipeline(pipeline common.Pipeline) error {
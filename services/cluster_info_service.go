@@ -0,0 +1,425 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+// cluster info service implementation, which reads cluster and bucket information from couchbase cluster rest api
+package services
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Xiaomei-Zhang/goxdcr/base"
+	"github.com/Xiaomei-Zhang/goxdcr/log"
+	"github.com/Xiaomei-Zhang/goxdcr/utils"
+	"github.com/couchbaselabs/go-couchbase"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rest api paths of couchbase cluster
+const (
+	PoolsPath              = "/pools"
+	DefaultPoolPath        = "/pools/default"
+	DefaultPoolBucketsPath = "/pools/default/buckets/"
+	NodeServicesPath       = "/pools/default/nodeServices"
+)
+
+// names of services in nodeServices
+const (
+	KVService   = "kv"
+	MgmtService = "mgmt"
+)
+
+// how long the responses of cluster rest api are cached
+var DefaultClusterInfoCacheTTL = 10 * time.Second
+
+var ErrorUnknownCluster = errors.New("Cluster is unknown to cluster info service")
+
+/************************************
+/* responses of cluster rest api
+*************************************/
+type PoolsInfo struct {
+	UUID string `json:"uuid"`
+}
+
+type NodePorts struct {
+	// memcached port
+	Direct int `json:"direct"`
+}
+
+type NodeInfo struct {
+	// host:port of the rest api
+	Hostname          string    `json:"hostname"`
+	Version           string    `json:"version"`
+	Status            string    `json:"status"`
+	ClusterMembership string    `json:"clusterMembership"`
+	Ports             NodePorts `json:"ports"`
+}
+
+type PoolInfo struct {
+	Nodes []NodeInfo `json:"nodes"`
+}
+
+type VBucketServerMap struct {
+	// kv addresses, host:port
+	ServerList []string `json:"serverList"`
+	// vbucket -> indexes of active and replica servers in ServerList
+	VBucketMap [][]int `json:"vBucketMap"`
+}
+
+type BucketInfo struct {
+	Name             string           `json:"name"`
+	UUID             string           `json:"uuid"`
+	VBucketServerMap VBucketServerMap `json:"vBucketServerMap"`
+}
+
+type NodeExt struct {
+	// service name -> port
+	Services map[string]int `json:"services"`
+	// not present when the cluster has a single node, in which case the host in the request url is the host of the node
+	Hostname string `json:"hostname"`
+	ThisNode bool   `json:"thisNode"`
+}
+
+type NodeServicesInfo struct {
+	Rev      int       `json:"rev"`
+	NodesExt []NodeExt `json:"nodesExt"`
+}
+
+// map of kv address -> active vbuckets on the kv node
+func (serverMap *VBucketServerMap) ServerVBucketsMap() (map[string][]uint16, error) {
+	serverVBMap := make(map[string][]uint16)
+	for vbno, servers := range serverMap.VBucketMap {
+		if len(servers) == 0 || servers[0] < 0 {
+			// vbucket has no active server, e.g., during failover
+			continue
+		}
+		if servers[0] >= len(serverMap.ServerList) {
+			return nil, errors.New(fmt.Sprintf("Invalid server index %v for vbucket %v in vBucketServerMap", servers[0], vbno))
+		}
+		server := serverMap.ServerList[servers[0]]
+		serverVBMap[server] = append(serverVBMap[server], uint16(vbno))
+	}
+	return serverVBMap, nil
+}
+
+// kv address of a node in nodeServices, or empty if the node does not run kv service
+func (node *NodeExt) KVAddr(defaultHost string) string {
+	port, ok := node.Services[KVService]
+	if !ok {
+		return ""
+	}
+	return utils.GetHostAddr(node.HostName(defaultHost), port)
+}
+
+func (node *NodeExt) HostName(defaultHost string) string {
+	if len(node.Hostname) > 0 {
+		return node.Hostname
+	}
+	return defaultHost
+}
+
+/************************************
+/* struct ClusterInfoSvc
+*************************************/
+// reference to a cluster, local or remote
+type clusterRef struct {
+	// host:port of cluster rest api
+	connStr  string
+	username string
+	password string
+}
+
+// cached response of a rest call
+type cacheEntry struct {
+	value  interface{}
+	expiry time.Time
+}
+
+type ClusterInfoSvc struct {
+	// connection string -> cluster
+	clusters     map[string]*clusterRef
+	clustersLock sync.RWMutex
+
+	// cluster connection string + rest path -> cached response
+	cache     map[string]*cacheEntry
+	cacheLock sync.Mutex
+	ttl       time.Duration
+
+	logger *log.CommonLogger
+}
+
+func NewClusterInfoSvc(ttl time.Duration, logger_ctx *log.LoggerContext) *ClusterInfoSvc {
+	return &ClusterInfoSvc{clusters: make(map[string]*clusterRef),
+		cache:  make(map[string]*cacheEntry),
+		ttl:    ttl,
+		logger: log.NewLogger("ClusterInfoService", logger_ctx)}
+}
+
+// register a cluster with the connection string, host:port, of its rest api
+func (ci_svc *ClusterInfoSvc) AddCluster(connStr, username, password string) {
+	ci_svc.clustersLock.Lock()
+	defer ci_svc.clustersLock.Unlock()
+	ci_svc.clusters[connStr] = &clusterRef{connStr: connStr, username: username, password: password}
+	ci_svc.logger.Infof("Added cluster %v\n", connStr)
+}
+
+func (ci_svc *ClusterInfoSvc) RemoveCluster(connStr string) {
+	ci_svc.clustersLock.Lock()
+	delete(ci_svc.clusters, connStr)
+	ci_svc.clustersLock.Unlock()
+
+	// drop cached responses of the cluster
+	ci_svc.cacheLock.Lock()
+	defer ci_svc.cacheLock.Unlock()
+	for key, _ := range ci_svc.cache {
+		if strings.HasPrefix(key, connStr+base.UrlDelimiter) {
+			delete(ci_svc.cache, key)
+		}
+	}
+}
+
+func (ci_svc *ClusterInfoSvc) clusterRefs() []*clusterRef {
+	ci_svc.clustersLock.RLock()
+	defer ci_svc.clustersLock.RUnlock()
+	refs := make([]*clusterRef, 0, len(ci_svc.clusters))
+	for _, ref := range ci_svc.clusters {
+		refs = append(refs, ref)
+	}
+	return refs
+}
+
+// uuid of the cluster with the specified connection string
+func (ci_svc *ClusterInfoSvc) ClusterUUID(connStr string) (string, error) {
+	ref, err := ci_svc.clusterRefByConnStr(connStr)
+	if err != nil {
+		return "", err
+	}
+	pools, err := ci_svc.poolsInfo(ref)
+	if err != nil {
+		return "", err
+	}
+	return pools.UUID, nil
+}
+
+func (ci_svc *ClusterInfoSvc) clusterRefByConnStr(connStr string) (*clusterRef, error) {
+	ci_svc.clustersLock.RLock()
+	defer ci_svc.clustersLock.RUnlock()
+	ref, ok := ci_svc.clusters[connStr]
+	if !ok {
+		return nil, ErrorUnknownCluster
+	}
+	return ref, nil
+}
+
+// look up a cluster by its uuid. for backward compatibility, the connection string of a cluster
+// is accepted as its uuid as well
+func (ci_svc *ClusterInfoSvc) clusterRef(clusterUUID string) (*clusterRef, error) {
+	if ref, err := ci_svc.clusterRefByConnStr(clusterUUID); err == nil {
+		return ref, nil
+	}
+
+	for _, ref := range ci_svc.clusterRefs() {
+		pools, err := ci_svc.poolsInfo(ref)
+		if err != nil {
+			ci_svc.logger.Errorf("Failed to get uuid of cluster %v. err=%v\n", ref.connStr, err)
+			continue
+		}
+		if pools.UUID == clusterUUID {
+			return ref, nil
+		}
+	}
+	return nil, ErrorUnknownCluster
+}
+
+// get the response of a rest call on a cluster, from cache if it has not expired.
+// newOut returns a pointer to a new value that the response is decoded into
+func (ci_svc *ClusterInfoSvc) query(ref *clusterRef, path string, newOut func() interface{}) (interface{}, error) {
+	cacheKey := ref.connStr + path
+
+	ci_svc.cacheLock.Lock()
+	entry, ok := ci_svc.cache[cacheKey]
+	ci_svc.cacheLock.Unlock()
+	if ok && time.Now().Before(entry.expiry) {
+		return entry.value, nil
+	}
+
+	baseURL, err := url.Parse("http://" + ref.connStr)
+	if err != nil {
+		return nil, err
+	}
+	out := newOut()
+	if err = utils.QueryRestAPI(baseURL, path, ref.username, ref.password, "GET", out, ci_svc.logger); err != nil {
+		return nil, err
+	}
+
+	ci_svc.cacheLock.Lock()
+	ci_svc.cache[cacheKey] = &cacheEntry{value: out, expiry: time.Now().Add(ci_svc.ttl)}
+	ci_svc.cacheLock.Unlock()
+	return out, nil
+}
+
+func (ci_svc *ClusterInfoSvc) poolsInfo(ref *clusterRef) (*PoolsInfo, error) {
+	out, err := ci_svc.query(ref, PoolsPath, func() interface{} { return &PoolsInfo{} })
+	if err != nil {
+		return nil, err
+	}
+	return out.(*PoolsInfo), nil
+}
+
+func (ci_svc *ClusterInfoSvc) poolInfo(ref *clusterRef) (*PoolInfo, error) {
+	out, err := ci_svc.query(ref, DefaultPoolPath, func() interface{} { return &PoolInfo{} })
+	if err != nil {
+		return nil, err
+	}
+	return out.(*PoolInfo), nil
+}
+
+// bucket configuration, including vbucket server map, of a bucket in the specified cluster
+func (ci_svc *ClusterInfoSvc) BucketInfo(clusterUUID, bucketName string) (*BucketInfo, error) {
+	ref, err := ci_svc.clusterRef(clusterUUID)
+	if err != nil {
+		return nil, err
+	}
+	out, err := ci_svc.query(ref, DefaultPoolBucketsPath+bucketName, func() interface{} { return &BucketInfo{} })
+	if errors.Is(err, utils.ErrorResourceNotFound) {
+		// the replication can't run till the bucket is created again
+		return nil, base.NewClassifiedError(base.ErrorClassConfiguration, fmt.Sprintf("getting bucket %v of cluster %v", bucketName, clusterUUID), base.ErrorBucketNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return out.(*BucketInfo), nil
+}
+
+// services running on the nodes of the specified cluster
+func (ci_svc *ClusterInfoSvc) NodeServices(clusterUUID string) (*NodeServicesInfo, error) {
+	ref, err := ci_svc.clusterRef(clusterUUID)
+	if err != nil {
+		return nil, err
+	}
+	out, err := ci_svc.query(ref, NodeServicesPath, func() interface{} { return &NodeServicesInfo{} })
+	if err != nil {
+		return nil, err
+	}
+	return out.(*NodeServicesInfo), nil
+}
+
+func (ci_svc *ClusterInfoSvc) GetClusterConnectionStr(clusterUUID string) (string, error) {
+	ref, err := ci_svc.clusterRef(clusterUUID)
+	if err != nil {
+		return "", err
+	}
+	return ref.connStr, nil
+}
+
+func (ci_svc *ClusterInfoSvc) GetMyActiveVBuckets(clusterUUID string, bucketName string, nodeId string) ([]uint16, error) {
+	serverVBMap, err := ci_svc.GetServerVBucketsMap(clusterUUID, bucketName)
+	if err != nil {
+		return nil, err
+	}
+	vbList, ok := serverVBMap[nodeId]
+	if !ok {
+		// the node does not have any active vbuckets
+		vbList = make([]uint16, 0)
+	}
+	return vbList, nil
+}
+
+func (ci_svc *ClusterInfoSvc) GetServerList(clusterUUID string, bucketName string) ([]string, error) {
+	bucketInfo, err := ci_svc.BucketInfo(clusterUUID, bucketName)
+	if err != nil {
+		return nil, err
+	}
+	return bucketInfo.VBucketServerMap.ServerList, nil
+}
+
+func (ci_svc *ClusterInfoSvc) GetServerVBucketsMap(clusterUUID string, bucketName string) (map[string][]uint16, error) {
+	bucketInfo, err := ci_svc.BucketInfo(clusterUUID, bucketName)
+	if err != nil {
+		return nil, err
+	}
+	return bucketInfo.VBucketServerMap.ServerVBucketsMap()
+}
+
+// whether the kv node, host:port, in any of the known clusters runs the specified version or later
+func (ci_svc *ClusterInfoSvc) IsNodeCompatible(node string, version string) (bool, error) {
+	host, portStr, err := net.SplitHostPort(node)
+	if err != nil {
+		return false, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return false, err
+	}
+
+	for _, ref := range ci_svc.clusterRefs() {
+		pool, err := ci_svc.poolInfo(ref)
+		if err != nil {
+			ci_svc.logger.Errorf("Failed to get nodes of cluster %v. err=%v\n", ref.connStr, err)
+			continue
+		}
+		for _, nodeInfo := range pool.Nodes {
+			nodeHost, _, err := net.SplitHostPort(nodeInfo.Hostname)
+			if err == nil && nodeHost == host && nodeInfo.Ports.Direct == port {
+				return compareVersions(nodeInfo.Version, version) >= 0, nil
+			}
+		}
+	}
+	return false, errors.New(fmt.Sprintf("Node %v is not found in any known cluster", node))
+}
+
+func (ci_svc *ClusterInfoSvc) GetBucket(clusterUUID, bucketName string) (*couchbase.Bucket, error) {
+	ref, err := ci_svc.clusterRef(clusterUUID)
+	if err != nil {
+		return nil, err
+	}
+	return utils.Bucket(ref.connStr, bucketName, ref.username, ref.password)
+}
+
+// compare version strings like "3.0.1-1444-rel-enterprise" on their numeric parts.
+// returns -1, 0, 1 when version1 is lower than, equal to, or higher than version2
+func compareVersions(version1, version2 string) int {
+	parts1 := versionNumbers(version1)
+	parts2 := versionNumbers(version2)
+	for i := 0; i < len(parts1) || i < len(parts2); i++ {
+		var num1, num2 int
+		if i < len(parts1) {
+			num1 = parts1[i]
+		}
+		if i < len(parts2) {
+			num2 = parts2[i]
+		}
+		if num1 < num2 {
+			return -1
+		} else if num1 > num2 {
+			return 1
+		}
+	}
+	return 0
+}
+
+// numeric parts of a version string before the first "-"
+func versionNumbers(version string) []int {
+	if index := strings.Index(version, "-"); index >= 0 {
+		version = version[:index]
+	}
+	numbers := make([]int, 0)
+	for _, part := range strings.Split(version, ".") {
+		num, err := strconv.Atoi(part)
+		if err != nil {
+			break
+		}
+		numbers = append(numbers, num)
+	}
+	return numbers
+}
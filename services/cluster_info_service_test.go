@@ -0,0 +1,271 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package services
+
+import (
+	"github.com/Xiaomei-Zhang/goxdcr/base"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testClusterUUID = "a1b2c3d4e5f60718293a4b5c6d7e8f90"
+	testUsername    = "Administrator"
+	testPassword    = "welcome"
+)
+
+// rest path -> file in testdata with the response recorded from a two node cluster
+var recordedResponses = map[string]string{
+	PoolsPath:                          "pools.json",
+	DefaultPoolPath:                    "pools_default.json",
+	DefaultPoolBucketsPath + "default": "bucket_default.json",
+	NodeServicesPath:                   "node_services.json",
+}
+
+// stand-in for the rest api of a cluster, which serves recorded responses
+type recordedCluster struct {
+	server *httptest.Server
+	// rest path -> number of requests
+	hits     map[string]int
+	hitsLock sync.Mutex
+}
+
+func newRecordedCluster(t *testing.T) *recordedCluster {
+	cluster := &recordedCluster{hits: make(map[string]int)}
+	cluster.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok || username != testUsername || password != testPassword {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		file, ok := recordedResponses[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		body, err := ioutil.ReadFile(filepath.Join("testdata", file))
+		if err != nil {
+			t.Errorf("Failed to read recorded response %v. err=%v", file, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		cluster.hitsLock.Lock()
+		cluster.hits[r.URL.Path]++
+		cluster.hitsLock.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}))
+	return cluster
+}
+
+func (cluster *recordedCluster) connStr() string {
+	return strings.TrimPrefix(cluster.server.URL, "http://")
+}
+
+func (cluster *recordedCluster) hitCount(path string) int {
+	cluster.hitsLock.Lock()
+	defer cluster.hitsLock.Unlock()
+	return cluster.hits[path]
+}
+
+func newTestClusterInfoSvc(t *testing.T, ttl time.Duration) (*ClusterInfoSvc, *recordedCluster) {
+	cluster := newRecordedCluster(t)
+	ci_svc := NewClusterInfoSvc(ttl, nil)
+	ci_svc.AddCluster(cluster.connStr(), testUsername, testPassword)
+	return ci_svc, cluster
+}
+
+func TestGetClusterConnectionStr(t *testing.T) {
+	ci_svc, cluster := newTestClusterInfoSvc(t, DefaultClusterInfoCacheTTL)
+	defer cluster.server.Close()
+
+	uuid, err := ci_svc.ClusterUUID(cluster.connStr())
+	if err != nil || uuid != testClusterUUID {
+		t.Fatalf("ClusterUUID returned %v, %v", uuid, err)
+	}
+
+	// look up by uuid and by connection string
+	for _, id := range []string{testClusterUUID, cluster.connStr()} {
+		connStr, err := ci_svc.GetClusterConnectionStr(id)
+		if err != nil || connStr != cluster.connStr() {
+			t.Errorf("GetClusterConnectionStr(%v) returned %v, %v", id, connStr, err)
+		}
+	}
+
+	if _, err := ci_svc.GetClusterConnectionStr("unknown"); err != ErrorUnknownCluster {
+		t.Errorf("Expected ErrorUnknownCluster for unknown cluster, got %v", err)
+	}
+}
+
+func TestGetServerVBucketsMap(t *testing.T) {
+	ci_svc, cluster := newTestClusterInfoSvc(t, DefaultClusterInfoCacheTTL)
+	defer cluster.server.Close()
+
+	serverList, err := ci_svc.GetServerList(testClusterUUID, "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(serverList, []string{"10.1.1.1:11210", "10.1.1.2:11210"}) {
+		t.Errorf("Unexpected server list %v", serverList)
+	}
+
+	// vbucket 5 has no active server
+	serverVBMap, err := ci_svc.GetServerVBucketsMap(testClusterUUID, "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][]uint16{
+		"10.1.1.1:11210": []uint16{0, 1, 4, 7},
+		"10.1.1.2:11210": []uint16{2, 3, 6},
+	}
+	if !reflect.DeepEqual(serverVBMap, expected) {
+		t.Errorf("Expected server vbucket map %v, got %v", expected, serverVBMap)
+	}
+
+	vbList, err := ci_svc.GetMyActiveVBuckets(testClusterUUID, "default", "10.1.1.2:11210")
+	if err != nil || !reflect.DeepEqual(vbList, []uint16{2, 3, 6}) {
+		t.Errorf("GetMyActiveVBuckets returned %v, %v", vbList, err)
+	}
+
+	if _, err := ci_svc.GetServerList(testClusterUUID, "missing"); base.ErrorClassOf(err) != base.ErrorClassConfiguration {
+		t.Errorf("Expected configuration error for missing bucket, got %v", err)
+	}
+}
+
+func TestIsNodeCompatible(t *testing.T) {
+	ci_svc, cluster := newTestClusterInfoSvc(t, DefaultClusterInfoCacheTTL)
+	defer cluster.server.Close()
+
+	tests := []struct {
+		node       string
+		version    string
+		compatible bool
+	}{
+		{"10.1.1.1:11210", "2.5", true},
+		{"10.1.1.1:11210", "3.0.1", true},
+		{"10.1.1.1:11210", "3.0.2", false},
+		{"10.1.1.2:11210", "2.5", false},
+		{"10.1.1.2:11210", "2.2", true},
+	}
+	for _, test := range tests {
+		compatible, err := ci_svc.IsNodeCompatible(test.node, test.version)
+		if err != nil || compatible != test.compatible {
+			t.Errorf("IsNodeCompatible(%v, %v) returned %v, %v", test.node, test.version, compatible, err)
+		}
+	}
+
+	if _, err := ci_svc.IsNodeCompatible("10.1.1.3:11210", "2.5"); err == nil {
+		t.Errorf("Expected error for unknown node")
+	}
+}
+
+func TestClusterInfoCache(t *testing.T) {
+	ci_svc, cluster := newTestClusterInfoSvc(t, 50*time.Millisecond)
+	defer cluster.server.Close()
+
+	path := DefaultPoolBucketsPath + "default"
+	for i := 0; i < 3; i++ {
+		if _, err := ci_svc.GetServerList(cluster.connStr(), "default"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if count := cluster.hitCount(path); count != 1 {
+		t.Errorf("Expected 1 request before cache expires, got %v", count)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if _, err := ci_svc.GetServerList(cluster.connStr(), "default"); err != nil {
+		t.Fatal(err)
+	}
+	if count := cluster.hitCount(path); count != 2 {
+		t.Errorf("Expected 2 requests after cache expires, got %v", count)
+	}
+
+	// responses of a removed cluster are not served from cache
+	ci_svc.RemoveCluster(cluster.connStr())
+	if _, err := ci_svc.GetServerList(cluster.connStr(), "default"); err != ErrorUnknownCluster {
+		t.Errorf("Expected ErrorUnknownCluster after cluster is removed, got %v", err)
+	}
+}
+
+func TestXDCRTopologySvc(t *testing.T) {
+	ci_svc := NewClusterInfoSvc(DefaultClusterInfoCacheTTL, nil)
+	cluster := newRecordedCluster(t)
+	defer cluster.server.Close()
+
+	// the node without host name in nodeServices is the node serving the rest request
+	top_svc, err := NewXDCRTopologySvc("127.0.0.1", cluster.connStr(), testUsername, testPassword, ci_svc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	myCluster, err := top_svc.MyCluster()
+	if err != nil || myCluster != testClusterUUID {
+		t.Errorf("MyCluster returned %v, %v", myCluster, err)
+	}
+
+	kvNodeMap, err := top_svc.XDCRCompToKVNodeMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedKVNodeMap := map[string][]string{
+		"127.0.0.1": []string{"127.0.0.1:11210"},
+		"10.1.1.2":  []string{"10.1.1.2:11210"},
+	}
+	if !reflect.DeepEqual(kvNodeMap, expectedKVNodeMap) {
+		t.Errorf("Expected kv node map %v, got %v", expectedKVNodeMap, kvNodeMap)
+	}
+
+	kvNodes, err := top_svc.MyKVNodes()
+	if err != nil || !reflect.DeepEqual(kvNodes, []string{"127.0.0.1"}) {
+		t.Errorf("MyKVNodes returned %v, %v", kvNodes, err)
+	}
+
+	topology, err := top_svc.XDCRTopology()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := make([]string, 0)
+	for host, port := range topology {
+		if port != uint16(base.AdminportNumber) {
+			t.Errorf("Unexpected admin port %v for %v", port, host)
+		}
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	if !reflect.DeepEqual(hosts, []string{"10.1.1.2", "127.0.0.1"}) {
+		t.Errorf("Unexpected xdcr nodes %v", hosts)
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		version1, version2 string
+		result             int
+	}{
+		{"3.0.1-1444-rel-enterprise", "2.5", 1},
+		{"2.5", "2.5.0", 0},
+		{"2.2.0-837-rel-enterprise", "2.5", -1},
+		{"10.0", "9.9.9", 1},
+	}
+	for _, test := range tests {
+		if result := compareVersions(test.version1, test.version2); result != test.result {
+			t.Errorf("compareVersions(%v, %v) = %v, expected %v", test.version1, test.version2, result, test.result)
+		}
+	}
+}
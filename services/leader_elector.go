@@ -0,0 +1,356 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+// lease-based leader election among xdcr nodes.
+//
+// Every term of leadership has its own lease record in the metadata store, keyed by the term.
+// A node becomes leader of term n+1 by adding the record of term n+1 after the lease of term n
+// has expired. Add only succeeds if the record does not exist yet, which is the compare-and-swap
+// that guarantees at most one leader per term. The leader renews the lease by updating the
+// record of its own term, which no other node writes to.
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Xiaomei-Zhang/goxdcr/log"
+	"github.com/Xiaomei-Zhang/goxdcr/metadata"
+	"github.com/Xiaomei-Zhang/goxdcr/metadata_svc"
+	"github.com/couchbase/gometa/common"
+	"github.com/couchbase/gometa/repository"
+	"sync"
+	"time"
+)
+
+// lease records are keyed by LeaderLeaseKeyPrefix followed by the zero padded term,
+// so that the keys sort in the order of terms.
+// the keys need to be outside of [XdcrKeyStart, XdcrKeyEnd), which is reserved for replication specs
+var LeaderLeaseKeyPrefix = metadata.XdcrPrefix + "LeaderLease_"
+
+// ':' follows '9', so that [LeaderLeaseKeyPrefix, LeaderLeaseKeyEnd) covers all lease records
+var LeaderLeaseKeyEnd = LeaderLeaseKeyPrefix + ":"
+
+var ErrorLeaderElectorNotStarted = errors.New("Leader elector is not started")
+
+// the operations of metadata store that leader election is built on
+type LeaseStore interface {
+	// add the key only if it does not exist yet. returns false if it exists
+	AddIfAbsent(key string, value []byte) (bool, error)
+	Get(key string) ([]byte, error)
+	Set(key string, value []byte) error
+	Delete(key string) error
+	// keys in [startKey, endKey), in ascending order
+	Keys(startKey, endKey string) ([]string, error)
+}
+
+func leaderLeaseKey(term uint64) string {
+	return LeaderLeaseKeyPrefix + fmt.Sprintf("%020d", term)
+}
+
+/************************************
+/* struct MetadataLeaseStore
+*************************************/
+// lease store on top of the gometa client of metadata service
+type MetadataLeaseStore struct {
+	metadata_svc *MetadataSvc
+}
+
+func NewMetadataLeaseStore(metadata_svc *MetadataSvc) *MetadataLeaseStore {
+	return &MetadataLeaseStore{metadata_svc: metadata_svc}
+}
+
+func (store *MetadataLeaseStore) AddIfAbsent(key string, value []byte) (bool, error) {
+	_, err := store.metadata_svc.sendRequest(common.GetOpCodeStr(common.OPCODE_ADD), key, value)
+	if err == nil {
+		return true, nil
+	}
+	// add fails if the key exists. tell it apart from other failures by reading the key
+	existing, getErr := store.Get(key)
+	if getErr != nil {
+		return false, err
+	}
+	// the value is ours if add succeeded but its reply was lost
+	return bytes.Equal(existing, value), nil
+}
+
+func (store *MetadataLeaseStore) Get(key string) ([]byte, error) {
+	return store.metadata_svc.sendRequest(common.GetOpCodeStr(common.OPCODE_GET), key, nil)
+}
+
+func (store *MetadataLeaseStore) Set(key string, value []byte) error {
+	_, err := store.metadata_svc.sendRequest(common.GetOpCodeStr(common.OPCODE_SET), key, value)
+	return err
+}
+
+func (store *MetadataLeaseStore) Delete(key string) error {
+	_, err := store.metadata_svc.sendRequest(common.GetOpCodeStr(common.OPCODE_DELETE), key, nil)
+	return err
+}
+
+func (store *MetadataLeaseStore) Keys(startKey, endKey string) ([]string, error) {
+	repo, err := repository.OpenRepository()
+	if err != nil {
+		return nil, err
+	}
+	iter, err := repo.NewIterator(startKey, endKey)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+	keys := make([]string, 0)
+	for {
+		key, _, err := iter.Next()
+		if err != nil {
+			break
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+/************************************
+/* struct LeaderElector
+*************************************/
+type LeaderElector struct {
+	store          LeaseStore
+	nodeId         string
+	lease_duration time.Duration
+	renew_interval time.Duration
+
+	// the lease as last observed, nil if there is no valid lease
+	leader      *metadata_svc.LeaderInfo
+	leader_lock sync.RWMutex
+
+	callbacks      []metadata_svc.LeaderChangeCallback
+	callbacks_lock sync.RWMutex
+
+	finch    chan bool
+	wait_grp sync.WaitGroup
+	logger   *log.CommonLogger
+}
+
+// renew_interval needs to be well below lease_duration, so that the leader renews its lease before it expires
+func NewLeaderElector(store LeaseStore, nodeId string, lease_duration, renew_interval time.Duration, logger_ctx *log.LoggerContext) *LeaderElector {
+	return &LeaderElector{store: store,
+		nodeId:         nodeId,
+		lease_duration: lease_duration,
+		renew_interval: renew_interval,
+		callbacks:      make([]metadata_svc.LeaderChangeCallback, 0),
+		logger:         log.NewLogger("LeaderElector", logger_ctx)}
+}
+
+func (elector *LeaderElector) Start() error {
+	elector.finch = make(chan bool)
+	elector.wait_grp.Add(1)
+	go elector.electing()
+	elector.logger.Infof("Leader elector is started on node %v\n", elector.nodeId)
+	return nil
+}
+
+func (elector *LeaderElector) Stop() error {
+	if elector.finch == nil {
+		return ErrorLeaderElectorNotStarted
+	}
+	close(elector.finch)
+	elector.wait_grp.Wait()
+	elector.finch = nil
+
+	// let other nodes take over right away instead of after the lease expires
+	if isLeader, _ := elector.IsLeader(); isLeader {
+		lease := *elector.Leader()
+		lease.Expiry = time.Now()
+		if err := elector.putLease(&lease); err != nil {
+			elector.logger.Errorf("Failed to release leader lease of term %v. err=%v\n", lease.Term, err)
+		}
+	}
+	elector.setLeader(nil)
+	elector.logger.Infof("Leader elector is stopped on node %v\n", elector.nodeId)
+	return nil
+}
+
+func (elector *LeaderElector) Leader() *metadata_svc.LeaderInfo {
+	elector.leader_lock.RLock()
+	defer elector.leader_lock.RUnlock()
+	if elector.leader == nil || !time.Now().Before(elector.leader.Expiry) {
+		return nil
+	}
+	leader := *elector.leader
+	return &leader
+}
+
+func (elector *LeaderElector) IsLeader() (bool, uint64) {
+	leader := elector.Leader()
+	if leader == nil || leader.NodeId != elector.nodeId {
+		return false, 0
+	}
+	return true, leader.Term
+}
+
+func (elector *LeaderElector) RegisterLeaderChangeCallback(callback metadata_svc.LeaderChangeCallback) {
+	elector.callbacks_lock.Lock()
+	defer elector.callbacks_lock.Unlock()
+	elector.callbacks = append(elector.callbacks, callback)
+}
+
+func (elector *LeaderElector) electing() {
+	defer elector.wait_grp.Done()
+
+	ticker := time.NewTicker(elector.renew_interval)
+	defer ticker.Stop()
+	for {
+		elector.elect()
+		select {
+		case <-elector.finch:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// one round of election: renew the lease if the current node holds it, acquire the lease of
+// the next term if the current lease has expired, or otherwise follow the current leader
+func (elector *LeaderElector) elect() {
+	now := time.Now()
+	latest, err := elector.latestLease()
+	if err != nil {
+		elector.logger.Errorf("Failed to read leader lease. err=%v\n", err)
+		elector.expireLeader(now)
+		return
+	}
+
+	if latest == nil || !now.Before(latest.Expiry) {
+		var term uint64 = 1
+		if latest != nil {
+			term = latest.Term + 1
+		}
+		lease := &metadata_svc.LeaderInfo{NodeId: elector.nodeId, Term: term, Expiry: now.Add(elector.lease_duration)}
+		acquired, err := elector.addLease(lease)
+		if err != nil {
+			elector.logger.Errorf("Failed to acquire leader lease of term %v. err=%v\n", term, err)
+			elector.expireLeader(now)
+			return
+		}
+		if acquired {
+			elector.setLeader(lease)
+			elector.removeLeasesBefore(term)
+			return
+		}
+		// another node acquired the lease first
+		latest, err = elector.latestLease()
+		if err != nil {
+			elector.logger.Errorf("Failed to read leader lease. err=%v\n", err)
+			elector.expireLeader(now)
+			return
+		}
+		elector.setLeader(latest)
+		return
+	}
+
+	if latest.NodeId == elector.nodeId {
+		lease := *latest
+		lease.Expiry = now.Add(elector.lease_duration)
+		if err := elector.putLease(&lease); err != nil {
+			elector.logger.Errorf("Failed to renew leader lease of term %v. err=%v\n", lease.Term, err)
+			elector.expireLeader(now)
+			return
+		}
+		elector.setLeader(&lease)
+		return
+	}
+
+	elector.setLeader(latest)
+}
+
+// the lease with the highest term, nil if there is none
+func (elector *LeaderElector) latestLease() (*metadata_svc.LeaderInfo, error) {
+	keys, err := elector.store.Keys(LeaderLeaseKeyPrefix, LeaderLeaseKeyEnd)
+	if err != nil || len(keys) == 0 {
+		return nil, err
+	}
+	value, err := elector.store.Get(keys[len(keys)-1])
+	if err != nil {
+		return nil, err
+	}
+	lease := &metadata_svc.LeaderInfo{}
+	err = json.Unmarshal(value, lease)
+	return lease, err
+}
+
+func (elector *LeaderElector) addLease(lease *metadata_svc.LeaderInfo) (bool, error) {
+	value, err := json.Marshal(lease)
+	if err != nil {
+		return false, err
+	}
+	return elector.store.AddIfAbsent(leaderLeaseKey(lease.Term), value)
+}
+
+func (elector *LeaderElector) putLease(lease *metadata_svc.LeaderInfo) error {
+	value, err := json.Marshal(lease)
+	if err != nil {
+		return err
+	}
+	return elector.store.Set(leaderLeaseKey(lease.Term), value)
+}
+
+// clean up the lease records of former terms
+func (elector *LeaderElector) removeLeasesBefore(term uint64) {
+	keys, err := elector.store.Keys(LeaderLeaseKeyPrefix, leaderLeaseKey(term))
+	if err != nil {
+		elector.logger.Errorf("Failed to list former leader leases. err=%v\n", err)
+		return
+	}
+	for _, key := range keys {
+		if err := elector.store.Delete(key); err != nil {
+			elector.logger.Errorf("Failed to remove former leader lease %v. err=%v\n", key, err)
+		}
+	}
+}
+
+// forget the observed lease once it expires, which is all that can be done when the store is not reachable
+func (elector *LeaderElector) expireLeader(now time.Time) {
+	elector.leader_lock.RLock()
+	expired := elector.leader != nil && !now.Before(elector.leader.Expiry)
+	elector.leader_lock.RUnlock()
+	if expired {
+		elector.setLeader(nil)
+	}
+}
+
+func (elector *LeaderElector) setLeader(lease *metadata_svc.LeaderInfo) {
+	elector.leader_lock.Lock()
+	old := elector.leader
+	elector.leader = lease
+	elector.leader_lock.Unlock()
+
+	if (old == nil && lease == nil) || (old != nil && lease != nil && old.Term == lease.Term) {
+		return
+	}
+
+	isLeader := lease != nil && lease.NodeId == elector.nodeId
+	if lease == nil {
+		elector.logger.Infof("There is no leader, as observed by node %v\n", elector.nodeId)
+	} else {
+		elector.logger.Infof("Node %v is the leader of term %v, as observed by node %v\n", lease.NodeId, lease.Term, elector.nodeId)
+	}
+
+	elector.callbacks_lock.RLock()
+	callbacks := make([]metadata_svc.LeaderChangeCallback, len(elector.callbacks))
+	copy(callbacks, elector.callbacks)
+	elector.callbacks_lock.RUnlock()
+	for _, callback := range callbacks {
+		var leader *metadata_svc.LeaderInfo
+		if lease != nil {
+			leaderCopy := *lease
+			leader = &leaderCopy
+		}
+		callback(leader, isLeader)
+	}
+}
@@ -0,0 +1,280 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package services
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Xiaomei-Zhang/goxdcr/metadata_svc"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testLeaseDuration = 100 * time.Millisecond
+	testRenewInterval = 20 * time.Millisecond
+)
+
+var errorStoreUnreachable = errors.New("store is unreachable")
+
+// in-memory lease store shared by the nodes of a test
+type memoryLeaseStore struct {
+	values map[string][]byte
+	lock   sync.Mutex
+}
+
+func newMemoryLeaseStore() *memoryLeaseStore {
+	return &memoryLeaseStore{values: make(map[string][]byte)}
+}
+
+func (store *memoryLeaseStore) AddIfAbsent(key string, value []byte) (bool, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if _, ok := store.values[key]; ok {
+		return false, nil
+	}
+	store.values[key] = value
+	return true, nil
+}
+
+func (store *memoryLeaseStore) Get(key string) ([]byte, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	value, ok := store.values[key]
+	if !ok {
+		return nil, errors.New("key not found")
+	}
+	return value, nil
+}
+
+func (store *memoryLeaseStore) Set(key string, value []byte) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.values[key] = value
+	return nil
+}
+
+func (store *memoryLeaseStore) Delete(key string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	delete(store.values, key)
+	return nil
+}
+
+func (store *memoryLeaseStore) Keys(startKey, endKey string) ([]string, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	keys := make([]string, 0)
+	for key, _ := range store.values {
+		if key >= startKey && key < endKey {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// the view of the shared store from one node, which can be cut off from the store
+type nodeLeaseStore struct {
+	*memoryLeaseStore
+	partitioned bool
+	lock        sync.Mutex
+}
+
+func (store *nodeLeaseStore) setPartitioned(partitioned bool) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.partitioned = partitioned
+}
+
+func (store *nodeLeaseStore) reachable() error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if store.partitioned {
+		return errorStoreUnreachable
+	}
+	return nil
+}
+
+func (store *nodeLeaseStore) AddIfAbsent(key string, value []byte) (bool, error) {
+	if err := store.reachable(); err != nil {
+		return false, err
+	}
+	return store.memoryLeaseStore.AddIfAbsent(key, value)
+}
+
+func (store *nodeLeaseStore) Get(key string) ([]byte, error) {
+	if err := store.reachable(); err != nil {
+		return nil, err
+	}
+	return store.memoryLeaseStore.Get(key)
+}
+
+func (store *nodeLeaseStore) Set(key string, value []byte) error {
+	if err := store.reachable(); err != nil {
+		return err
+	}
+	return store.memoryLeaseStore.Set(key, value)
+}
+
+func (store *nodeLeaseStore) Keys(startKey, endKey string) ([]string, error) {
+	if err := store.reachable(); err != nil {
+		return nil, err
+	}
+	return store.memoryLeaseStore.Keys(startKey, endKey)
+}
+
+type testNode struct {
+	elector *LeaderElector
+	store   *nodeLeaseStore
+	// leader changes observed by callback
+	changes     []*metadata_svc.LeaderInfo
+	changesLock sync.Mutex
+}
+
+func startTestNodes(t *testing.T, store *memoryLeaseStore, count int) []*testNode {
+	nodes := make([]*testNode, count)
+	for i := 0; i < count; i++ {
+		node := &testNode{store: &nodeLeaseStore{memoryLeaseStore: store}}
+		node.elector = NewLeaderElector(node.store, fmt.Sprintf("node%v:12100", i), testLeaseDuration, testRenewInterval, nil)
+		node.elector.RegisterLeaderChangeCallback(func(leader *metadata_svc.LeaderInfo, isLeader bool) {
+			node.changesLock.Lock()
+			defer node.changesLock.Unlock()
+			node.changes = append(node.changes, leader)
+		})
+		node.elector.Start()
+		nodes[i] = node
+	}
+	return nodes
+}
+
+// wait until all nodes agree on one leader, which is not excluded
+func waitForLeader(t *testing.T, nodes []*testNode, excluded *testNode) (*testNode, uint64) {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		var leaderNode *testNode
+		var term uint64
+		leaderCount := 0
+		agreed := true
+		for _, node := range nodes {
+			if node == excluded {
+				continue
+			}
+			if isLeader, token := node.elector.IsLeader(); isLeader {
+				leaderNode = node
+				term = token
+				leaderCount++
+			}
+		}
+		if leaderCount == 1 {
+			for _, node := range nodes {
+				if node == excluded {
+					continue
+				}
+				leader := node.elector.Leader()
+				if leader == nil || leader.NodeId != leaderNode.elector.nodeId || leader.Term != term {
+					agreed = false
+				}
+			}
+			if agreed {
+				return leaderNode, term
+			}
+		}
+		if leaderCount > 1 {
+			t.Fatalf("%v nodes consider themselves leader", leaderCount)
+		}
+		time.Sleep(testRenewInterval)
+	}
+	t.Fatalf("Nodes did not agree on a leader")
+	return nil, 0
+}
+
+func TestLeaderElection(t *testing.T) {
+	nodes := startTestNodes(t, newMemoryLeaseStore(), 3)
+
+	leader, term := waitForLeader(t, nodes, nil)
+
+	// the leader keeps renewing its lease
+	time.Sleep(3 * testLeaseDuration)
+	if newLeader, newTerm := waitForLeader(t, nodes, nil); newLeader != leader || newTerm != term {
+		t.Errorf("Leadership changed from %v of term %v to %v of term %v without failure", leader.elector.nodeId, term, newLeader.elector.nodeId, newTerm)
+	}
+
+	// another node takes over, with a higher fencing token, when the leader stops
+	leader.elector.Stop()
+	newLeader, newTerm := waitForLeader(t, nodes, leader)
+	if newTerm <= term {
+		t.Errorf("Expected fencing token of new leader to be higher than %v, got %v", term, newTerm)
+	}
+	if isLeader, _ := leader.elector.IsLeader(); isLeader {
+		t.Errorf("Stopped node still considers itself leader")
+	}
+
+	for _, node := range nodes {
+		if node == leader {
+			continue
+		}
+		node.changesLock.Lock()
+		last := node.changes[len(node.changes)-1]
+		node.changesLock.Unlock()
+		if last == nil || last.NodeId != newLeader.elector.nodeId || last.Term != newTerm {
+			t.Errorf("Callback on %v was not notified of the new leader, last change=%v", node.elector.nodeId, last)
+		}
+		node.elector.Stop()
+	}
+}
+
+func TestLeaderElectionPartition(t *testing.T) {
+	nodes := startTestNodes(t, newMemoryLeaseStore(), 3)
+	defer func() {
+		for _, node := range nodes {
+			node.elector.Stop()
+		}
+	}()
+
+	leader, term := waitForLeader(t, nodes, nil)
+
+	// the leader is cut off from the store. it steps down once its lease expires,
+	// and another node takes over
+	leader.store.setPartitioned(true)
+	time.Sleep(testLeaseDuration + 2*testRenewInterval)
+	if isLeader, _ := leader.elector.IsLeader(); isLeader {
+		t.Errorf("Node cut off from the store still considers itself leader after its lease expired")
+	}
+	newLeader, newTerm := waitForLeader(t, nodes, leader)
+	if newTerm <= term {
+		t.Errorf("Expected fencing token of new leader to be higher than %v, got %v", term, newTerm)
+	}
+
+	// the former leader follows the new leader when it is back
+	leader.store.setPartitioned(false)
+	if backLeader, backTerm := waitForLeader(t, nodes, nil); backLeader != newLeader || backTerm != newTerm {
+		t.Errorf("Expected %v of term %v to stay leader, got %v of term %v", newLeader.elector.nodeId, newTerm, backLeader.elector.nodeId, backTerm)
+	}
+}
+
+func TestLeaderElectionSingleLeaderPerTerm(t *testing.T) {
+	store := newMemoryLeaseStore()
+	nodes := startTestNodes(t, store, 5)
+	defer func() {
+		for _, node := range nodes {
+			node.elector.Stop()
+		}
+	}()
+
+	// all nodes race for the first term
+	waitForLeader(t, nodes, nil)
+	keys, _ := store.Keys(LeaderLeaseKeyPrefix, LeaderLeaseKeyEnd)
+	if len(keys) != 1 || keys[0] != leaderLeaseKey(1) {
+		t.Errorf("Expected only the lease of term 1, got %v", keys)
+	}
+}
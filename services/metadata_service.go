@@ -96,6 +96,21 @@ func (meta_svc *MetadataSvc) DelReplicationSpec(replicationId string) error {
 }
 
 func (meta_svc *MetadataSvc) ActiveReplicationSpecs() (map[string]*metadata.ReplicationSpecification, error) {
+	specs, err := meta_svc.ReplicationSpecs()
+	if err != nil {
+		return nil, err
+	}
+	
+	for key, spec := range specs {
+		if !spec.Settings.Active {
+			delete(specs, key)
+		}
+	}
+	return specs, nil
+}
+
+// all replication specs, active or not
+func (meta_svc *MetadataSvc) ReplicationSpecs() (map[string]*metadata.ReplicationSpecification, error) {
 	specs := make(map[string]*metadata.ReplicationSpecification, 0)
 	repo, _ := repository.OpenRepository()
 	iter, _ := repo.NewIterator(XdcrKeyStart, XdcrKeyEnd)
@@ -110,9 +125,7 @@ func (meta_svc *MetadataSvc) ActiveReplicationSpecs() (map[string]*metadata.Repl
 		if err != nil {
 			return nil, err
 		}
-		if spec.Settings.Active {
-			specs[key] = spec
-		}
+		specs[key] = spec
 	}
 	
 	return specs, nil
@@ -0,0 +1,78 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+// replication settings service implementation, which persists default replication settings in gometa
+package services
+
+import (
+	"encoding/json"
+	"github.com/Xiaomei-Zhang/goxdcr/log"
+	"github.com/Xiaomei-Zhang/goxdcr/metadata"
+	"github.com/couchbase/gometa/common"
+)
+
+// key of default replication settings in gometa.
+// it needs to be outside of [XdcrKeyStart, XdcrKeyEnd), which is reserved for replication specs
+var DefaultReplicationSettingsKey = metadata.XdcrPrefix + "DefaultReplicationSettings"
+
+type ReplicationSettingsSvc struct {
+	metadata_svc *MetadataSvc
+	logger       *log.CommonLogger
+}
+
+// create the service on top of the gometa client of metadata service.
+// default replication settings are initialized from the settings schema if they have never been persisted
+func NewReplicationSettingsSvc(metadata_svc *MetadataSvc, logger_ctx *log.LoggerContext) (*ReplicationSettingsSvc, error) {
+	repl_settings_svc := &ReplicationSettingsSvc{
+		metadata_svc: metadata_svc,
+		logger:       log.NewLogger("ReplicationSettingsService", logger_ctx),
+	}
+
+	if _, err := repl_settings_svc.GetReplicationSettings(); err != nil {
+		// settings do not exist yet. Add fails if they do, in which case the original error is real
+		repl_settings_svc.logger.Infof("Initializing default replication settings. err=%v\n", err)
+		if err = repl_settings_svc.addReplicationSettings(metadata.DefaultSettings()); err != nil {
+			return nil, err
+		}
+	}
+	return repl_settings_svc, nil
+}
+
+func (repl_settings_svc *ReplicationSettingsSvc) GetReplicationSettings() (*metadata.ReplicationSettings, error) {
+	opCode := common.GetOpCodeStr(common.OPCODE_GET)
+	result, err := repl_settings_svc.metadata_svc.sendRequest(opCode, DefaultReplicationSettingsKey, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// settings added to the schema after the defaults were persisted keep their default values
+	settings := metadata.DefaultSettings()
+	err = json.Unmarshal(result, settings)
+	return settings, err
+}
+
+func (repl_settings_svc *ReplicationSettingsSvc) SetReplicationSettings(settings *metadata.ReplicationSettings) error {
+	return repl_settings_svc.persistReplicationSettings(common.GetOpCodeStr(common.OPCODE_SET), settings)
+}
+
+func (repl_settings_svc *ReplicationSettingsSvc) addReplicationSettings(settings *metadata.ReplicationSettings) error {
+	return repl_settings_svc.persistReplicationSettings(common.GetOpCodeStr(common.OPCODE_ADD), settings)
+}
+
+func (repl_settings_svc *ReplicationSettingsSvc) persistReplicationSettings(opCode string, settings *metadata.ReplicationSettings) error {
+	value, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	_, err = repl_settings_svc.metadata_svc.sendRequest(opCode, DefaultReplicationSettingsKey, value)
+	if err == nil {
+		repl_settings_svc.logger.Infof("Default replication settings are set to %v\n", settings.ToMap())
+	}
+	return err
+}
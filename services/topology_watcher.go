@@ -0,0 +1,243 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+// topology watcher implementation, which polls the vbucket server maps of watched buckets
+// through cluster info service
+package services
+
+import (
+	"errors"
+	"github.com/Xiaomei-Zhang/goxdcr/log"
+	"github.com/Xiaomei-Zhang/goxdcr/metadata_svc"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrorTopologyWatcherNotStarted = errors.New("Topology watcher is not started")
+
+type bucketKey struct {
+	clusterUUID string
+	bucket      string
+}
+
+type watchedBucket struct {
+	listeners []metadata_svc.TopologyChangeListener
+	// kv node -> active vbuckets, as of the last successful poll. nil before the first successful poll
+	serverVBMap map[string][]uint16
+}
+
+/************************************
+/* struct TopologyWatcher
+*************************************/
+type TopologyWatcher struct {
+	cluster_info_svc metadata_svc.ClusterInfoSvc
+	poll_interval    time.Duration
+
+	buckets      map[bucketKey]*watchedBucket
+	buckets_lock sync.Mutex
+
+	finch    chan bool
+	wait_grp sync.WaitGroup
+	logger   *log.CommonLogger
+}
+
+func NewTopologyWatcher(cluster_info_svc metadata_svc.ClusterInfoSvc, poll_interval time.Duration, logger_ctx *log.LoggerContext) *TopologyWatcher {
+	return &TopologyWatcher{cluster_info_svc: cluster_info_svc,
+		poll_interval: poll_interval,
+		buckets:       make(map[bucketKey]*watchedBucket),
+		logger:        log.NewLogger("TopologyWatcher", logger_ctx)}
+}
+
+func (watcher *TopologyWatcher) Start() error {
+	watcher.finch = make(chan bool)
+	watcher.wait_grp.Add(1)
+	go watcher.polling()
+	watcher.logger.Infof("Topology watcher is started with poll interval %v\n", watcher.poll_interval)
+	return nil
+}
+
+func (watcher *TopologyWatcher) Stop() error {
+	if watcher.finch == nil {
+		return ErrorTopologyWatcherNotStarted
+	}
+	close(watcher.finch)
+	watcher.wait_grp.Wait()
+	watcher.finch = nil
+	watcher.logger.Info("Topology watcher is stopped")
+	return nil
+}
+
+func (watcher *TopologyWatcher) Subscribe(clusterUUID, bucket string, listener metadata_svc.TopologyChangeListener) error {
+	key := bucketKey{clusterUUID, bucket}
+
+	watcher.buckets_lock.Lock()
+	watched, ok := watcher.buckets[key]
+	if !ok {
+		watched = &watchedBucket{listeners: make([]metadata_svc.TopologyChangeListener, 0)}
+		watcher.buckets[key] = watched
+		watcher.logger.Infof("Start watching bucket %v of cluster %v\n", bucket, clusterUUID)
+	}
+	for _, l := range watched.listeners {
+		if l == listener {
+			watcher.buckets_lock.Unlock()
+			return nil
+		}
+	}
+	watched.listeners = append(watched.listeners, listener)
+	watcher.buckets_lock.Unlock()
+
+	if !ok {
+		// record the current map so that the changes after subscription can be detected
+		watcher.pollBucket(key)
+	}
+	return nil
+}
+
+func (watcher *TopologyWatcher) Unsubscribe(clusterUUID, bucket string, listener metadata_svc.TopologyChangeListener) error {
+	key := bucketKey{clusterUUID, bucket}
+
+	watcher.buckets_lock.Lock()
+	defer watcher.buckets_lock.Unlock()
+	watched, ok := watcher.buckets[key]
+	if !ok {
+		return nil
+	}
+	for i, l := range watched.listeners {
+		if l == listener {
+			watched.listeners = append(watched.listeners[:i], watched.listeners[i+1:]...)
+			break
+		}
+	}
+	if len(watched.listeners) == 0 {
+		delete(watcher.buckets, key)
+		watcher.logger.Infof("Stop watching bucket %v of cluster %v\n", bucket, clusterUUID)
+	}
+	return nil
+}
+
+func (watcher *TopologyWatcher) polling() {
+	defer watcher.wait_grp.Done()
+
+	ticker := time.NewTicker(watcher.poll_interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-watcher.finch:
+			return
+		case <-ticker.C:
+			watcher.poll()
+		}
+	}
+}
+
+func (watcher *TopologyWatcher) poll() {
+	watcher.buckets_lock.Lock()
+	keys := make([]bucketKey, 0, len(watcher.buckets))
+	for key, _ := range watcher.buckets {
+		keys = append(keys, key)
+	}
+	watcher.buckets_lock.Unlock()
+
+	for _, key := range keys {
+		watcher.pollBucket(key)
+	}
+}
+
+// get the current vbucket server map of a bucket, and notify listeners if it is different from the last one
+func (watcher *TopologyWatcher) pollBucket(key bucketKey) {
+	serverVBMap, err := watcher.cluster_info_svc.GetServerVBucketsMap(key.clusterUUID, key.bucket)
+	if err != nil {
+		// try again at next poll
+		watcher.logger.Errorf("Failed to get vbucket server map of bucket %v of cluster %v. err=%v\n", key.bucket, key.clusterUUID, err)
+		return
+	}
+
+	watcher.buckets_lock.Lock()
+	watched, ok := watcher.buckets[key]
+	if !ok {
+		// unsubscribed while polling
+		watcher.buckets_lock.Unlock()
+		return
+	}
+	var events []*metadata_svc.TopologyChangeEvent
+	if watched.serverVBMap != nil {
+		events = diffServerVBucketsMaps(key.clusterUUID, key.bucket, watched.serverVBMap, serverVBMap)
+	}
+	watched.serverVBMap = serverVBMap
+	listeners := make([]metadata_svc.TopologyChangeListener, len(watched.listeners))
+	copy(listeners, watched.listeners)
+	watcher.buckets_lock.Unlock()
+
+	if len(events) == 0 {
+		return
+	}
+	watcher.logger.Infof("Topology of bucket %v of cluster %v has changed. events=%v\n", key.bucket, key.clusterUUID, events)
+	for _, listener := range listeners {
+		listener.OnTopologyChange(key.clusterUUID, key.bucket, events)
+	}
+}
+
+// changes from one vbucket server map to another. Node events come first, in the order of node names
+func diffServerVBucketsMaps(clusterUUID, bucket string, oldMap, newMap map[string][]uint16) []*metadata_svc.TopologyChangeEvent {
+	events := make([]*metadata_svc.TopologyChangeEvent, 0)
+
+	addedNodes := make([]string, 0)
+	for node, _ := range newMap {
+		if _, ok := oldMap[node]; !ok {
+			addedNodes = append(addedNodes, node)
+		}
+	}
+	removedNodes := make([]string, 0)
+	for node, _ := range oldMap {
+		if _, ok := newMap[node]; !ok {
+			removedNodes = append(removedNodes, node)
+		}
+	}
+	sort.Strings(addedNodes)
+	sort.Strings(removedNodes)
+	for _, node := range addedNodes {
+		events = append(events, &metadata_svc.TopologyChangeEvent{EventType: metadata_svc.NodeAdded,
+			ClusterUUID: clusterUUID, Bucket: bucket, Node: node})
+	}
+	for _, node := range removedNodes {
+		events = append(events, &metadata_svc.TopologyChangeEvent{EventType: metadata_svc.NodeRemoved,
+			ClusterUUID: clusterUUID, Bucket: bucket, Node: node})
+	}
+
+	oldOwners := vbucketOwners(oldMap)
+	newOwners := vbucketOwners(newMap)
+	moves := make(map[uint16]*metadata_svc.VBucketMove)
+	for vbno, from := range oldOwners {
+		if to := newOwners[vbno]; to != from {
+			moves[vbno] = &metadata_svc.VBucketMove{From: from, To: to}
+		}
+	}
+	for vbno, to := range newOwners {
+		if _, ok := oldOwners[vbno]; !ok {
+			moves[vbno] = &metadata_svc.VBucketMove{From: "", To: to}
+		}
+	}
+	if len(moves) > 0 {
+		events = append(events, &metadata_svc.TopologyChangeEvent{EventType: metadata_svc.VBucketsMoved,
+			ClusterUUID: clusterUUID, Bucket: bucket, VBucketMoves: moves})
+	}
+	return events
+}
+
+// vbucket -> kv node hosting the active vbucket
+func vbucketOwners(serverVBMap map[string][]uint16) map[uint16]string {
+	owners := make(map[uint16]string)
+	for node, vbnos := range serverVBMap {
+		for _, vbno := range vbnos {
+			owners[vbno] = node
+		}
+	}
+	return owners
+}
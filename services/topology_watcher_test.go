@@ -0,0 +1,116 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package services
+
+import (
+	"github.com/Xiaomei-Zhang/goxdcr/metadata_svc"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// cluster info service whose vbucket server map is set by the test
+type fakeClusterInfoSvc struct {
+	metadata_svc.ClusterInfoSvc
+	serverVBMap map[string][]uint16
+	lock        sync.Mutex
+}
+
+func (ci_svc *fakeClusterInfoSvc) GetServerVBucketsMap(clusterUUID string, bucketName string) (map[string][]uint16, error) {
+	ci_svc.lock.Lock()
+	defer ci_svc.lock.Unlock()
+	return ci_svc.serverVBMap, nil
+}
+
+func (ci_svc *fakeClusterInfoSvc) setServerVBucketsMap(serverVBMap map[string][]uint16) {
+	ci_svc.lock.Lock()
+	defer ci_svc.lock.Unlock()
+	ci_svc.serverVBMap = serverVBMap
+}
+
+type testTopologyListener struct {
+	eventsch chan []*metadata_svc.TopologyChangeEvent
+}
+
+func (listener *testTopologyListener) OnTopologyChange(clusterUUID, bucket string, events []*metadata_svc.TopologyChangeEvent) {
+	listener.eventsch <- events
+}
+
+func TestDiffServerVBucketsMaps(t *testing.T) {
+	oldMap := map[string][]uint16{
+		"a:11210": []uint16{0, 1},
+		"b:11210": []uint16{2, 3},
+	}
+	newMap := map[string][]uint16{
+		"a:11210": []uint16{0},
+		"c:11210": []uint16{1, 2, 3, 4},
+	}
+	events := diffServerVBucketsMaps("uuid", "default", oldMap, newMap)
+	if len(events) != 3 {
+		t.Fatalf("Expected 3 events, got %v", events)
+	}
+	if events[0].EventType != metadata_svc.NodeAdded || events[0].Node != "c:11210" {
+		t.Errorf("Expected c:11210 to be added, got %v", events[0])
+	}
+	if events[1].EventType != metadata_svc.NodeRemoved || events[1].Node != "b:11210" {
+		t.Errorf("Expected b:11210 to be removed, got %v", events[1])
+	}
+	expectedMoves := map[uint16]*metadata_svc.VBucketMove{
+		1: &metadata_svc.VBucketMove{From: "a:11210", To: "c:11210"},
+		2: &metadata_svc.VBucketMove{From: "b:11210", To: "c:11210"},
+		3: &metadata_svc.VBucketMove{From: "b:11210", To: "c:11210"},
+		4: &metadata_svc.VBucketMove{From: "", To: "c:11210"},
+	}
+	if events[2].EventType != metadata_svc.VBucketsMoved || !reflect.DeepEqual(events[2].VBucketMoves, expectedMoves) {
+		t.Errorf("Expected vbucket moves %v, got %v", expectedMoves, events[2].VBucketMoves)
+	}
+
+	if events := diffServerVBucketsMaps("uuid", "default", oldMap, oldMap); len(events) != 0 {
+		t.Errorf("Expected no events on unchanged map, got %v", events)
+	}
+}
+
+func TestTopologyWatcher(t *testing.T) {
+	ci_svc := &fakeClusterInfoSvc{serverVBMap: map[string][]uint16{"a:11210": []uint16{0, 1}}}
+	watcher := NewTopologyWatcher(ci_svc, 10*time.Millisecond, nil)
+	watcher.Start()
+	defer watcher.Stop()
+
+	listener := &testTopologyListener{eventsch: make(chan []*metadata_svc.TopologyChangeEvent, 10)}
+	watcher.Subscribe("uuid", "default", listener)
+	// subscribing again does not lead to duplicate notifications
+	watcher.Subscribe("uuid", "default", listener)
+
+	ci_svc.setServerVBucketsMap(map[string][]uint16{"a:11210": []uint16{0}, "b:11210": []uint16{1}})
+	select {
+	case events := <-listener.eventsch:
+		if len(events) != 2 || events[0].EventType != metadata_svc.NodeAdded || events[1].EventType != metadata_svc.VBucketsMoved {
+			t.Errorf("Unexpected events %v", events)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Listener was not notified of topology change")
+	}
+
+	// no further notification until the map changes again
+	select {
+	case events := <-listener.eventsch:
+		t.Errorf("Unexpected events %v", events)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	watcher.Unsubscribe("uuid", "default", listener)
+	ci_svc.setServerVBucketsMap(map[string][]uint16{"b:11210": []uint16{0, 1}})
+	select {
+	case events := <-listener.eventsch:
+		t.Errorf("Unsubscribed listener was notified of %v", events)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2013 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+// xdcr topology service implementation for the deployment where an xdcr comp runs on
+// every kv node of the local cluster and is responsible for that kv node only
+package services
+
+import (
+	"github.com/Xiaomei-Zhang/goxdcr/base"
+	"github.com/Xiaomei-Zhang/goxdcr/log"
+	"net"
+)
+
+type XDCRTopologySvc struct {
+	// host name of this xdcr comp, which is the host name of the kv node in the local cluster
+	myHost string
+	// host:port of the rest api of the local cluster
+	localConnStr string
+	// host of the local cluster, used as the host name of a node when nodeServices does not return one
+	localHost        string
+	cluster_info_svc *ClusterInfoSvc
+	logger           *log.CommonLogger
+}
+
+// the local cluster is registered with cluster info service
+func NewXDCRTopologySvc(myHost, localConnStr, username, password string, cluster_info_svc *ClusterInfoSvc, logger_ctx *log.LoggerContext) (*XDCRTopologySvc, error) {
+	localHost, _, err := net.SplitHostPort(localConnStr)
+	if err != nil {
+		return nil, err
+	}
+	cluster_info_svc.AddCluster(localConnStr, username, password)
+	return &XDCRTopologySvc{myHost: myHost,
+		localConnStr:     localConnStr,
+		localHost:        localHost,
+		cluster_info_svc: cluster_info_svc,
+		logger:           log.NewLogger("XDCRTopologyService", logger_ctx)}, nil
+}
+
+func (top_svc *XDCRTopologySvc) MyHost() (string, error) {
+	return top_svc.myHost, nil
+}
+
+func (top_svc *XDCRTopologySvc) MyAdminPort() (uint16, error) {
+	return uint16(base.AdminportNumber), nil
+}
+
+// host name of the kv node this xdcr comp is responsible for, which is on the same host
+func (top_svc *XDCRTopologySvc) MyKVNodes() ([]string, error) {
+	kvNodeMap, err := top_svc.XDCRCompToKVNodeMap()
+	if err != nil {
+		return nil, err
+	}
+	nodes := make([]string, 0)
+	for _, kvaddr := range kvNodeMap[top_svc.myHost] {
+		host, _, err := net.SplitHostPort(kvaddr)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, host)
+	}
+	return nodes, nil
+}
+
+// uuid of the local cluster
+func (top_svc *XDCRTopologySvc) MyCluster() (string, error) {
+	return top_svc.cluster_info_svc.ClusterUUID(top_svc.localConnStr)
+}
+
+func (top_svc *XDCRTopologySvc) XDCRTopology() (map[string]uint16, error) {
+	kvNodeMap, err := top_svc.XDCRCompToKVNodeMap()
+	if err != nil {
+		return nil, err
+	}
+	retmap := make(map[string]uint16)
+	for host, _ := range kvNodeMap {
+		retmap[host] = uint16(base.AdminportNumber)
+	}
+	return retmap, nil
+}
+
+// every kv node in the local cluster has an xdcr comp on the same host
+func (top_svc *XDCRTopologySvc) XDCRCompToKVNodeMap() (map[string][]string, error) {
+	nodeServices, err := top_svc.cluster_info_svc.NodeServices(top_svc.localConnStr)
+	if err != nil {
+		return nil, err
+	}
+	retmap := make(map[string][]string)
+	for _, node := range nodeServices.NodesExt {
+		kvaddr := node.KVAddr(top_svc.localHost)
+		if len(kvaddr) == 0 {
+			continue
+		}
+		host := node.HostName(top_svc.localHost)
+		retmap[host] = append(retmap[host], kvaddr)
+	}
+	return retmap, nil
+}
@@ -12,6 +12,7 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -33,8 +34,9 @@ const (
 	NumSourceConn    = 2
 	NumTargetConn    = 3
 	FilterExpression = "testExpr"
-	BatchCount       = 20
+	BatchCount       = 600
 	BatchSize        = 30
+	V2BatchSize      = 40
 )
 
 var options struct {
@@ -94,9 +96,11 @@ func startAdminport() {
 		return
 	}
 
-	rm.Initialize(metadata_svc, new(c.MockClusterInfoSvc), new(c.MockXDCRTopologySvc), new(c.MockReplicationSettingsSvc))
+	rm.Initialize(metadata_svc, new(c.MockClusterInfoSvc), new(c.MockXDCRTopologySvc), new(c.MockReplicationSettingsSvc), nil, nil)
 
-	go ap.MainAdminPort(options.sourceKVHost)
+	userStore := ap.NewMemoryUserStore()
+	userStore.AddUser(options.username, options.password, ap.RoleAdmin)
+	go ap.MainAdminPort(options.sourceKVHost, ap.NewAuthConfig("", "", ap.NewBasicAuthenticator(userStore)), nil)
 	//wait for server to finish starting
 	time.Sleep(time.Second * 3)
 
@@ -119,6 +123,21 @@ func startAdminport() {
 		return
 	}
 
+	if err := testV2ChangeReplicationSettings(replicationId, escapedReplId); err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	if err := testV2InvalidReplicationSettings(escapedReplId); err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	if err := testV2GetOpenAPI(); err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
 	if err := testPauseReplication(replicationId, escapedReplId); err != nil {
 		fmt.Println(err.Error())
 		return
@@ -166,6 +185,7 @@ func testCreateReplication() (string, error) {
 		return "", err
 	}
 	request.Header.Set(ap.ContentType, ap.DefaultContentType)
+	request.SetBasicAuth(options.username, options.password)
 
 	fmt.Println("request", request)
 
@@ -193,6 +213,7 @@ func testPauseReplication(replicationId, escapedReplId string) error {
 		return err
 	}
 	request.Header.Set(ap.ContentType, ap.DefaultContentType)
+	request.SetBasicAuth(options.username, options.password)
 
 	fmt.Println("request", request)
 
@@ -216,6 +237,7 @@ func testResumeReplication(replicationId, escapedReplId string) error {
 		return err
 	}
 	request.Header.Set(ap.ContentType, ap.DefaultContentType)
+	request.SetBasicAuth(options.username, options.password)
 
 	fmt.Println("request", request)
 
@@ -239,6 +261,7 @@ func testDeleteReplication(replicationId, escapedReplId string) error {
 		return err
 	}
 	request.Header.Set(ap.ContentType, ap.DefaultContentType)
+	request.SetBasicAuth(options.username, options.password)
 
 	fmt.Println("request", request)
 
@@ -262,6 +285,7 @@ func testViewReplicationSettings(replicationId string) error {
 		return err
 	}
 	request.Header.Set(ap.ContentType, ap.DefaultContentType)
+	request.SetBasicAuth(options.username, options.password)
 
 	fmt.Println("request", request)
 
@@ -284,6 +308,7 @@ func testChangeReplicationSettings(replicationId, escapedReplicationId string) e
 		return err
 	}
 	request.Header.Set(ap.ContentType, ap.DefaultContentType)
+	request.SetBasicAuth(options.username, options.password)
 
 	fmt.Println("request", request)
 
@@ -313,6 +338,7 @@ func testGetStatistics() error {
 		return err
 	}
 	request.Header.Set(ap.ContentType, ap.DefaultContentType)
+	request.SetBasicAuth(options.username, options.password)
 
 	fmt.Println("request", request)
 
@@ -321,6 +347,101 @@ func testGetStatistics() error {
 	return validateResponse("GetStatistics", response, err)
 }
 
+func testV2ChangeReplicationSettings(replicationId, escapedReplicationId string) error {
+	url := getUrlPrefix() + ap.V2ReplicationsPath + base.UrlDelimiter + escapedReplicationId + base.UrlDelimiter + ap.V2SettingsAction
+
+	paramsBytes, _ := json.Marshal(map[string]interface{}{ap.BatchSize: V2BatchSize})
+	request, err := http.NewRequest(ap.MethodPost, url, bytes.NewBuffer(paramsBytes))
+	if err != nil {
+		return err
+	}
+	request.Header.Set(ap.ContentType, ap.JsonContentType)
+	request.SetBasicAuth(options.username, options.password)
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil || response.StatusCode != http.StatusNoContent {
+		return validateResponse("V2ChangeReplicationSettings", response, errors.New("expected no content"))
+	}
+
+	// read settings back through v2 api with the same setting names
+	request, err = http.NewRequest(ap.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	request.SetBasicAuth(options.username, options.password)
+	response, err = http.DefaultClient.Do(request)
+	if err = validateResponse("V2ViewReplicationSettings", response, err); err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	settings := make(map[string]interface{})
+	if err = json.NewDecoder(response.Body).Decode(&settings); err != nil {
+		return err
+	}
+	if resultingBatchSize, ok := settings[ap.BatchSize].(float64); !ok || int(resultingBatchSize) != V2BatchSize {
+		return errors.New(fmt.Sprintf("Test V2ChangeReplicationSettings failed. Resulting batch size, %v, does not match the specified value, %v\n", settings[ap.BatchSize], V2BatchSize))
+	}
+
+	fmt.Println("Test V2ChangeReplicationSettings passed.")
+	return nil
+}
+
+func testV2InvalidReplicationSettings(escapedReplicationId string) error {
+	url := getUrlPrefix() + ap.V2ReplicationsPath + base.UrlDelimiter + escapedReplicationId + base.UrlDelimiter + ap.V2SettingsAction
+
+	// batch size needs to be a json number
+	paramsBytes, _ := json.Marshal(map[string]interface{}{ap.BatchSize: "abc"})
+	request, err := http.NewRequest(ap.MethodPost, url, bytes.NewBuffer(paramsBytes))
+	if err != nil {
+		return err
+	}
+	request.Header.Set(ap.ContentType, ap.JsonContentType)
+	request.SetBasicAuth(options.username, options.password)
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	envelope := make(map[string]*ap.RequestError)
+	if err = json.NewDecoder(response.Body).Decode(&envelope); err != nil {
+		return err
+	}
+	reqErr := envelope["error"]
+	if response.StatusCode != http.StatusBadRequest || reqErr == nil || reqErr.Code != ap.ErrorCodeInvalidRequest || len(reqErr.Details[ap.BatchSize]) == 0 {
+		return errors.New(fmt.Sprintf("Test V2InvalidReplicationSettings failed. status=%v, error=%v\n", response.Status, reqErr))
+	}
+
+	fmt.Println("Test V2InvalidReplicationSettings passed.")
+	return nil
+}
+
+func testV2GetOpenAPI() error {
+	url := getUrlPrefix() + ap.V2OpenAPIPath
+
+	request, err := http.NewRequest(ap.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	request.SetBasicAuth(options.username, options.password)
+
+	response, err := http.DefaultClient.Do(request)
+	if err = validateResponse("V2GetOpenAPI", response, err); err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	spec := make(map[string]interface{})
+	if err = json.NewDecoder(response.Body).Decode(&spec); err != nil {
+		return errors.New(fmt.Sprintf("Test V2GetOpenAPI failed. err=%v\n", err))
+	}
+
+	fmt.Println("Test V2GetOpenAPI passed.")
+	return nil
+}
+
 func validateResponse(testName string, response *http.Response, err error) error {
 	if err != nil || response.StatusCode != 200 {
 		errMsg := fmt.Sprintf("Test %v failed. err=%v", testName, err)
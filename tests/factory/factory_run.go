@@ -124,9 +124,18 @@ func invokeFactory() error {
 		if len(downStreamParts) != NUM_TARGET_CONN {
 			return errors.New(fmt.Sprintf("incorrect number of downstream parts for source nozzle %v. expected %v; actual %v", sourceId, NUM_TARGET_CONN, len(downStreamParts)))
 		}
-		for partId := range downStreamParts {
-			if _, ok := targets[partId]; !ok {
-				return errors.New(fmt.Sprintf("invalid downstream part %v for source nozzle %v.", partId, sourceId))
+		// router forwards to the queue parts in front of target nozzles
+		for partId, part := range downStreamParts {
+			if _, ok := part.(*parts.QueuePart); !ok {
+				return errors.New(fmt.Sprintf("incorrect part type for downstream part %v of source nozzle %v.", partId, sourceId))
+			}
+			if part.Connector() == nil {
+				return errors.New(fmt.Sprintf("no connector defined in queue part %v.", partId))
+			}
+			for targetId := range part.Connector().DownStreams() {
+				if _, ok := targets[targetId]; !ok {
+					return errors.New(fmt.Sprintf("invalid downstream part %v for queue part %v.", targetId, partId))
+				}
 			}
 		}
 	}
@@ -118,7 +118,7 @@ func setup() error {
 	if err != nil {
 		return err
 	}
-	replication_manager.Initialize(metadata_svc, new(c.MockClusterInfoSvc), new(c.MockXDCRTopologySvc), new(c.MockReplicationSettingsSvc))
+	replication_manager.Initialize(metadata_svc, new(c.MockClusterInfoSvc), new(c.MockXDCRTopologySvc), new(c.MockReplicationSettingsSvc), nil, nil)
 	fmt.Println("Finish setup")
 	return nil
 }
@@ -30,6 +30,9 @@ var MaxIdleConnsPerHost = 256
 var HTTPTransport = &http.Transport{MaxIdleConnsPerHost: MaxIdleConnsPerHost}
 var HTTPClient = &http.Client{Transport: HTTPTransport}
 
+// returned by QueryRestAPI when the requested resource, e.g., a bucket, does not exist
+var ErrorResourceNotFound = errors.New("Resource is not found.")
+
 func loggerForFunc(logger *log.CommonLogger) *log.CommonLogger {
 	var l *log.CommonLogger
 	if logger != nil {
@@ -112,6 +115,9 @@ func QueryRestAPI(
 		return err
 	}
 	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%w HTTP error %v getting %q", ErrorResourceNotFound, res.Status, path)
+	}
 	if res.StatusCode != 200 {
 		bod, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
 		return fmt.Errorf("HTTP error %v getting %q: %s",
@@ -151,11 +157,16 @@ func Bucket(connectStr string, bucketName string, clusterUserName, clusterPasswo
 	}
 
 	var password string
+	found := false
 	for _, bucketInfo := range bucketInfos {
 		if bucketInfo.Name == bucketName {
 			password = bucketInfo.Password
+			found = true
 		}
 	}
+	if !found {
+		return nil, base.NewClassifiedError(base.ErrorClassConfiguration, fmt.Sprintf("getting bucket %v from %v", bucketName, connectStr), base.ErrorBucketNotFound)
+	}
 	couch, err := couchbase.Connect("http://" + bucketName + ":" + password + "@" + connectStr)
 	if err != nil {
 		return nil, NewEnhancedError(fmt.Sprintf("Error connecting to couchbase. bucketName=%v; password=%v; connectStr=%v", bucketName, password, connectStr), err)